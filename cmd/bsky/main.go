@@ -12,12 +12,14 @@ import (
 
 	"github.com/yunomu/bskylog/cmd/bsky/archive"
 	"github.com/yunomu/bskylog/cmd/bsky/download"
+	"github.com/yunomu/bskylog/lib/pds"
 )
 
 type command struct {
 	handle   *string
 	password *string
 	host     *string
+	plc      *string
 
 	commander *subcommands.Commander
 }
@@ -36,7 +38,8 @@ func (c *command) Usage() string {
 func (c *command) SetFlags(f *flag.FlagSet) {
 	c.handle = f.String("handle", "", "your handle xxx.bsky.social")
 	c.password = f.String("password", "", "xxxx-xxxx-xxxx-xxxx")
-	c.host = f.String("host", "https://bsky.social", "bsky host")
+	c.host = f.String("host", "", "PDS of the account (default resolved from the handle)")
+	c.plc = f.String("plc", pds.DefaultPLCURL, "PLC directory resolving did:plc")
 
 	commander := subcommands.NewCommander(f, "bsky")
 	commander.Register(download.NewCommand(), "")
@@ -65,8 +68,23 @@ func (c *command) Execute(ctx context.Context, f *flag.FlagSet, args ...interfac
 		return subcommands.ExitFailure
 	}
 
+	host := *c.host
+	if host == "" {
+		ident, err := pds.Lookup(ctx, pds.NewDirectory(*c.plc), *c.handle)
+		if err != nil {
+			slog.Error("Resolve handle", "err", err, "handle", *c.handle)
+			return subcommands.ExitFailure
+		}
+		host = ident.PDSEndpoint()
+		if host == "" {
+			slog.Error("No PDS", "handle", *c.handle, "did", ident.DID)
+			return subcommands.ExitFailure
+		}
+		slog.Info("Resolved", "handle", *c.handle, "did", ident.DID, "pds", host)
+	}
+
 	client := &xrpc.Client{
-		Host: *c.host,
+		Host: host,
 	}
 
 	auth, err := atproto.ServerCreateSession(ctx, client, &atproto.ServerCreateSession_Input{
@@ -77,13 +95,12 @@ func (c *command) Execute(ctx context.Context, f *flag.FlagSet, args ...interfac
 		slog.Error("Authentication error",
 			"err", err,
 			"handle", *c.handle,
-			"password", *c.password,
 		)
 		return subcommands.ExitFailure
 	}
 	slog.Info("Auth",
 		"handle", auth.Handle,
-		"auth", auth,
+		"did", auth.Did,
 	)
 
 	client.Auth = &xrpc.AuthInfo{
@@ -0,0 +1,83 @@
+package history
+
+import (
+	"context"
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/subcommands"
+	"github.com/yunomu/bskylog/lib/crawlerdb"
+)
+
+type command struct {
+	did   *string
+	limit *int
+}
+
+func NewCommand() subcommands.Command {
+	return &command{}
+}
+
+func (c *command) Name() string     { return "history" }
+func (c *command) Synopsis() string { return "show crawl runs of an account, most recent first" }
+func (c *command) Usage() string {
+	return `history -did {did} [-limit {n}]
+`
+}
+
+func (c *command) SetFlags(f *flag.FlagSet) {
+	c.did = f.String("did", "", "DID")
+	c.limit = f.Int("limit", 20, "maximum number of runs")
+}
+
+func (c *command) Execute(ctx context.Context, f *flag.FlagSet, args ...interface{}) subcommands.ExitStatus {
+	if len(args) < 3 {
+		slog.Error("history not found")
+		return subcommands.ExitFailure
+	}
+	history, ok := args[2].(crawlerdb.History)
+	if !ok || history == nil {
+		slog.Error("history table is empty")
+		return subcommands.ExitFailure
+	}
+
+	if *c.did == "" {
+		slog.Error("did is empty")
+		return subcommands.ExitUsageError
+	}
+	if *c.limit < 1 {
+		slog.Error("limit must be positive", "limit", *c.limit)
+		return subcommands.ExitUsageError
+	}
+
+	runs, err := history.Runs(ctx, *c.did, *c.limit)
+	if err != nil {
+		slog.Error("Runs error", "err", err)
+		return subcommands.ExitFailure
+	}
+
+	w := csv.NewWriter(os.Stdout)
+	defer w.Flush()
+
+	w.Write([]string{"started", "ended", "pages", "posts", "keys", "index", "invalidation", "error_class", "error"})
+	for _, run := range runs {
+		w.Write([]string{
+			run.StartedAt.Format(time.RFC3339),
+			run.EndedAt.Format(time.RFC3339),
+			fmt.Sprintf("%d", run.Pages),
+			fmt.Sprintf("%d", run.Posts),
+			strings.Join(run.Keys, " "),
+			string(run.Index),
+			string(run.Invalidation),
+			string(run.ErrorClass),
+			run.Error,
+		})
+	}
+
+	return subcommands.ExitSuccess
+}
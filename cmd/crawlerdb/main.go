@@ -10,13 +10,17 @@ import (
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 
+	"github.com/yunomu/bskylog/cmd/crawlerdb/history"
 	"github.com/yunomu/bskylog/cmd/crawlerdb/list"
 	"github.com/yunomu/bskylog/cmd/crawlerdb/put"
 	"github.com/yunomu/bskylog/lib/crawlerdb"
 )
 
 type command struct {
-	table *string
+	file         *string
+	historyFile  *string
+	table        *string
+	historyTable *string
 
 	commander *subcommands.Commander
 }
@@ -28,16 +32,24 @@ func NewCommand() subcommands.Command {
 func (c *command) Name() string     { return "crawlerdb" }
 func (c *command) Synopsis() string { return "crawlerdb command" }
 func (c *command) Usage() string {
-	return `crawlerdb -table {table_name} <subcommand>
+	return `crawlerdb -table {table_name} [-history-table {table_name}] <subcommand>
+crawlerdb -file {crawler_file} [-history-file {history_file}] <subcommand>
+
+With -file, the crawler state is kept in the files used by "run" instead
+of DynamoDB.
 `
 }
 
 func (c *command) SetFlags(f *flag.FlagSet) {
+	c.file = f.String("file", "", "crawler DB file instead of the table")
+	c.historyFile = f.String("history-file", "", "crawl history file instead of the table")
 	c.table = f.String("table", "", "table name (CrawlerTable)")
+	c.historyTable = f.String("history-table", "", "crawl history table name (CrawlHistoryTable)")
 
 	commander := subcommands.NewCommander(f, "bsky")
 	commander.Register(list.NewCommand(), "")
 	commander.Register(put.NewCommand(), "")
+	commander.Register(history.NewCommand(), "")
 	c.commander = commander
 }
 
@@ -52,6 +64,14 @@ func (c *command) Execute(ctx context.Context, f *flag.FlagSet, args ...interfac
 		return subcommands.ExitFailure
 	}
 
+	if *c.file != "" {
+		var history crawlerdb.History
+		if *c.historyFile != "" {
+			history = crawlerdb.NewFileHistory(*c.historyFile)
+		}
+		return c.commander.Execute(ctx, crawlerdb.NewFile(*c.file), cfg, history)
+	}
+
 	table := *c.table
 	if v, ok := cfg["CrawlerTable"]; ok && table == "" {
 		table = v
@@ -67,10 +87,20 @@ func (c *command) Execute(ctx context.Context, f *flag.FlagSet, args ...interfac
 		return subcommands.ExitFailure
 	}
 
+	client := dynamodb.NewFromConfig(awsCfg)
 	db := crawlerdb.NewDynamoDB(
-		dynamodb.NewFromConfig(awsCfg),
+		client,
 		table,
 	)
 
-	return c.commander.Execute(ctx, db, cfg)
+	historyTable := *c.historyTable
+	if v, ok := cfg["CrawlHistoryTable"]; ok && historyTable == "" {
+		historyTable = v
+	}
+	var history crawlerdb.History
+	if historyTable != "" {
+		history = crawlerdb.NewDynamoDBHistory(client, historyTable, 0)
+	}
+
+	return c.commander.Execute(ctx, db, cfg, history)
 }
@@ -12,6 +12,8 @@ import (
 	"github.com/yunomu/bskylog/cmd/bsky"
 	"github.com/yunomu/bskylog/cmd/config"
 	"github.com/yunomu/bskylog/cmd/crawlerdb"
+	"github.com/yunomu/bskylog/cmd/run"
+	"github.com/yunomu/bskylog/cmd/serve"
 	"github.com/yunomu/bskylog/cmd/sqlite"
 	"github.com/yunomu/bskylog/cmd/storage"
 	"github.com/yunomu/bskylog/cmd/userdb"
@@ -28,6 +30,8 @@ func init() {
 	subcommands.Register(config.NewCommand(), "")
 	subcommands.Register(sqlite.NewCommand(), "")
 	subcommands.Register(storage.NewCommand(), "")
+	subcommands.Register(serve.NewCommand(), "")
+	subcommands.Register(run.NewCommand(), "")
 
 	subcommands.Register(subcommands.CommandsCommand(), "other")
 	subcommands.Register(subcommands.FlagsCommand(), "other")
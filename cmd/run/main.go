@@ -0,0 +1,273 @@
+package run
+
+import (
+	"context"
+	"flag"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/google/subcommands"
+	"github.com/robfig/cron/v3"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/cloudfront"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+
+	crawlerhandler "github.com/yunomu/bskylog/crawler/handler"
+	indexhandler "github.com/yunomu/bskylog/index/handler"
+	"github.com/yunomu/bskylog/lib/crawlerdb"
+	"github.com/yunomu/bskylog/lib/invalidation"
+	"github.com/yunomu/bskylog/lib/pds"
+	"github.com/yunomu/bskylog/lib/storage"
+	"github.com/yunomu/bskylog/lib/userdb"
+)
+
+type command struct {
+	localDir      *string
+	publishBucket *string
+	indexBucket   *string
+	usersFile     *string
+	crawlerFile   *string
+	historyFile   *string
+	kmsKey        *string
+	keyFile       *string
+	plcURL        *string
+	tmpDir        *string
+	schedule      *string
+	parallelism   *int
+	once          *bool
+
+	distribution *string
+	webhookURL   *string
+	purgeDir     *string
+}
+
+func NewCommand() subcommands.Command {
+	return &command{}
+}
+
+func (c *command) Name() string     { return "run" }
+func (c *command) Synopsis() string { return "Crawl, archive and index all users on a schedule" }
+func (c *command) Usage() string {
+	return `run [-local {dir}] [-publish {bucket}] [-index {bucket}] [-users {file}] [-crawler {file}]
+    [-key-file {file} | -kms-key {key}] [-schedule {cron}] [-once]
+    [-distribution {id}] [-invalidate-webhook {url}] [-purge-dir {dir}]
+
+Runs the pipeline of the trigger, crawler and index functions in-process,
+with the users and the crawler state in files. Without -local, the
+buckets are in S3. With -local, buckets are subdirectories of the
+directory, which can be served with "serve -local". The files updated by
+a run are invalidated at the end of the run, in the CloudFront
+distribution, through the webhook and in the cache directory when they
+are set.
+
+Users are added with "userdb -file {file} put". Passwords are sealed with
+the AES-GCM key in the key file or in the environment variable
+BSKYLOG_CREDENTIAL_KEY (base64), or with the KMS key. Accounts
+authorized only with OAuth are not crawled.
+`
+}
+
+func (c *command) SetFlags(f *flag.FlagSet) {
+	c.localDir = f.String("local", "", "Directory of local buckets instead of S3")
+	c.publishBucket = f.String("publish", "", "Publish bucket (default PublishBucket of config, or \"publish\" with -local)")
+	c.indexBucket = f.String("index", "", "Search index bucket (default SearchIndexBucket of config, or \"index\" with -local)")
+	c.usersFile = f.String("users", "", "User DB file (default users.json, in the -local directory with -local)")
+	c.crawlerFile = f.String("crawler", "", "Crawler DB file (default crawler.json, in the -local directory with -local)")
+	c.historyFile = f.String("history", "", "Crawl history file (default history.jsonl, in the -local directory with -local)")
+	c.kmsKey = f.String("kms-key", "", "KMS key sealing passwords")
+	c.keyFile = f.String("key-file", "", "AES-GCM key file sealing passwords")
+	c.plcURL = f.String("plc", pds.DefaultPLCURL, "PLC directory URL")
+	c.tmpDir = f.String("tmpdir", "", "Directory for indexes being updated (default a new temporary directory)")
+	c.schedule = f.String("schedule", "0 * * * *", "Cron expression of the runs, in local time")
+	c.parallelism = f.Int("parallel", 1, "Number of users crawled at the same time")
+	c.once = f.Bool("once", false, "Run once and exit")
+	c.distribution = f.String("distribution", "", "CloudFront distribution invalidated (default Distribution of config without -local)")
+	c.webhookURL = f.String("invalidate-webhook", "", "URL receiving the paths of updated files as JSON")
+	c.purgeDir = f.String("purge-dir", "", "Cache directory of the publish bucket whose updated files are removed")
+}
+
+func bucketName(flagValue, configValue, localDefault string, local bool) string {
+	switch {
+	case flagValue != "":
+		return flagValue
+	case configValue != "":
+		return configValue
+	case local:
+		return localDefault
+	}
+	return ""
+}
+
+func fileName(flagValue, localDir, name string) string {
+	if flagValue != "" {
+		return flagValue
+	}
+	return filepath.Join(localDir, name)
+}
+
+func (c *command) Execute(ctx context.Context, f *flag.FlagSet, args ...interface{}) subcommands.ExitStatus {
+	cfg := make(map[string]string)
+	if len(args) > 0 {
+		if v, ok := args[0].(map[string]string); ok {
+			cfg = v
+		}
+	}
+
+	local := *c.localDir != ""
+	publishBucket := bucketName(*c.publishBucket, cfg["PublishBucket"], "publish", local)
+	indexBucket := bucketName(*c.indexBucket, cfg["SearchIndexBucket"], "index", local)
+	if publishBucket == "" || indexBucket == "" {
+		slog.Error("bucket is empty", "publish", publishBucket, "index", indexBucket)
+		return subcommands.ExitUsageError
+	}
+
+	sched, err := cron.ParseStandard(*c.schedule)
+	if err != nil {
+		slog.Error("invalid schedule", "schedule", *c.schedule, "err", err)
+		return subcommands.ExitUsageError
+	}
+	if *c.parallelism < 1 {
+		slog.Error("invalid parallel", "parallel", *c.parallelism)
+		return subcommands.ExitUsageError
+	}
+
+	var awsCfg aws.Config
+	if !local || *c.kmsKey != "" {
+		awsCfg, err = config.LoadDefaultConfig(ctx)
+		if err != nil {
+			slog.Error("LoadConfig", "err", err)
+			return subcommands.ExitFailure
+		}
+	}
+
+	distribution := *c.distribution
+	if distribution == "" && !local {
+		distribution = cfg["Distribution"]
+	}
+	var invalidators invalidation.Multi
+	if distribution != "" {
+		if local {
+			awsCfg, err = config.LoadDefaultConfig(ctx)
+			if err != nil {
+				slog.Error("LoadConfig", "err", err)
+				return subcommands.ExitFailure
+			}
+		}
+		invalidators = append(invalidators, invalidation.NewCloudFront(cloudfront.NewFromConfig(awsCfg), distribution))
+	}
+	if *c.webhookURL != "" {
+		invalidators = append(invalidators, invalidation.NewWebhook(*c.webhookURL))
+	}
+	if *c.purgeDir != "" {
+		invalidators = append(invalidators, invalidation.NewLocalPurge(*c.purgeDir))
+	}
+	// Crawls only queue the paths, which are coalesced across users.
+	var batch *invalidation.Batch
+	var invalidator invalidation.Invalidator
+	if len(invalidators) != 0 {
+		batch = invalidation.NewBatch(invalidators)
+		invalidator = batch
+	}
+
+	var client indexhandler.S3Client
+	if local {
+		client = storage.NewLocal(*c.localDir)
+	} else {
+		client = s3.NewFromConfig(awsCfg)
+	}
+
+	sealer, err := userdb.NewSealer(kms.NewFromConfig(awsCfg), *c.kmsKey, *c.keyFile, os.Getenv("BSKYLOG_CREDENTIAL_KEY"))
+	if err != nil {
+		slog.Error("NewSealer", "err", err)
+		return subcommands.ExitFailure
+	}
+
+	tmpDir := *c.tmpDir
+	if tmpDir == "" {
+		dir, err := os.MkdirTemp("", "bskylog-run-")
+		if err != nil {
+			slog.Error("MkdirTemp", "err", err)
+			return subcommands.ExitFailure
+		}
+		defer os.RemoveAll(dir)
+		tmpDir = dir
+	}
+
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+
+	users := userdb.NewFile(fileName(*c.usersFile, *c.localDir, "users.json"))
+	crawlerDB := crawlerdb.NewFile(fileName(*c.crawlerFile, *c.localDir, "crawler.json"))
+	history := crawlerdb.NewFileHistory(fileName(*c.historyFile, *c.localDir, "history.jsonl"))
+
+	index := indexhandler.NewHandler(
+		client,
+		indexBucket,
+		tmpDir,
+		logger.With("module", "index"),
+		indexhandler.WithPublishBucket(publishBucket),
+	)
+	r := &runner{
+		users:     users,
+		crawlerDB: crawlerDB,
+		crawler: crawlerhandler.NewHandler(
+			pds.NewResolver(pds.NewDirectory(*c.plcURL), users, pds.WithLogger(logger.With("module", "pds"))),
+			users,
+			sealer,
+			nil,
+			crawlerDB,
+			client,
+			publishBucket,
+			invalidator,
+			&indexInvoker{index: index},
+			"index",
+			indexBucket,
+			history,
+			logger.With("module", "crawler"),
+		),
+		invalidation: batch,
+		parallelism:  *c.parallelism,
+		logger:       logger.With("module", "run"),
+	}
+
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	logger.Info("Start",
+		"local", *c.localDir,
+		"publishBucket", publishBucket,
+		"indexBucket", indexBucket,
+		"schedule", *c.schedule,
+	)
+
+	if *c.once {
+		failed, err := r.run(ctx)
+		if err != nil || failed != 0 {
+			return subcommands.ExitFailure
+		}
+		return subcommands.ExitSuccess
+	}
+
+	for {
+		next := sched.Next(time.Now())
+		logger.Info("Next run", "at", next)
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return subcommands.ExitSuccess
+		case <-timer.C:
+		}
+
+		// Failures are logged and kept in the crawl history, and the
+		// users are crawled again on the next run.
+		r.run(ctx)
+	}
+}
@@ -0,0 +1,112 @@
+package run
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+
+	"github.com/aws/aws-sdk-go-v2/service/lambda"
+
+	crawlerhandler "github.com/yunomu/bskylog/crawler/handler"
+	indexhandler "github.com/yunomu/bskylog/index/handler"
+	"github.com/yunomu/bskylog/lib/crawlerdb"
+	"github.com/yunomu/bskylog/lib/invalidation"
+	"github.com/yunomu/bskylog/lib/userdb"
+)
+
+// indexInvoker serves the invocations of the index function by the
+// crawler in-process. Unlike the asynchronous invocation of the Lambda
+// function, the index is updated before Invoke returns.
+type indexInvoker struct {
+	index *indexhandler.Handler
+}
+
+func (i *indexInvoker) Invoke(ctx context.Context, params *lambda.InvokeInput, optFns ...func(*lambda.Options)) (*lambda.InvokeOutput, error) {
+	var req indexhandler.Request
+	if err := json.Unmarshal(params.Payload, &req); err != nil {
+		return nil, err
+	}
+	if err := i.index.Handle(ctx, &req); err != nil {
+		return nil, err
+	}
+	return &lambda.InvokeOutput{StatusCode: 202}, nil
+}
+
+// runner crawls the due users, as the trigger function does.
+type runner struct {
+	users       userdb.DB
+	crawlerDB   crawlerdb.DB
+	crawler     *crawlerhandler.Handler
+	parallelism int
+	logger      *slog.Logger
+
+	// invalidation collects the paths updated by the crawls of a run.
+	invalidation *invalidation.Batch
+}
+
+// run crawls the due users, invalidates the updated files and returns the
+// number of failures. The crawler reschedules the users.
+func (r *runner) run(ctx context.Context) (int, error) {
+	var users []*userdb.User
+	if err := r.users.Scan(ctx, func(user *userdb.User) error {
+		users = append(users, user)
+		return nil
+	}); err != nil {
+		r.logger.Error("userdb.Scan", "err", err)
+		return 0, err
+	}
+	var dids []string
+	for _, user := range userdb.SelectDue(users, time.Now()) {
+		dids = append(dids, user.Did)
+	}
+
+	var failed atomic.Int32
+	// Wait cancels the context of the group, so the invalidations are
+	// flushed with ctx.
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(r.parallelism)
+	for _, did := range dids {
+		g.Go(func() error {
+			if err := r.seed(gctx, did); err != nil {
+				failed.Add(1)
+				return nil
+			}
+			run, _ := r.crawler.Handle(gctx, &crawlerhandler.Request{Did: did})
+			// Users deleted during the crawl are not failures.
+			failedRun := run.ErrorClass != "" && run.ErrorClass != crawlerdb.ErrorClassDeleted
+			if failedRun || run.Index == crawlerdb.OutcomeFailed {
+				failed.Add(1)
+			}
+			return nil
+		})
+	}
+	g.Wait()
+
+	if r.invalidation != nil {
+		if err := r.invalidation.Flush(ctx); err != nil {
+			r.logger.Error("Invalidate", "err", err)
+			failed.Add(1)
+		}
+	}
+
+	r.logger.Info("Run", "users", len(dids), "skipped", len(users)-len(dids), "failed", failed.Load())
+	return int(failed.Load()), nil
+}
+
+// seed adds users new to the crawler DB, whose posts are crawled from the
+// beginning.
+func (r *runner) seed(ctx context.Context, did string) error {
+	added, err := crawlerdb.Seed(ctx, r.crawlerDB, did)
+	if err != nil {
+		r.logger.Error("crawlerdb.Seed", "err", err, "did", did)
+		return err
+	}
+	if added {
+		r.logger.Info("New user", "did", did)
+	}
+	return nil
+}
@@ -0,0 +1,304 @@
+package run
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/bluesky-social/indigo/atproto/identity"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+
+	crawlerhandler "github.com/yunomu/bskylog/crawler/handler"
+	indexhandler "github.com/yunomu/bskylog/index/handler"
+	"github.com/yunomu/bskylog/lib/crawlerdb"
+	"github.com/yunomu/bskylog/lib/invalidation"
+	"github.com/yunomu/bskylog/lib/pds"
+	"github.com/yunomu/bskylog/lib/purge"
+	"github.com/yunomu/bskylog/lib/storage"
+	"github.com/yunomu/bskylog/lib/userdb"
+)
+
+const testDid = "did:plc:alice"
+
+type recordInvalidator struct {
+	paths []string
+}
+
+func (r *recordInvalidator) Invalidate(ctx context.Context, paths []string) error {
+	r.paths = append(r.paths, paths...)
+	return nil
+}
+
+// newTestPDS serves a session for the app password "secret" and an author
+// feed of two posts. Unless it is nil, onFeed is called before the feed is
+// served.
+func newTestPDS(t *testing.T, onFeed func()) *httptest.Server {
+	t.Helper()
+
+	post := func(cid, createdAt, text string) string {
+		return `{"post":{"author":{"did":"` + testDid + `","handle":"alice.test"},"cid":"` + cid + `","indexedAt":"` + createdAt + `","uri":"at://` + testDid + `/app.bsky.feed.post/` + cid + `","record":{"$type":"app.bsky.feed.post","createdAt":"` + createdAt + `","text":"` + text + `"}}}`
+	}
+	feed := `{"feed":[` +
+		post("cid2", "2026-01-02T00:00:00Z", "second post") + `,` +
+		post("cid1", "2026-01-01T00:00:00Z", "first post") + `]}`
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/xrpc/com.atproto.server.createSession":
+			var in struct {
+				Identifier string `json:"identifier"`
+				Password   string `json:"password"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&in); err != nil || in.Identifier != testDid || in.Password != "secret" {
+				w.WriteHeader(http.StatusUnauthorized)
+				io.WriteString(w, `{"error":"AuthenticationRequired"}`)
+				return
+			}
+			io.WriteString(w, `{"accessJwt":"access","refreshJwt":"refresh","did":"`+testDid+`","handle":"alice.test"}`)
+		case "/xrpc/app.bsky.feed.getAuthorFeed":
+			if r.Header.Get("Authorization") != "Bearer access" {
+				w.WriteHeader(http.StatusUnauthorized)
+				io.WriteString(w, `{"error":"AuthenticationRequired"}`)
+				return
+			}
+			if onFeed != nil {
+				onFeed()
+			}
+			io.WriteString(w, feed)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// newTestRunner returns a runner of alice, whose PDS is newTestPDS with
+// onFeed, with the DB files and the buckets in dir. The updated paths are
+// invalidated by next.
+func newTestRunner(t *testing.T, dir string, next invalidation.Invalidator, onFeed func()) *runner {
+	t.Helper()
+	ctx := context.Background()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	srv := newTestPDS(t, onFeed)
+	mock := identity.NewMockDirectory()
+	mock.Insert(identity.Identity{
+		DID:    syntax.DID(testDid),
+		Handle: syntax.Handle("alice.test"),
+		Services: map[string]identity.ServiceEndpoint{
+			"atproto_pds": {Type: "AtprotoPersonalDataServer", URL: srv.URL},
+		},
+	})
+
+	key := make([]byte, 32)
+	sealer, err := userdb.NewAESGCM(key)
+	if err != nil {
+		t.Fatalf("NewAESGCM: %v", err)
+	}
+	sealed, err := sealer.Seal(ctx, testDid, "secret")
+	if err != nil {
+		t.Fatalf("Seal: %v", err)
+	}
+
+	users := userdb.NewFile(filepath.Join(dir, "users.json"))
+	if err := users.Put(ctx, &userdb.User{Did: testDid, Handle: "alice.test", SealedPassword: sealed}); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	crawlerDB := crawlerdb.NewFile(filepath.Join(dir, "crawler.json"))
+	history := crawlerdb.NewFileHistory(filepath.Join(dir, "history.jsonl"))
+
+	batch := invalidation.NewBatch(next)
+
+	client := storage.NewLocal(filepath.Join(dir, "buckets"))
+	index := indexhandler.NewHandler(client, "index", t.TempDir(), logger, indexhandler.WithPublishBucket("publish"))
+	return &runner{
+		users:     users,
+		crawlerDB: crawlerDB,
+		crawler: crawlerhandler.NewHandler(
+			pds.NewResolver(&mock, users, pds.WithLogger(logger)),
+			users,
+			sealer,
+			nil,
+			crawlerDB,
+			client,
+			"publish",
+			batch,
+			&indexInvoker{index: index},
+			"index",
+			"index",
+			history,
+			logger,
+		),
+		invalidation: batch,
+		parallelism:  1,
+		logger:       logger,
+	}
+}
+
+func TestRunner(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	invalidated := &recordInvalidator{}
+	r := newTestRunner(t, dir, invalidated, nil)
+	users := r.users
+	crawlerDB := r.crawlerDB
+	history := crawlerdb.NewFileHistory(filepath.Join(dir, "history.jsonl"))
+
+	failed, err := r.run(ctx)
+	if err != nil || failed != 0 {
+		t.Fatalf("run: failed %d, %v", failed, err)
+	}
+
+	// The day files are published and indexed.
+	for _, name := range []string{
+		"publish/" + testDid + "/2026/01/01",
+		"publish/" + testDid + "/2026/01/02",
+		"index/" + testDid + "/2026/01",
+	} {
+		if _, err := os.Stat(filepath.Join(dir, "buckets", filepath.FromSlash(name))); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "buckets", "publish", testDid, "2026", "01", "02"))
+	if err != nil || !strings.Contains(string(data), "second post") {
+		t.Errorf("day file: got %q, %v", data, err)
+	}
+
+	// Day files new to the bucket are not cached yet, so only the month
+	// index is invalidated.
+	want := []string{"/" + testDid + "/2026/01/index"}
+	if diff := cmp.Diff(want, invalidated.paths); diff != "" {
+		t.Errorf("invalidated mismatch (-want +got):\n%s", diff)
+	}
+
+	ts, err := crawlerDB.Get(ctx, testDid)
+	if err != nil || ts.LatestCid != "cid2" {
+		t.Errorf("crawler DB: got %+v, %v", ts, err)
+	}
+	runs, err := history.Runs(ctx, testDid, 10)
+	if err != nil || len(runs) != 1 || runs[0].Posts != 2 || runs[0].Index != crawlerdb.OutcomeDone || runs[0].Invalidation != crawlerdb.OutcomeDone {
+		t.Errorf("history: got %+v, %v", runs, err)
+	}
+
+	// Nothing is new on the next run.
+	if failed, err := r.run(ctx); err != nil || failed != 0 {
+		t.Fatalf("second run: failed %d, %v", failed, err)
+	}
+	runs, err = history.Runs(ctx, testDid, 1)
+	if err != nil || len(runs) != 1 || runs[0].Posts != 0 {
+		t.Errorf("second run: got %+v, %v", runs, err)
+	}
+	if len(invalidated.paths) != len(want) {
+		t.Errorf("second run invalidated %v", invalidated.paths[len(want):])
+	}
+
+	// Users are not crawled before they are due.
+	user, err := users.Get(ctx, testDid)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if user.NextDue.IsZero() || user.Failures != 0 {
+		t.Errorf("not rescheduled: %+v", user)
+	}
+	user.Interval = time.Hour
+	user.NextDue = time.Now().Add(time.Hour)
+	if err := users.Put(ctx, user); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if failed, err := r.run(ctx); err != nil || failed != 0 {
+		t.Fatalf("third run: failed %d, %v", failed, err)
+	}
+	runs, err = history.Runs(ctx, testDid, 10)
+	if err != nil || len(runs) != 2 {
+		t.Errorf("third run: got %d runs, %v", len(runs), err)
+	}
+}
+
+func TestRunner_webhook(t *testing.T) {
+	var got []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Paths []string `json:"paths"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		got = append(got, req.Paths...)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	r := newTestRunner(t, t.TempDir(), invalidation.NewWebhook(srv.URL), nil)
+	if failed, err := r.run(context.Background()); err != nil || failed != 0 {
+		t.Fatalf("run: failed %d, %v", failed, err)
+	}
+	want := []string{"/" + testDid + "/2026/01/index"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("invalidated mismatch (-want +got):\n%s", diff)
+	}
+}
+
+// TestRunner_purge purges alice while she is crawled.
+func TestRunner_purge(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	users := userdb.NewFile(filepath.Join(dir, "users.json"))
+	crawlerDB := crawlerdb.NewFile(filepath.Join(dir, "crawler.json"))
+	history := crawlerdb.NewFileHistory(filepath.Join(dir, "history.jsonl"))
+	client := storage.NewLocal(filepath.Join(dir, "buckets"))
+	purger := purge.NewPurger(users, crawlerDB, history, client, "publish", "index")
+
+	purged := false
+	r := newTestRunner(t, dir, &recordInvalidator{}, func() {
+		if purged {
+			return
+		}
+		purged = true
+		plan, err := purger.Plan(ctx, testDid)
+		if err != nil {
+			t.Errorf("Plan: %v", err)
+			return
+		}
+		if err := purger.Purge(ctx, plan); err != nil {
+			t.Errorf("Purge: %v", err)
+		}
+	})
+
+	if failed, err := r.run(ctx); err != nil || failed != 0 {
+		t.Fatalf("run: failed %d, %v", failed, err)
+	}
+	if !purged {
+		t.Fatalf("not purged")
+	}
+
+	if _, err := users.Get(ctx, testDid); err != userdb.ErrNotExists {
+		t.Errorf("user: got %v", err)
+	}
+	if ts, err := crawlerDB.Get(ctx, testDid); err != crawlerdb.ErrNotExists {
+		t.Errorf("crawler DB: got %+v, %v", ts, err)
+	}
+	if runs, err := history.Runs(ctx, testDid, 10); err != nil || len(runs) != 0 {
+		t.Errorf("history: got %+v, %v", runs, err)
+	}
+	plan, err := purger.Plan(ctx, testDid)
+	if err != nil {
+		t.Fatalf("Plan: %v", err)
+	}
+	if len(plan.PublishKeys) != 0 || len(plan.IndexKeys) != 0 || len(plan.ManifestKeys) != 0 {
+		t.Errorf("left after the purge: %+v", plan)
+	}
+}
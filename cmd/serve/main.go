@@ -0,0 +1,237 @@
+package serve
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/google/subcommands"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+
+	"github.com/yunomu/bskylog/lib/crawlerdb"
+	"github.com/yunomu/bskylog/lib/functionurl"
+	"github.com/yunomu/bskylog/lib/pds"
+	"github.com/yunomu/bskylog/lib/purge"
+	"github.com/yunomu/bskylog/lib/signup"
+	"github.com/yunomu/bskylog/lib/storage"
+	"github.com/yunomu/bskylog/lib/userdb"
+	"github.com/yunomu/bskylog/search/handler"
+)
+
+// S3Client is the union of the operations used by the search handler, the
+// publish bucket and the purge of deleted accounts.
+type S3Client interface {
+	handler.S3Client
+	ObjectGetter
+	purge.S3Client
+}
+
+type command struct {
+	addr          *string
+	staticDir     *string
+	localDir      *string
+	publishBucket *string
+	indexBucket   *string
+	tmpDir        *string
+
+	feedHostname  *string
+	feedPublisher *string
+	feedTZ        *string
+
+	signup      *bool
+	usersFile   *string
+	crawlerFile *string
+	historyFile *string
+	kmsKey      *string
+	keyFile     *string
+	plcURL      *string
+}
+
+func NewCommand() subcommands.Command {
+	return &command{}
+}
+
+func (c *command) Name() string     { return "serve" }
+func (c *command) Synopsis() string { return "Serve the frontend, the logs and search over HTTP" }
+func (c *command) Usage() string {
+	return `serve [-addr {addr}] [-static {dir}] [-local {dir}] [-publish {bucket}] [-index {bucket}]
+      [-feed-hostname {hostname} -feed-publisher {did} [-feed-tz {tz}]]
+      [-signup [-users {file}] [-crawler {file}] [-history {file}] [-kms-key {key} | -key-file {file}] [-plc {url}]]
+
+Without -local, the buckets are read from S3. With -local, buckets are
+subdirectories of the directory.
+
+With -signup, accounts signed up at /signup are added to the user and crawler
+DB files of the run command, which crawls them at its next run. Accounts are
+deleted with all their data, including their crawl history, by DELETE /signup.
+`
+}
+
+func (c *command) SetFlags(f *flag.FlagSet) {
+	c.addr = f.String("addr", "localhost:8080", "Address to listen on")
+	c.staticDir = f.String("static", "web/static", "Directory of the frontend, served before the publish bucket (empty to disable)")
+	c.localDir = f.String("local", "", "Directory of local buckets instead of S3")
+	c.publishBucket = f.String("publish", "", "Publish bucket (default PublishBucket of config, or \"publish\" with -local)")
+	c.indexBucket = f.String("index", "", "Search index bucket (default SearchIndexBucket of config, or \"index\" with -local)")
+	c.tmpDir = f.String("tmpdir", "", "Directory for downloaded indexes (default a new temporary directory)")
+	c.feedHostname = f.String("feed-hostname", "", "Hostname of the feed generator (empty to disable)")
+	c.feedPublisher = f.String("feed-publisher", "", "DID of the account publishing the feed records")
+	c.feedTZ = f.String("feed-tz", "", "Time zone of the on this day feed, in minutes or a name")
+	c.signup = f.Bool("signup", false, "Serve /signup")
+	c.usersFile = f.String("users", "", "User DB file of -signup (default users.json, in the -local directory with -local)")
+	c.crawlerFile = f.String("crawler", "", "Crawler DB file of -signup (default crawler.json, in the -local directory with -local)")
+	c.historyFile = f.String("history", "", "Crawl history file of -signup (default history.jsonl, in the -local directory with -local)")
+	c.kmsKey = f.String("kms-key", "", "KMS key sealing passwords of -signup")
+	c.keyFile = f.String("key-file", "", "AES-GCM key file sealing passwords of -signup")
+	c.plcURL = f.String("plc", pds.DefaultPLCURL, "PLC directory URL")
+}
+
+func bucketName(flagValue, configValue, localDefault string, local bool) string {
+	switch {
+	case flagValue != "":
+		return flagValue
+	case configValue != "":
+		return configValue
+	case local:
+		return localDefault
+	}
+	return ""
+}
+
+func fileName(flagValue, localDir, name string) string {
+	if flagValue != "" {
+		return flagValue
+	}
+	return filepath.Join(localDir, name)
+}
+
+func (c *command) Execute(ctx context.Context, f *flag.FlagSet, args ...interface{}) subcommands.ExitStatus {
+	cfg := make(map[string]string)
+	if len(args) > 0 {
+		if v, ok := args[0].(map[string]string); ok {
+			cfg = v
+		}
+	}
+
+	local := *c.localDir != ""
+	publishBucket := bucketName(*c.publishBucket, cfg["PublishBucket"], "publish", local)
+	indexBucket := bucketName(*c.indexBucket, cfg["SearchIndexBucket"], "index", local)
+	if publishBucket == "" || indexBucket == "" {
+		slog.Error("bucket is empty", "publish", publishBucket, "index", indexBucket)
+		return subcommands.ExitUsageError
+	}
+
+	feedLoc, err := handler.ParseLocation(*c.feedTZ)
+	if err != nil {
+		slog.Error("invalid feed-tz", "err", err)
+		return subcommands.ExitUsageError
+	}
+
+	var awsCfg aws.Config
+	if !local || *c.kmsKey != "" {
+		awsCfg, err = config.LoadDefaultConfig(ctx)
+		if err != nil {
+			slog.Error("LoadConfig", "err", err)
+			return subcommands.ExitFailure
+		}
+	}
+
+	var client S3Client
+	if local {
+		client = storage.NewLocal(*c.localDir)
+	} else {
+		client = s3.NewFromConfig(awsCfg)
+	}
+
+	tmpDir := *c.tmpDir
+	if tmpDir == "" {
+		dir, err := os.MkdirTemp("", "bskylog-serve-")
+		if err != nil {
+			slog.Error("MkdirTemp", "err", err)
+			return subcommands.ExitFailure
+		}
+		defer os.RemoveAll(dir)
+		tmpDir = dir
+	}
+
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+
+	var signupServer *signup.Server
+	if *c.signup {
+		if !local && (*c.usersFile == "" || *c.crawlerFile == "") {
+			slog.Error("-signup requires -local, or -users and -crawler")
+			return subcommands.ExitUsageError
+		}
+		sealer, err := userdb.NewSealer(kms.NewFromConfig(awsCfg), *c.kmsKey, *c.keyFile, os.Getenv("BSKYLOG_CREDENTIAL_KEY"))
+		if err != nil {
+			slog.Error("NewSealer", "err", err)
+			return subcommands.ExitFailure
+		}
+		users := userdb.NewFile(fileName(*c.usersFile, *c.localDir, "users.json"))
+		crawlerDB := crawlerdb.NewFile(fileName(*c.crawlerFile, *c.localDir, "crawler.json"))
+		var history crawlerdb.History
+		if local || *c.historyFile != "" {
+			history = crawlerdb.NewFileHistory(fileName(*c.historyFile, *c.localDir, "history.jsonl"))
+		}
+		signupServer = signup.NewServer(
+			users,
+			crawlerDB,
+			sealer,
+			pds.NewDirectory(*c.plcURL),
+			signup.WithPurger(purge.NewPurger(users, crawlerDB, history, client, publishBucket, indexBucket, purge.WithLogger(logger.With("module", "purge")))),
+			signup.WithLogger(logger.With("module", "signup")),
+		)
+	}
+
+	searchHandler := handler.NewHandler(
+		client,
+		indexBucket,
+		publishBucket,
+		handler.WithTmpDir(tmpDir),
+		handler.WithLogger(logger.With("module", "search")),
+		handler.WithLimit(100),
+		handler.WithFeedGenerator(*c.feedHostname, *c.feedPublisher, feedLoc),
+		handler.WithSignup(signupServer),
+	)
+
+	server := &http.Server{
+		Addr: *c.addr,
+		Handler: newServer(
+			functionurl.Handler(searchHandler.Handle, functionurl.WithLogger(logger.With("module", "functionurl"))),
+			&publishHandler{
+				staticDir: *c.staticDir,
+				client:    client,
+				bucket:    publishBucket,
+				logger:    logger.With("module", "publish"),
+			},
+		),
+	}
+
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	logger.Info("Listening", "addr", *c.addr, "local", *c.localDir, "publishBucket", publishBucket, "indexBucket", indexBucket)
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		logger.Error("ListenAndServe", "err", err)
+		return subcommands.ExitFailure
+	}
+
+	return subcommands.ExitSuccess
+}
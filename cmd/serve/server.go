@@ -0,0 +1,126 @@
+package serve
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// ObjectGetter gets objects of the publish bucket.
+type ObjectGetter interface {
+	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+}
+
+// publishHandler serves what CloudFront serves from the publish bucket:
+// the frontend, the day files and the month indexes. Paths that are not
+// files are routes of the frontend and get index.html.
+type publishHandler struct {
+	staticDir string
+	client    ObjectGetter
+	bucket    string
+	logger    *slog.Logger
+}
+
+func (h *publishHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	key := strings.TrimPrefix(path.Clean(r.URL.Path), "/")
+	if key == "" {
+		key = "index.html"
+	}
+	if h.serveStatic(w, r, key) || h.serveObject(w, r, key) {
+		return
+	}
+	if h.serveStatic(w, r, "index.html") || h.serveObject(w, r, "index.html") {
+		return
+	}
+	http.NotFound(w, r)
+}
+
+func (h *publishHandler) serveStatic(w http.ResponseWriter, r *http.Request, key string) bool {
+	if h.staticDir == "" {
+		return false
+	}
+	f, err := os.Open(filepath.Join(h.staticDir, filepath.FromSlash(key)))
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil || fi.IsDir() {
+		return false
+	}
+	http.ServeContent(w, r, fi.Name(), fi.ModTime(), f)
+	return true
+}
+
+func (h *publishHandler) serveObject(w http.ResponseWriter, r *http.Request, key string) bool {
+	if h.client == nil {
+		return false
+	}
+	out, err := h.client.GetObject(r.Context(), &s3.GetObjectInput{
+		Bucket: &h.bucket,
+		Key:    &key,
+	})
+	if err != nil {
+		var noSuchKey *types.NoSuchKey
+		if !errors.As(err, &noSuchKey) {
+			h.logger.Warn("Failed to get object", "err", err, "bucket", h.bucket, "key", key)
+		}
+		return false
+	}
+	defer out.Body.Close()
+
+	body, err := io.ReadAll(out.Body)
+	if err != nil {
+		h.logger.Error("Failed to read object", "err", err, "bucket", h.bucket, "key", key)
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return true
+	}
+	if out.ContentType != nil {
+		w.Header().Set("Content-Type", *out.ContentType)
+	}
+	if out.ETag != nil {
+		w.Header().Set("ETag", *out.ETag)
+	}
+	var modTime time.Time
+	if out.LastModified != nil {
+		modTime = aws.ToTime(out.LastModified)
+	}
+	http.ServeContent(w, r, path.Base(key), modTime, bytes.NewReader(body))
+	return true
+}
+
+// newServer routes the search API to search and everything else to the
+// publish bucket, as the CloudFront distribution does.
+func newServer(search http.Handler, publish http.Handler) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/search", search)
+	mux.Handle("/search/", search)
+	mux.Handle("/stats/", search)
+	mux.Handle("/related/", search)
+	mux.Handle("/onthisday/", search)
+	mux.Handle("/post/", search)
+	mux.Handle("/xrpc/", search)
+	mux.Handle("/.well-known/did.json", search)
+	mux.Handle("/oauth/", search)
+	mux.Handle("/signup", search)
+	mux.Handle("/", publish)
+	return mux
+}
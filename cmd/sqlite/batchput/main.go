@@ -49,7 +49,11 @@ func (c *command) Execute(ctx context.Context, f *flag.FlagSet, args ...interfac
 		return subcommands.ExitFailure
 	}
 
-	recordStore := index.NewGorm(db)
+	recordStore, err := index.NewGorm(ctx, db)
+	if err != nil {
+		slog.Error("failed to open index", "err", err)
+		return subcommands.ExitFailure
+	}
 
 	scanner := bufio.NewScanner(os.Stdin)
 	for scanner.Scan() {
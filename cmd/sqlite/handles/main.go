@@ -0,0 +1,285 @@
+package handles
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/google/subcommands"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+	gormlogger "gorm.io/gorm/logger"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+
+	"github.com/bluesky-social/indigo/atproto/identity"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+
+	indexhandler "github.com/yunomu/bskylog/index/handler"
+	"github.com/yunomu/bskylog/lib/index"
+	"github.com/yunomu/bskylog/lib/pds"
+)
+
+type command struct {
+	bucket *string
+	did    *string
+	plcURL *string
+	tmpDir *string
+	local  *bool
+	dryRun *bool
+
+	dir     identity.Directory
+	current map[string]string
+}
+
+func NewCommand() subcommands.Command {
+	return &command{}
+}
+
+func (c *command) Name() string     { return "handles" }
+func (c *command) Synopsis() string { return "rewrite stale handles in indexes" }
+func (c *command) Usage() string {
+	return `handles [-bucket {search_index_bucket}] [-did {did}] [-plc {plc_url}] [-dryrun]
+handles -local:
+  Rewrite the handles kept in every index in the search index bucket, or
+  in the -dbpath file with -local, with the current handles resolved from
+  the DIDs in the PLC directory. Stale handles are those kept in the index
+  that differ from the current ones.
+`
+}
+
+func (c *command) SetFlags(f *flag.FlagSet) {
+	c.bucket = f.String("bucket", "", "search index bucket (SearchIndexBucket)")
+	c.did = f.String("did", "", "rewrite only the indexes of this DID")
+	c.plcURL = f.String("plc", pds.DefaultPLCURL, "PLC directory URL")
+	c.tmpDir = f.String("tmpdir", os.TempDir(), "working directory")
+	c.local = f.Bool("local", false, "rewrite the -dbpath file instead of the bucket")
+	c.dryRun = f.Bool("dryrun", false, "print stale handles without rewriting")
+}
+
+func (c *command) Execute(ctx context.Context, f *flag.FlagSet, args ...interface{}) subcommands.ExitStatus {
+	if len(args) < 2 {
+		slog.Error("arguments not found")
+		return subcommands.ExitFailure
+	}
+	db, ok := args[0].(*gorm.DB)
+	if !ok {
+		slog.Error("db has unexpected type", "arg", args[0])
+		return subcommands.ExitFailure
+	}
+	cfg, ok := args[1].(map[string]string)
+	if !ok {
+		slog.Error("config has unexpected type", "arg", args[1])
+		return subcommands.ExitFailure
+	}
+
+	c.dir = pds.NewDirectory(*c.plcURL)
+	c.current = make(map[string]string)
+
+	if *c.local {
+		if _, err := c.rewrite(ctx, "local", db); err != nil {
+			return subcommands.ExitFailure
+		}
+		return subcommands.ExitSuccess
+	}
+
+	bucket := *c.bucket
+	if v, ok := cfg["SearchIndexBucket"]; ok && bucket == "" {
+		bucket = v
+	}
+	if bucket == "" {
+		slog.Error("bucket is empty")
+		return subcommands.ExitFailure
+	}
+
+	awsCfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		slog.Error("LoadConfig", "err", err)
+		return subcommands.ExitFailure
+	}
+	client := s3.NewFromConfig(awsCfg)
+
+	input := &s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+	}
+	if *c.did != "" {
+		input.Prefix = c.did
+	}
+
+	failed := 0
+	paginator := s3.NewListObjectsV2Paginator(client, input)
+	for paginator.HasMorePages() {
+		out, err := paginator.NextPage(ctx)
+		if err != nil {
+			slog.Error("ListObjectsV2", "err", err, "bucket", bucket)
+			return subcommands.ExitFailure
+		}
+
+		for _, obj := range out.Contents {
+			key := aws.ToString(obj.Key)
+			if strings.HasPrefix(key, indexhandler.ManifestPrefix) {
+				continue
+			}
+			if *c.did != "" && key != *c.did && !strings.HasPrefix(key, *c.did+"/") {
+				continue
+			}
+			if err := c.rewriteObject(ctx, client, bucket, key); err != nil {
+				failed++
+				// continue
+			}
+		}
+	}
+
+	if failed != 0 {
+		slog.Error("some indexes were not rewritten", "failed", failed)
+		return subcommands.ExitFailure
+	}
+
+	return subcommands.ExitSuccess
+}
+
+// currentHandle returns the current handle of did, or "" if it is not
+// resolved. Results are kept for the other indexes.
+func (c *command) currentHandle(ctx context.Context, did string) string {
+	if h, ok := c.current[did]; ok {
+		return h
+	}
+
+	var handle string
+	ident, err := pds.Lookup(ctx, c.dir, did)
+	if err != nil {
+		slog.Warn("resolve DID", "err", err, "did", did)
+	} else if ident.Handle != syntax.HandleInvalid {
+		handle = ident.Handle.String()
+	}
+	c.current[did] = handle
+	return handle
+}
+
+// rewrite reports whether db was changed.
+func (c *command) rewrite(ctx context.Context, name string, db *gorm.DB) (bool, error) {
+	logger := slog.With("index", name)
+
+	g, err := index.NewGorm(ctx, db, index.GormOptionLogger(logger))
+	if err != nil {
+		slog.Error("NewGorm", "err", err, "index", name)
+		return false, err
+	}
+
+	handles, err := g.Handles(ctx)
+	if err != nil {
+		return false, err
+	}
+	dids := make([]string, 0, len(handles))
+	for did := range handles {
+		dids = append(dids, did)
+	}
+	sort.Strings(dids)
+
+	stale := make(map[string]string)
+	for _, did := range dids {
+		current := c.currentHandle(ctx, did)
+		if current == "" {
+			continue
+		}
+		for _, h := range handles[did] {
+			if h != current {
+				fmt.Printf("%s\t%s\t%s\t%s\n", name, did, h, current)
+				stale[did] = current
+			}
+		}
+	}
+	if *c.dryRun || len(stale) == 0 {
+		return false, nil
+	}
+
+	n, err := g.RewriteHandles(ctx, stale)
+	if err != nil {
+		slog.Error("RewriteHandles", "err", err, "index", name)
+		return false, err
+	}
+	slog.Info("rewritten", "index", name, "dids", len(stale), "rows", n)
+
+	return n > 0, nil
+}
+
+func (c *command) rewriteObject(ctx context.Context, client *s3.Client, bucket string, key string) error {
+	filePath := filepath.Join(*c.tmpDir, strings.ReplaceAll(key, "/", "_"))
+	defer os.Remove(filePath)
+
+	out, err := client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		slog.Error("GetObject", "err", err, "bucket", bucket, "key", key)
+		return err
+	}
+	if err := func() error {
+		defer out.Body.Close()
+
+		file, err := os.Create(filePath)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		_, err = io.Copy(file, out.Body)
+		return err
+	}(); err != nil {
+		slog.Error("failed to download index", "err", err, "key", key, "filePath", filePath)
+		return err
+	}
+
+	changed, err := func() (bool, error) {
+		db, err := gorm.Open(sqlite.Open(filePath), &gorm.Config{
+			Logger: gormlogger.Default.LogMode(gormlogger.Silent),
+		})
+		if err != nil {
+			return false, err
+		}
+		sqlDB, err := db.DB()
+		if err != nil {
+			return false, err
+		}
+		defer sqlDB.Close()
+
+		return c.rewrite(ctx, key, db)
+	}()
+	if err != nil {
+		return err
+	}
+	if !changed {
+		return nil
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		slog.Error("os.Open", "err", err, "filePath", filePath)
+		return err
+	}
+	defer file.Close()
+
+	// Fails rather than overwrite posts indexed while rewriting.
+	if _, err := client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(bucket),
+		Key:         aws.String(key),
+		Body:        file,
+		ContentType: aws.String("application/vnd.sqlite3"),
+		IfMatch:     out.ETag,
+	}); err != nil {
+		slog.Error("PutObject", "err", err, "bucket", bucket, "key", key)
+		return err
+	}
+
+	return nil
+}
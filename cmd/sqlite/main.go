@@ -11,7 +11,10 @@ import (
 	"gorm.io/gorm"
 
 	"github.com/yunomu/bskylog/cmd/sqlite/batchput"
+	"github.com/yunomu/bskylog/cmd/sqlite/handles"
+	"github.com/yunomu/bskylog/cmd/sqlite/migrate"
 	"github.com/yunomu/bskylog/cmd/sqlite/put"
+	"github.com/yunomu/bskylog/cmd/sqlite/rebuild"
 	"github.com/yunomu/bskylog/cmd/sqlite/search" // searchパッケージをインポート
 )
 
@@ -40,6 +43,9 @@ func (c *command) SetFlags(f *flag.FlagSet) {
 	commander.Register(put.NewCommand(), "")
 	commander.Register(batchput.NewCommand(), "")
 	commander.Register(search.NewCommand(), "") // searchサブコマンドを登録
+	commander.Register(migrate.NewCommand(), "")
+	commander.Register(rebuild.NewCommand(), "")
+	commander.Register(handles.NewCommand(), "")
 	c.commander = commander
 }
 
@@ -56,5 +62,12 @@ func (c *command) Execute(ctx context.Context, f *flag.FlagSet, args ...interfac
 		return subcommands.ExitFailure
 	}
 
-	return c.commander.Execute(ctx, db)
+	cfg := make(map[string]string)
+	if len(args) > 0 {
+		if v, ok := args[0].(map[string]string); ok {
+			cfg = v
+		}
+	}
+
+	return c.commander.Execute(ctx, db, cfg)
 }
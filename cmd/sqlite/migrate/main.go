@@ -0,0 +1,234 @@
+package migrate
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/subcommands"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+	gormlogger "gorm.io/gorm/logger"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+
+	indexhandler "github.com/yunomu/bskylog/index/handler"
+	"github.com/yunomu/bskylog/lib/index"
+)
+
+type command struct {
+	bucket *string
+	did    *string
+	tmpDir *string
+	local  *bool
+	dryRun *bool
+}
+
+func NewCommand() subcommands.Command {
+	return &command{}
+}
+
+func (c *command) Name() string     { return "migrate" }
+func (c *command) Synopsis() string { return "upgrade index schema" }
+func (c *command) Usage() string {
+	return `migrate [-bucket {search_index_bucket}] [-did {did}] [-dryrun]
+migrate -local:
+  Upgrade the schema of every index in the search index bucket,
+  or of the -dbpath file with -local.
+
+  Search migrates its own copy of an index of an older schema each time
+  it downloads it, and the indexer migrates the indexes it writes to. Run
+  this after deploying a version with a new schema to save search the
+  work for the shards the indexer no longer writes.
+`
+}
+
+func (c *command) SetFlags(f *flag.FlagSet) {
+	c.bucket = f.String("bucket", "", "search index bucket (SearchIndexBucket)")
+	c.did = f.String("did", "", "migrate only this DID")
+	c.tmpDir = f.String("tmpdir", os.TempDir(), "working directory")
+	c.local = f.Bool("local", false, "migrate the -dbpath file instead of the bucket")
+	c.dryRun = f.Bool("dryrun", false, "print schema versions without migrating")
+}
+
+func (c *command) Execute(ctx context.Context, f *flag.FlagSet, args ...interface{}) subcommands.ExitStatus {
+	if len(args) < 2 {
+		slog.Error("arguments not found")
+		return subcommands.ExitFailure
+	}
+	db, ok := args[0].(*gorm.DB)
+	if !ok {
+		slog.Error("db has unexpected type", "arg", args[0])
+		return subcommands.ExitFailure
+	}
+	cfg, ok := args[1].(map[string]string)
+	if !ok {
+		slog.Error("config has unexpected type", "arg", args[1])
+		return subcommands.ExitFailure
+	}
+
+	if *c.local {
+		if _, err := c.migrate(ctx, "local", db); err != nil {
+			return subcommands.ExitFailure
+		}
+		return subcommands.ExitSuccess
+	}
+
+	bucket := *c.bucket
+	if v, ok := cfg["SearchIndexBucket"]; ok && bucket == "" {
+		bucket = v
+	}
+	if bucket == "" {
+		slog.Error("bucket is empty")
+		return subcommands.ExitFailure
+	}
+
+	awsCfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		slog.Error("LoadConfig", "err", err)
+		return subcommands.ExitFailure
+	}
+	client := s3.NewFromConfig(awsCfg)
+
+	// Indexes are month shards "<did>/YYYY/MM", or "<did>" from before
+	// sharding.
+	input := &s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+	}
+	if *c.did != "" {
+		input.Prefix = c.did
+	}
+
+	failed := 0
+	paginator := s3.NewListObjectsV2Paginator(client, input)
+	for paginator.HasMorePages() {
+		out, err := paginator.NextPage(ctx)
+		if err != nil {
+			slog.Error("ListObjectsV2", "err", err, "bucket", bucket)
+			return subcommands.ExitFailure
+		}
+
+		for _, obj := range out.Contents {
+			key := aws.ToString(obj.Key)
+			if strings.HasPrefix(key, indexhandler.ManifestPrefix) {
+				continue
+			}
+			if *c.did != "" && key != *c.did && !strings.HasPrefix(key, *c.did+"/") {
+				continue
+			}
+			if err := c.migrateObject(ctx, client, bucket, key); err != nil {
+				failed++
+				// continue
+			}
+		}
+	}
+
+	if failed != 0 {
+		slog.Error("some indexes were not migrated", "failed", failed)
+		return subcommands.ExitFailure
+	}
+
+	return subcommands.ExitSuccess
+}
+
+// migrate reports whether db was changed.
+func (c *command) migrate(ctx context.Context, name string, db *gorm.DB) (bool, error) {
+	version, _, err := index.GetSchemaVersion(ctx, db)
+	if err != nil {
+		slog.Error("GetSchemaVersion", "err", err, "index", name)
+		return false, err
+	}
+
+	fmt.Printf("%s\t%d\t%d\n", name, version, index.CurrentSchemaVersion)
+	if *c.dryRun || version == index.CurrentSchemaVersion {
+		return false, nil
+	}
+
+	if err := index.Migrate(ctx, db, slog.With("index", name)); err != nil {
+		slog.Error("Migrate", "err", err, "index", name)
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (c *command) migrateObject(ctx context.Context, client *s3.Client, bucket string, key string) error {
+	filePath := filepath.Join(*c.tmpDir, strings.ReplaceAll(key, "/", "_"))
+	defer os.Remove(filePath)
+
+	out, err := client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		slog.Error("GetObject", "err", err, "bucket", bucket, "key", key)
+		return err
+	}
+	if err := func() error {
+		defer out.Body.Close()
+
+		file, err := os.Create(filePath)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		_, err = io.Copy(file, out.Body)
+		return err
+	}(); err != nil {
+		slog.Error("failed to download index", "err", err, "key", key, "filePath", filePath)
+		return err
+	}
+
+	changed, err := func() (bool, error) {
+		db, err := gorm.Open(sqlite.Open(filePath), &gorm.Config{
+			Logger: gormlogger.Default.LogMode(gormlogger.Silent),
+		})
+		if err != nil {
+			return false, err
+		}
+		sqlDB, err := db.DB()
+		if err != nil {
+			return false, err
+		}
+		defer sqlDB.Close()
+
+		return c.migrate(ctx, key, db)
+	}()
+	if err != nil {
+		return err
+	}
+	if !changed {
+		return nil
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		slog.Error("os.Open", "err", err, "filePath", filePath)
+		return err
+	}
+	defer file.Close()
+
+	// Fails rather than overwrite posts indexed while migrating.
+	if _, err := client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(bucket),
+		Key:         aws.String(key),
+		Body:        file,
+		ContentType: aws.String("application/vnd.sqlite3"),
+		IfMatch:     out.ETag,
+	}); err != nil {
+		slog.Error("PutObject", "err", err, "bucket", bucket, "key", key)
+		return err
+	}
+
+	slog.Info("migrated", "key", key, "version", index.CurrentSchemaVersion)
+	return nil
+}
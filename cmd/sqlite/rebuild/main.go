@@ -0,0 +1,103 @@
+package rebuild
+
+import (
+	"context"
+	"flag"
+	"log/slog"
+	"os"
+
+	"github.com/google/subcommands"
+
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+
+	indexhandler "github.com/yunomu/bskylog/index/handler"
+)
+
+type command struct {
+	did           *string
+	bucket        *string
+	publishBucket *string
+	batchSize     *int
+	tmpDir        *string
+}
+
+func NewCommand() subcommands.Command {
+	return &command{}
+}
+
+func (c *command) Name() string     { return "rebuild" }
+func (c *command) Synopsis() string { return "rebuild index from storage" }
+func (c *command) Usage() string {
+	return `rebuild -did {did} [-bucket {search_index_bucket}] [-publish {publish_bucket}]:
+  Rebuild the index of the DID from the day files in the publish bucket
+  and replace it in the search index bucket.
+`
+}
+
+func (c *command) SetFlags(f *flag.FlagSet) {
+	c.did = f.String("did", "", "DID")
+	c.bucket = f.String("bucket", "", "search index bucket (SearchIndexBucket)")
+	c.publishBucket = f.String("publish", "", "publish bucket (PublishBucket)")
+	c.batchSize = f.Int("batch", 500, "posts per transaction")
+	c.tmpDir = f.String("tmpdir", os.TempDir(), "working directory")
+}
+
+func (c *command) Execute(ctx context.Context, f *flag.FlagSet, args ...interface{}) subcommands.ExitStatus {
+	if *c.did == "" {
+		slog.Error("-did is required")
+		return subcommands.ExitUsageError
+	}
+
+	if len(args) < 2 {
+		slog.Error("arguments not found")
+		return subcommands.ExitFailure
+	}
+	cfg, ok := args[1].(map[string]string)
+	if !ok {
+		slog.Error("config has unexpected type", "arg", args[1])
+		return subcommands.ExitFailure
+	}
+
+	bucket := *c.bucket
+	if v, ok := cfg["SearchIndexBucket"]; ok && bucket == "" {
+		bucket = v
+	}
+	if bucket == "" {
+		slog.Error("bucket is empty")
+		return subcommands.ExitFailure
+	}
+
+	publishBucket := *c.publishBucket
+	if v, ok := cfg["PublishBucket"]; ok && publishBucket == "" {
+		publishBucket = v
+	}
+	if publishBucket == "" {
+		slog.Error("publish bucket is empty")
+		return subcommands.ExitFailure
+	}
+
+	awsCfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		slog.Error("LoadConfig", "err", err)
+		return subcommands.ExitFailure
+	}
+
+	h := indexhandler.NewHandler(
+		s3.NewFromConfig(awsCfg),
+		bucket,
+		*c.tmpDir,
+		slog.Default(),
+		indexhandler.WithPublishBucket(publishBucket),
+		indexhandler.WithBatchSize(*c.batchSize),
+	)
+
+	stats, err := h.Rebuild(ctx, *c.did)
+	if err != nil {
+		slog.Error("Rebuild", "err", err, "did", *c.did)
+		return subcommands.ExitFailure
+	}
+
+	slog.Info("Complete", "did", *c.did, "keys", stats.Keys, "posts", stats.Posts, "skipped", stats.Skipped)
+	return subcommands.ExitSuccess
+}
@@ -6,7 +6,6 @@ import (
 	"fmt"
 	"log/slog"
 	"os"
-	"strings"
 
 	"github.com/google/subcommands"
 	"gorm.io/gorm"
@@ -50,11 +49,13 @@ func (c *command) Execute(ctx context.Context, f *flag.FlagSet, args ...interfac
 	}
 
 	logger := slog.New(slog.NewJSONHandler(os.Stderr, nil))
-	gormIndex := index.NewGorm(db, index.GormOptionLogger(logger))
+	gormIndex, err := index.NewGorm(ctx, db, index.GormOptionLogger(logger), index.GormOptionReadOnly())
+	if err != nil {
+		slog.Error("failed to open index", "err", err)
+		return subcommands.ExitFailure
+	}
 
-	results, err := gormIndex.Search(ctx, &index.Query{
-		Text: strings.Fields(*c.query),
-	})
+	results, err := gormIndex.Search(ctx, index.ParseQuery(*c.query))
 	if err != nil {
 		slog.Error("failed to execute search", "query", *c.query, "err", err)
 		return subcommands.ExitFailure
@@ -0,0 +1,265 @@
+package delete
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	"github.com/google/subcommands"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/cloudfront"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+
+	"github.com/yunomu/bskylog/lib/crawlerdb"
+	"github.com/yunomu/bskylog/lib/invalidation"
+	"github.com/yunomu/bskylog/lib/purge"
+	"github.com/yunomu/bskylog/lib/storage"
+	"github.com/yunomu/bskylog/lib/userdb"
+)
+
+type command struct {
+	did    *string
+	purge  *bool
+	dryRun *bool
+
+	localDir      *string
+	crawlerFile   *string
+	crawlerTable  *string
+	historyFile   *string
+	historyTable  *string
+	publishBucket *string
+	indexBucket   *string
+	distribution  *string
+	purgeDir      *string
+}
+
+func NewCommand() subcommands.Command {
+	return &command{}
+}
+
+func (c *command) Name() string     { return "delete" }
+func (c *command) Synopsis() string { return "delete a user and, with -purge, all their data" }
+func (c *command) Usage() string {
+	return `delete -did {did} [-purge] [-dryrun]
+       [-local {dir}] [-crawler {file} | -crawler-table {table}]
+       [-history {file} | -history-table {table}] [-publish {bucket}] [-index {bucket}]
+       [-distribution {id}] [-purge-dir {dir}]
+
+Without -purge, only the user is deleted, and the archive is kept. With
+-purge, the crawler state and crawl history, the day files and month indexes
+in the publish bucket and the search index and its manifests are deleted too,
+and the paths of the user are invalidated. With -dryrun, what would be deleted
+is printed instead.
+
+With -local, the buckets are subdirectories of the directory and the crawler
+state and crawl history are in crawler.json and history.jsonl there, as with
+"run".
+`
+}
+
+func (c *command) SetFlags(f *flag.FlagSet) {
+	c.did = f.String("did", "", "Did")
+	c.purge = f.Bool("purge", false, "Delete all the data of the user")
+	c.dryRun = f.Bool("dryrun", false, "Print what would be deleted")
+	c.localDir = f.String("local", "", "Directory of local buckets instead of S3")
+	c.crawlerFile = f.String("crawler", "", "Crawler DB file (default crawler.json, in the -local directory with -local)")
+	c.crawlerTable = f.String("crawler-table", "", "Crawler table name (CrawlerTable)")
+	c.historyFile = f.String("history", "", "Crawl history file (default history.jsonl, in the -local directory with -local)")
+	c.historyTable = f.String("history-table", "", "Crawl history table name (CrawlHistoryTable)")
+	c.publishBucket = f.String("publish", "", "Publish bucket (default PublishBucket of config, or \"publish\" with -local)")
+	c.indexBucket = f.String("index", "", "Search index bucket (default SearchIndexBucket of config, or \"index\" with -local)")
+	c.distribution = f.String("distribution", "", "CloudFront distribution to invalidate (default Distribution of config, without -local)")
+	c.purgeDir = f.String("purge-dir", "", "Directory of cached files to remove")
+}
+
+func bucketName(flagValue, configValue, localDefault string, local bool) string {
+	switch {
+	case flagValue != "":
+		return flagValue
+	case configValue != "":
+		return configValue
+	case local:
+		return localDefault
+	}
+	return ""
+}
+
+func (c *command) Execute(ctx context.Context, f *flag.FlagSet, args ...interface{}) subcommands.ExitStatus {
+	if *c.did == "" {
+		slog.Error("-did is required")
+		return subcommands.ExitFailure
+	}
+
+	if len(args) == 0 {
+		slog.Error("db not found")
+		return subcommands.ExitFailure
+	}
+	users, ok := args[0].(userdb.DB)
+	if !ok {
+		slog.Error("unexpected type", "arg", args[0])
+		return subcommands.ExitFailure
+	}
+	cfg := make(map[string]string)
+	if len(args) > 1 {
+		if v, ok := args[1].(map[string]string); ok {
+			cfg = v
+		}
+	}
+
+	if !*c.purge {
+		return c.deleteUser(ctx, users)
+	}
+
+	p, status := c.newPurger(ctx, users, cfg)
+	if p == nil {
+		return status
+	}
+
+	plan, err := p.Plan(ctx, *c.did)
+	if err != nil {
+		slog.Error("Plan", "err", err, "did", *c.did)
+		return subcommands.ExitFailure
+	}
+	if *c.dryRun {
+		w := bufio.NewWriter(os.Stdout)
+		defer w.Flush()
+		if plan.User {
+			fmt.Fprintf(w, "user\t%s\n", plan.Did)
+		}
+		if plan.Crawler {
+			fmt.Fprintf(w, "crawler\t%s\n", plan.Did)
+		}
+		if plan.Runs != 0 {
+			fmt.Fprintf(w, "history\t%s\t%d runs\n", plan.Did, plan.Runs)
+		}
+		for _, key := range plan.PublishKeys {
+			fmt.Fprintf(w, "publish\t%s\n", key)
+		}
+		for _, key := range plan.IndexKeys {
+			fmt.Fprintf(w, "index\t%s\n", key)
+		}
+		for _, key := range plan.ManifestKeys {
+			fmt.Fprintf(w, "manifest\t%s\n", key)
+		}
+		for _, path := range plan.Paths {
+			fmt.Fprintf(w, "invalidate\t%s\n", path)
+		}
+		return subcommands.ExitSuccess
+	}
+
+	if err := p.Purge(ctx, plan); err != nil {
+		slog.Error("Purge", "err", err, "did", *c.did)
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
+
+// deleteUser deletes only the user, which is no longer crawled.
+func (c *command) deleteUser(ctx context.Context, users userdb.DB) subcommands.ExitStatus {
+	if _, err := users.Get(ctx, *c.did); errors.Is(err, userdb.ErrNotExists) {
+		slog.Error("user not found", "did", *c.did)
+		return subcommands.ExitFailure
+	} else if err != nil {
+		slog.Error("Get", "err", err, "did", *c.did)
+		return subcommands.ExitFailure
+	}
+	if *c.dryRun {
+		fmt.Printf("user\t%s\n", *c.did)
+		return subcommands.ExitSuccess
+	}
+	if err := users.Delete(ctx, *c.did); err != nil {
+		slog.Error("Delete", "err", err, "did", *c.did)
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
+
+func (c *command) newPurger(ctx context.Context, users userdb.DB, cfg map[string]string) (*purge.Purger, subcommands.ExitStatus) {
+	local := *c.localDir != ""
+	publishBucket := bucketName(*c.publishBucket, cfg["PublishBucket"], "publish", local)
+	indexBucket := bucketName(*c.indexBucket, cfg["SearchIndexBucket"], "index", local)
+	if publishBucket == "" || indexBucket == "" {
+		slog.Error("bucket is empty", "publish", publishBucket, "index", indexBucket)
+		return nil, subcommands.ExitUsageError
+	}
+	distribution := *c.distribution
+	if distribution == "" && !local {
+		distribution = cfg["Distribution"]
+	}
+
+	crawlerFile := *c.crawlerFile
+	if crawlerFile == "" && local && *c.crawlerTable == "" {
+		crawlerFile = filepath.Join(*c.localDir, "crawler.json")
+	}
+	crawlerTable := *c.crawlerTable
+	if crawlerTable == "" && crawlerFile == "" {
+		crawlerTable = cfg["CrawlerTable"]
+	}
+	if crawlerFile == "" && crawlerTable == "" {
+		slog.Error("crawler DB is not configured")
+		return nil, subcommands.ExitUsageError
+	}
+
+	historyFile := *c.historyFile
+	if historyFile == "" && local && *c.historyTable == "" {
+		historyFile = filepath.Join(*c.localDir, "history.jsonl")
+	}
+	historyTable := *c.historyTable
+	if historyTable == "" && historyFile == "" {
+		historyTable = cfg["CrawlHistoryTable"]
+	}
+
+	var awsCfg aws.Config
+	if !local || crawlerTable != "" || historyTable != "" || distribution != "" {
+		var err error
+		awsCfg, err = config.LoadDefaultConfig(ctx)
+		if err != nil {
+			slog.Error("LoadConfig", "err", err)
+			return nil, subcommands.ExitFailure
+		}
+	}
+
+	var crawlerDB crawlerdb.DB
+	if crawlerFile != "" {
+		crawlerDB = crawlerdb.NewFile(crawlerFile)
+	} else {
+		crawlerDB = crawlerdb.NewDynamoDB(dynamodb.NewFromConfig(awsCfg), crawlerTable)
+	}
+
+	var history crawlerdb.History
+	switch {
+	case historyFile != "":
+		history = crawlerdb.NewFileHistory(historyFile)
+	case historyTable != "":
+		history = crawlerdb.NewDynamoDBHistory(dynamodb.NewFromConfig(awsCfg), historyTable, 0)
+	}
+
+	var client purge.S3Client
+	if local {
+		client = storage.NewLocal(*c.localDir)
+	} else {
+		client = s3.NewFromConfig(awsCfg)
+	}
+
+	var invalidators invalidation.Multi
+	if distribution != "" {
+		invalidators = append(invalidators, invalidation.NewCloudFront(cloudfront.NewFromConfig(awsCfg), distribution))
+	}
+	if *c.purgeDir != "" {
+		invalidators = append(invalidators, invalidation.NewLocalPurge(*c.purgeDir))
+	}
+	var opts []purge.Option
+	if len(invalidators) != 0 {
+		opts = append(opts, purge.WithInvalidator(invalidators))
+	}
+
+	return purge.NewPurger(users, crawlerDB, history, client, publishBucket, indexBucket, opts...), subcommands.ExitSuccess
+}
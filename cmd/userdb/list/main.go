@@ -7,6 +7,7 @@ import (
 	"log/slog"
 	"os"
 	"strconv"
+	"time"
 
 	"github.com/google/subcommands"
 	"github.com/yunomu/bskylog/lib/userdb"
@@ -42,14 +43,20 @@ func (c *command) Execute(ctx context.Context, f *flag.FlagSet, args ...interfac
 	w := csv.NewWriter(os.Stdout)
 	defer w.Flush()
 
-	w.Write([]string{"did", "handle", "password", "timezone"})
+	w.Write([]string{"did", "handle", "sealed", "oauth", "timezone", "pds", "paused", "interval", "next_due", "failures"})
 
 	if err := client.Scan(ctx, func(user *userdb.User) error {
 		w.Write([]string{
 			user.Did,
 			user.Handle,
-			user.Password,
+			strconv.FormatBool(userdb.IsSealed(user.SealedPassword)),
+			strconv.FormatBool(user.OAuthSession != ""),
 			strconv.Itoa(user.TimeZone),
+			user.PDS,
+			strconv.FormatBool(user.Paused),
+			user.Interval.String(),
+			formatTime(user.NextDue),
+			strconv.Itoa(user.Failures),
 		})
 		return nil
 	}); err != nil {
@@ -59,3 +66,10 @@ func (c *command) Execute(ctx context.Context, f *flag.FlagSet, args ...interfac
 
 	return subcommands.ExitSuccess
 }
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
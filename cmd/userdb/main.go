@@ -4,20 +4,30 @@ import (
 	"context"
 	"flag"
 	"log/slog"
+	"os"
 
 	"github.com/google/subcommands"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
 
+	"github.com/yunomu/bskylog/cmd/userdb/delete"
 	"github.com/yunomu/bskylog/cmd/userdb/list"
 	"github.com/yunomu/bskylog/cmd/userdb/put"
+	"github.com/yunomu/bskylog/cmd/userdb/schedule"
+	"github.com/yunomu/bskylog/cmd/userdb/seal"
 	"github.com/yunomu/bskylog/lib/userdb"
 )
 
 type command struct {
-	table *string
-	index *string
+	file        *string
+	table       *string
+	index       *string
+	handleTable *string
+	kmsKey      *string
+	keyFile     *string
 
 	commander *subcommands.Commander
 }
@@ -29,17 +39,29 @@ func NewCommand() subcommands.Command {
 func (c *command) Name() string     { return "userdb" }
 func (c *command) Synopsis() string { return "userdb command" }
 func (c *command) Usage() string {
-	return `userdb -table {table_name} <subcommand>
+	return `userdb -table {table_name} [-kms-key {key} | -key-file {file}] <subcommand>
+userdb -file {users_file} [-key-file {file}] <subcommand>
+
+With -file, users are kept in the file used by "run" instead of DynamoDB.
+Passwords are sealed with the KMS key, or with the AES-GCM key in the key
+file or in the environment variable BSKYLOG_CREDENTIAL_KEY (base64).
 `
 }
 
 func (c *command) SetFlags(f *flag.FlagSet) {
+	c.file = f.String("file", "", "user DB file instead of the table")
 	c.table = f.String("table", "", "table name (UserTable)")
 	c.index = f.String("index", "", "Handle index name (HandleIndex)")
+	c.handleTable = f.String("handle-table", "", "previous handle table name (HandleTable)")
+	c.kmsKey = f.String("kms-key", "", "KMS key sealing passwords (CredentialKey)")
+	c.keyFile = f.String("key-file", "", "AES-GCM key file sealing passwords, instead of KMS")
 
 	commander := subcommands.NewCommander(f, "bsky")
+	commander.Register(delete.NewCommand(), "")
 	commander.Register(list.NewCommand(), "")
 	commander.Register(put.NewCommand(), "")
+	commander.Register(schedule.NewCommand(), "")
+	commander.Register(seal.NewCommand(), "")
 	c.commander = commander
 }
 
@@ -54,35 +76,69 @@ func (c *command) Execute(ctx context.Context, f *flag.FlagSet, args ...interfac
 		return subcommands.ExitFailure
 	}
 
-	table := *c.table
-	if v, ok := cfg["UserTable"]; ok && table == "" {
-		table = v
-	}
-	if table == "" {
-		slog.Error("table is empty")
-		return subcommands.ExitFailure
+	var db userdb.DB
+	var awsCfg aws.Config
+	if *c.file != "" {
+		db = userdb.NewFile(*c.file)
+	} else {
+		table := *c.table
+		if v, ok := cfg["UserTable"]; ok && table == "" {
+			table = v
+		}
+		if table == "" {
+			slog.Error("table is empty")
+			return subcommands.ExitFailure
+		}
+
+		index := *c.index
+		if v, ok := cfg["HandleIndex"]; ok && index == "" {
+			index = v
+		}
+		if index == "" {
+			slog.Error("Handle index is empty")
+			return subcommands.ExitFailure
+		}
+
+		handleTable := *c.handleTable
+		if v, ok := cfg["HandleTable"]; ok && handleTable == "" {
+			handleTable = v
+		}
+
+		var err error
+		awsCfg, err = config.LoadDefaultConfig(ctx)
+		if err != nil {
+			slog.Error("LoadConfig", "error", err)
+			return subcommands.ExitFailure
+		}
+
+		db = userdb.NewDynamoDB(
+			dynamodb.NewFromConfig(awsCfg),
+			table,
+			index,
+			handleTable,
+		)
 	}
 
-	index := *c.index
-	if v, ok := cfg["HandleIndex"]; ok && index == "" {
-		index = v
+	kmsKey := *c.kmsKey
+	if v, ok := cfg["CredentialKey"]; ok && kmsKey == "" && *c.keyFile == "" && *c.file == "" {
+		kmsKey = v
 	}
-	if index == "" {
-		slog.Error("Handle index is empty")
-		return subcommands.ExitFailure
+	if *c.file != "" && kmsKey != "" {
+		var err error
+		awsCfg, err = config.LoadDefaultConfig(ctx)
+		if err != nil {
+			slog.Error("LoadConfig", "error", err)
+			return subcommands.ExitFailure
+		}
 	}
-
-	awsCfg, err := config.LoadDefaultConfig(ctx)
-	if err != nil {
-		slog.Error("LoadConfig", "error", err)
+	// Commands that do not seal work without a key.
+	var sealer userdb.Sealer
+	if s, err := userdb.NewSealer(kms.NewFromConfig(awsCfg), kmsKey, *c.keyFile, os.Getenv("BSKYLOG_CREDENTIAL_KEY")); err == nil {
+		sealer = s
+	} else if kmsKey != "" || *c.keyFile != "" || os.Getenv("BSKYLOG_CREDENTIAL_KEY") != "" {
+		slog.Error("NewSealer", "err", err)
 		return subcommands.ExitFailure
 	}
 
-	db := userdb.NewDynamoDB(
-		dynamodb.NewFromConfig(awsCfg),
-		table,
-		index,
-	)
-
-	return c.commander.Execute(ctx, db, cfg)
+	return c.commander.Execute(ctx, db, cfg, sealer)
 }
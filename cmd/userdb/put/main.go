@@ -4,6 +4,7 @@ import (
 	"context"
 	"flag"
 	"log/slog"
+	"time"
 
 	"github.com/google/subcommands"
 	"github.com/yunomu/bskylog/lib/userdb"
@@ -14,6 +15,7 @@ type command struct {
 	handle   *string
 	password *string
 	timezone *int
+	interval *time.Duration
 }
 
 func NewCommand() subcommands.Command {
@@ -23,7 +25,7 @@ func NewCommand() subcommands.Command {
 func (c *command) Name() string     { return "put" }
 func (c *command) Synopsis() string { return "put" }
 func (c *command) Usage() string {
-	return `put -did {did} -handle {handle} -password {password} -timezone {timezone}
+	return `put -did {did} -handle {handle} -password {password} -timezone {timezone} [-interval {duration}]
 `
 }
 
@@ -32,6 +34,7 @@ func (c *command) SetFlags(f *flag.FlagSet) {
 	c.handle = f.String("handle", "", "Handle")
 	c.password = f.String("password", "", "Password")
 	c.timezone = f.Int("timezone", 0, "Timezone (min)")
+	c.interval = f.Duration("interval", 0, "Crawl interval (0 for every trigger)")
 }
 
 func (c *command) Execute(ctx context.Context, f *flag.FlagSet, args ...interface{}) subcommands.ExitStatus {
@@ -57,12 +60,27 @@ func (c *command) Execute(ctx context.Context, f *flag.FlagSet, args ...interfac
 		slog.Error("unexpected type", "arg", args[0])
 		return subcommands.ExitFailure
 	}
+	var sealer userdb.Sealer
+	if len(args) > 2 {
+		sealer, _ = args[2].(userdb.Sealer)
+	}
+	if sealer == nil {
+		slog.Error("credential key is not configured")
+		return subcommands.ExitFailure
+	}
+
+	sealed, err := sealer.Seal(ctx, *c.did, *c.password)
+	if err != nil {
+		slog.Error("Seal", "err", err)
+		return subcommands.ExitFailure
+	}
 
 	if err := client.Put(ctx, &userdb.User{
-		Did:      *c.did,
-		Handle:   *c.handle,
-		Password: *c.password,
-		TimeZone: *c.timezone,
+		Did:            *c.did,
+		Handle:         *c.handle,
+		SealedPassword: sealed,
+		TimeZone:       *c.timezone,
+		Interval:       *c.interval,
 	}); err != nil {
 		slog.Error("Put", "err", err)
 		return subcommands.ExitFailure
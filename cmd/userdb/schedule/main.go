@@ -0,0 +1,92 @@
+package schedule
+
+import (
+	"context"
+	"flag"
+	"log/slog"
+	"time"
+
+	"github.com/google/subcommands"
+	"github.com/yunomu/bskylog/lib/userdb"
+)
+
+type command struct {
+	did      *string
+	pause    *bool
+	resume   *bool
+	interval *time.Duration
+	now      *bool
+}
+
+func NewCommand() subcommands.Command {
+	return &command{}
+}
+
+func (c *command) Name() string     { return "schedule" }
+func (c *command) Synopsis() string { return "pause, resume or set the crawl interval of a user" }
+func (c *command) Usage() string {
+	return `schedule -did {did} [-pause|-resume] [-interval {duration}] [-now]
+`
+}
+
+func (c *command) SetFlags(f *flag.FlagSet) {
+	c.did = f.String("did", "", "Did")
+	c.pause = f.Bool("pause", false, "Stop crawling the user")
+	c.resume = f.Bool("resume", false, "Crawl the user again")
+	c.interval = f.Duration("interval", -1, "Crawl interval (0 for every trigger)")
+	c.now = f.Bool("now", false, "Crawl the user at the next trigger")
+}
+
+func (c *command) Execute(ctx context.Context, f *flag.FlagSet, args ...interface{}) subcommands.ExitStatus {
+	if *c.did == "" {
+		slog.Error("-did is required")
+		return subcommands.ExitFailure
+	}
+	if *c.pause && *c.resume {
+		slog.Error("-pause and -resume are exclusive")
+		return subcommands.ExitFailure
+	}
+
+	if len(args) == 0 {
+		slog.Error("db not found")
+		return subcommands.ExitFailure
+	}
+	client, ok := args[0].(userdb.DB)
+	if !ok {
+		slog.Error("unexpected type", "arg", args[0])
+		return subcommands.ExitFailure
+	}
+
+	user, err := client.Get(ctx, *c.did)
+	if err != nil {
+		slog.Error("Get", "err", err, "did", *c.did)
+		return subcommands.ExitFailure
+	}
+
+	if *c.pause {
+		user.Paused = true
+	}
+	if *c.resume {
+		user.Paused = false
+		user.Failures = 0
+	}
+	if *c.interval >= 0 {
+		user.Interval = *c.interval
+	}
+	if *c.now {
+		user.NextDue = time.Time{}
+	}
+
+	if err := client.Put(ctx, user); err != nil {
+		slog.Error("Put", "err", err)
+		return subcommands.ExitFailure
+	}
+
+	slog.Info("Scheduled",
+		"did", user.Did,
+		"paused", user.Paused,
+		"interval", user.Interval,
+		"nextDue", user.NextDue,
+	)
+	return subcommands.ExitSuccess
+}
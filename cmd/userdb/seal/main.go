@@ -0,0 +1,81 @@
+package seal
+
+import (
+	"context"
+	"flag"
+	"log/slog"
+
+	"github.com/google/subcommands"
+	"github.com/yunomu/bskylog/lib/userdb"
+)
+
+type command struct {
+	dryRun *bool
+}
+
+func NewCommand() subcommands.Command {
+	return &command{}
+}
+
+func (c *command) Name() string     { return "seal" }
+func (c *command) Synopsis() string { return "seal passwords stored in plaintext" }
+func (c *command) Usage() string {
+	return `seal [-dry-run]
+`
+}
+
+func (c *command) SetFlags(f *flag.FlagSet) {
+	c.dryRun = f.Bool("dry-run", false, "only list the users to seal")
+}
+
+func (c *command) Execute(ctx context.Context, f *flag.FlagSet, args ...interface{}) subcommands.ExitStatus {
+	if len(args) == 0 {
+		slog.Error("db not found")
+		return subcommands.ExitFailure
+	}
+	client, ok := args[0].(userdb.DB)
+	if !ok {
+		slog.Error("unexpected type", "arg", args[0])
+		return subcommands.ExitFailure
+	}
+	var sealer userdb.Sealer
+	if len(args) > 2 {
+		sealer, _ = args[2].(userdb.Sealer)
+	}
+	if sealer == nil {
+		slog.Error("credential key is not configured")
+		return subcommands.ExitFailure
+	}
+
+	var users []*userdb.User
+	if err := client.Scan(ctx, func(user *userdb.User) error {
+		if user.SealedPassword != "" && !userdb.IsSealed(user.SealedPassword) {
+			users = append(users, user)
+		}
+		return nil
+	}); err != nil {
+		slog.Error("Scan error", "err", err)
+		return subcommands.ExitFailure
+	}
+
+	for _, user := range users {
+		if *c.dryRun {
+			slog.Info("Plaintext password", "did", user.Did, "handle", user.Handle)
+			continue
+		}
+
+		sealed, err := sealer.Seal(ctx, user.Did, user.SealedPassword)
+		if err != nil {
+			slog.Error("Seal", "err", err, "did", user.Did)
+			return subcommands.ExitFailure
+		}
+		user.SealedPassword = sealed
+		if err := client.Put(ctx, user); err != nil {
+			slog.Error("Put", "err", err, "did", user.Did)
+			return subcommands.ExitFailure
+		}
+		slog.Info("Sealed", "did", user.Did, "handle", user.Handle)
+	}
+
+	return subcommands.ExitSuccess
+}
@@ -4,78 +4,89 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
-	"strconv"
 	"time"
 
 	"github.com/bluesky-social/indigo/api/atproto"
 	"github.com/bluesky-social/indigo/api/bsky"
+	lexutil "github.com/bluesky-social/indigo/lex/util"
 	"github.com/bluesky-social/indigo/xrpc"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/service/cloudfront"
-	"github.com/aws/aws-sdk-go-v2/service/cloudfront/types"
 	"github.com/aws/aws-sdk-go-v2/service/lambda"
 	lambdatypes "github.com/aws/aws-sdk-go-v2/service/lambda/types"
 
 	"github.com/yunomu/bskylog/lib/consumer"
 	"github.com/yunomu/bskylog/lib/crawlerdb"
+	"github.com/yunomu/bskylog/lib/invalidation"
+	"github.com/yunomu/bskylog/lib/oauth"
+	"github.com/yunomu/bskylog/lib/pds"
 	"github.com/yunomu/bskylog/lib/processor"
 	"github.com/yunomu/bskylog/lib/scanner"
+	"github.com/yunomu/bskylog/lib/userdb"
 
 	indexhandler "github.com/yunomu/bskylog/index/handler"
 )
 
-type CloudFrontClient interface {
-	CreateInvalidation(ctx context.Context, params *cloudfront.CreateInvalidationInput, optFns ...func(*cloudfront.Options)) (*cloudfront.CreateInvalidationOutput, error)
-}
-
 type LambdaClient interface {
 	Invoke(ctx context.Context, params *lambda.InvokeInput, optFns ...func(*lambda.Options)) (*lambda.InvokeOutput, error)
 }
 
 type Handler struct {
-	xrpcHost         string
-	crawlerDB        crawlerdb.DB
-	s3Client         consumer.S3Client
-	bucket           string
-	cloudfrontClient CloudFrontClient
-	distribution     string
-	lambdaClient     LambdaClient
-	indexFunction    string
+	resolver      *pds.Resolver
+	userDB        userdb.DB
+	sealer        userdb.Sealer
+	oauth         *oauth.Client
+	crawlerDB     crawlerdb.DB
+	s3Client      consumer.S3Client
+	bucket        string
+	invalidator   invalidation.Invalidator
+	lambdaClient  LambdaClient
+	indexFunction string
+	indexBucket   string
+	history       crawlerdb.History
 
 	logger *slog.Logger
 }
 
 func NewHandler(
-	xrpcHost string,
+	resolver *pds.Resolver,
+	userDB userdb.DB,
+	sealer userdb.Sealer,
+	oauthClient *oauth.Client,
 	crawlerDB crawlerdb.DB,
 	s3Client consumer.S3Client,
 	bucket string,
-	cloudfrontClient CloudFrontClient,
-	distribution string,
+	invalidator invalidation.Invalidator,
 	lambdaClient LambdaClient,
 	indexFunction string,
+	indexBucket string,
+	history crawlerdb.History,
 	logger *slog.Logger,
 ) *Handler {
 	return &Handler{
-		xrpcHost:         xrpcHost,
-		crawlerDB:        crawlerDB,
-		s3Client:         s3Client,
-		bucket:           bucket,
-		cloudfrontClient: cloudfrontClient,
-		distribution:     distribution,
-		lambdaClient:     lambdaClient,
-		indexFunction:    indexFunction,
-		logger:           logger,
+		resolver:      resolver,
+		userDB:        userDB,
+		sealer:        sealer,
+		oauth:         oauthClient,
+		crawlerDB:     crawlerDB,
+		s3Client:      s3Client,
+		bucket:        bucket,
+		invalidator:   invalidator,
+		lambdaClient:  lambdaClient,
+		indexFunction: indexFunction,
+		indexBucket:   indexBucket,
+		history:       history,
+		logger:        logger,
 	}
 }
 
+// Request is the event of a crawl. The credentials of the account are read
+// from the user DB, so that the event carries no password.
 type Request struct {
-	Handle   string `json:"handle"`
-	Password string `json:"password"`
-	TimeZone int    `json:"timezone"`
+	Did string `json:"did"`
 }
 
 func (h *Handler) invokeIndexFunction(ctx context.Context, req *indexhandler.Request) error {
@@ -103,66 +114,304 @@ func (h *Handler) invokeIndexFunction(ctx context.Context, req *indexhandler.Req
 	return nil
 }
 
-func (h *Handler) Handle(ctx context.Context, req *Request) {
-	if req.Handle == "" {
-		h.logger.Error("handle is empty")
+// requestIndex hands items over to the index function through a manifest
+// in the index bucket, since async invocation payloads are limited to
+// 256 KB.
+func (h *Handler) requestIndex(ctx context.Context, did string, items []*indexhandler.Item) error {
+	key := indexhandler.ManifestKey(did, time.Now())
+	if err := indexhandler.WriteManifest(ctx, h.s3Client, h.indexBucket, key, items); err != nil {
+		h.logger.Error("WriteManifest",
+			"err", err,
+			"bucket", h.indexBucket,
+			"key", key,
+		)
+		return err
+	}
+
+	return h.invokeIndexFunction(ctx, &indexhandler.Request{
+		DID:      did,
+		Manifest: key,
+	})
+}
+
+// errDeleted stops crawls of users deleted during the crawl, so that the
+// day files, the crawler state and the index of purged users are not
+// written again.
+var errDeleted = errors.New("user was deleted during the crawl")
+
+// checkUser returns errDeleted if the user of did no longer exists. Other
+// failures to read the user are logged and do not stop the crawl.
+func (h *Handler) checkUser(ctx context.Context, did string) error {
+	_, err := h.userDB.Get(ctx, did)
+	if errors.Is(err, userdb.ErrNotExists) {
+		h.logger.Info("User deleted during the crawl", "did", did)
+		return errDeleted
+	} else if err != nil {
+		h.logger.Warn("userdb.Get",
+			"err", err,
+			"did", did,
+		)
+	}
+	return nil
+}
+
+// pageScanner counts the pages fetched by a scanner and whether the scan
+// failed in the callback, that is in storing the posts, rather than in
+// fetching them. Before each page is stored, check is called.
+type pageScanner struct {
+	scanner.Scanner
+	check       func(ctx context.Context) error
+	pages       int
+	storeFailed bool
+}
+
+func (s *pageScanner) Scan(ctx context.Context, f func([]*bsky.FeedDefs_FeedViewPost) error) error {
+	return s.Scanner.Scan(ctx, func(feed []*bsky.FeedDefs_FeedViewPost) error {
+		s.pages++
+		if err := s.check(ctx); err != nil {
+			return err
+		}
+		if err := f(feed); err != nil {
+			s.storeFailed = true
+			return err
+		}
+		return nil
+	})
+}
+
+func (h *Handler) putRun(ctx context.Context, run *crawlerdb.Run) {
+	run.EndedAt = time.Now()
+	switch run.ErrorClass {
+	case "", crawlerdb.ErrorClassDeleted:
+		h.logger.Info("Crawl", "run", run)
+	default:
+		h.logger.Error("Crawl failed", "run", run)
+	}
+
+	// The history of deleted users is purged with them.
+	if h.history == nil || run.Did == "" || run.ErrorClass == crawlerdb.ErrorClassDeleted {
 		return
 	}
-	if req.Password == "" {
-		h.logger.Error("password is empty")
+	if err := h.history.PutRun(ctx, run); err != nil {
+		h.logger.Error("history.PutRun",
+			"err", err,
+			"did", run.Did,
+		)
+	}
+}
+
+func fail(run *crawlerdb.Run, class crawlerdb.ErrorClass, err error) {
+	if run.ErrorClass != "" {
 		return
 	}
+	run.ErrorClass = class
+	run.Error = err.Error()
+}
 
-	loc := time.FixedZone(fmt.Sprintf("%dmin", req.TimeZone), req.TimeZone*60)
+// Handle crawls the account and returns the report of the run, which is
+// also kept in the crawl history. Failures are reported in the run rather
+// than returned as errors, so that asynchronous invocations are not
+// retried.
+func (h *Handler) Handle(ctx context.Context, req *Request) (*crawlerdb.Run, error) {
+	run := &crawlerdb.Run{
+		StartedAt:    time.Now(),
+		Index:        crawlerdb.OutcomeSkipped,
+		Invalidation: crawlerdb.OutcomeSkipped,
+	}
+	h.crawl(ctx, req, run)
+	h.putRun(ctx, run)
+	h.reschedule(ctx, run)
+	return run, nil
+}
 
-	xrpcClient := &xrpc.Client{
-		Host: h.xrpcHost,
+// reschedule sets when the user of run is due next from its outcome. The
+// user is read again, as it may have changed during the crawl, and only the
+// schedule is written back.
+func (h *Handler) reschedule(ctx context.Context, run *crawlerdb.Run) {
+	if run.Did == "" || run.ErrorClass == crawlerdb.ErrorClassRequest || run.ErrorClass == crawlerdb.ErrorClassDeleted {
+		return
 	}
 
-	session, err := atproto.ServerCreateSession(ctx, xrpcClient, &atproto.ServerCreateSession_Input{
-		Identifier: req.Handle,
-		Password:   req.Password,
-	})
+	user, err := h.userDB.Get(ctx, run.Did)
 	if err != nil {
-		h.logger.Error("ServerCreateSession",
+		h.logger.Error("userdb.Get",
+			"err", err,
+			"did", run.Did,
+		)
+		return
+	}
+	user.Reschedule(run.EndedAt, run.ErrorClass != "")
+	if err := h.userDB.SetSchedule(ctx, user.Did, user.NextDue, user.Failures); err != nil {
+		h.logger.Error("userdb.SetSchedule",
 			"err", err,
-			"identifier", req.Handle,
-			"password", req.Password,
+			"did", run.Did,
 		)
 		return
 	}
+	h.logger.Debug("Rescheduled",
+		"did", user.Did,
+		"nextDue", user.NextDue,
+		"failures", user.Failures,
+	)
+}
+
+// client returns a client of the account authorized by its OAuth session
+// or, without one, by its app password. The handle of the account is
+// refreshed from the session or the DID document.
+func (h *Handler) client(ctx context.Context, user *userdb.User) (lexutil.LexClient, error) {
+	if user.OAuthSession != "" && h.oauth != nil {
+		client, err := h.oauth.APIClient(ctx, user.Did)
+		if err != nil {
+			h.logger.Error("Resume OAuth session",
+				"err", err,
+				"did", user.Did,
+			)
+			return nil, err
+		}
+		// The session carries no handle, which is taken from the DID
+		// document instead.
+		if _, err := h.resolver.Refresh(ctx, user); err != nil {
+			h.logger.Warn("Refresh handle",
+				"err", err,
+				"did", user.Did,
+			)
+		}
+		return client, nil
+	}
 
-	ts, err := h.crawlerDB.Get(ctx, session.Did)
+	password, err := h.sealer.Open(ctx, user.Did, user.SealedPassword)
 	if err != nil {
-		h.logger.Error("crawldb.Get",
+		h.logger.Error("Open sealed password",
 			"err", err,
-			"did", session.Did,
+			"did", user.Did,
 		)
-		return
+		return nil, err
+	}
+
+	host, err := h.resolver.Host(ctx, user)
+	if err != nil {
+		h.logger.Error("Resolve PDS",
+			"err", err,
+			"did", user.Did,
+		)
+		return nil, err
+	}
+
+	xrpcClient := &xrpc.Client{
+		Host: host,
+	}
+	input := &atproto.ServerCreateSession_Input{
+		Identifier: user.Did,
+		Password:   password,
+	}
+
+	session, err := atproto.ServerCreateSession(ctx, xrpcClient, input)
+	if err != nil {
+		// The account may have moved since the PDS was resolved.
+		if newHost, rerr := h.resolver.Refresh(ctx, user); rerr == nil && newHost != host {
+			h.logger.Info("PDS changed",
+				"did", user.Did,
+				"pds", newHost,
+				"previous", host,
+			)
+			xrpcClient.Host = newHost
+			session, err = atproto.ServerCreateSession(ctx, xrpcClient, input)
+		}
+	}
+	if err != nil {
+		h.logger.Error("ServerCreateSession",
+			"err", err,
+			"did", user.Did,
+			"pds", xrpcClient.Host,
+		)
+		return nil, err
 	}
 
+	h.setHandle(ctx, user, session.Handle)
+
 	xrpcClient.Auth = &xrpc.AuthInfo{
 		AccessJwt:  session.AccessJwt,
 		RefreshJwt: session.RefreshJwt,
 		Did:        session.Did,
 		Handle:     session.Handle,
 	}
+	return xrpcClient, nil
+}
+
+// setHandle records the handle of the session in the handle history of
+// user.
+func (h *Handler) setHandle(ctx context.Context, user *userdb.User, handle string) {
+	if !user.SetHandle(handle, time.Now()) {
+		return
+	}
+	h.logger.Info("Handle changed",
+		"did", user.Did,
+		"handle", user.Handle,
+	)
+	if err := h.userDB.SetIdentity(ctx, user); err != nil {
+		h.logger.Warn("Failed to keep the handle",
+			"err", err,
+			"did", user.Did,
+		)
+	}
+}
+
+func (h *Handler) crawl(ctx context.Context, req *Request, run *crawlerdb.Run) {
+	if req.Did == "" {
+		fail(run, crawlerdb.ErrorClassRequest, errors.New("did is empty"))
+		return
+	}
+	run.Did = req.Did
+
+	user, err := h.userDB.Get(ctx, req.Did)
+	if err != nil {
+		h.logger.Error("userdb.Get",
+			"err", err,
+			"did", req.Did,
+		)
+		fail(run, crawlerdb.ErrorClassRequest, err)
+		return
+	}
+
+	client, err := h.client(ctx, user)
+	if err != nil {
+		fail(run, crawlerdb.ErrorClassAuth, err)
+		return
+	}
+
+	loc := time.FixedZone(fmt.Sprintf("%dmin", user.TimeZone), user.TimeZone*60)
+
+	ts, err := h.crawlerDB.Get(ctx, user.Did)
+	if err != nil {
+		h.logger.Error("crawldb.Get",
+			"err", err,
+			"did", user.Did,
+		)
+		fail(run, crawlerdb.ErrorClassState, err)
+		return
+	}
 
 	var first *consumer.TerminalValue
 	var updatedKeys []string
 	var items []*indexhandler.Item
-	p := processor.New(
-		scanner.NewXRPCScanner(
-			xrpcClient,
-			session.Did,
+	pages := &pageScanner{
+		Scanner: scanner.NewXRPCScanner(
+			client,
+			user.Did,
 			"posts_with_replies",
 			false,
 			scanner.SetLogger(h.logger.With("module", "scanner")),
 		),
+		check: func(ctx context.Context) error {
+			return h.checkUser(ctx, user.Did)
+		},
+	}
+	p := processor.New(
+		pages,
 		consumer.NewDailyJSONRecordS3(
 			h.s3Client,
 			h.bucket,
-			session.Did,
+			user.Did,
 			loc,
 			consumer.SetDailyJSONRecordS3Logger(h.logger.With("module", "consumer")),
 			consumer.SetDailyJSONRecordS3TerminalValue(
@@ -181,6 +430,7 @@ func (h *Handler) Handle(ctx context.Context, req *Request) {
 			),
 			consumer.SetDailyJSONRecordS3KeyUpdateFunc(
 				func(key string) {
+					run.Keys = append(run.Keys, key)
 					updatedKeys = append(updatedKeys, "/"+key)
 				},
 			),
@@ -196,59 +446,81 @@ func (h *Handler) Handle(ctx context.Context, req *Request) {
 		),
 	)
 
-	if err := p.Proc(ctx); err != nil {
+	err = p.Proc(ctx)
+	run.Pages = pages.pages
+	run.Posts = len(items)
+	if errors.Is(err, errDeleted) {
+		fail(run, crawlerdb.ErrorClassDeleted, err)
+		return
+	} else if err != nil {
 		h.logger.Error("Proc",
 			"err", err,
 		)
+		if pages.storeFailed {
+			fail(run, crawlerdb.ErrorClassStore, err)
+		} else {
+			fail(run, crawlerdb.ErrorClassFetch, err)
+		}
 		return
 	}
 
+	if err := h.checkUser(ctx, user.Did); err != nil {
+		fail(run, crawlerdb.ErrorClassDeleted, err)
+		return
+	}
 	if err := p.Close(ctx); err != nil {
 		h.logger.Warn("Proc close",
 			"err", err,
 		)
+		fail(run, crawlerdb.ErrorClassStore, err)
 		// continue
 	}
 
-	if err := h.invokeIndexFunction(ctx, &indexhandler.Request{
-		DID:   session.Did,
-		Items: items,
-	}); err != nil {
-		h.logger.Error("invoke index function error",
-			"err", err,
-		)
-		// continue
+	if err := h.checkUser(ctx, user.Did); err != nil {
+		fail(run, crawlerdb.ErrorClassDeleted, err)
+		return
 	}
 
-	if len(updatedKeys) != 0 {
-		if _, err := h.cloudfrontClient.CreateInvalidation(ctx, &cloudfront.CreateInvalidationInput{
-			DistributionId: aws.String(h.distribution),
-			InvalidationBatch: &types.InvalidationBatch{
-				CallerReference: aws.String(strconv.FormatInt(time.Now().Unix(), 10)),
-				Paths: &types.Paths{
-					Quantity: aws.Int32(int32(len(updatedKeys))),
-					Items:    updatedKeys,
-				},
-			},
-		}); err != nil {
-			h.logger.Error("cloudfront.CreateInvalidation",
+	if len(items) != 0 {
+		run.Index = crawlerdb.OutcomeDone
+		if err := h.requestIndex(ctx, user.Did, items); err != nil {
+			h.logger.Error("request index error",
+				"err", err,
+			)
+			run.Index = crawlerdb.OutcomeFailed
+			// continue
+		}
+	}
+
+	// Without an invalidator, as when nothing is cached, the day files are
+	// not invalidated.
+	if len(updatedKeys) != 0 && h.invalidator != nil {
+		run.Invalidation = crawlerdb.OutcomeDone
+		paths := invalidation.Coalesce(updatedKeys, invalidation.DefaultThreshold)
+		if err := h.invalidator.Invalidate(ctx, paths); err != nil {
+			h.logger.Error("Invalidate",
 				"err", err,
-				"distributionId", h.distribution,
-				"paths", updatedKeys,
+				"paths", paths,
 			)
+			run.Invalidation = crawlerdb.OutcomeFailed
 			// continue
 		}
 	}
 
+	// Without new posts, the latest post is still the one in the DB.
+	if first == nil {
+		return
+	}
+
 	if err := h.crawlerDB.Put(ctx, &crawlerdb.Timestamp{
-		Did:       session.Did,
+		Did:       user.Did,
 		LatestCid: first.Cid,
 		Timestamp: first.TimeStamp,
 	}); err != nil {
-		h.logger.Error("crawldb.Get",
+		h.logger.Error("crawldb.Put",
 			"err", err,
-			"did", session.Did,
+			"did", user.Did,
 		)
-		// continue
+		fail(run, crawlerdb.ErrorClassState, err)
 	}
 }
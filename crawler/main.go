@@ -4,20 +4,29 @@ import (
 	"context"
 	"log/slog"
 	"os"
+	"time"
 
 	lambdahandler "github.com/aws/aws-lambda-go/lambda"
 
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/cloudfront"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
 	"github.com/aws/aws-sdk-go-v2/service/lambda"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 
 	"github.com/yunomu/bskylog/lib/crawlerdb"
+	"github.com/yunomu/bskylog/lib/invalidation"
+	"github.com/yunomu/bskylog/lib/oauth"
+	"github.com/yunomu/bskylog/lib/pds"
+	"github.com/yunomu/bskylog/lib/userdb"
 
 	"github.com/yunomu/bskylog/crawler/handler"
 )
 
+// historyRetention is how long crawl runs are kept in the history.
+const historyRetention = 90 * 24 * time.Hour
+
 var (
 	logger *slog.Logger
 	debug  bool
@@ -39,17 +48,37 @@ func main() {
 	region := os.Getenv("REGION")
 	bucket := os.Getenv("BUCKET")
 	distribution := os.Getenv("DISTRIBUTION")
+	webhookURL := os.Getenv("INVALIDATION_WEBHOOK_URL")
+	userTable := os.Getenv("USER_TABLE")
+	userHandleIndex := os.Getenv("USER_HANDLE_INDEX")
+	userHandleTable := os.Getenv("USER_HANDLE_TABLE")
+	credentialKMSKey := os.Getenv("CREDENTIAL_KMS_KEY")
+	credentialKeyFile := os.Getenv("CREDENTIAL_KEY_FILE")
+	oauthClientID := os.Getenv("OAUTH_CLIENT_ID")
+	oauthCallbackURL := os.Getenv("OAUTH_CALLBACK_URL")
 	crawlerTable := os.Getenv("CRAWLER_TABLE")
-	bskyHost := os.Getenv("BSKY_HOST")
+	historyTable := os.Getenv("CRAWL_HISTORY_TABLE")
+	plcURL := os.Getenv("PLC_URL")
 	indexFunction := os.Getenv("INDEX_FUNCTION")
+	indexBucket := os.Getenv("SEARCH_INDEX_BUCKET")
 
 	logger.Info("Init",
 		"region", region,
 		"bucket", bucket,
 		"distribution", distribution,
+		"webhookURL", webhookURL,
+		"userTable", userTable,
+		"userHandleIndex", userHandleIndex,
+		"userHandleTable", userHandleTable,
+		"credentialKMSKey", credentialKMSKey,
+		"credentialKeyFile", credentialKeyFile,
+		"oauthClientID", oauthClientID,
+		"oauthCallbackURL", oauthCallbackURL,
 		"crawlerTable", crawlerTable,
-		"bskyHost", bskyHost,
+		"historyTable", historyTable,
+		"plcURL", plcURL,
 		"indexFunction", indexFunction,
+		"indexBucket", indexBucket,
 	)
 
 	ctx := context.Background()
@@ -65,18 +94,85 @@ func main() {
 		return
 	}
 
+	sealer, err := userdb.NewSealer(
+		kms.NewFromConfig(awsCfg),
+		credentialKMSKey,
+		credentialKeyFile,
+		os.Getenv("CREDENTIAL_KEY"),
+	)
+	if err != nil {
+		logger.Error("NewSealer", "err", err)
+		return
+	}
+
+	dynamodbClient := dynamodb.NewFromConfig(awsCfg)
+
+	var history crawlerdb.History
+	if historyTable != "" {
+		history = crawlerdb.NewDynamoDBHistory(dynamodbClient, historyTable, historyRetention)
+	}
+
+	userDB := userdb.NewDynamoDB(
+		dynamodbClient,
+		userTable,
+		userHandleIndex,
+		userHandleTable,
+	)
+
+	crawlerDB := crawlerdb.NewDynamoDB(
+		dynamodbClient,
+		crawlerTable,
+	)
+
+	dir := pds.NewDirectory(plcURL)
+
+	// Accounts authorized with OAuth are crawled with their sessions when
+	// OAUTH_CALLBACK_URL is set. The crawler only refreshes sessions and
+	// needs no authorization requests.
+	var oauthClient *oauth.Client
+	if oauthCallbackURL != "" {
+		oauthClient = oauth.NewClient(
+			oauthClientID,
+			oauthCallbackURL,
+			oauth.NewStore(userDB, nil, sealer),
+			crawlerDB,
+			oauth.WithDirectory(dir),
+			oauth.WithLogger(logger.With("module", "oauth")),
+		)
+	}
+
+	// Updated files are invalidated in the distribution and through the
+	// webhook, when they are set. INVALIDATION_WEBHOOK_TOKEN is sent as a
+	// bearer token.
+	var invalidators invalidation.Multi
+	if distribution != "" {
+		invalidators = append(invalidators, invalidation.NewCloudFront(cloudfront.NewFromConfig(awsCfg), distribution))
+	}
+	if webhookURL != "" {
+		var opts []invalidation.WebhookOption
+		if token := os.Getenv("INVALIDATION_WEBHOOK_TOKEN"); token != "" {
+			opts = append(opts, invalidation.WithHeader("Authorization", "Bearer "+token))
+		}
+		invalidators = append(invalidators, invalidation.NewWebhook(webhookURL, opts...))
+	}
+	var invalidator invalidation.Invalidator
+	if len(invalidators) != 0 {
+		invalidator = invalidators
+	}
+
 	h := handler.NewHandler(
-		bskyHost,
-		crawlerdb.NewDynamoDB(
-			dynamodb.NewFromConfig(awsCfg),
-			crawlerTable,
-		),
+		pds.NewResolver(dir, userDB, pds.WithLogger(logger.With("module", "pds"))),
+		userDB,
+		sealer,
+		oauthClient,
+		crawlerDB,
 		s3.NewFromConfig(awsCfg),
 		bucket,
-		cloudfront.NewFromConfig(awsCfg),
-		distribution,
+		invalidator,
 		lambda.NewFromConfig(awsCfg),
 		indexFunction,
+		indexBucket,
+		history,
 		logger.With("module", "handler"),
 	)
 
@@ -3,16 +3,21 @@ package handler
 import (
 	"context"
 	"errors"
+	"fmt"
 	"io"
 	"log/slog"
+	"math/rand/v2"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/bluesky-social/indigo/api/bsky"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
 
 	"github.com/glebarez/sqlite"
 	"gorm.io/gorm"
@@ -25,22 +30,68 @@ import (
 type S3Client interface {
 	PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
 	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+	ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error)
+	HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error)
+	DeleteObject(ctx context.Context, params *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error)
 }
 
+// ErrConflict is returned when the index kept being updated by other
+// invocations for the same DID until the attempts ran out.
+var ErrConflict = errors.New("index was updated concurrently")
+
 type Handler struct {
-	s3Client S3Client
-	bucket   string
-	tmpDir   string
-	logger   *slog.Logger
+	s3Client      S3Client
+	bucket        string
+	tmpDir        string
+	publishBucket string
+	batchSize     int
+	maxAttempts   int
+	retryInterval time.Duration
+	logger        *slog.Logger
+}
+
+type HandlerOption func(*Handler)
+
+// WithPublishBucket sets the bucket of the day files, which is required
+// to rebuild an index.
+func WithPublishBucket(b string) HandlerOption {
+	return func(h *Handler) {
+		h.publishBucket = b
+	}
+}
+
+// WithBatchSize sets the number of posts per transaction on rebuild.
+func WithBatchSize(n int) HandlerOption {
+	return func(h *Handler) {
+		h.batchSize = n
+	}
+}
+
+// WithRetry sets how many times an update is attempted when the index is
+// replaced concurrently, and the base interval between attempts.
+func WithRetry(maxAttempts int, interval time.Duration) HandlerOption {
+	return func(h *Handler) {
+		h.maxAttempts = maxAttempts
+		h.retryInterval = interval
+	}
 }
 
-func NewHandler(s3Client S3Client, bucket string, tmpDir string, logger *slog.Logger) *Handler {
-	return &Handler{
-		s3Client: s3Client,
-		bucket:   bucket,
-		tmpDir:   tmpDir,
-		logger:   logger,
+func NewHandler(s3Client S3Client, bucket string, tmpDir string, logger *slog.Logger, opts ...HandlerOption) *Handler {
+	h := &Handler{
+		s3Client:      s3Client,
+		bucket:        bucket,
+		tmpDir:        tmpDir,
+		batchSize:     500,
+		maxAttempts:   5,
+		retryInterval: 200 * time.Millisecond,
+		logger:        logger,
 	}
+
+	for _, opt := range opts {
+		opt(h)
+	}
+
+	return h
 }
 
 type Item struct {
@@ -61,21 +112,32 @@ func SortItems(items []*Item) {
 type Request struct {
 	DID   string  `json:"did"`
 	Items []*Item `json:"items"`
+
+	// Manifest is the key of an index batch manifest in the search index
+	// bucket, written by WriteManifest. Its items are put before Items,
+	// and it is deleted once they are committed.
+	Manifest string `json:"manifest,omitempty"`
+
+	// Rebuild discards the index of DID and rebuilds it from the publish
+	// bucket. Items are ignored.
+	Rebuild bool `json:"rebuild,omitempty"`
 }
 
-func (h *Handler) storeDB(ctx context.Context, filePath string, did string) error {
+// storeDB downloads the index object key to filePath and returns its
+// ETag, or "" if the object does not exist yet.
+func (h *Handler) storeDB(ctx context.Context, filePath string, key string) (string, error) {
 	getObjectOutput, err := h.s3Client.GetObject(ctx, &s3.GetObjectInput{
 		Bucket: aws.String(h.bucket),
-		Key:    aws.String(did),
+		Key:    aws.String(key),
 	})
 	if err != nil {
 		var noSuchKey *types.NoSuchKey
 		if errors.As(err, &noSuchKey) {
-			h.logger.Info("Object not found in S3, creating new database", "bucket", h.bucket, "key", did)
-			return nil // If object not found, we don't need to copy anything.
+			h.logger.Info("Object not found in S3, creating new database", "bucket", h.bucket, "key", key)
+			return "", nil // If object not found, we don't need to copy anything.
 		} else {
-			h.logger.Error("s3Client.GetObject", "err", err, "bucket", h.bucket, "key", did)
-			return err
+			h.logger.Error("s3Client.GetObject", "err", err, "bucket", h.bucket, "key", key)
+			return "", err
 		}
 	} else {
 		defer getObjectOutput.Body.Close()
@@ -84,65 +146,231 @@ func (h *Handler) storeDB(ctx context.Context, filePath string, did string) erro
 	file, err := os.Create(filePath)
 	if err != nil {
 		h.logger.Error("os.Create", "err", err, "filePath", filePath)
-		return err
+		return "", err
 	}
 	defer file.Close()
 
 	if _, err := io.Copy(file, getObjectOutput.Body); err != nil {
 		h.logger.Error("io.Copy", "err", err, "filePath", filePath)
-		return err
+		return "", err
 	}
 
 	h.logger.Info("Successfully saved object to temporary file", "filePath", filePath)
 
-	return nil
+	return aws.ToString(getObjectOutput.ETag), nil
+}
+
+// shard is a month shard of an index downloaded for update.
+type shard struct {
+	key      string
+	filePath string
+	etag     string
+	db       *index.Gorm
+	close    func()
+	put      int
+	skipped  int
 }
 
-func (h *Handler) putItems(
-	ctx context.Context,
-	filePath string,
-	items []*Item,
-) error {
+func (h *Handler) openShard(ctx context.Context, key string) (*shard, error) {
+	filePath := filepath.Join(h.tmpDir, strings.ReplaceAll(key, "/", "_"))
+	os.Remove(filePath)
+
+	etag, err := h.storeDB(ctx, filePath, key)
+	if err != nil {
+		return nil, err
+	}
+
 	db, err := gorm.Open(sqlite.Open(filePath), &gorm.Config{})
 	if err != nil {
 		h.logger.Error("gorm.Open", "err", err, "filePath", filePath)
-		return err
+		return nil, err
 	}
 	sqlDB, err := db.DB()
 	if err != nil {
 		h.logger.Error("db.DB", "err", err)
-		return err
+		return nil, err
 	}
-	defer sqlDB.Close()
 
-	gormDB := index.NewGorm(db, index.GormOptionLogger(h.logger))
+	gormDB, err := index.NewGorm(ctx, db, index.GormOptionLogger(h.logger))
+	if err != nil {
+		h.logger.Error("index.NewGorm", "err", err, "filePath", filePath)
+		sqlDB.Close()
+		return nil, err
+	}
 
-	for _, item := range items {
-		if err := gormDB.Put(ctx, item.Key, item.Position, item.Post); err != nil {
-			h.logger.Error("gormDB.Put", "err", err, "item", item)
+	return &shard{
+		key:      key,
+		filePath: filePath,
+		etag:     etag,
+		db:       gormDB,
+		close: func() {
+			sqlDB.Close()
+			os.Remove(filePath)
+		},
+	}, nil
+}
+
+// updateShards puts the items of req into their month shards and uploads
+// the shards that changed. If only is not nil, items of other shards are
+// skipped. It returns the keys of the shards whose upload conflicted.
+func (h *Handler) updateShards(ctx context.Context, req *Request, only map[string]bool) ([]string, error) {
+	shards := make(map[string]*shard)
+	defer func() {
+		for _, s := range shards {
+			s.close()
+		}
+	}()
+
+	if err := h.eachItem(ctx, req, func(item *Item) error {
+		key := index.ShardKey(item.Key)
+		if only != nil && !only[key] {
+			return nil
+		}
+
+		s, ok := shards[key]
+		if !ok {
+			var err error
+			s, err = h.openShard(ctx, key)
+			if err != nil {
+				return err
+			}
+			shards[key] = s
+		}
+
+		// Items may have been put already by a retried invocation.
+		ok, err := s.db.PutIfAbsent(ctx, item.Key, item.Position, item.Post)
+		if err != nil {
+			h.logger.Error("PutIfAbsent", "err", err, "item", item)
 			return err
 		}
+		if ok {
+			s.put++
+		} else {
+			s.skipped++
+		}
+		return nil
+	}); err != nil {
+		return nil, err
 	}
 
-	h.logger.Info("Successfully put posts into SQLite DB", "filepath", filePath, "num_items", len(items))
+	keys := make([]string, 0, len(shards))
+	for key := range shards {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
 
-	return nil
+	var conflicted []string
+	for _, key := range keys {
+		s := shards[key]
+		h.logger.Info("Successfully put posts into SQLite DB", "key", key, "put", s.put, "skipped", s.skipped)
+		if s.put == 0 {
+			continue
+		}
+
+		if err := h.uploadDB(ctx, s.filePath, key, s.etag); isConflict(err) {
+			conflicted = append(conflicted, key)
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	return conflicted, nil
 }
 
 func (h *Handler) Handle(ctx context.Context, req *Request) error {
-	h.logger.Info("IndexFunction received request", "did", req.DID, "num_items", len(req.Items))
-
-	filePath := filepath.Join(h.tmpDir, req.DID)
-	defer os.Remove(filePath)
+	h.logger.Info("IndexFunction received request", "did", req.DID, "num_items", len(req.Items), "manifest", req.Manifest, "rebuild", req.Rebuild)
 
-	if err := h.storeDB(ctx, filePath, req.DID); err != nil {
+	if req.Rebuild {
+		_, err := h.Rebuild(ctx, req.DID)
 		return err
 	}
 
-	if err := h.putItems(ctx, filePath, req.Items); err != nil {
+	// An index from before sharding is split by rebuilding it, which also
+	// covers the items since they are in the publish bucket already.
+	legacy, err := h.headETag(ctx, req.DID)
+	if err != nil {
 		return err
 	}
+	if legacy != "" {
+		h.logger.Info("Splitting index into month shards", "did", req.DID)
+		if _, err := h.Rebuild(ctx, req.DID); err != nil {
+			return err
+		}
+	} else {
+		conflicted, err := h.updateShards(ctx, req, nil)
+		for attempt := 1; err == nil && len(conflicted) != 0; attempt++ {
+			if attempt >= h.maxAttempts {
+				h.logger.Error("Index update conflicted", "did", req.DID, "attempts", attempt, "shards", conflicted)
+				return ErrConflict
+			}
+			if err := h.backoff(ctx, req.DID, attempt); err != nil {
+				return err
+			}
+
+			// Only the shards replaced in the meantime are updated again.
+			only := make(map[string]bool)
+			for _, key := range conflicted {
+				only[key] = true
+			}
+			conflicted, err = h.updateShards(ctx, req, only)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if req.Manifest != "" {
+		h.deleteManifest(ctx, req.Manifest)
+	}
+
+	return nil
+}
+
+func isConflict(err error) bool {
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	switch apiErr.ErrorCode() {
+	case "PreconditionFailed", "ConditionalRequestConflict":
+		return true
+	default:
+		return false
+	}
+}
+
+// retryOnConflict runs update until its upload is not rejected because
+// another invocation replaced the index object key in the meantime.
+func (h *Handler) retryOnConflict(ctx context.Context, key string, update func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := update()
+		if !isConflict(err) {
+			return err
+		}
+		if attempt >= h.maxAttempts {
+			h.logger.Error("Index update conflicted", "key", key, "attempts", attempt, "err", err)
+			return fmt.Errorf("%w: %w", ErrConflict, err)
+		}
+		if err := h.backoff(ctx, key, attempt); err != nil {
+			return err
+		}
+	}
+}
 
+func (h *Handler) backoff(ctx context.Context, key string, attempt int) error {
+	wait := time.Duration(attempt)*h.retryInterval + rand.N(h.retryInterval+1)
+	h.logger.Warn("Index was updated concurrently, retrying", "key", key, "attempt", attempt, "wait", wait)
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(wait):
+		return nil
+	}
+}
+
+// uploadDB replaces the index object key only if it is still the version
+// identified by etag. An empty etag means that the object must not exist.
+func (h *Handler) uploadDB(ctx context.Context, filePath string, key string, etag string) error {
 	file, err := os.Open(filePath)
 	if err != nil {
 		h.logger.Error("os.Open", "err", err, "filePath", filePath)
@@ -150,17 +378,28 @@ func (h *Handler) Handle(ctx context.Context, req *Request) error {
 	}
 	defer file.Close()
 
-	if _, err := h.s3Client.PutObject(ctx, &s3.PutObjectInput{
+	input := &s3.PutObjectInput{
 		Bucket:      aws.String(h.bucket),
-		Key:         aws.String(req.DID),
+		Key:         aws.String(key),
 		Body:        file,
 		ContentType: aws.String("application/vnd.sqlite3"),
-	}); err != nil {
-		h.logger.Error("s3Client.PutObject", "err", err, "bucket", h.bucket, "key", req.DID)
+	}
+	if etag == "" {
+		input.IfNoneMatch = aws.String("*")
+	} else {
+		input.IfMatch = aws.String(etag)
+	}
+
+	if _, err := h.s3Client.PutObject(ctx, input); err != nil {
+		if isConflict(err) {
+			h.logger.Warn("s3Client.PutObject", "err", err, "bucket", h.bucket, "key", key, "etag", etag)
+		} else {
+			h.logger.Error("s3Client.PutObject", "err", err, "bucket", h.bucket, "key", key)
+		}
 		return err
 	}
 
-	h.logger.Info("Successfully put SQLite DB to S3", "did", req.DID, "bucket", h.bucket, "key", req.DID)
+	h.logger.Info("Successfully put SQLite DB to S3", "bucket", h.bucket, "key", key)
 
 	return nil
 }
@@ -0,0 +1,457 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+
+	"github.com/bluesky-social/indigo/api/bsky"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+	gormlogger "gorm.io/gorm/logger"
+)
+
+type fakeObject struct {
+	data []byte
+	etag string
+}
+
+// fakeS3 is an in-memory S3 that honours If-Match and If-None-Match on
+// PutObject. Objects are keyed by "<bucket>:<key>". beforePut is called
+// before each PutObject is applied, which lets a test interleave another
+// writer.
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string]*fakeObject
+	version int
+
+	beforePut func(key string)
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{objects: make(map[string]*fakeObject)}
+}
+
+func (f *fakeS3) GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	obj, ok := f.objects[aws.ToString(params.Bucket)+":"+aws.ToString(params.Key)]
+	if !ok {
+		return nil, &types.NoSuchKey{}
+	}
+	return &s3.GetObjectOutput{
+		Body: io.NopCloser(bytes.NewReader(obj.data)),
+		ETag: aws.String(obj.etag),
+	}, nil
+}
+
+func (f *fakeS3) HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	obj, ok := f.objects[aws.ToString(params.Bucket)+":"+aws.ToString(params.Key)]
+	if !ok {
+		return nil, &types.NotFound{}
+	}
+	return &s3.HeadObjectOutput{ETag: aws.String(obj.etag)}, nil
+}
+
+func (f *fakeS3) PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	data, err := io.ReadAll(params.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	key := aws.ToString(params.Bucket) + ":" + aws.ToString(params.Key)
+	if f.beforePut != nil {
+		f.beforePut(key)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	obj, exists := f.objects[key]
+	if params.IfNoneMatch != nil && exists {
+		return nil, &smithy.GenericAPIError{Code: "PreconditionFailed"}
+	}
+	if params.IfMatch != nil && (!exists || obj.etag != *params.IfMatch) {
+		return nil, &smithy.GenericAPIError{Code: "PreconditionFailed"}
+	}
+
+	f.version++
+	etag := fmt.Sprintf(`"%d"`, f.version)
+	f.objects[key] = &fakeObject{data: data, etag: etag}
+	return &s3.PutObjectOutput{ETag: aws.String(etag)}, nil
+}
+
+func (f *fakeS3) ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	bucket := aws.ToString(params.Bucket) + ":"
+	prefix := aws.ToString(params.Prefix)
+	delimiter := aws.ToString(params.Delimiter)
+
+	var keys []string
+	prefixes := make(map[string]bool)
+	for k := range f.objects {
+		key, ok := strings.CutPrefix(k, bucket)
+		if !ok || !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		if delimiter != "" {
+			if i := strings.Index(key[len(prefix):], delimiter); i >= 0 {
+				prefixes[key[:len(prefix)+i+len(delimiter)]] = true
+				continue
+			}
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	out := &s3.ListObjectsV2Output{}
+	for _, k := range keys {
+		out.Contents = append(out.Contents, types.Object{Key: aws.String(k)})
+	}
+	var ps []string
+	for p := range prefixes {
+		ps = append(ps, p)
+	}
+	sort.Strings(ps)
+	for _, p := range ps {
+		out.CommonPrefixes = append(out.CommonPrefixes, types.CommonPrefix{Prefix: aws.String(p)})
+	}
+	return out, nil
+}
+
+func (f *fakeS3) DeleteObject(ctx context.Context, params *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	delete(f.objects, aws.ToString(params.Bucket)+":"+aws.ToString(params.Key))
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+// touch replaces the object as another writer would.
+func (f *fakeS3) touch(key string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.version++
+	obj := f.objects[key]
+	if obj == nil {
+		obj = &fakeObject{}
+		f.objects[key] = obj
+	}
+	obj.etag = fmt.Sprintf(`"%d"`, f.version)
+}
+
+// put stores an object as another writer would.
+func (f *fakeS3) put(key string, data []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.version++
+	f.objects[key] = &fakeObject{data: data, etag: fmt.Sprintf(`"%d"`, f.version)}
+}
+
+const (
+	testDID   = "did:plc:test"
+	testShard = "index:" + testDID + "/2026/01"
+)
+
+func newTestHandler(t *testing.T, s3Client S3Client) *Handler {
+	t.Helper()
+
+	return NewHandler(
+		s3Client,
+		"index",
+		t.TempDir(),
+		slog.New(slog.NewTextHandler(io.Discard, nil)),
+		WithRetry(50, time.Millisecond),
+		WithPublishBucket("publish"),
+	)
+}
+
+func testPostJSON(cid string) string {
+	return `{"post":{"author":{"did":"` + testDID + `","handle":"test.example.com"},"cid":"` + cid + `","record":{"$type":"app.bsky.feed.post","createdAt":"2026-01-01T00:00:00Z","text":"post ` + cid + `"}}}`
+}
+
+func testItemAt(t *testing.T, key string, cid string) *Item {
+	t.Helper()
+
+	var post bsky.FeedDefs_FeedViewPost
+	if err := json.Unmarshal([]byte(testPostJSON(cid)), &post); err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+	return &Item{Key: key, Position: 0, Post: &post}
+}
+
+func testItem(t *testing.T, cid string) *Item {
+	t.Helper()
+
+	return testItemAt(t, testDID+"/2026/01/01", cid)
+}
+
+// indexedCids opens the index object key and returns the CIDs in it.
+func indexedCids(t *testing.T, f *fakeS3, key string) []string {
+	t.Helper()
+
+	obj, ok := f.objects[key]
+	if !ok {
+		t.Fatalf("index object not found: %s", key)
+	}
+	path := filepath.Join(t.TempDir(), "index")
+	if err := os.WriteFile(path, obj.data, 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	db, err := gorm.Open(sqlite.Open(path), &gorm.Config{
+		Logger: gormlogger.Default.LogMode(gormlogger.Silent),
+	})
+	if err != nil {
+		t.Fatalf("gorm.Open: %v", err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatalf("db.DB: %v", err)
+	}
+	defer sqlDB.Close()
+
+	var cids []string
+	if err := db.Table("records").Order("cid").Pluck("cid", &cids).Error; err != nil {
+		t.Fatalf("Pluck: %v", err)
+	}
+	return cids
+}
+
+func TestHandler_Handle_interleaved(t *testing.T) {
+	ctx := context.Background()
+	f := newFakeS3()
+
+	h1 := newTestHandler(t, f)
+	h2 := newTestHandler(t, f)
+
+	// The second invocation runs to completion while the first one is
+	// about to upload, so the first upload is based on a stale index.
+	interleaved := false
+	f.beforePut = func(key string) {
+		if interleaved {
+			return
+		}
+		interleaved = true
+		if err := h2.Handle(ctx, &Request{DID: testDID, Items: []*Item{testItem(t, "cid2")}}); err != nil {
+			t.Errorf("Handle 2: %v", err)
+		}
+	}
+
+	if err := h1.Handle(ctx, &Request{DID: testDID, Items: []*Item{testItem(t, "cid1")}}); err != nil {
+		t.Fatalf("Handle 1: %v", err)
+	}
+
+	got := indexedCids(t, f, testShard)
+	if want := []string{"cid1", "cid2"}; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("cids: got %v, want %v", got, want)
+	}
+}
+
+func TestHandler_Handle_concurrent(t *testing.T) {
+	ctx := context.Background()
+	f := newFakeS3()
+
+	const n = 8
+	var wg sync.WaitGroup
+	errs := make([]error, n)
+	for i := 0; i < n; i++ {
+		h := newTestHandler(t, f)
+		item := testItem(t, fmt.Sprintf("cid%d", i))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = h.Handle(ctx, &Request{DID: testDID, Items: []*Item{item}})
+		}()
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("Handle %d: %v", i, err)
+		}
+	}
+	if got := indexedCids(t, f, testShard); len(got) != n {
+		t.Errorf("cids: got %v, want %d posts", got, n)
+	}
+}
+
+func TestHandler_Handle_redelivered(t *testing.T) {
+	ctx := context.Background()
+	f := newFakeS3()
+	h := newTestHandler(t, f)
+
+	req := &Request{DID: testDID, Items: []*Item{testItem(t, "cid1"), testItem(t, "cid2")}}
+	for i := 0; i < 2; i++ {
+		if err := h.Handle(ctx, req); err != nil {
+			t.Fatalf("Handle %d: %v", i, err)
+		}
+	}
+
+	got := indexedCids(t, f, testShard)
+	if want := []string{"cid1", "cid2"}; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("cids: got %v, want %v", got, want)
+	}
+}
+
+func TestHandler_Handle_conflictExhausted(t *testing.T) {
+	ctx := context.Background()
+	f := newFakeS3()
+	h := newTestHandler(t, f)
+
+	// Another writer always wins.
+	f.beforePut = f.touch
+
+	err := h.Handle(ctx, &Request{DID: testDID, Items: []*Item{testItem(t, "cid1")}})
+	if !errors.Is(err, ErrConflict) {
+		t.Errorf("Handle: got %v, want ErrConflict", err)
+	}
+}
+
+func TestHandler_Handle_manifest(t *testing.T) {
+	ctx := context.Background()
+	f := newFakeS3()
+	h1 := newTestHandler(t, f)
+	h2 := newTestHandler(t, f)
+
+	key := ManifestKey(testDID, time.Unix(0, 1))
+	if err := WriteManifest(ctx, f, "index", key, []*Item{testItem(t, "cid1"), testItem(t, "cid2")}); err != nil {
+		t.Fatalf("WriteManifest: %v", err)
+	}
+
+	// The manifest is read again after the first upload conflicts.
+	interleaved := false
+	f.beforePut = func(k string) {
+		if interleaved || k != testShard {
+			return
+		}
+		interleaved = true
+		if err := h2.Handle(ctx, &Request{DID: testDID, Items: []*Item{testItem(t, "cid3")}}); err != nil {
+			t.Errorf("Handle 2: %v", err)
+		}
+	}
+
+	if err := h1.Handle(ctx, &Request{DID: testDID, Manifest: key}); err != nil {
+		t.Fatalf("Handle 1: %v", err)
+	}
+
+	got := indexedCids(t, f, testShard)
+	if want := []string{"cid1", "cid2", "cid3"}; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("cids: got %v, want %v", got, want)
+	}
+	if _, ok := f.objects[key]; ok {
+		t.Errorf("manifest was not deleted")
+	}
+}
+
+func TestHandler_Handle_shards(t *testing.T) {
+	ctx := context.Background()
+	f := newFakeS3()
+	h := newTestHandler(t, f)
+
+	if err := h.Handle(ctx, &Request{DID: testDID, Items: []*Item{
+		testItemAt(t, testDID+"/2026/01/31", "cid1"),
+		testItemAt(t, testDID+"/2026/02/01", "cid2"),
+	}}); err != nil {
+		t.Fatalf("Handle: %v", err)
+	}
+	jan := f.objects[testShard].etag
+
+	if err := h.Handle(ctx, &Request{DID: testDID, Items: []*Item{
+		testItemAt(t, testDID+"/2026/02/02", "cid3"),
+	}}); err != nil {
+		t.Fatalf("Handle: %v", err)
+	}
+
+	if got := indexedCids(t, f, testShard); strings.Join(got, ",") != "cid1" {
+		t.Errorf("2026/01: got %v", got)
+	}
+	if got := indexedCids(t, f, "index:"+testDID+"/2026/02"); strings.Join(got, ",") != "cid2,cid3" {
+		t.Errorf("2026/02: got %v", got)
+	}
+	if f.objects[testShard].etag != jan {
+		t.Errorf("untouched shard was rewritten")
+	}
+}
+
+func TestHandler_Handle_legacy(t *testing.T) {
+	ctx := context.Background()
+	f := newFakeS3()
+	h := newTestHandler(t, f)
+
+	f.put("index:"+testDID, []byte("legacy"))
+	f.put("publish:"+testDID+"/2026/01/01", []byte(testPostJSON("cid1")+"\n"+testPostJSON("cid2")+"\n"))
+	f.put("publish:"+testDID+"/2026/01/index", []byte("2026/01/01\n"))
+	f.put("publish:"+testDID+"/2026/02/01", []byte(testPostJSON("cid3")+"\n"))
+
+	if err := h.Handle(ctx, &Request{DID: testDID, Items: []*Item{
+		testItemAt(t, testDID+"/2026/02/01", "cid3"),
+	}}); err != nil {
+		t.Fatalf("Handle: %v", err)
+	}
+
+	if got := indexedCids(t, f, testShard); strings.Join(got, ",") != "cid1,cid2" {
+		t.Errorf("2026/01: got %v", got)
+	}
+	if got := indexedCids(t, f, "index:"+testDID+"/2026/02"); strings.Join(got, ",") != "cid3" {
+		t.Errorf("2026/02: got %v", got)
+	}
+	if _, ok := f.objects["index:"+testDID]; ok {
+		t.Errorf("legacy index was not deleted")
+	}
+}
+
+func TestHandler_Rebuild_stale(t *testing.T) {
+	ctx := context.Background()
+	f := newFakeS3()
+	h := newTestHandler(t, f)
+
+	f.put("index:"+testDID+"/2025/12", []byte("stale"))
+	f.put("index:"+ManifestKey(testDID, time.Now()), []byte("manifest"))
+	f.put("publish:"+testDID+"/2026/01/01", []byte(testPostJSON("cid1")+"\n"))
+
+	if _, err := h.Rebuild(ctx, testDID); err != nil {
+		t.Fatalf("Rebuild: %v", err)
+	}
+
+	if got := indexedCids(t, f, testShard); strings.Join(got, ",") != "cid1" {
+		t.Errorf("2026/01: got %v", got)
+	}
+	if _, ok := f.objects["index:"+testDID+"/2025/12"]; ok {
+		t.Errorf("stale shard was not deleted")
+	}
+	var manifests int
+	for key := range f.objects {
+		if strings.HasPrefix(key, "index:"+ManifestPrefix) {
+			manifests++
+		}
+	}
+	if manifests != 1 {
+		t.Errorf("manifests: got %d, want 1", manifests)
+	}
+}
@@ -0,0 +1,103 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// ManifestPrefix is the key prefix of index batch manifests in the search
+// index bucket. Index objects are keyed "<did>/YYYY/MM", or "<did>" from
+// before sharding, and never start with ManifestPrefix.
+const ManifestPrefix = "manifests/"
+
+// ManifestKey returns a new manifest key for a batch of did.
+func ManifestKey(did string, t time.Time) string {
+	return fmt.Sprintf("%s%s/%d.jsonl", ManifestPrefix, did, t.UnixNano())
+}
+
+type ManifestWriter interface {
+	PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+}
+
+// WriteManifest stores items as JSON lines, which the index function reads
+// when Request.Manifest is set to key.
+func WriteManifest(ctx context.Context, client ManifestWriter, bucket, key string, items []*Item) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, item := range items {
+		if err := enc.Encode(item); err != nil {
+			return err
+		}
+	}
+
+	if _, err := client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(buf.Bytes()),
+		ContentType: aws.String("application/jsonl"),
+	}); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// eachItem calls f for the items of the manifest, streamed from S3, and
+// then for the inline items of req.
+func (h *Handler) eachItem(ctx context.Context, req *Request, f func(*Item) error) error {
+	if req.Manifest != "" {
+		out, err := h.s3Client.GetObject(ctx, &s3.GetObjectInput{
+			Bucket: aws.String(h.bucket),
+			Key:    aws.String(req.Manifest),
+		})
+		if err != nil {
+			h.logger.Error("s3Client.GetObject", "err", err, "bucket", h.bucket, "key", req.Manifest)
+			return err
+		}
+		defer out.Body.Close()
+
+		dec := json.NewDecoder(out.Body)
+		for {
+			var item Item
+			if err := dec.Decode(&item); errors.Is(err, io.EOF) {
+				break
+			} else if err != nil {
+				h.logger.Error("manifest decode error", "err", err, "key", req.Manifest)
+				return err
+			}
+			if err := f(&item); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, item := range req.Items {
+		if err := f(item); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// deleteManifest removes a manifest after its items are committed. A
+// manifest left behind is only garbage, so errors are logged and ignored.
+func (h *Handler) deleteManifest(ctx context.Context, key string) {
+	if _, err := h.s3Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(h.bucket),
+		Key:    aws.String(key),
+	}); err != nil {
+		h.logger.Warn("s3Client.DeleteObject", "err", err, "bucket", h.bucket, "key", key)
+		return
+	}
+
+	h.logger.Info("Deleted manifest", "bucket", h.bucket, "key", key)
+}
@@ -0,0 +1,241 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+	gormlogger "gorm.io/gorm/logger"
+
+	"github.com/yunomu/bskylog/lib/index"
+	"github.com/yunomu/bskylog/lib/storage"
+)
+
+var ErrNoPublishBucket = errors.New("publish bucket is not configured")
+
+// Rebuild builds fresh month shards of the index of did from the day files
+// in the publish bucket and replaces them in the search index bucket. A
+// shard stays in place until the new one is validated, and its build
+// starts over if it is updated in the meantime. Shards of months that no
+// longer have day files, and an index from before sharding, are deleted
+// afterwards.
+func (h *Handler) Rebuild(ctx context.Context, did string) (*index.LoadStats, error) {
+	if h.publishBucket == "" {
+		h.logger.Error("Rebuild", "err", ErrNoPublishBucket)
+		return nil, ErrNoPublishBucket
+	}
+
+	// Shards are listed before the months, so that shards of months whose
+	// day files are written in the meantime are kept.
+	shards, err := h.listShards(ctx, did)
+	if err != nil {
+		return nil, err
+	}
+	months, err := h.listMonths(ctx, did)
+	if err != nil {
+		return nil, err
+	}
+
+	total := &index.LoadStats{}
+	start := time.Now()
+	for _, key := range months {
+		stats, err := h.rebuildShard(ctx, key)
+		if err != nil {
+			return total, err
+		}
+		total.Keys += stats.Keys
+		total.Posts += stats.Posts
+		total.Skipped += stats.Skipped
+	}
+
+	h.logger.Info("Index rebuilt",
+		"did", did,
+		"shards", len(months),
+		"keys", total.Keys,
+		"posts", total.Posts,
+		"skipped", total.Skipped,
+		"elapsed", time.Since(start),
+	)
+
+	stale := []string{did}
+	for _, key := range shards {
+		if !slices.Contains(months, key) {
+			stale = append(stale, key)
+		}
+	}
+	for _, key := range stale {
+		if _, err := h.s3Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+			Bucket: aws.String(h.bucket),
+			Key:    aws.String(key),
+		}); err != nil {
+			h.logger.Error("s3Client.DeleteObject", "err", err, "bucket", h.bucket, "key", key)
+			return total, err
+		}
+	}
+	if len(stale) > 1 {
+		h.logger.Info("Stale shards deleted", "did", did, "keys", stale[1:])
+	}
+
+	return total, nil
+}
+
+// listShards returns the keys of the month shards of did in the search
+// index bucket.
+func (h *Handler) listShards(ctx context.Context, did string) ([]string, error) {
+	var keys []string
+	paginator := s3.NewListObjectsV2Paginator(h.s3Client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(h.bucket),
+		Prefix: aws.String(did + "/"),
+	})
+	for paginator.HasMorePages() {
+		out, err := paginator.NextPage(ctx)
+		if err != nil {
+			h.logger.Error("ListObjectsV2", "err", err, "bucket", h.bucket, "prefix", did+"/")
+			return nil, err
+		}
+		for _, obj := range out.Contents {
+			keys = append(keys, aws.ToString(obj.Key))
+		}
+	}
+	return keys, nil
+}
+
+// listMonths returns the shard keys "<did>/YYYY/MM" of the months that
+// have day files in the publish bucket.
+func (h *Handler) listMonths(ctx context.Context, did string) ([]string, error) {
+	years, err := h.listPrefixes(ctx, did+"/")
+	if err != nil {
+		return nil, err
+	}
+
+	var months []string
+	for _, year := range years {
+		ms, err := h.listPrefixes(ctx, year)
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range ms {
+			months = append(months, strings.TrimSuffix(m, "/"))
+		}
+	}
+	return months, nil
+}
+
+func (h *Handler) listPrefixes(ctx context.Context, prefix string) ([]string, error) {
+	var ret []string
+	paginator := s3.NewListObjectsV2Paginator(h.s3Client, &s3.ListObjectsV2Input{
+		Bucket:    aws.String(h.publishBucket),
+		Prefix:    aws.String(prefix),
+		Delimiter: aws.String("/"),
+	})
+	for paginator.HasMorePages() {
+		out, err := paginator.NextPage(ctx)
+		if err != nil {
+			h.logger.Error("ListObjectsV2", "err", err, "bucket", h.publishBucket, "prefix", prefix)
+			return nil, err
+		}
+		for _, p := range out.CommonPrefixes {
+			ret = append(ret, aws.ToString(p.Prefix))
+		}
+	}
+	return ret, nil
+}
+
+func (h *Handler) rebuildShard(ctx context.Context, key string) (*index.LoadStats, error) {
+	filePath := filepath.Join(h.tmpDir, strings.ReplaceAll(key, "/", "_")+".rebuild")
+	defer os.Remove(filePath)
+
+	var stats *index.LoadStats
+	err := h.retryOnConflict(ctx, key, func() error {
+		os.Remove(filePath)
+
+		// Posts indexed after this point are also in the publish bucket,
+		// but they may be missed by the scan, so the upload must fail.
+		etag, err := h.headETag(ctx, key)
+		if err != nil {
+			return err
+		}
+
+		stats, err = h.buildDB(ctx, filePath, key)
+		if err != nil {
+			return err
+		}
+
+		return h.uploadDB(ctx, filePath, key, etag)
+	})
+	return stats, err
+}
+
+// headETag returns the ETag of the index object key, or "" if it does not
+// exist.
+func (h *Handler) headETag(ctx context.Context, key string) (string, error) {
+	out, err := h.s3Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(h.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		var notFound *types.NotFound
+		if errors.As(err, &notFound) {
+			return "", nil
+		}
+		h.logger.Error("s3Client.HeadObject", "err", err, "bucket", h.bucket, "key", key)
+		return "", err
+	}
+	return aws.ToString(out.ETag), nil
+}
+
+// buildDB builds the shard key "<did>/YYYY/MM" at filePath.
+func (h *Handler) buildDB(ctx context.Context, filePath string, key string) (*index.LoadStats, error) {
+	// The file is discarded on failure, so durability is not needed while building.
+	db, err := gorm.Open(sqlite.Open(filePath+"?_pragma=journal_mode(OFF)&_pragma=synchronous(OFF)"), &gorm.Config{
+		Logger: gormlogger.Default.LogMode(gormlogger.Silent),
+	})
+	if err != nil {
+		h.logger.Error("gorm.Open", "err", err, "filePath", filePath)
+		return nil, err
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		h.logger.Error("db.DB", "err", err)
+		return nil, err
+	}
+	defer sqlDB.Close()
+
+	gormDB, err := index.NewGorm(ctx, db, index.GormOptionLogger(h.logger))
+	if err != nil {
+		h.logger.Error("index.NewGorm", "err", err, "filePath", filePath)
+		return nil, err
+	}
+
+	scanner := storage.NewS3(
+		h.s3Client,
+		h.publishBucket,
+		storage.S3OptionPrefix(key+"/"),
+		storage.S3OptionLogger(h.logger.With("module", "storage")),
+	)
+
+	stats, err := gormDB.Load(ctx, scanner, h.batchSize, func(stats *index.LoadStats) {
+		h.logger.Info("Rebuild progress", "key", key, "keys", stats.Keys, "posts", stats.Posts, "skipped", stats.Skipped)
+	})
+	if err != nil {
+		h.logger.Error("Load", "err", err, "key", key)
+		return stats, err
+	}
+
+	if err := gormDB.Validate(ctx, stats.Posts); err != nil {
+		h.logger.Error("Validate", "err", err, "key", key)
+		return stats, err
+	}
+
+	return stats, nil
+}
@@ -24,9 +24,11 @@ func main() {
 	}
 
 	bucket := os.Getenv("SEARCH_INDEX_BUCKET")
+	publishBucket := os.Getenv("PUBLISH_BUCKET")
 	tmpDir := os.Getenv("TMP_DIR")
 	logger.Info("Start",
 		"searchIndexBucket", bucket,
+		"publishBucket", publishBucket,
 		"tmpDir", tmpDir,
 	)
 
@@ -35,6 +37,7 @@ func main() {
 		bucket,
 		tmpDir,
 		logger.With("module", "handler"),
+		handler.WithPublishBucket(publishBucket),
 	)
 
 	lambda.StartWithContext(ctx, h.Handle)
@@ -16,7 +16,6 @@ import (
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
-	smithy "github.com/aws/smithy-go"
 
 	"github.com/bluesky-social/indigo/api/bsky"
 )
@@ -149,9 +148,8 @@ func (c *DailyJSONRecordS3) ensureStream(ctx context.Context, now time.Time) err
 		Key:    aws.String(c.indexKey),
 	})
 	if err != nil {
-		var opErr *smithy.OperationError
 		var noSuchKey *types.NoSuchKey
-		if errors.As(err, &opErr) && errors.As(opErr.Err, &noSuchKey) {
+		if errors.As(err, &noSuchKey) {
 			// do nothing
 		} else {
 			c.logger.Error("s3.GetObject(index)",
@@ -261,9 +259,8 @@ func (c *DailyJSONRecordS3) appendObject(ctx context.Context) error {
 		Key:    aws.String(c.key),
 	})
 	if err != nil {
-		var opErr *smithy.OperationError
 		var noSuchKey *types.NoSuchKey
-		if errors.As(err, &opErr) && errors.As(opErr.Err, &noSuchKey) {
+		if errors.As(err, &noSuchKey) {
 			// do nothing
 			return nil
 		} else {
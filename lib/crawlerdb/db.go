@@ -17,4 +17,22 @@ type DB interface {
 	Get(ctx context.Context, did string) (*Timestamp, error)
 	Put(ctx context.Context, ts *Timestamp) error
 	Scan(ctx context.Context, f func(*Timestamp) error) error
+	// Delete removes the timestamp of did. Timestamps that do not exist
+	// are ignored.
+	Delete(ctx context.Context, did string) error
+}
+
+// Seed adds did to db, if it is new, to be crawled from the beginning. It
+// reports whether did was added.
+func Seed(ctx context.Context, db DB, did string) (bool, error) {
+	_, err := db.Get(ctx, did)
+	if err == nil {
+		return false, nil
+	} else if !errors.Is(err, ErrNotExists) {
+		return false, err
+	}
+	if err := db.Put(ctx, &Timestamp{Did: did}); err != nil {
+		return false, err
+	}
+	return true, nil
 }
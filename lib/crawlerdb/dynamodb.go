@@ -107,3 +107,16 @@ func (d *DynamoDB) Put(ctx context.Context, ts *Timestamp) error {
 
 	return err
 }
+
+func (d *DynamoDB) Delete(ctx context.Context, did string) error {
+	_, err := d.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(d.tableName),
+		Key: map[string]types.AttributeValue{
+			"Did": &types.AttributeValueMemberS{
+				Value: did,
+			},
+		},
+	})
+
+	return err
+}
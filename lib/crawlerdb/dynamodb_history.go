@@ -0,0 +1,178 @@
+package crawlerdb
+
+import (
+	"context"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// DynamoDBHistory keeps crawl runs in a table with the hash key Did and
+// the range key StartedAt. Runs expire after the retention through the TTL
+// attribute ExpiresAt.
+type DynamoDBHistory struct {
+	client    *dynamodb.Client
+	tableName string
+	retention time.Duration
+}
+
+var _ History = (*DynamoDBHistory)(nil)
+
+func NewDynamoDBHistory(
+	client *dynamodb.Client,
+	tableName string,
+	retention time.Duration,
+) *DynamoDBHistory {
+	return &DynamoDBHistory{
+		client:    client,
+		tableName: tableName,
+		retention: retention,
+	}
+}
+
+type DynamoDBRunRecord struct {
+	Did          string   `dynamodbav:"Did"`
+	StartedAt    int64    `dynamodbav:"StartedAt"` // unix milliseconds
+	EndedAt      int64    `dynamodbav:"EndedAt"`
+	Pages        int      `dynamodbav:"Pages"`
+	Posts        int      `dynamodbav:"Posts"`
+	Keys         []string `dynamodbav:"Keys,omitempty"`
+	Index        string   `dynamodbav:"Index"`
+	Invalidation string   `dynamodbav:"Invalidation"`
+	ErrorClass   string   `dynamodbav:"ErrorClass,omitempty"`
+	Error        string   `dynamodbav:"Error,omitempty"`
+	ExpiresAt    int64    `dynamodbav:"ExpiresAt,omitempty"` // unix seconds
+}
+
+func dynamoToRun(rec *DynamoDBRunRecord) *Run {
+	return &Run{
+		Did:          rec.Did,
+		StartedAt:    time.UnixMilli(rec.StartedAt),
+		EndedAt:      time.UnixMilli(rec.EndedAt),
+		Pages:        rec.Pages,
+		Posts:        rec.Posts,
+		Keys:         rec.Keys,
+		Index:        Outcome(rec.Index),
+		Invalidation: Outcome(rec.Invalidation),
+		ErrorClass:   ErrorClass(rec.ErrorClass),
+		Error:        rec.Error,
+	}
+}
+
+func (d *DynamoDBHistory) PutRun(ctx context.Context, run *Run) error {
+	rec := &DynamoDBRunRecord{
+		Did:          run.Did,
+		StartedAt:    run.StartedAt.UnixMilli(),
+		EndedAt:      run.EndedAt.UnixMilli(),
+		Pages:        run.Pages,
+		Posts:        run.Posts,
+		Keys:         run.Keys,
+		Index:        string(run.Index),
+		Invalidation: string(run.Invalidation),
+		ErrorClass:   string(run.ErrorClass),
+		Error:        run.Error,
+	}
+	if d.retention > 0 {
+		rec.ExpiresAt = run.StartedAt.Add(d.retention).Unix()
+	}
+
+	item, err := attributevalue.MarshalMap(rec)
+	if err != nil {
+		return err
+	}
+
+	_, err = d.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(d.tableName),
+		Item:      item,
+	})
+
+	return err
+}
+
+func (d *DynamoDBHistory) Runs(ctx context.Context, did string, limit int) ([]*Run, error) {
+	var runs []*Run
+	paginator := dynamodb.NewQueryPaginator(d.client, &dynamodb.QueryInput{
+		TableName:              aws.String(d.tableName),
+		KeyConditionExpression: aws.String("Did = :did"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":did": &types.AttributeValueMemberS{Value: did},
+		},
+		ScanIndexForward: aws.Bool(false),
+		Limit:            aws.Int32(int32(limit)),
+	})
+	for paginator.HasMorePages() && len(runs) < limit {
+		out, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, item := range out.Items {
+			var rec DynamoDBRunRecord
+			if err := attributevalue.UnmarshalMap(item, &rec); err != nil {
+				return nil, err
+			}
+			runs = append(runs, dynamoToRun(&rec))
+		}
+	}
+	if len(runs) > limit {
+		runs = runs[:limit]
+	}
+
+	return runs, nil
+}
+
+// maxBatchWrite is the number of requests DynamoDB takes in a batch write.
+const maxBatchWrite = 25
+
+func (d *DynamoDBHistory) DeleteRuns(ctx context.Context, did string) (int, error) {
+	var requests []types.WriteRequest
+	paginator := dynamodb.NewQueryPaginator(d.client, &dynamodb.QueryInput{
+		TableName:              aws.String(d.tableName),
+		KeyConditionExpression: aws.String("Did = :did"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":did": &types.AttributeValueMemberS{Value: did},
+		},
+		ProjectionExpression: aws.String("Did, StartedAt"),
+	})
+	for paginator.HasMorePages() {
+		out, err := paginator.NextPage(ctx)
+		if err != nil {
+			return 0, err
+		}
+		for _, item := range out.Items {
+			requests = append(requests, types.WriteRequest{
+				DeleteRequest: &types.DeleteRequest{Key: item},
+			})
+		}
+	}
+
+	for pending := requests; len(pending) > 0; {
+		n := min(len(pending), maxBatchWrite)
+		batch := pending[:n]
+		pending = pending[n:]
+		// Unprocessed requests, as when throttled, are sent again.
+		for len(batch) > 0 {
+			out, err := d.client.BatchWriteItem(ctx, &dynamodb.BatchWriteItemInput{
+				RequestItems: map[string][]types.WriteRequest{
+					d.tableName: batch,
+				},
+			})
+			if err != nil {
+				return 0, err
+			}
+			batch = out.UnprocessedItems[d.tableName]
+			if len(batch) > 0 {
+				select {
+				case <-ctx.Done():
+					return 0, ctx.Err()
+				case <-time.After(100 * time.Millisecond):
+				}
+			}
+		}
+	}
+
+	return len(requests), nil
+}
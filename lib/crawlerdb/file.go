@@ -0,0 +1,263 @@
+package crawlerdb
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// File keeps the timestamps in a JSON file, for running without DynamoDB.
+type File struct {
+	path string
+
+	mu sync.Mutex
+}
+
+var _ DB = (*File)(nil)
+
+func NewFile(path string) *File {
+	return &File{path: path}
+}
+
+func (f *File) load() (map[string]*Timestamp, error) {
+	ret := make(map[string]*Timestamp)
+
+	data, err := os.ReadFile(f.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return ret, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var tss []*Timestamp
+	if err := json.Unmarshal(data, &tss); err != nil {
+		return nil, err
+	}
+	for _, ts := range tss {
+		ret[ts.Did] = ts
+	}
+	return ret, nil
+}
+
+// save writes the timestamps to a temporary file and renames it, so
+// readers never see a partial file.
+func (f *File) save(m map[string]*Timestamp) error {
+	tss := make([]*Timestamp, 0, len(m))
+	for _, ts := range m {
+		tss = append(tss, ts)
+	}
+	sort.Slice(tss, func(i, j int) bool { return tss[i].Did < tss[j].Did })
+	data, err := json.MarshalIndent(tss, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(f.path), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(f.path), filepath.Base(f.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), f.path)
+}
+
+func (f *File) Get(ctx context.Context, did string) (*Timestamp, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	m, err := f.load()
+	if err != nil {
+		return nil, err
+	}
+	ts, ok := m[did]
+	if !ok {
+		return nil, ErrNotExists
+	}
+	return ts, nil
+}
+
+func (f *File) Put(ctx context.Context, ts *Timestamp) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	m, err := f.load()
+	if err != nil {
+		return err
+	}
+	t := *ts
+	m[ts.Did] = &t
+	return f.save(m)
+}
+
+func (f *File) Delete(ctx context.Context, did string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	m, err := f.load()
+	if err != nil {
+		return err
+	}
+	if _, ok := m[did]; !ok {
+		return nil
+	}
+	delete(m, did)
+	return f.save(m)
+}
+
+func (f *File) Scan(ctx context.Context, fn func(*Timestamp) error) error {
+	f.mu.Lock()
+	m, err := f.load()
+	f.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	dids := make([]string, 0, len(m))
+	for did := range m {
+		dids = append(dids, did)
+	}
+	sort.Strings(dids)
+	for _, did := range dids {
+		if err := fn(m[did]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FileHistory appends crawl runs to a file of JSON lines. Runs are kept
+// until the file is removed.
+type FileHistory struct {
+	path string
+
+	mu sync.Mutex
+}
+
+var _ History = (*FileHistory)(nil)
+
+func NewFileHistory(path string) *FileHistory {
+	return &FileHistory{path: path}
+}
+
+func (h *FileHistory) PutRun(ctx context.Context, run *Run) error {
+	data, err := json.Marshal(run)
+	if err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(h.path), 0o755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(h.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func (h *FileHistory) Runs(ctx context.Context, did string, limit int) ([]*Run, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	file, err := os.Open(h.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var runs []*Run
+	s := bufio.NewScanner(file)
+	s.Buffer(nil, 16*1024*1024)
+	for s.Scan() {
+		var run Run
+		if err := json.Unmarshal(s.Bytes(), &run); err != nil {
+			return nil, err
+		}
+		if run.Did == did {
+			runs = append(runs, &run)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(runs, func(i, j int) bool { return runs[i].StartedAt.After(runs[j].StartedAt) })
+	if limit > 0 && len(runs) > limit {
+		runs = runs[:limit]
+	}
+	return runs, nil
+}
+
+func (h *FileHistory) DeleteRuns(ctx context.Context, did string) (int, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	data, err := os.ReadFile(h.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	var kept []byte
+	deleted := 0
+	for line := range bytes.Lines(data) {
+		var run Run
+		if err := json.Unmarshal(line, &run); err != nil {
+			return 0, err
+		}
+		if run.Did == did {
+			deleted++
+			continue
+		}
+		kept = append(kept, line...)
+	}
+	if deleted == 0 {
+		return 0, nil
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(h.path), filepath.Base(h.path)+".*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(kept); err != nil {
+		tmp.Close()
+		return 0, err
+	}
+	if err := tmp.Close(); err != nil {
+		return 0, err
+	}
+	if err := os.Chmod(tmp.Name(), 0o644); err != nil {
+		return 0, err
+	}
+	if err := os.Rename(tmp.Name(), h.path); err != nil {
+		return 0, err
+	}
+	return deleted, nil
+}
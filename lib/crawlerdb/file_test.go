@@ -0,0 +1,81 @@
+package crawlerdb
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFile(t *testing.T) {
+	ctx := context.Background()
+	db := NewFile(filepath.Join(t.TempDir(), "crawler.json"))
+
+	if _, err := db.Get(ctx, "did:plc:a"); err != ErrNotExists {
+		t.Errorf("Get of an empty file: got %v", err)
+	}
+	for _, ts := range []*Timestamp{
+		{Did: "did:plc:b", LatestCid: "b1", Timestamp: 1},
+		{Did: "did:plc:a", LatestCid: "a1", Timestamp: 2},
+		{Did: "did:plc:b", LatestCid: "b2", Timestamp: 3},
+	} {
+		if err := db.Put(ctx, ts); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+	}
+
+	got, err := db.Get(ctx, "did:plc:b")
+	if err != nil || got.LatestCid != "b2" || got.Timestamp != 3 {
+		t.Errorf("Get: got %+v, %v", got, err)
+	}
+
+	var dids []string
+	if err := db.Scan(ctx, func(ts *Timestamp) error {
+		dids = append(dids, ts.Did)
+		return nil
+	}); err != nil {
+		t.Fatalf("Scan: %v", err)
+	}
+	if len(dids) != 2 || dids[0] != "did:plc:a" || dids[1] != "did:plc:b" {
+		t.Errorf("Scan: got %v", dids)
+	}
+}
+
+func TestFileHistory(t *testing.T) {
+	ctx := context.Background()
+	h := NewFileHistory(filepath.Join(t.TempDir(), "history.jsonl"))
+
+	if runs, err := h.Runs(ctx, "did:plc:a", 10); err != nil || len(runs) != 0 {
+		t.Errorf("Runs of an empty file: got %v, %v", runs, err)
+	}
+
+	start := time.Unix(1700000000, 0)
+	for i, did := range []string{"did:plc:a", "did:plc:b", "did:plc:a", "did:plc:a"} {
+		if err := h.PutRun(ctx, &Run{
+			Did:       did,
+			StartedAt: start.Add(time.Duration(i) * time.Hour),
+			Posts:     i,
+			Index:     OutcomeDone,
+		}); err != nil {
+			t.Fatalf("PutRun: %v", err)
+		}
+	}
+
+	runs, err := h.Runs(ctx, "did:plc:a", 2)
+	if err != nil {
+		t.Fatalf("Runs: %v", err)
+	}
+	if len(runs) != 2 || runs[0].Posts != 3 || runs[1].Posts != 2 || runs[0].Index != OutcomeDone {
+		t.Errorf("Runs: got %+v", runs)
+	}
+
+	if n, err := h.DeleteRuns(ctx, "did:plc:a"); err != nil || n != 3 {
+		t.Errorf("DeleteRuns: got %d, %v", n, err)
+	}
+	if runs, err := h.Runs(ctx, "did:plc:a", 10); err != nil || len(runs) != 0 {
+		t.Errorf("Runs after DeleteRuns: got %+v, %v", runs, err)
+	}
+	if runs, err := h.Runs(ctx, "did:plc:b", 10); err != nil || len(runs) != 1 {
+		t.Errorf("Runs of another account: got %+v, %v", runs, err)
+	}
+}
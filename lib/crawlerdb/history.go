@@ -0,0 +1,58 @@
+package crawlerdb
+
+import (
+	"context"
+	"time"
+)
+
+// Outcome is the result of a step of a crawl run that may be skipped.
+type Outcome string
+
+const (
+	OutcomeSkipped Outcome = "skipped"
+	OutcomeDone    Outcome = "done"
+	OutcomeFailed  Outcome = "failed"
+)
+
+// ErrorClass tells which step a crawl run failed at. It is empty for runs
+// that succeeded.
+type ErrorClass string
+
+const (
+	ErrorClassRequest ErrorClass = "request" // invalid request
+	ErrorClassAuth    ErrorClass = "auth"    // session could not be created
+	ErrorClassState   ErrorClass = "state"   // crawler state could not be read or written
+	ErrorClassFetch   ErrorClass = "fetch"   // author feed could not be read
+	ErrorClassStore   ErrorClass = "store"   // day files could not be written
+	ErrorClassDeleted ErrorClass = "deleted" // user was deleted during the crawl
+)
+
+// Run is the report of a crawl run.
+type Run struct {
+	Did       string
+	StartedAt time.Time
+	EndedAt   time.Time
+
+	// Pages is the number of author feed pages fetched and Posts the
+	// number of posts archived.
+	Pages int
+	Posts int
+
+	// Keys are the keys of the day files and month indexes updated.
+	Keys []string
+
+	Index        Outcome
+	Invalidation Outcome
+
+	ErrorClass ErrorClass
+	Error      string
+}
+
+// History keeps the reports of crawl runs.
+type History interface {
+	PutRun(ctx context.Context, run *Run) error
+	// Runs returns up to limit runs of did, most recent first.
+	Runs(ctx context.Context, did string, limit int) ([]*Run, error)
+	// DeleteRuns deletes the runs of did and returns how many there were.
+	DeleteRuns(ctx context.Context, did string) (int, error)
+}
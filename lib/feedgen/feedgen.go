@@ -0,0 +1,292 @@
+// Package feedgen serves a Bluesky feed generator, the XRPC methods
+// app.bsky.feed.describeFeedGenerator and app.bsky.feed.getFeedSkeleton and
+// the did:web document of the service, as a Lambda function URL handler.
+package feedgen
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+const (
+	defaultLimit = 50
+	maxLimit     = 100
+)
+
+// ErrBadCursor is returned by feeds for cursors they did not issue.
+var ErrBadCursor = errors.New("bad cursor")
+
+// Request is a getFeedSkeleton request to a feed.
+type Request struct {
+	// Viewer is the DID of the requesting account, or empty if the
+	// request is not authenticated.
+	Viewer string
+	Limit  int
+	Cursor string
+}
+
+type SkeletonPost struct {
+	Post string `json:"post"`
+}
+
+type Skeleton struct {
+	Cursor string          `json:"cursor,omitempty"`
+	Feed   []*SkeletonPost `json:"feed"`
+}
+
+// Feed returns the posts of a feed.
+type Feed func(ctx context.Context, req *Request) (*Skeleton, error)
+
+type Server struct {
+	hostname  string
+	publisher string
+	feeds     map[string]Feed
+	logger    *slog.Logger
+}
+
+type Option func(*Server)
+
+// WithFeed adds the feed published as the record name of the collection
+// app.bsky.feed.generator.
+func WithFeed(name string, f Feed) Option {
+	return func(s *Server) {
+		s.feeds[name] = f
+	}
+}
+
+func WithLogger(l *slog.Logger) Option {
+	return func(s *Server) {
+		if l == nil {
+			s.logger = slog.Default()
+		} else {
+			s.logger = l
+		}
+	}
+}
+
+// NewServer returns a feed generator served at https://<hostname> as
+// did:web:<hostname>, whose feed records are in the repository of the
+// account publisher.
+func NewServer(hostname, publisher string, opts ...Option) *Server {
+	s := &Server{
+		hostname:  hostname,
+		publisher: publisher,
+		feeds:     make(map[string]Feed),
+		logger:    slog.Default(),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// ServiceDid returns the DID of the feed generator.
+func (s *Server) ServiceDid() string {
+	return "did:web:" + s.hostname
+}
+
+// FeedURI returns the AT-URI of the feed record of name.
+func (s *Server) FeedURI(name string) string {
+	return "at://" + s.publisher + "/app.bsky.feed.generator/" + name
+}
+
+// Handles reports whether path is served by Handle.
+func Handles(path string) bool {
+	return path == "/.well-known/did.json" || strings.HasPrefix(path, "/xrpc/")
+}
+
+func (s *Server) Handle(ctx context.Context, req *events.LambdaFunctionURLRequest) (*events.LambdaFunctionURLResponse, error) {
+	switch req.RawPath {
+	case "/.well-known/did.json":
+		return s.jsonResponse(s.didDocument()), nil
+	case "/xrpc/app.bsky.feed.describeFeedGenerator":
+		return s.jsonResponse(s.describe()), nil
+	case "/xrpc/app.bsky.feed.getFeedSkeleton":
+		return s.getFeedSkeleton(ctx, req), nil
+	}
+	return s.xrpcError(http.StatusNotImplemented, "MethodNotImplemented", "Method not implemented"), nil
+}
+
+type didService struct {
+	ID              string `json:"id"`
+	Type            string `json:"type"`
+	ServiceEndpoint string `json:"serviceEndpoint"`
+}
+
+type didDocument struct {
+	Context []string      `json:"@context"`
+	ID      string        `json:"id"`
+	Service []*didService `json:"service"`
+}
+
+func (s *Server) didDocument() *didDocument {
+	return &didDocument{
+		Context: []string{"https://www.w3.org/ns/did/v1"},
+		ID:      s.ServiceDid(),
+		Service: []*didService{{
+			ID:              "#bsky_fg",
+			Type:            "BskyFeedGenerator",
+			ServiceEndpoint: "https://" + s.hostname,
+		}},
+	}
+}
+
+type describedFeed struct {
+	URI string `json:"uri"`
+}
+
+type description struct {
+	Did   string           `json:"did"`
+	Feeds []*describedFeed `json:"feeds"`
+}
+
+func (s *Server) describe() *description {
+	names := make([]string, 0, len(s.feeds))
+	for name := range s.feeds {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	d := &description{Did: s.ServiceDid(), Feeds: []*describedFeed{}}
+	for _, name := range names {
+		d.Feeds = append(d.Feeds, &describedFeed{URI: s.FeedURI(name)})
+	}
+	return d
+}
+
+func (s *Server) getFeedSkeleton(ctx context.Context, req *events.LambdaFunctionURLRequest) *events.LambdaFunctionURLResponse {
+	params := req.QueryStringParameters
+
+	uri := params["feed"]
+	name, ok := strings.CutPrefix(uri, "at://"+s.publisher+"/app.bsky.feed.generator/")
+	f := s.feeds[name]
+	if !ok || f == nil {
+		return s.xrpcError(http.StatusBadRequest, "UnknownFeed", "Unknown feed: "+uri)
+	}
+
+	limit := defaultLimit
+	if v, ok := params["limit"]; ok {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxLimit {
+			return s.xrpcError(http.StatusBadRequest, "InvalidRequest", "Invalid limit: "+v)
+		}
+		limit = n
+	}
+
+	viewer := s.viewer(req.Headers["authorization"])
+	skeleton, err := f(ctx, &Request{
+		Viewer: viewer,
+		Limit:  limit,
+		Cursor: params["cursor"],
+	})
+	if errors.Is(err, ErrBadCursor) {
+		return s.xrpcError(http.StatusBadRequest, "InvalidRequest", "Invalid cursor")
+	} else if err != nil {
+		s.logger.Error("Failed to get feed", "err", err, "feed", name, "viewer", viewer)
+		return s.xrpcError(http.StatusInternalServerError, "InternalServerError", "Internal server error")
+	}
+	if skeleton.Feed == nil {
+		skeleton.Feed = []*SkeletonPost{}
+	}
+
+	s.logger.Info("Feed", "feed", name, "viewer", viewer, "posts", len(skeleton.Feed))
+	return s.jsonResponse(skeleton)
+}
+
+type claims struct {
+	Iss string `json:"iss"`
+	Aud string `json:"aud"`
+	Exp int64  `json:"exp"`
+}
+
+// viewer returns the issuer of the bearer token if it is addressed to this
+// service and not expired.
+//
+// The signature is not verified: the feeds only contain posts that are
+// published in the archive anyway, and the viewer merely selects whose.
+func (s *Server) viewer(authorization string) string {
+	token, ok := strings.CutPrefix(authorization, "Bearer ")
+	if !ok {
+		return ""
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return ""
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return ""
+	}
+	var c claims
+	if err := json.Unmarshal(payload, &c); err != nil {
+		return ""
+	}
+	if c.Aud != s.ServiceDid() || c.Exp < time.Now().Unix() || !strings.HasPrefix(c.Iss, "did:") {
+		return ""
+	}
+	// The issuer may refer to a service of the DID.
+	did, _, _ := strings.Cut(c.Iss, "#")
+	return did
+}
+
+func (s *Server) jsonResponse(v any) *events.LambdaFunctionURLResponse {
+	b, err := json.Marshal(v)
+	if err != nil {
+		s.logger.Error("Failed to marshal response to JSON", "err", err)
+		return &events.LambdaFunctionURLResponse{
+			StatusCode: http.StatusInternalServerError,
+		}
+	}
+	return &events.LambdaFunctionURLResponse{
+		StatusCode: http.StatusOK,
+		Headers: map[string]string{
+			"Content-Type": "application/json",
+		},
+		Body: string(b),
+	}
+}
+
+type xrpcError struct {
+	Error   string `json:"error"`
+	Message string `json:"message"`
+}
+
+func (s *Server) xrpcError(status int, name, message string) *events.LambdaFunctionURLResponse {
+	res := s.jsonResponse(&xrpcError{Error: name, Message: message})
+	if res.StatusCode == http.StatusOK {
+		res.StatusCode = status
+	}
+	return res
+}
+
+// OffsetCursor parses a cursor issued by NextOffsetCursor. An empty cursor
+// is offset 0.
+func OffsetCursor(cursor string) (int, error) {
+	if cursor == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(cursor)
+	if err != nil || n < 0 {
+		return 0, ErrBadCursor
+	}
+	return n, nil
+}
+
+// NextOffsetCursor returns the cursor of the page after offset, or an
+// empty string if there are no more than total posts.
+func NextOffsetCursor(offset, limit, total int) string {
+	if offset+limit >= total {
+		return ""
+	}
+	return strconv.Itoa(offset + limit)
+}
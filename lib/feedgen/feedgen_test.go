@@ -0,0 +1,98 @@
+package feedgen
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+func testToken(iss, aud string, exp time.Time) string {
+	claims, _ := json.Marshal(&claims{Iss: iss, Aud: aud, Exp: exp.Unix()})
+	return "Bearer e30." + base64.RawURLEncoding.EncodeToString(claims) + ".sig"
+}
+
+func TestServer(t *testing.T) {
+	s := NewServer("feed.example.com", "did:plc:pub",
+		WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil))),
+		WithFeed("numbers", func(ctx context.Context, req *Request) (*Skeleton, error) {
+			offset, err := OffsetCursor(req.Cursor)
+			if err != nil {
+				return nil, err
+			}
+			var uris []string
+			for i := range 5 {
+				uris = append(uris, fmt.Sprintf("at://%s/app.bsky.feed.post/%d", req.Viewer, i))
+			}
+			ret := &Skeleton{Cursor: NextOffsetCursor(offset, req.Limit, len(uris))}
+			for _, uri := range uris[offset:min(offset+req.Limit, len(uris))] {
+				ret.Feed = append(ret.Feed, &SkeletonPost{Post: uri})
+			}
+			return ret, nil
+		}),
+	)
+
+	get := func(path string, params map[string]string, authorization string) (int, string) {
+		t.Helper()
+
+		res, err := s.Handle(context.Background(), &events.LambdaFunctionURLRequest{
+			RawPath:               path,
+			QueryStringParameters: params,
+			Headers:               map[string]string{"authorization": authorization},
+		})
+		if err != nil {
+			t.Fatalf("Handle: %v", err)
+		}
+		return res.StatusCode, res.Body
+	}
+
+	feed := "at://did:plc:pub/app.bsky.feed.generator/numbers"
+	now := time.Now()
+	tests := []struct {
+		name          string
+		path          string
+		params        map[string]string
+		authorization string
+		status        int
+		body          string
+	}{
+		{"did", "/.well-known/did.json", nil, "", http.StatusOK,
+			`{"@context":["https://www.w3.org/ns/did/v1"],"id":"did:web:feed.example.com","service":[{"id":"#bsky_fg","type":"BskyFeedGenerator","serviceEndpoint":"https://feed.example.com"}]}`},
+		{"describe", "/xrpc/app.bsky.feed.describeFeedGenerator", nil, "", http.StatusOK,
+			`{"did":"did:web:feed.example.com","feeds":[{"uri":"at://did:plc:pub/app.bsky.feed.generator/numbers"}]}`},
+		{"first page", "/xrpc/app.bsky.feed.getFeedSkeleton", map[string]string{"feed": feed, "limit": "2"},
+			testToken("did:plc:a", "did:web:feed.example.com", now.Add(time.Minute)), http.StatusOK,
+			`{"cursor":"2","feed":[{"post":"at://did:plc:a/app.bsky.feed.post/0"},{"post":"at://did:plc:a/app.bsky.feed.post/1"}]}`},
+		{"last page", "/xrpc/app.bsky.feed.getFeedSkeleton", map[string]string{"feed": feed, "limit": "2", "cursor": "4"},
+			testToken("did:plc:a#atproto", "did:web:feed.example.com", now.Add(time.Minute)), http.StatusOK,
+			`{"feed":[{"post":"at://did:plc:a/app.bsky.feed.post/4"}]}`},
+		{"other audience", "/xrpc/app.bsky.feed.getFeedSkeleton", map[string]string{"feed": feed, "limit": "1"},
+			testToken("did:plc:a", "did:web:other.example.com", now.Add(time.Minute)), http.StatusOK,
+			`{"cursor":"1","feed":[{"post":"at:///app.bsky.feed.post/0"}]}`},
+		{"expired", "/xrpc/app.bsky.feed.getFeedSkeleton", map[string]string{"feed": feed, "limit": "1"},
+			testToken("did:plc:a", "did:web:feed.example.com", now.Add(-time.Minute)), http.StatusOK,
+			`{"cursor":"1","feed":[{"post":"at:///app.bsky.feed.post/0"}]}`},
+		{"bad cursor", "/xrpc/app.bsky.feed.getFeedSkeleton", map[string]string{"feed": feed, "cursor": "x"}, "", http.StatusBadRequest,
+			`{"error":"InvalidRequest","message":"Invalid cursor"}`},
+		{"bad limit", "/xrpc/app.bsky.feed.getFeedSkeleton", map[string]string{"feed": feed, "limit": "101"}, "", http.StatusBadRequest,
+			`{"error":"InvalidRequest","message":"Invalid limit: 101"}`},
+		{"unknown feed", "/xrpc/app.bsky.feed.getFeedSkeleton", map[string]string{"feed": "at://did:plc:other/app.bsky.feed.generator/numbers"}, "", http.StatusBadRequest,
+			`{"error":"UnknownFeed","message":"Unknown feed: at://did:plc:other/app.bsky.feed.generator/numbers"}`},
+		{"unknown method", "/xrpc/app.bsky.feed.getTimeline", nil, "", http.StatusNotImplemented,
+			`{"error":"MethodNotImplemented","message":"Method not implemented"}`},
+	}
+	for _, tt := range tests {
+		status, body := get(tt.path, tt.params, tt.authorization)
+		if status != tt.status || strings.TrimSpace(body) != tt.body {
+			t.Errorf("%s: got %d %s, want %d %s", tt.name, status, body, tt.status, tt.body)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+// Package functionurl serves Lambda function URL handlers on net/http.
+package functionurl
+
+import (
+	"context"
+	"encoding/base64"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// HandlerFunc is the signature of a function URL handler.
+type HandlerFunc func(ctx context.Context, req *events.LambdaFunctionURLRequest) (*events.LambdaFunctionURLResponse, error)
+
+type handler struct {
+	f      HandlerFunc
+	logger *slog.Logger
+}
+
+type Option func(*handler)
+
+func WithLogger(l *slog.Logger) Option {
+	return func(h *handler) {
+		if l == nil {
+			h.logger = slog.Default()
+		} else {
+			h.logger = l
+		}
+	}
+}
+
+// Handler returns an http.Handler that converts requests and responses
+// the way Lambda function URLs do.
+func Handler(f HandlerFunc, opts ...Option) http.Handler {
+	h := &handler{
+		f:      f,
+		logger: slog.Default(),
+	}
+	for _, opt := range opts {
+		opt(h)
+	}
+	return h
+}
+
+// Request converts r to a function URL request. Repeated headers and query
+// parameters are joined with commas as Lambda does.
+func Request(r *http.Request) (*events.LambdaFunctionURLRequest, error) {
+	var body []byte
+	if r.Body != nil {
+		b, err := io.ReadAll(r.Body)
+		if err != nil {
+			return nil, err
+		}
+		body = b
+	}
+
+	req := &events.LambdaFunctionURLRequest{
+		Version:        "2.0",
+		RawPath:        r.URL.Path,
+		RawQueryString: r.URL.RawQuery,
+		Headers:        make(map[string]string),
+		RequestContext: events.LambdaFunctionURLRequestContext{
+			DomainName: r.Host,
+			TimeEpoch:  time.Now().UnixMilli(),
+			HTTP: events.LambdaFunctionURLRequestContextHTTPDescription{
+				Method:    r.Method,
+				Path:      r.URL.Path,
+				Protocol:  r.Proto,
+				SourceIP:  sourceIP(r.RemoteAddr),
+				UserAgent: r.UserAgent(),
+			},
+		},
+	}
+	for k, v := range r.Header {
+		if k == "Cookie" {
+			continue
+		}
+		req.Headers[strings.ToLower(k)] = strings.Join(v, ",")
+	}
+	for _, c := range r.Cookies() {
+		req.Cookies = append(req.Cookies, c.String())
+	}
+	if q := r.URL.Query(); len(q) > 0 {
+		req.QueryStringParameters = make(map[string]string, len(q))
+		for k, v := range q {
+			req.QueryStringParameters[k] = strings.Join(v, ",")
+		}
+	}
+	if utf8.Valid(body) {
+		req.Body = string(body)
+	} else {
+		req.Body = base64.StdEncoding.EncodeToString(body)
+		req.IsBase64Encoded = true
+	}
+	return req, nil
+}
+
+func sourceIP(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	return host
+}
+
+// WriteResponse writes res to w. A zero status code is sent as 200.
+func WriteResponse(w http.ResponseWriter, res *events.LambdaFunctionURLResponse) error {
+	body := []byte(res.Body)
+	if res.IsBase64Encoded {
+		b, err := base64.StdEncoding.DecodeString(res.Body)
+		if err != nil {
+			return err
+		}
+		body = b
+	}
+
+	for k, v := range res.Headers {
+		w.Header().Set(k, v)
+	}
+	for _, c := range res.Cookies {
+		w.Header().Add("Set-Cookie", c)
+	}
+	status := res.StatusCode
+	if status == 0 {
+		status = http.StatusOK
+	}
+	w.WriteHeader(status)
+	_, err := w.Write(body)
+	return err
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	req, err := Request(r)
+	if err != nil {
+		h.logger.Error("Failed to read request", "err", err, "path", r.URL.Path)
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	res, err := h.f(r.Context(), req)
+	if err != nil {
+		h.logger.Error("Handler error", "err", err, "path", r.URL.Path)
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return
+	}
+	if res == nil {
+		res = &events.LambdaFunctionURLResponse{}
+	}
+	if err := WriteResponse(w, res); err != nil {
+		h.logger.Error("Failed to write response", "err", err, "path", r.URL.Path)
+	}
+}
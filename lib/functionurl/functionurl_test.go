@@ -0,0 +1,57 @@
+package functionurl
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+func TestHandler(t *testing.T) {
+	var got *events.LambdaFunctionURLRequest
+	h := Handler(func(ctx context.Context, req *events.LambdaFunctionURLRequest) (*events.LambdaFunctionURLResponse, error) {
+		got = req
+		if req.RawPath == "/error" {
+			return nil, errors.New("error")
+		}
+		return &events.LambdaFunctionURLResponse{
+			StatusCode:      http.StatusCreated,
+			Headers:         map[string]string{"Content-Type": "application/octet-stream"},
+			Body:            base64.StdEncoding.EncodeToString([]byte{0xff, 0x00}),
+			IsBase64Encoded: true,
+		}, nil
+	}, WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil))))
+
+	req := httptest.NewRequest(http.MethodPost, "/search/did:plc:a?q=hello+world&tag=a&tag=b", strings.NewReader("body"))
+	req.Header.Add("X-Test", "1")
+	req.Header.Add("X-Test", "2")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	if got.RawPath != "/search/did:plc:a" ||
+		got.QueryStringParameters["q"] != "hello world" ||
+		got.QueryStringParameters["tag"] != "a,b" ||
+		got.Headers["x-test"] != "1,2" ||
+		got.RequestContext.HTTP.Method != http.MethodPost ||
+		got.Body != "body" || got.IsBase64Encoded {
+		t.Errorf("request: %+v", got)
+	}
+	if rec.Code != http.StatusCreated ||
+		rec.Header().Get("Content-Type") != "application/octet-stream" ||
+		rec.Body.String() != "\xff\x00" {
+		t.Errorf("response: %d %v %q", rec.Code, rec.Header(), rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/error", nil))
+	if rec.Code != http.StatusBadGateway {
+		t.Errorf("error: got %d, want %d", rec.Code, http.StatusBadGateway)
+	}
+}
@@ -4,16 +4,19 @@ import (
 	"context"
 	"errors"
 	"log/slog"
-	"strings"
+	"sort"
 
 	"gorm.io/gorm"
 
 	"github.com/bluesky-social/indigo/api/bsky"
 )
 
+var ErrReadOnly = errors.New("index is opened read-only")
+
 type Gorm struct {
-	db     *gorm.DB
-	logger *slog.Logger
+	db       *gorm.DB
+	readOnly bool
+	logger   *slog.Logger
 }
 
 type GormOption func(*Gorm)
@@ -28,7 +31,16 @@ func GormOptionLogger(logger *slog.Logger) GormOption {
 	}
 }
 
-func NewGorm(db *gorm.DB, opts ...GormOption) *Gorm {
+// GormOptionReadOnly opens the index without applying migrations.
+// NewGorm fails with ErrSchemaOutdated or ErrSchemaTooNew if the index
+// cannot be read as is, so readers migrate a copy of older indexes first.
+func GormOptionReadOnly() GormOption {
+	return func(g *Gorm) {
+		g.readOnly = true
+	}
+}
+
+func NewGorm(ctx context.Context, db *gorm.DB, opts ...GormOption) (*Gorm, error) {
 	g := &Gorm{
 		db:     db,
 		logger: slog.Default(),
@@ -38,21 +50,33 @@ func NewGorm(db *gorm.DB, opts ...GormOption) *Gorm {
 		opt(g)
 	}
 
-	err := db.AutoMigrate(&Record{})
-	if err != nil {
-		g.logger.Error("failed to auto migrate Record table", "err", err)
-		panic(err)
+	if g.readOnly {
+		if err := checkReadable(ctx, db); err != nil {
+			g.logger.Error("index is not readable", "err", err)
+			return nil, err
+		}
+		return g, nil
+	}
+
+	if err := Migrate(ctx, db, g.logger); err != nil {
+		g.logger.Error("failed to migrate index", "err", err)
+		return nil, err
 	}
-	return g
+	return g, nil
 }
 
 func (s *Gorm) Put(ctx context.Context, key string, position int, post *bsky.FeedDefs_FeedViewPost) error {
+	if s.readOnly {
+		return ErrReadOnly
+	}
+
 	rec := ToRecord(key, position, post)
 	if rec == nil {
 		err := errors.New("unexpected post")
 		s.logger.Error("failed to create record", "key", key, "position", position, "err", err)
 		return err
 	}
+	rec.Terms = recordTerms(rec)
 
 	if err := s.db.WithContext(ctx).Create(rec).Error; err != nil {
 		s.logger.Error("failed to put record into database", "key", key, "cid", rec.Cid, "err", err)
@@ -61,25 +85,86 @@ func (s *Gorm) Put(ctx context.Context, key string, position int, post *bsky.Fee
 	return nil
 }
 
+// PutIfAbsent puts the post unless a record with the same CID exists,
+// including a soft deleted one. It reports whether the post was put.
+func (s *Gorm) PutIfAbsent(ctx context.Context, key string, position int, post *bsky.FeedDefs_FeedViewPost) (bool, error) {
+	if s.readOnly {
+		return false, ErrReadOnly
+	}
+	if post == nil || post.Post == nil {
+		return false, s.Put(ctx, key, position, post)
+	}
+
+	var count int64
+	if err := s.db.WithContext(ctx).Unscoped().Model(&Record{}).Where("cid = ?", post.Post.Cid).Count(&count).Error; err != nil {
+		s.logger.Error("failed to find record", "key", key, "cid", post.Post.Cid, "err", err)
+		return false, err
+	}
+	if count > 0 {
+		return false, nil
+	}
+
+	if err := s.Put(ctx, key, position, post); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// accountDids selects the DIDs that posted or were replied to under one of
+// the handles, so that a previous handle of an account also finds the
+// posts from after it was changed.
+const accountDids = "SELECT did FROM records WHERE handle IN ? " +
+	"UNION SELECT reply_parent_did FROM records WHERE reply_parent_handle IN ?"
+
 type SearchResult struct {
 	Key      string
 	Position int
 }
 
-type Query struct {
-	Text []string
-}
-
 func (s *Gorm) Search(ctx context.Context, query *Query) ([]*SearchResult, error) {
+	if query.IsEmpty() {
+		return nil, nil
+	}
+
 	db := s.db.WithContext(ctx)
-	dbOrig := db
-	var likes []string
-	var args []interface{}
 	for _, text := range query.Text {
-		likes = append(likes, "text LIKE ?")
-		args = append(args, "%"+text+"%")
+		like := "%" + text + "%"
+		db = db.Where(
+			"text LIKE ? OR embed_post_text LIKE ? OR "+
+				"cid IN (SELECT record_cid FROM record_alt_texts WHERE text LIKE ?) OR "+
+				"cid IN (SELECT record_cid FROM record_links WHERE title LIKE ?)",
+			like, like, like, like,
+		)
+	}
+	for _, tag := range query.Tags {
+		db = db.Where("cid IN (SELECT record_cid FROM record_tags WHERE tag = ?)", tag)
+	}
+	for _, handle := range query.Mentions {
+		db = db.Where("cid IN (SELECT record_cid FROM record_mentions WHERE handle = ? OR did = ?)", handle, handle)
+	}
+	for _, account := range query.From {
+		ids := query.aliases(account)
+		db = db.Where("did IN ? OR handle IN ? OR did IN ("+accountDids+")", ids, ids, ids, ids)
+	}
+	for _, account := range query.To {
+		ids := query.aliases(account)
+		db = db.Where(
+			"reply_parent_did IN ? OR reply_parent_handle IN ? OR reply_parent_did IN ("+accountDids+")",
+			ids, ids, ids, ids,
+		)
+	}
+	for _, lang := range query.Langs {
+		db = db.Where("cid IN (SELECT record_cid FROM record_langs WHERE lang = ? OR lang LIKE ?)", lang, lang+"-%")
+	}
+	for _, domain := range query.Domains {
+		db = db.Where("cid IN (SELECT record_cid FROM record_links WHERE domain = ? OR domain LIKE ?)", domain, "%."+domain)
+	}
+	if query.Since != 0 {
+		db = db.Where("timestamp >= ?", query.Since)
+	}
+	if query.Until != 0 {
+		db = db.Where("timestamp < ?", query.Until)
 	}
-	db = db.Where(strings.Join(likes, " AND "), args...)
 
 	var records []Record
 	if err := db.Find(&records).Error; err != nil {
@@ -87,10 +172,6 @@ func (s *Gorm) Search(ctx context.Context, query *Query) ([]*SearchResult, error
 		return nil, err
 	}
 
-	if db == dbOrig {
-		return nil, nil
-	}
-
 	results := make([]*SearchResult, len(records))
 	for i, rec := range records {
 		results[i] = &SearchResult{
@@ -101,3 +182,56 @@ func (s *Gorm) Search(ctx context.Context, query *Query) ([]*SearchResult, error
 
 	return results, nil
 }
+
+// LikedResult is a post ranked by its like count.
+type LikedResult struct {
+	Key       string
+	Position  int
+	LikeCount int64
+	Timestamp int64
+}
+
+// MostLiked returns the limit posts with the most likes, most liked first.
+// Posts with no likes are not returned.
+func (s *Gorm) MostLiked(ctx context.Context, limit int) ([]*LikedResult, error) {
+	var records []Record
+	if err := s.db.WithContext(ctx).
+		Select("key", "position", "like_count", "timestamp").
+		Where("like_count > 0").
+		Order("like_count DESC").Order("timestamp DESC").
+		Limit(limit).
+		Find(&records).Error; err != nil {
+		s.logger.Error("failed to find most liked records", "limit", limit, "err", err)
+		return nil, err
+	}
+
+	results := make([]*LikedResult, len(records))
+	for i, rec := range records {
+		results[i] = &LikedResult{
+			Key:       rec.Key,
+			Position:  int(rec.Position),
+			LikeCount: rec.LikeCount,
+			Timestamp: rec.Timestamp,
+		}
+	}
+	return results, nil
+}
+
+// MergeLiked merges the results of MostLiked of shards into the limit
+// most liked posts.
+func MergeLiked(shards [][]*LikedResult, limit int) []*LikedResult {
+	var ret []*LikedResult
+	for _, rs := range shards {
+		ret = append(ret, rs...)
+	}
+	sort.SliceStable(ret, func(i, j int) bool {
+		if ret[i].LikeCount != ret[j].LikeCount {
+			return ret[i].LikeCount > ret[j].LikeCount
+		}
+		return ret[i].Timestamp > ret[j].Timestamp
+	})
+	if len(ret) > limit {
+		ret = ret[:limit]
+	}
+	return ret
+}
@@ -0,0 +1,151 @@
+package index
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/bluesky-social/indigo/api/bsky"
+	"github.com/google/go-cmp/cmp"
+)
+
+func putTestPost(t *testing.T, g *Gorm, key string, position int, text string) {
+	t.Helper()
+
+	var fvp bsky.FeedDefs_FeedViewPost
+	if err := json.Unmarshal([]byte(text), &fvp); err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+	if err := g.Put(context.Background(), key, position, &fvp); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+}
+
+func newTestGorm(t *testing.T) *Gorm {
+	t.Helper()
+
+	g, err := NewGorm(context.Background(), openTestDB(t, filepath.Join(t.TempDir(), "index")))
+	if err != nil {
+		t.Fatalf("NewGorm: %v", err)
+	}
+	return g
+}
+
+func TestGorm_Search(t *testing.T) {
+	ctx := context.Background()
+	g := newTestGorm(t)
+
+	putTestPost(t, g, "k/2026/01/01", 0, `{"post":{"author":{"did":"did:plc:a","handle":"a.example.com"},"cid":"cid1","record":{"$type":"app.bsky.feed.post","createdAt":"2026-01-01T00:00:00Z","facets":[{"features":[{"$type":"app.bsky.richtext.facet#tag","tag":"golang"}],"index":{"byteStart":6,"byteEnd":13}}],"langs":["ja-JP"],"text":"hello #golang"}}}`)
+	putTestPost(t, g, "k/2026/01/01", 1, `{"post":{"author":{"did":"did:plc:a","handle":"a.example.com"},"cid":"cid2","embed":{"$type":"app.bsky.embed.external#view","external":{"description":"","title":"Example Title","uri":"https://www.blog.example.com/post"}},"record":{"$type":"app.bsky.feed.post","createdAt":"2026-01-01T01:00:00Z","facets":[{"features":[{"$type":"app.bsky.richtext.facet#mention","did":"did:plc:b"}],"index":{"byteStart":0,"byteEnd":14}}],"langs":["en"],"text":"@b.example.com look"}}}`)
+	putTestPost(t, g, "k/2026/01/02", 0, `{"post":{"author":{"did":"did:plc:a","handle":"a.example.com"},"cid":"cid3","embed":{"$type":"app.bsky.embed.images#view","images":[{"alt":"a cat photo","fullsize":"","thumb":""}]},"record":{"$type":"app.bsky.feed.post","createdAt":"2026-01-02T00:00:00Z","text":"hello"}}}`)
+
+	tests := []struct {
+		query string
+		want  []*SearchResult
+	}{
+		{"hello", []*SearchResult{{"k/2026/01/01", 0}, {"k/2026/01/02", 0}}},
+		{"#GoLang", []*SearchResult{{"k/2026/01/01", 0}}},
+		{"hello #golang", []*SearchResult{{"k/2026/01/01", 0}}},
+		{"@b.example.com", []*SearchResult{{"k/2026/01/01", 1}}},
+		{"@did:plc:b", []*SearchResult{{"k/2026/01/01", 1}}},
+		{"lang:ja", []*SearchResult{{"k/2026/01/01", 0}}},
+		{"domain:example.com", []*SearchResult{{"k/2026/01/01", 1}}},
+		{"domain:blog.example.com", []*SearchResult{{"k/2026/01/01", 1}}},
+		{"Title", []*SearchResult{{"k/2026/01/01", 1}}},
+		{"cat", []*SearchResult{{"k/2026/01/02", 0}}},
+		{"#nothing", []*SearchResult{}},
+		{"", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			got, err := g.Search(ctx, ParseQuery(tt.query))
+			if err != nil {
+				t.Fatalf("Search: %v", err)
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("Search mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestGorm_MostLiked(t *testing.T) {
+	ctx := context.Background()
+	g := newTestGorm(t)
+	h := newTestGorm(t)
+
+	post := func(cid string, likes int, createdAt string) string {
+		return `{"post":{"author":{"did":"did:plc:a","handle":"a.example.com"},"cid":"` + cid + `","likeCount":` + strconv.Itoa(likes) + `,"record":{"$type":"app.bsky.feed.post","createdAt":"` + createdAt + `","text":"hello"}}}`
+	}
+	putTestPost(t, g, "k/2026/01/01", 0, post("cid1", 3, "2026-01-01T00:00:00Z"))
+	putTestPost(t, g, "k/2026/01/01", 1, post("cid2", 0, "2026-01-01T01:00:00Z"))
+	putTestPost(t, g, "k/2026/01/02", 0, post("cid3", 5, "2026-01-02T00:00:00Z"))
+	putTestPost(t, h, "k/2026/02/01", 0, post("cid4", 3, "2026-02-01T00:00:00Z"))
+	putTestPost(t, h, "k/2026/02/02", 0, post("cid5", 1, "2026-02-02T00:00:00Z"))
+
+	var shards [][]*LikedResult
+	for _, idx := range []*Gorm{g, h} {
+		rs, err := idx.MostLiked(ctx, 3)
+		if err != nil {
+			t.Fatalf("MostLiked: %v", err)
+		}
+		shards = append(shards, rs)
+	}
+
+	var got []string
+	for _, r := range MergeLiked(shards, 3) {
+		got = append(got, fmt.Sprintf("%s:%d:%d", r.Key, r.Position, r.LikeCount))
+	}
+	// Ties are broken by recency; posts without likes are not ranked.
+	want := []string{"k/2026/01/02:0:5", "k/2026/02/01:0:3", "k/2026/01/01:0:3"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("MostLiked mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestGorm_Search_accounts(t *testing.T) {
+	ctx := context.Background()
+	g := newTestGorm(t)
+
+	// a changed its handle from a.example.com to a2.example.com between
+	// the posts.
+	putTestPost(t, g, "k/2026/01/01", 0, `{"post":{"author":{"did":"did:plc:a","handle":"a.example.com"},"cid":"cid1","record":{"$type":"app.bsky.feed.post","createdAt":"2026-01-01T00:00:00Z","text":"one"}}}`)
+	putTestPost(t, g, "k/2026/01/01", 1, `{"post":{"author":{"did":"did:plc:a","handle":"a2.example.com"},"cid":"cid2","record":{"$type":"app.bsky.feed.post","createdAt":"2026-01-01T01:00:00Z","text":"two"}}}`)
+	putTestPost(t, g, "k/2026/01/02", 0, `{"post":{"author":{"did":"did:plc:b","handle":"b.example.com"},"cid":"cid3","record":{"$type":"app.bsky.feed.post","createdAt":"2026-01-02T00:00:00Z","text":"three"}},"reply":{"parent":{"$type":"app.bsky.feed.defs#postView","author":{"did":"did:plc:a","handle":"a.example.com"},"cid":"cid1","indexedAt":"","record":{"$type":"app.bsky.feed.post","createdAt":"2026-01-01T00:00:00Z","text":"one"},"uri":"at://did:plc:a/app.bsky.feed.post/1"},"root":{"$type":"app.bsky.feed.defs#postView","author":{"did":"did:plc:a","handle":"a.example.com"},"cid":"cid1","indexedAt":"","record":{"$type":"app.bsky.feed.post","createdAt":"2026-01-01T00:00:00Z","text":"one"},"uri":"at://did:plc:a/app.bsky.feed.post/1"}}}`)
+
+	tests := []struct {
+		query   string
+		aliases map[string][]string
+		want    []*SearchResult
+	}{
+		{"from:a.example.com", nil, []*SearchResult{{"k/2026/01/01", 0}, {"k/2026/01/01", 1}}},
+		{"from:@A2.example.com", nil, []*SearchResult{{"k/2026/01/01", 0}, {"k/2026/01/01", 1}}},
+		{"from:did:plc:a two", nil, []*SearchResult{{"k/2026/01/01", 1}}},
+		{"from:b.example.com", nil, []*SearchResult{{"k/2026/01/02", 0}}},
+		{"to:a2.example.com", nil, []*SearchResult{{"k/2026/01/02", 0}}},
+		{"to:b.example.com", nil, []*SearchResult{}},
+		{"from:a3.example.com", nil, []*SearchResult{}},
+		// A handle unknown to the index matches by its aliases.
+		{"from:a3.example.com", map[string][]string{"a3.example.com": {"did:plc:a"}}, []*SearchResult{{"k/2026/01/01", 0}, {"k/2026/01/01", 1}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			q := ParseQuery(tt.query)
+			for account, aliases := range tt.aliases {
+				for _, alias := range aliases {
+					q.AddAlias(account, alias)
+				}
+			}
+			got, err := g.Search(ctx, q)
+			if err != nil {
+				t.Fatalf("Search: %v", err)
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("Search mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
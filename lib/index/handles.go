@@ -0,0 +1,76 @@
+package index
+
+import (
+	"context"
+	"sort"
+)
+
+// handleColumns are the tables and the DID and handle columns that keep
+// handles as they were when the posts were crawled.
+var handleColumns = []struct {
+	table  string
+	did    string
+	handle string
+}{
+	{"records", "did", "handle"},
+	{"records", "reply_parent_did", "reply_parent_handle"},
+	{"records", "embed_post_did", "embed_post_handle"},
+	{"record_mentions", "did", "handle"},
+}
+
+// Handles returns the handles kept in the index for each DID.
+func (s *Gorm) Handles(ctx context.Context) (map[string][]string, error) {
+	ret := make(map[string][]string)
+	seen := make(map[[2]string]bool)
+	for _, c := range handleColumns {
+		var rows []struct {
+			Did    string
+			Handle string
+		}
+		if err := s.db.WithContext(ctx).Table(c.table).
+			Distinct(c.did+" AS did", c.handle+" AS handle").
+			Where(c.did + " IS NOT NULL AND " + c.did + " != ''").
+			Where(c.handle + " IS NOT NULL AND " + c.handle + " != ''").
+			Scan(&rows).Error; err != nil {
+			s.logger.Error("failed to find handles", "table", c.table, "column", c.handle, "err", err)
+			return nil, err
+		}
+		for _, row := range rows {
+			if seen[[2]string{row.Did, row.Handle}] {
+				continue
+			}
+			seen[[2]string{row.Did, row.Handle}] = true
+			ret[row.Did] = append(ret[row.Did], row.Handle)
+		}
+	}
+	for _, handles := range ret {
+		sort.Strings(handles)
+	}
+	return ret, nil
+}
+
+// RewriteHandles replaces the handles of the DIDs of handles with the
+// current ones, and returns the number of rows changed.
+func (s *Gorm) RewriteHandles(ctx context.Context, handles map[string]string) (int64, error) {
+	if s.readOnly {
+		return 0, ErrReadOnly
+	}
+
+	var changed int64
+	for did, handle := range handles {
+		if handle == "" {
+			continue
+		}
+		for _, c := range handleColumns {
+			res := s.db.WithContext(ctx).Table(c.table).
+				Where(c.did+" = ? AND "+c.handle+" != ?", did, handle).
+				Update(c.handle, handle)
+			if res.Error != nil {
+				s.logger.Error("failed to rewrite handles", "table", c.table, "column", c.handle, "did", did, "err", res.Error)
+				return changed, res.Error
+			}
+			changed += res.RowsAffected
+		}
+	}
+	return changed, nil
+}
@@ -0,0 +1,56 @@
+package index
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestGorm_RewriteHandles(t *testing.T) {
+	ctx := context.Background()
+	g := newTestGorm(t)
+
+	putTestPost(t, g, "k/2026/01/01", 0, `{"post":{"author":{"did":"did:plc:a","handle":"a.example.com"},"cid":"cid1","record":{"$type":"app.bsky.feed.post","createdAt":"2026-01-01T00:00:00Z","facets":[{"features":[{"$type":"app.bsky.richtext.facet#mention","did":"did:plc:b"}],"index":{"byteStart":0,"byteEnd":14}}],"text":"@b.example.com hi"}}}`)
+	putTestPost(t, g, "k/2026/01/01", 1, `{"post":{"author":{"did":"did:plc:a","handle":"a2.example.com"},"cid":"cid2","record":{"$type":"app.bsky.feed.post","createdAt":"2026-01-01T01:00:00Z","text":"two"}}}`)
+
+	got, err := g.Handles(ctx)
+	if err != nil {
+		t.Fatalf("Handles: %v", err)
+	}
+	want := map[string][]string{
+		"did:plc:a": {"a.example.com", "a2.example.com"},
+		"did:plc:b": {"b.example.com"},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Handles mismatch (-want +got):\n%s", diff)
+	}
+
+	n, err := g.RewriteHandles(ctx, map[string]string{
+		"did:plc:a": "a2.example.com",
+		"did:plc:b": "b2.example.com",
+	})
+	if err != nil {
+		t.Fatalf("RewriteHandles: %v", err)
+	}
+	if n != 2 {
+		t.Errorf("RewriteHandles: got %d rows, want 2", n)
+	}
+
+	got, err = g.Handles(ctx)
+	if err != nil {
+		t.Fatalf("Handles: %v", err)
+	}
+	want = map[string][]string{
+		"did:plc:a": {"a2.example.com"},
+		"did:plc:b": {"b2.example.com"},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Handles after rewrite mismatch (-want +got):\n%s", diff)
+	}
+
+	rs, err := g.Search(ctx, ParseQuery("@b2.example.com"))
+	if err != nil || len(rs) != 1 {
+		t.Errorf("Search rewritten mention: got %v, %v", rs, err)
+	}
+}
@@ -0,0 +1,201 @@
+package index
+
+import (
+	"html"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// Match is a range of a record field that matched a query term. Offsets
+// are in bytes like app.bsky.richtext.facet. Index is the position in
+// AltTexts or Links for the "alt" and "title" fields.
+type Match struct {
+	Field     string `json:"field"`
+	Index     int    `json:"index,omitempty"`
+	ByteStart int    `json:"byteStart"`
+	ByteEnd   int    `json:"byteEnd"`
+}
+
+// equalFoldASCII reports whether s and t are equal, ignoring the case of
+// ASCII letters only, as SQLite LIKE does.
+func equalFoldASCII(s, t string) bool {
+	if len(s) != len(t) {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		a, b := s[i], t[i]
+		if 'A' <= a && a <= 'Z' {
+			a += 'a' - 'A'
+		}
+		if 'A' <= b && b <= 'Z' {
+			b += 'a' - 'A'
+		}
+		if a != b {
+			return false
+		}
+	}
+	return true
+}
+
+// findAll returns the merged byte ranges of s that match any of terms,
+// ignoring the case of ASCII letters.
+func findAll(s string, terms []string) [][2]int {
+	var ranges [][2]int
+	for _, term := range terms {
+		if term == "" {
+			continue
+		}
+		for i := range s {
+			j := i + len(term)
+			if j <= len(s) && equalFoldASCII(s[i:j], term) {
+				ranges = append(ranges, [2]int{i, j})
+			}
+		}
+	}
+	if len(ranges) == 0 {
+		return nil
+	}
+
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i][0] < ranges[j][0] })
+	merged := ranges[:1]
+	for _, r := range ranges[1:] {
+		last := &merged[len(merged)-1]
+		if r[0] <= last[1] {
+			if r[1] > last[1] {
+				last[1] = r[1]
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// Highlight returns the ranges of rec that match the text, tag and
+// mention terms of q. As with Search, only the case of ASCII letters is
+// ignored.
+func Highlight(rec *Record, q *Query) []*Match {
+	textTerms := append([]string(nil), q.Text...)
+	for _, tag := range q.Tags {
+		textTerms = append(textTerms, "#"+tag)
+	}
+	for _, handle := range q.Mentions {
+		textTerms = append(textTerms, "@"+handle)
+	}
+
+	var matches []*Match
+	add := func(field string, index int, s string, terms []string) {
+		for _, r := range findAll(s, terms) {
+			matches = append(matches, &Match{
+				Field:     field,
+				Index:     index,
+				ByteStart: r[0],
+				ByteEnd:   r[1],
+			})
+		}
+	}
+
+	add("text", 0, rec.Text, textTerms)
+	if rec.EmbedPostText != nil {
+		add("quote", 0, *rec.EmbedPostText, q.Text)
+	}
+	for i, alt := range rec.AltTexts {
+		add("alt", i, alt.Text, q.Text)
+	}
+	for i, link := range rec.Links {
+		if link.Title != nil {
+			add("title", i, *link.Title, q.Text)
+		}
+	}
+
+	return matches
+}
+
+func fieldText(rec *Record, m *Match) string {
+	switch m.Field {
+	case "text":
+		return rec.Text
+	case "quote":
+		if rec.EmbedPostText != nil {
+			return *rec.EmbedPostText
+		}
+	case "alt":
+		if m.Index < len(rec.AltTexts) {
+			return rec.AltTexts[m.Index].Text
+		}
+	case "title":
+		if m.Index < len(rec.Links) && rec.Links[m.Index].Title != nil {
+			return *rec.Links[m.Index].Title
+		}
+	}
+	return ""
+}
+
+// Snippet returns an HTML escaped excerpt of about width characters
+// around the first match, with matches wrapped in <mark>. Matches in the
+// post text are preferred over matches in embeds.
+func Snippet(rec *Record, matches []*Match, width int) string {
+	if len(matches) == 0 {
+		return truncate(rec.Text, width)
+	}
+
+	first := matches[0]
+	for _, m := range matches {
+		if m.Field == "text" {
+			first = m
+			break
+		}
+	}
+	s := fieldText(rec, first)
+
+	// Start a fifth of the width before the first match, on a rune boundary.
+	start := first.ByteStart
+	for n := 0; n < width/5 && start > 0; n++ {
+		_, size := utf8.DecodeLastRuneInString(s[:start])
+		start -= size
+	}
+	end := start
+	for n := 0; n < width && end < len(s); n++ {
+		_, size := utf8.DecodeRuneInString(s[end:])
+		end += size
+	}
+
+	var b strings.Builder
+	if start > 0 {
+		b.WriteString("…")
+	}
+	pos := start
+	for _, m := range matches {
+		if m.Field != first.Field || m.Index != first.Index {
+			continue
+		}
+		if m.ByteEnd <= pos || m.ByteStart >= end {
+			continue
+		}
+		ms, me := max(m.ByteStart, pos), min(m.ByteEnd, end)
+		b.WriteString(html.EscapeString(s[pos:ms]))
+		b.WriteString("<mark>")
+		b.WriteString(html.EscapeString(s[ms:me]))
+		b.WriteString("</mark>")
+		pos = me
+	}
+	b.WriteString(html.EscapeString(s[pos:end]))
+	if end < len(s) {
+		b.WriteString("…")
+	}
+
+	return b.String()
+}
+
+func truncate(s string, width int) string {
+	end := 0
+	for n := 0; n < width && end < len(s); n++ {
+		_, size := utf8.DecodeRuneInString(s[end:])
+		end += size
+	}
+	if end < len(s) {
+		return html.EscapeString(s[:end]) + "…"
+	}
+	return html.EscapeString(s)
+}
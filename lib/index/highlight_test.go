@@ -0,0 +1,57 @@
+package index
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestHighlight(t *testing.T) {
+	title := "Go Blog"
+	rec := &Record{
+		Text: "Hello <Go> 言語と go と #GoLang",
+		AltTexts: []RecordAltText{
+			{Kind: "image", Text: "a gopher"},
+		},
+		Links: []RecordLink{
+			{Uri: "https://go.dev/blog", Title: &title},
+		},
+	}
+
+	matches := Highlight(rec, ParseQuery("go 言語 #golang"))
+	expected := []*Match{
+		{Field: "text", ByteStart: 7, ByteEnd: 9},
+		{Field: "text", ByteStart: 11, ByteEnd: 17},
+		{Field: "text", ByteStart: 21, ByteEnd: 23},
+		{Field: "text", ByteStart: 28, ByteEnd: 35},
+		{Field: "alt", ByteStart: 2, ByteEnd: 4},
+		{Field: "title", ByteStart: 0, ByteEnd: 2},
+	}
+	if diff := cmp.Diff(expected, matches); diff != "" {
+		t.Errorf("Highlight mismatch (-want +got):\n%s", diff)
+	}
+
+	// As with SQLite LIKE, only ASCII letters are case folded.
+	if got := Highlight(&Record{Text: "Ärger und ärger"}, ParseQuery("ärger")); len(got) != 1 || got[0].ByteStart != 11 {
+		t.Errorf("Highlight of non-ASCII letters: got %+v", got)
+	}
+
+	snippet := Snippet(rec, matches, 100)
+	want := "Hello &lt;<mark>Go</mark>&gt; <mark>言語</mark>と <mark>go</mark> と <mark>#GoLang</mark>"
+	if snippet != want {
+		t.Errorf("Snippet: want %q, got %q", want, snippet)
+	}
+}
+
+func TestSnippet_window(t *testing.T) {
+	rec := &Record{
+		Text: "ああああああああああああああああああああ猫いいいいいいいいいいいいいいいいいいいい",
+	}
+
+	matches := Highlight(rec, ParseQuery("猫"))
+	snippet := Snippet(rec, matches, 10)
+	want := "…ああ<mark>猫</mark>いいいいいいい…"
+	if snippet != want {
+		t.Errorf("Snippet: want %q, got %q", want, snippet)
+	}
+}
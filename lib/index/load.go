@@ -0,0 +1,125 @@
+package index
+
+import (
+	"context"
+	"fmt"
+
+	"gorm.io/gorm"
+
+	"github.com/bluesky-social/indigo/api/bsky"
+
+	"github.com/yunomu/bskylog/lib/storage"
+)
+
+type LoadStats struct {
+	Keys    int
+	Posts   int
+	Skipped int
+}
+
+type loadEntry struct {
+	key      string
+	position int
+	post     *bsky.FeedDefs_FeedViewPost
+}
+
+// Load puts every post of scanner into the index in transactions of
+// batchSize posts. Posts that cannot be indexed and duplicated CIDs are
+// skipped. progress is called after each committed batch.
+func (s *Gorm) Load(ctx context.Context, scanner storage.Scanner, batchSize int, progress func(*LoadStats)) (*LoadStats, error) {
+	if s.readOnly {
+		return nil, ErrReadOnly
+	}
+	if batchSize <= 0 {
+		batchSize = 1
+	}
+	if progress == nil {
+		progress = func(*LoadStats) {}
+	}
+
+	stats := &LoadStats{}
+	seen := make(map[string]bool)
+	var lastKey string
+	var batch []*loadEntry
+
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+			for _, e := range batch {
+				rec := ToRecord(e.key, e.position, e.post)
+				rec.Terms = recordTerms(rec)
+				if err := tx.Create(rec).Error; err != nil {
+					s.logger.Error("failed to put record into database", "key", e.key, "cid", rec.Cid, "err", err)
+					return err
+				}
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		stats.Posts += len(batch)
+		batch = batch[:0]
+		progress(stats)
+		return nil
+	}
+
+	if err := scanner.Scan(ctx, func(key string, position int, post *bsky.FeedDefs_FeedViewPost) error {
+		if key != lastKey {
+			stats.Keys++
+			lastKey = key
+		}
+
+		rec := ToRecord(key, position, post)
+		if rec == nil || seen[rec.Cid] {
+			s.logger.Warn("skip post", "key", key, "position", position)
+			stats.Skipped++
+			return nil
+		}
+		seen[rec.Cid] = true
+
+		batch = append(batch, &loadEntry{key: key, position: position, post: post})
+		if len(batch) >= batchSize {
+			return flush()
+		}
+		return nil
+	}); err != nil {
+		s.logger.Error("failed to scan posts", "err", err)
+		return stats, err
+	}
+
+	if err := flush(); err != nil {
+		return stats, err
+	}
+
+	return stats, nil
+}
+
+// Validate checks the integrity and schema of the index and that it holds
+// the expected number of posts.
+func (s *Gorm) Validate(ctx context.Context, expectedPosts int) error {
+	db := s.db.WithContext(ctx)
+
+	var result string
+	if err := db.Raw("PRAGMA integrity_check").Scan(&result).Error; err != nil {
+		return err
+	}
+	if result != "ok" {
+		return fmt.Errorf("integrity check failed: %s", result)
+	}
+
+	if err := checkReadable(ctx, db); err != nil {
+		return err
+	}
+
+	var count int64
+	if err := db.Model(&Record{}).Count(&count).Error; err != nil {
+		return err
+	}
+	if int(count) != expectedPosts {
+		return fmt.Errorf("unexpected number of posts: expected=%d actual=%d", expectedPosts, count)
+	}
+
+	return nil
+}
@@ -0,0 +1,65 @@
+package index
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/bluesky-social/indigo/api/bsky"
+)
+
+type sliceScanner []struct {
+	key  string
+	post string
+}
+
+func (s sliceScanner) Scan(ctx context.Context, f func(key string, position int, post *bsky.FeedDefs_FeedViewPost) error) error {
+	positions := make(map[string]int)
+	for _, e := range s {
+		var post bsky.FeedDefs_FeedViewPost
+		if err := json.Unmarshal([]byte(e.post), &post); err != nil {
+			return err
+		}
+		if err := f(e.key, positions[e.key], &post); err != nil {
+			return err
+		}
+		positions[e.key]++
+	}
+	return nil
+}
+
+func TestGorm_Load(t *testing.T) {
+	ctx := context.Background()
+	g := newTestGorm(t)
+
+	post := func(cid string) string {
+		return fmt.Sprintf(`{"post":{"author":{"did":"did:plc:a","handle":"a.example.com"},"cid":%q,"record":{"$type":"app.bsky.feed.post","createdAt":"2026-01-01T00:00:00Z","text":"hello"}}}`, cid)
+	}
+	scanner := sliceScanner{
+		{"k/2026/01/01", post("cid1")},
+		{"k/2026/01/01", post("cid2")},
+		{"k/2026/01/02", post("cid3")},
+		{"k/2026/01/02", post("cid1")}, // duplicated
+		{"k/2026/01/02", `{}`},         // not a post
+	}
+
+	var batches int
+	stats, err := g.Load(ctx, scanner, 2, func(*LoadStats) { batches++ })
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if *stats != (LoadStats{Keys: 2, Posts: 3, Skipped: 2}) {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+	if batches != 2 {
+		t.Errorf("batches: want 2, got %d", batches)
+	}
+
+	if err := g.Validate(ctx, 3); err != nil {
+		t.Errorf("Validate: %v", err)
+	}
+	if err := g.Validate(ctx, 4); err == nil {
+		t.Errorf("Validate: expected error for wrong count")
+	}
+}
@@ -0,0 +1,341 @@
+package index
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+var (
+	// ErrSchemaTooNew is returned when the index was written by a newer
+	// version of this package and cannot be used safely.
+	ErrSchemaTooNew = errors.New("index schema is newer than supported")
+
+	// ErrSchemaOutdated is returned by a read-only Gorm when the index
+	// needs migrations that it is not allowed to apply.
+	ErrSchemaOutdated = errors.New("index schema is outdated")
+)
+
+// schemaVersion is the single row table that records which migrations
+// have been applied to an index file.
+type schemaVersion struct {
+	ID      int `gorm:"primaryKey"`
+	Version int
+	// ReadCompatVersion is the oldest schema version whose readers can
+	// still read this file.
+	ReadCompatVersion int
+	UpdatedAt         time.Time
+}
+
+func (schemaVersion) TableName() string { return "schema_version" }
+
+type migration struct {
+	version int
+	name    string
+	// readCompat is true when readers built for the previous version can
+	// still read the schema after this step (e.g. only columns were added).
+	readCompat bool
+	up         func(tx *gorm.DB) error
+}
+
+// recordV1 is the records table as created by the original AutoMigrate.
+// Migration models are frozen so that later changes to Record do not
+// change what earlier steps do.
+type recordV1 struct {
+	Cid       string `gorm:"primaryKey"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	DeletedAt gorm.DeletedAt `gorm:"index"`
+
+	Text      string
+	Timestamp int64
+
+	Did    string
+	Handle string
+	Name   string
+
+	ReplyParentHandle *string
+	ReplyParentDid    *string
+	ReplyParentName   *string
+
+	Embed           string
+	EmbedPostHandle *string
+	EmbedPostDid    *string
+	EmbedPostName   *string
+
+	Key      string
+	Position int32
+}
+
+func (recordV1) TableName() string { return "records" }
+
+// recordV2 adds the quoted post text to records.
+type recordV2 struct {
+	EmbedPostText *string
+}
+
+func (recordV2) TableName() string { return "records" }
+
+type recordTagV2 struct {
+	ID        uint   `gorm:"primaryKey"`
+	RecordCid string `gorm:"index"`
+	Tag       string `gorm:"index"`
+}
+
+func (recordTagV2) TableName() string { return "record_tags" }
+
+type recordMentionV2 struct {
+	ID        uint   `gorm:"primaryKey"`
+	RecordCid string `gorm:"index"`
+	Did       string `gorm:"index"`
+	Handle    string `gorm:"index"`
+}
+
+func (recordMentionV2) TableName() string { return "record_mentions" }
+
+type recordLinkV2 struct {
+	ID        uint   `gorm:"primaryKey"`
+	RecordCid string `gorm:"index"`
+	Uri       string
+	Domain    string `gorm:"index"`
+	Title     *string
+}
+
+func (recordLinkV2) TableName() string { return "record_links" }
+
+type recordLangV2 struct {
+	ID        uint   `gorm:"primaryKey"`
+	RecordCid string `gorm:"index"`
+	Lang      string `gorm:"index"`
+}
+
+func (recordLangV2) TableName() string { return "record_langs" }
+
+type recordAltTextV2 struct {
+	ID        uint   `gorm:"primaryKey"`
+	RecordCid string `gorm:"index"`
+	Kind      string
+	Text      string
+}
+
+func (recordAltTextV2) TableName() string { return "record_alt_texts" }
+
+type recordTermV3 struct {
+	ID        uint   `gorm:"primaryKey"`
+	RecordCid string `gorm:"index"`
+	Term      string `gorm:"index"`
+	Tf        int
+}
+
+func (recordTermV3) TableName() string { return "record_terms" }
+
+// recordV4 adds the like count of posts at the time they were crawled.
+type recordV4 struct {
+	LikeCount int64 `gorm:"index"`
+}
+
+func (recordV4) TableName() string { return "records" }
+
+// recordV5 adds the AT-URI and record key of posts.
+type recordV5 struct {
+	Uri  string `gorm:"index"`
+	Rkey string `gorm:"index"`
+}
+
+func (recordV5) TableName() string { return "records" }
+
+// addColumns adds the fields of model that records does not have yet.
+func addColumns(tx *gorm.DB, model interface{}, fields ...string) error {
+	migrator := tx.Migrator()
+	for _, field := range fields {
+		if migrator.HasColumn(model, field) {
+			continue
+		}
+		if err := migrator.AddColumn(model, field); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrations must be ordered by version and never be edited once released.
+var migrations = []*migration{
+	{
+		version: 1,
+		name:    "create records",
+		up: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&recordV1{})
+		},
+	},
+	{
+		// Posts indexed before this version have no facets until the
+		// index is rebuilt.
+		version:    2,
+		name:       "add facets",
+		readCompat: true,
+		up: func(tx *gorm.DB) error {
+			if err := addColumns(tx, &recordV2{}, "EmbedPostText"); err != nil {
+				return err
+			}
+			return tx.AutoMigrate(
+				&recordTagV2{},
+				&recordMentionV2{},
+				&recordLinkV2{},
+				&recordLangV2{},
+				&recordAltTextV2{},
+			)
+		},
+	},
+	{
+		// Posts indexed before this version have no terms, and are
+		// missing from related posts, until the index is rebuilt.
+		version:    3,
+		name:       "add terms",
+		readCompat: true,
+		up: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&recordTermV3{})
+		},
+	},
+	{
+		// Posts indexed before this version have no like count until the
+		// index is rebuilt.
+		version:    4,
+		name:       "add like counts",
+		readCompat: true,
+		up: func(tx *gorm.DB) error {
+			if err := addColumns(tx, &recordV4{}, "LikeCount"); err != nil {
+				return err
+			}
+			if tx.Migrator().HasIndex(&recordV4{}, "LikeCount") {
+				return nil
+			}
+			return tx.Migrator().CreateIndex(&recordV4{}, "LikeCount")
+		},
+	},
+	{
+		// Posts indexed before this version cannot be looked up by URI
+		// until the index is rebuilt.
+		version:    5,
+		name:       "add post uris",
+		readCompat: true,
+		up: func(tx *gorm.DB) error {
+			if err := addColumns(tx, &recordV5{}, "Uri", "Rkey"); err != nil {
+				return err
+			}
+			for _, field := range []string{"Uri", "Rkey"} {
+				if tx.Migrator().HasIndex(&recordV5{}, field) {
+					continue
+				}
+				if err := tx.Migrator().CreateIndex(&recordV5{}, field); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+}
+
+// CurrentSchemaVersion is the schema version this package reads and writes.
+var CurrentSchemaVersion = migrations[len(migrations)-1].version
+
+// GetSchemaVersion returns the schema version and the read compatible
+// version of the index. Files written before schema versioning was
+// introduced report version 1 if they have a records table, 0 otherwise.
+func GetSchemaVersion(ctx context.Context, db *gorm.DB) (version int, readCompat int, err error) {
+	db = db.WithContext(ctx)
+	migrator := db.Migrator()
+	if !migrator.HasTable(&schemaVersion{}) {
+		if migrator.HasTable(&recordV1{}) {
+			return 1, 1, nil
+		}
+		return 0, 0, nil
+	}
+
+	var sv schemaVersion
+	if err := db.Limit(1).Find(&sv).Error; err != nil {
+		return 0, 0, err
+	}
+	return sv.Version, sv.ReadCompatVersion, nil
+}
+
+// Migrate applies all pending migrations in order, each in its own
+// transaction. It returns ErrSchemaTooNew if the index was written by a
+// newer version.
+func Migrate(ctx context.Context, db *gorm.DB, logger *slog.Logger) error {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	db = db.WithContext(ctx)
+
+	version, readCompat, err := GetSchemaVersion(ctx, db)
+	if err != nil {
+		logger.Error("failed to get schema version", "err", err)
+		return err
+	}
+	if version > CurrentSchemaVersion {
+		logger.Error("index schema is newer than supported", "version", version, "supported", CurrentSchemaVersion)
+		return ErrSchemaTooNew
+	}
+
+	legacy := !db.Migrator().HasTable(&schemaVersion{})
+	if err := db.AutoMigrate(&schemaVersion{}); err != nil {
+		logger.Error("failed to create schema_version table", "err", err)
+		return err
+	}
+
+	for _, m := range migrations {
+		if m.version <= version {
+			continue
+		}
+
+		if !m.readCompat {
+			readCompat = m.version
+		}
+		if err := db.Transaction(func(tx *gorm.DB) error {
+			if err := m.up(tx); err != nil {
+				return err
+			}
+			return tx.Save(&schemaVersion{
+				ID:                1,
+				Version:           m.version,
+				ReadCompatVersion: readCompat,
+			}).Error
+		}); err != nil {
+			logger.Error("failed to apply migration", "version", m.version, "name", m.name, "err", err)
+			return err
+		}
+		version = m.version
+
+		logger.Info("applied migration", "version", m.version, "name", m.name)
+	}
+
+	if legacy {
+		// Files written before schema versioning have no row yet.
+		return db.Save(&schemaVersion{
+			ID:                1,
+			Version:           version,
+			ReadCompatVersion: readCompat,
+		}).Error
+	}
+
+	return nil
+}
+
+// checkReadable reports whether a reader for CurrentSchemaVersion can read
+// the index without migrating it.
+func checkReadable(ctx context.Context, db *gorm.DB) error {
+	version, readCompat, err := GetSchemaVersion(ctx, db)
+	if err != nil {
+		return err
+	}
+	switch {
+	case version < CurrentSchemaVersion:
+		return ErrSchemaOutdated
+	case version > CurrentSchemaVersion && readCompat > CurrentSchemaVersion:
+		return ErrSchemaTooNew
+	}
+	return nil
+}
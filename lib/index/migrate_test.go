@@ -0,0 +1,127 @@
+package index
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+	gormlogger "gorm.io/gorm/logger"
+)
+
+func openTestDB(t *testing.T, dsn string) *gorm.DB {
+	t.Helper()
+
+	db, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{
+		Logger: gormlogger.Default.LogMode(gormlogger.Silent),
+	})
+	if err != nil {
+		t.Fatalf("gorm.Open: %v", err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatalf("db.DB: %v", err)
+	}
+	t.Cleanup(func() { sqlDB.Close() })
+
+	return db
+}
+
+func TestMigrate_fresh(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t, filepath.Join(t.TempDir(), "index"))
+
+	if _, err := NewGorm(ctx, db); err != nil {
+		t.Fatalf("NewGorm: %v", err)
+	}
+
+	version, readCompat, err := GetSchemaVersion(ctx, db)
+	if err != nil {
+		t.Fatalf("GetSchemaVersion: %v", err)
+	}
+	if version != CurrentSchemaVersion {
+		t.Errorf("version: want %d, got %d", CurrentSchemaVersion, version)
+	}
+	if readCompat < 1 || readCompat > version {
+		t.Errorf("readCompat out of range: %d", readCompat)
+	}
+}
+
+func TestMigrate_legacy(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t, filepath.Join(t.TempDir(), "index"))
+
+	// Files written before versioning only have the records table.
+	if err := db.AutoMigrate(&recordV1{}); err != nil {
+		t.Fatalf("AutoMigrate: %v", err)
+	}
+
+	if err := Migrate(ctx, db, nil); err != nil {
+		t.Fatalf("Migrate: %v", err)
+	}
+
+	version, _, err := GetSchemaVersion(ctx, db)
+	if err != nil {
+		t.Fatalf("GetSchemaVersion: %v", err)
+	}
+	if version != CurrentSchemaVersion {
+		t.Errorf("version: want %d, got %d", CurrentSchemaVersion, version)
+	}
+}
+
+func TestNewGorm_readOnly(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "index")
+	db := openTestDB(t, path)
+
+	if err := Migrate(ctx, db, nil); err != nil {
+		t.Fatalf("Migrate: %v", err)
+	}
+
+	ro := openTestDB(t, "file:"+path+"?mode=ro")
+	g, err := NewGorm(ctx, ro, GormOptionReadOnly())
+	if err != nil {
+		t.Fatalf("NewGorm(read only): %v", err)
+	}
+	if err := g.Put(ctx, "key", 0, nil); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Put: want ErrReadOnly, got %v", err)
+	}
+
+	// A compatible newer schema can still be read.
+	if err := db.Save(&schemaVersion{
+		ID:                1,
+		Version:           CurrentSchemaVersion + 1,
+		ReadCompatVersion: CurrentSchemaVersion,
+	}).Error; err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if _, err := NewGorm(ctx, ro, GormOptionReadOnly()); err != nil {
+		t.Errorf("NewGorm(compatible newer schema): %v", err)
+	}
+
+	// An incompatible newer schema is refused by readers and writers.
+	if err := db.Save(&schemaVersion{
+		ID:                1,
+		Version:           CurrentSchemaVersion + 1,
+		ReadCompatVersion: CurrentSchemaVersion + 1,
+	}).Error; err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if _, err := NewGorm(ctx, ro, GormOptionReadOnly()); !errors.Is(err, ErrSchemaTooNew) {
+		t.Errorf("NewGorm(read only): want ErrSchemaTooNew, got %v", err)
+	}
+	if _, err := NewGorm(ctx, db); !errors.Is(err, ErrSchemaTooNew) {
+		t.Errorf("NewGorm: want ErrSchemaTooNew, got %v", err)
+	}
+}
+
+func TestNewGorm_readOnlyOutdated(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t, filepath.Join(t.TempDir(), "index"))
+
+	if _, err := NewGorm(ctx, db, GormOptionReadOnly()); !errors.Is(err, ErrSchemaOutdated) {
+		t.Errorf("NewGorm: want ErrSchemaOutdated, got %v", err)
+	}
+}
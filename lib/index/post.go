@@ -0,0 +1,68 @@
+package index
+
+import (
+	"context"
+	"strings"
+	"time"
+)
+
+const postCollection = "app.bsky.feed.post"
+
+// PostURI returns the AT-URI of the post rkey of did.
+func PostURI(did, rkey string) string {
+	return "at://" + did + "/" + postCollection + "/" + rkey
+}
+
+// ParsePostURI returns the repository and the record key of a post AT-URI.
+func ParsePostURI(uri string) (string, string, bool) {
+	rest, ok := strings.CutPrefix(uri, "at://")
+	if !ok {
+		return "", "", false
+	}
+	parts := strings.Split(rest, "/")
+	if len(parts) != 3 || parts[0] == "" || parts[1] != postCollection || parts[2] == "" {
+		return "", "", false
+	}
+	return parts[0], parts[2], true
+}
+
+const tidAlphabet = "234567abcdefghijklmnopqrstuvwxyz"
+
+// TIDTime returns the time encoded in a record key that is a TID. Posts
+// are usually created with TIDs of their creation time, but this is not
+// guaranteed, so the time is only a hint.
+func TIDTime(rkey string) (time.Time, bool) {
+	if len(rkey) != 13 {
+		return time.Time{}, false
+	}
+	var v uint64
+	for _, c := range rkey {
+		i := strings.IndexRune(tidAlphabet, c)
+		if i < 0 {
+			return time.Time{}, false
+		}
+		v = v<<5 | uint64(i)
+	}
+	if v>>63 != 0 {
+		return time.Time{}, false
+	}
+	return time.UnixMicro(int64(v >> 10)), true
+}
+
+// FindByURI returns the location of the post with the AT-URI, or
+// ErrNotFound.
+func (s *Gorm) FindByURI(ctx context.Context, uri string) (*SearchResult, error) {
+	var records []Record
+	if err := s.db.WithContext(ctx).
+		Select("key", "position").
+		Where("uri = ?", uri).
+		Limit(1).
+		Find(&records).Error; err != nil {
+		s.logger.Error("failed to find record by uri", "uri", uri, "err", err)
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, ErrNotFound
+	}
+	return &SearchResult{Key: records[0].Key, Position: int(records[0].Position)}, nil
+}
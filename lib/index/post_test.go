@@ -0,0 +1,62 @@
+package index
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestParsePostURI(t *testing.T) {
+	tests := []struct {
+		uri       string
+		did, rkey string
+		ok        bool
+	}{
+		{"at://did:plc:a/app.bsky.feed.post/3mgkblzv6gk2r", "did:plc:a", "3mgkblzv6gk2r", true},
+		{"at://did:plc:a/app.bsky.feed.like/3mgkblzv6gk2r", "", "", false},
+		{"at://did:plc:a/app.bsky.feed.post/", "", "", false},
+		{"https://bsky.app/profile/a.example.com/post/3mgkblzv6gk2r", "", "", false},
+	}
+	for _, tt := range tests {
+		did, rkey, ok := ParsePostURI(tt.uri)
+		if did != tt.did || rkey != tt.rkey || ok != tt.ok {
+			t.Errorf("ParsePostURI(%s): got %s %s %v", tt.uri, did, rkey, ok)
+		}
+	}
+}
+
+func TestTIDTime(t *testing.T) {
+	// Created at 2026-03-08T11:50:19.803Z.
+	got, ok := TIDTime("3mgkblzv6gk2r")
+	want := time.Date(2026, 3, 8, 11, 50, 19, 803000000, time.UTC)
+	if d := got.Sub(want); !ok || d < -time.Second || d > time.Second {
+		t.Errorf("TIDTime: got %v %v, want about %v", got, ok, want)
+	}
+
+	for _, rkey := range []string{"self", "3mgkblzv6gk2!", "zzzzzzzzzzzzz"} {
+		if _, ok := TIDTime(rkey); ok {
+			t.Errorf("TIDTime(%s): want not ok", rkey)
+		}
+	}
+}
+
+func TestGorm_FindByURI(t *testing.T) {
+	ctx := context.Background()
+	g := newTestGorm(t)
+
+	putTestPost(t, g, "k/2026/01/01", 0, `{"post":{"author":{"did":"did:plc:a","handle":"a.example.com"},"cid":"cid1","uri":"at://did:plc:a/app.bsky.feed.post/rkey1","record":{"$type":"app.bsky.feed.post","createdAt":"2026-01-01T00:00:00Z","text":"hello"}}}`)
+	putTestPost(t, g, "k/2026/01/01", 1, `{"post":{"author":{"did":"did:plc:a","handle":"a.example.com"},"cid":"cid2","uri":"at://did:plc:a/app.bsky.feed.post/rkey2","record":{"$type":"app.bsky.feed.post","createdAt":"2026-01-01T01:00:00Z","text":"world"}}}`)
+
+	got, err := g.FindByURI(ctx, PostURI("did:plc:a", "rkey2"))
+	if err != nil {
+		t.Fatalf("FindByURI: %v", err)
+	}
+	if got.Key != "k/2026/01/01" || got.Position != 1 {
+		t.Errorf("FindByURI: got %+v", got)
+	}
+
+	if _, err := g.FindByURI(ctx, PostURI("did:plc:a", "missing")); !errors.Is(err, ErrNotFound) {
+		t.Errorf("FindByURI(missing): want ErrNotFound, got %v", err)
+	}
+}
@@ -0,0 +1,102 @@
+package index
+
+import (
+	"strings"
+)
+
+type Query struct {
+	Text     []string
+	Tags     []string
+	Mentions []string
+	Langs    []string
+	Domains  []string
+
+	// From and To are the accounts, by handle or DID, that posted or were
+	// replied to.
+	From []string
+	To   []string
+
+	// Aliases maps a handle or a DID of From and To to the other handles
+	// and DIDs of the account, so that posts from before a handle change
+	// match.
+	Aliases map[string][]string
+
+	// Since and Until bound the post timestamps, in unix microseconds.
+	// Zero means unbounded. They narrow a search but are not terms.
+	Since int64
+	Until int64
+}
+
+// ParseQuery splits a search string into terms. Terms of the form
+// `#tag`, `@handle`, `lang:ja` and `domain:example.com` match facets,
+// `from:handle` and `to:handle` match the author and the reply parent,
+// everything else matches the text of the post and its embeds.
+func ParseQuery(s string) *Query {
+	q := &Query{}
+	for _, term := range strings.Fields(s) {
+		switch {
+		case len(term) > 1 && strings.HasPrefix(term, "#"):
+			q.Tags = append(q.Tags, NormalizeTag(term))
+		case len(term) > 1 && strings.HasPrefix(term, "@"):
+			q.Mentions = append(q.Mentions, NormalizeHandle(term))
+		case len(term) > len("lang:") && strings.HasPrefix(term, "lang:"):
+			q.Langs = append(q.Langs, strings.ToLower(strings.TrimPrefix(term, "lang:")))
+		case len(term) > len("domain:") && strings.HasPrefix(term, "domain:"):
+			q.Domains = append(q.Domains, NormalizeDomain(strings.TrimPrefix(term, "domain:")))
+		case len(term) > len("from:") && strings.HasPrefix(term, "from:"):
+			q.From = append(q.From, NormalizeAccount(strings.TrimPrefix(term, "from:")))
+		case len(term) > len("to:") && strings.HasPrefix(term, "to:"):
+			q.To = append(q.To, NormalizeAccount(strings.TrimPrefix(term, "to:")))
+		default:
+			q.Text = append(q.Text, term)
+		}
+	}
+	return q
+}
+
+func (q *Query) IsEmpty() bool {
+	return len(q.Text) == 0 &&
+		len(q.Tags) == 0 &&
+		len(q.Mentions) == 0 &&
+		len(q.Langs) == 0 &&
+		len(q.Domains) == 0 &&
+		len(q.From) == 0 &&
+		len(q.To) == 0
+}
+
+// Accounts returns the handles and DIDs of From and To.
+func (q *Query) Accounts() []string {
+	return append(append([]string(nil), q.From...), q.To...)
+}
+
+// AddAlias records alias as another handle or DID of account.
+func (q *Query) AddAlias(account, alias string) {
+	alias = NormalizeAccount(alias)
+	if alias == "" || alias == account {
+		return
+	}
+	for _, a := range q.Aliases[account] {
+		if a == alias {
+			return
+		}
+	}
+	if q.Aliases == nil {
+		q.Aliases = make(map[string][]string)
+	}
+	q.Aliases[account] = append(q.Aliases[account], alias)
+}
+
+// aliases returns account and its aliases.
+func (q *Query) aliases(account string) []string {
+	return append([]string{account}, q.Aliases[account]...)
+}
+
+// NormalizeAccount normalizes a handle like NormalizeHandle and keeps a
+// DID as is.
+func NormalizeAccount(s string) string {
+	s = strings.TrimPrefix(strings.TrimSpace(s), "@")
+	if strings.HasPrefix(s, "did:") {
+		return s
+	}
+	return NormalizeHandle(s)
+}
@@ -1,6 +1,8 @@
 package index
 
 import (
+	"net/url"
+	"strings"
 	"time"
 
 	"gorm.io/gorm"
@@ -14,6 +16,10 @@ type Record struct {
 	UpdatedAt time.Time
 	DeletedAt gorm.DeletedAt `gorm:"index"`
 
+	// Uri is the AT-URI of the post and Rkey its record key.
+	Uri  string `gorm:"index"`
+	Rkey string `gorm:"index"`
+
 	Text      string
 	Timestamp int64
 
@@ -29,9 +35,63 @@ type Record struct {
 	EmbedPostHandle *string
 	EmbedPostDid    *string
 	EmbedPostName   *string
+	EmbedPostText   *string
 
 	Key      string
 	Position int32
+
+	// LikeCount is the like count when the post was crawled.
+	LikeCount int64 `gorm:"index"`
+
+	Tags     []RecordTag     `gorm:"foreignKey:RecordCid"`
+	Mentions []RecordMention `gorm:"foreignKey:RecordCid"`
+	Links    []RecordLink    `gorm:"foreignKey:RecordCid"`
+	Langs    []RecordLang    `gorm:"foreignKey:RecordCid"`
+	AltTexts []RecordAltText `gorm:"foreignKey:RecordCid"`
+
+	// Terms is filled by Put, not by ToRecord.
+	Terms []RecordTerm `gorm:"foreignKey:RecordCid"`
+}
+
+// RecordTag is a hashtag of a post, from tag facets and the post's tags.
+// Tag is lower case without the leading '#'.
+type RecordTag struct {
+	ID        uint   `gorm:"primaryKey"`
+	RecordCid string `gorm:"index"`
+	Tag       string `gorm:"index"`
+}
+
+// RecordMention is a mention facet. Handle is taken from the mentioned
+// text and is lower case without the leading '@'.
+type RecordMention struct {
+	ID        uint   `gorm:"primaryKey"`
+	RecordCid string `gorm:"index"`
+	Did       string `gorm:"index"`
+	Handle    string `gorm:"index"`
+}
+
+// RecordLink is a link facet or an external embed. Title is set only for
+// external embeds.
+type RecordLink struct {
+	ID        uint   `gorm:"primaryKey"`
+	RecordCid string `gorm:"index"`
+	Uri       string
+	Domain    string `gorm:"index"`
+	Title     *string
+}
+
+type RecordLang struct {
+	ID        uint   `gorm:"primaryKey"`
+	RecordCid string `gorm:"index"`
+	Lang      string `gorm:"index"`
+}
+
+// RecordAltText is the alt text of an embedded image or video.
+type RecordAltText struct {
+	ID        uint   `gorm:"primaryKey"`
+	RecordCid string `gorm:"index"`
+	Kind      string
+	Text      string
 }
 
 func ToRecord(key string, position int, post *bsky.FeedDefs_FeedViewPost) *Record {
@@ -46,6 +106,13 @@ func ToRecord(key string, position int, post *bsky.FeedDefs_FeedViewPost) *Recor
 	}
 
 	rec.Cid = post.Post.Cid
+	rec.Uri = post.Post.Uri
+	if _, rkey, ok := ParsePostURI(post.Post.Uri); ok {
+		rec.Rkey = rkey
+	}
+	if post.Post.LikeCount != nil {
+		rec.LikeCount = *post.Post.LikeCount
+	}
 	if post.Post.Author != nil {
 		rec.Did = post.Post.Author.Did
 		rec.Handle = post.Post.Author.Handle
@@ -59,6 +126,7 @@ func ToRecord(key string, position int, post *bsky.FeedDefs_FeedViewPost) *Recor
 		if createdAt, err := time.Parse(time.RFC3339, feedPost.CreatedAt); err == nil {
 			rec.Timestamp = createdAt.UnixMicro()
 		}
+		rec.addFacets(feedPost)
 	}
 
 	if post.Reply != nil && post.Reply.Parent != nil && post.Reply.Parent.FeedDefs_PostView != nil {
@@ -75,30 +143,175 @@ func ToRecord(key string, position int, post *bsky.FeedDefs_FeedViewPost) *Recor
 	if post.Post.Embed != nil {
 		if post.Post.Embed.EmbedImages_View != nil {
 			rec.Embed = "image"
+			rec.addImages(post.Post.Embed.EmbedImages_View)
+		} else if post.Post.Embed.EmbedVideo_View != nil {
+			rec.Embed = "video"
+			rec.addVideo(post.Post.Embed.EmbedVideo_View)
 		} else if post.Post.Embed.EmbedExternal_View != nil {
 			rec.Embed = "external"
+			rec.addExternal(post.Post.Embed.EmbedExternal_View)
 		} else if post.Post.Embed.EmbedRecord_View != nil && post.Post.Embed.EmbedRecord_View.Record != nil {
 			rec.Embed = "post"
-
-			r := post.Post.Embed.EmbedRecord_View.Record.EmbedRecord_ViewRecord
-			if r != nil {
-				if r.Author != nil {
-					rec.EmbedPostDid = &r.Author.Did
-					rec.EmbedPostHandle = &r.Author.Handle
-					rec.EmbedPostName = r.Author.DisplayName
-				}
-			}
+			rec.addQuote(post.Post.Embed.EmbedRecord_View)
 		} else if post.Post.Embed.EmbedRecordWithMedia_View != nil {
-			// For now, just record the media type
-			if post.Post.Embed.EmbedRecordWithMedia_View.Media != nil {
-				if post.Post.Embed.EmbedRecordWithMedia_View.Media.EmbedImages_View != nil {
+			v := post.Post.Embed.EmbedRecordWithMedia_View
+			rec.Embed = "post"
+			if v.Media != nil {
+				if v.Media.EmbedImages_View != nil {
 					rec.Embed = "image"
-				} else if post.Post.Embed.EmbedRecordWithMedia_View.Media.EmbedExternal_View != nil {
+					rec.addImages(v.Media.EmbedImages_View)
+				} else if v.Media.EmbedVideo_View != nil {
+					rec.Embed = "video"
+					rec.addVideo(v.Media.EmbedVideo_View)
+				} else if v.Media.EmbedExternal_View != nil {
 					rec.Embed = "external"
+					rec.addExternal(v.Media.EmbedExternal_View)
 				}
 			}
+			rec.addQuote(v.Record)
 		}
 	}
 
 	return rec
 }
+
+func (rec *Record) addFacets(post *bsky.FeedPost) {
+	tags := make(map[string]bool)
+	addTag := func(tag string) {
+		tag = NormalizeTag(tag)
+		if tag == "" || tags[tag] {
+			return
+		}
+		tags[tag] = true
+		rec.Tags = append(rec.Tags, RecordTag{RecordCid: rec.Cid, Tag: tag})
+	}
+
+	for _, facet := range post.Facets {
+		if facet == nil {
+			continue
+		}
+		for _, feature := range facet.Features {
+			if feature == nil {
+				continue
+			}
+			switch {
+			case feature.RichtextFacet_Tag != nil:
+				addTag(feature.RichtextFacet_Tag.Tag)
+			case feature.RichtextFacet_Mention != nil:
+				rec.Mentions = append(rec.Mentions, RecordMention{
+					RecordCid: rec.Cid,
+					Did:       feature.RichtextFacet_Mention.Did,
+					Handle:    NormalizeHandle(facetText(post.Text, facet.Index)),
+				})
+			case feature.RichtextFacet_Link != nil:
+				rec.addLink(feature.RichtextFacet_Link.Uri, nil)
+			}
+		}
+	}
+	for _, tag := range post.Tags {
+		addTag(tag)
+	}
+
+	for _, lang := range post.Langs {
+		if lang == "" {
+			continue
+		}
+		rec.Langs = append(rec.Langs, RecordLang{RecordCid: rec.Cid, Lang: strings.ToLower(lang)})
+	}
+}
+
+// facetText returns the text that a facet annotates, or "" if the byte
+// slice is out of range.
+func facetText(text string, index *bsky.RichtextFacet_ByteSlice) string {
+	if index == nil || index.ByteStart < 0 || index.ByteEnd > int64(len(text)) || index.ByteStart >= index.ByteEnd {
+		return ""
+	}
+	return text[index.ByteStart:index.ByteEnd]
+}
+
+// addLink adds uri unless it is already recorded. A title replaces a
+// missing one, since a link facet and an external embed often share a URI.
+func (rec *Record) addLink(uri string, title *string) {
+	if uri == "" {
+		return
+	}
+	for i := range rec.Links {
+		if rec.Links[i].Uri == uri {
+			if rec.Links[i].Title == nil {
+				rec.Links[i].Title = title
+			}
+			return
+		}
+	}
+
+	var domain string
+	if u, err := url.Parse(uri); err == nil {
+		domain = NormalizeDomain(u.Hostname())
+	}
+	rec.Links = append(rec.Links, RecordLink{
+		RecordCid: rec.Cid,
+		Uri:       uri,
+		Domain:    domain,
+		Title:     title,
+	})
+}
+
+func (rec *Record) addImages(v *bsky.EmbedImages_View) {
+	for _, img := range v.Images {
+		if img == nil || img.Alt == "" {
+			continue
+		}
+		rec.AltTexts = append(rec.AltTexts, RecordAltText{RecordCid: rec.Cid, Kind: "image", Text: img.Alt})
+	}
+}
+
+func (rec *Record) addVideo(v *bsky.EmbedVideo_View) {
+	if v.Alt == nil || *v.Alt == "" {
+		return
+	}
+	rec.AltTexts = append(rec.AltTexts, RecordAltText{RecordCid: rec.Cid, Kind: "video", Text: *v.Alt})
+}
+
+func (rec *Record) addExternal(v *bsky.EmbedExternal_View) {
+	if v.External == nil {
+		return
+	}
+	var title *string
+	if v.External.Title != "" {
+		title = &v.External.Title
+	}
+	rec.addLink(v.External.Uri, title)
+}
+
+func (rec *Record) addQuote(v *bsky.EmbedRecord_View) {
+	if v == nil || v.Record == nil || v.Record.EmbedRecord_ViewRecord == nil {
+		return
+	}
+
+	r := v.Record.EmbedRecord_ViewRecord
+	if r.Author != nil {
+		rec.EmbedPostDid = &r.Author.Did
+		rec.EmbedPostHandle = &r.Author.Handle
+		rec.EmbedPostName = r.Author.DisplayName
+	}
+	if r.Value != nil {
+		if p, ok := r.Value.Val.(*bsky.FeedPost); ok && p != nil {
+			rec.EmbedPostText = &p.Text
+		}
+	}
+}
+
+// NormalizeTag lower-cases a hashtag and strips the leading '#'.
+func NormalizeTag(tag string) string {
+	return strings.ToLower(strings.TrimPrefix(strings.TrimSpace(tag), "#"))
+}
+
+// NormalizeHandle lower-cases a handle and strips the leading '@'.
+func NormalizeHandle(handle string) string {
+	return strings.ToLower(strings.TrimPrefix(strings.TrimSpace(handle), "@"))
+}
+
+// NormalizeDomain lower-cases a host name and strips a leading "www.".
+func NormalizeDomain(domain string) string {
+	return strings.TrimPrefix(strings.ToLower(strings.TrimSpace(domain)), "www.")
+}
@@ -27,6 +27,8 @@ func Test_toRecord(t *testing.T) {
 
 	expected := &Record{
 		Cid:       "bafyreibz3kp63xwcclijfxmb7ddkvkaokmvswrij5ek7f6f4ph6r6lzxaa",
+		Uri:       "at://did:plc:spfskpvcqvyicwe6hn75sr4d/app.bsky.feed.post/3mgkblzv6gk2r",
+		Rkey:      "3mgkblzv6gk2r",
 		Text:      "ノーマルタイプが強すぎるんだよ",
 		Timestamp: ts.UnixMicro(),
 		Did:       "did:plc:spfskpvcqvyicwe6hn75sr4d",
@@ -35,6 +37,9 @@ func Test_toRecord(t *testing.T) {
 		Embed:     "none",
 		Key:       "key",
 		Position:  1,
+		Langs: []RecordLang{
+			{RecordCid: "bafyreibz3kp63xwcclijfxmb7ddkvkaokmvswrij5ek7f6f4ph6r6lzxaa", Lang: "ja"},
+		},
 	}
 
 	if diff := cmp.Diff(expected, rec, cmpopts.IgnoreUnexported(Record{})); diff != "" {
@@ -63,6 +68,8 @@ func Test_toRecord_embed(t *testing.T) {
 
 	expected := &Record{
 		Cid:       "bafyreicvjbfra2ucxpubnnquqg4v67vx66v6o5gysvtjbl7vctxpvoocti",
+		Uri:       "at://did:plc:spfskpvcqvyicwe6hn75sr4d/app.bsky.feed.post/3mgkdnr2zmc2d",
+		Rkey:      "3mgkdnr2zmc2d",
 		Text:      "ｳﾋｮｰ",
 		Timestamp: ts.UnixMicro(),
 		Did:       "did:plc:spfskpvcqvyicwe6hn75sr4d",
@@ -71,6 +78,12 @@ func Test_toRecord_embed(t *testing.T) {
 		Embed:     "image",
 		Key:       "key",
 		Position:  1,
+		Langs: []RecordLang{
+			{RecordCid: "bafyreicvjbfra2ucxpubnnquqg4v67vx66v6o5gysvtjbl7vctxpvoocti", Lang: "ja"},
+		},
+		AltTexts: []RecordAltText{
+			{RecordCid: "bafyreicvjbfra2ucxpubnnquqg4v67vx66v6o5gysvtjbl7vctxpvoocti", Kind: "image", Text: "ポケットモンスターファイアレッドのスロットで777が出ている画像"},
+		},
 	}
 
 	if diff := cmp.Diff(expected, rec, cmpopts.IgnoreUnexported(Record{})); diff != "" {
@@ -97,8 +110,11 @@ func Test_toRecord_link(t *testing.T) {
 		t.Fatalf("time parse error: %v", err)
 	}
 
+	title := "初星学園 「キミとセミブルー」Official Music Video (HATSUBOSHI GAKUEN - Kimi to Semi Blue)"
 	expected := &Record{
 		Cid:       "bafyreibjfxwfe3z6mmis5nwmb5p6u4k27ji35ammiz3mgwck3mnmmq6vrq",
+		Uri:       "at://did:plc:spfskpvcqvyicwe6hn75sr4d/app.bsky.feed.post/3mgkes5zhrc2r",
+		Rkey:      "3mgkes5zhrc2r",
 		Text:      "youtu.be/Z-LWjF5J6Mw?...",
 		Timestamp: ts.UnixMicro(),
 		Did:       "did:plc:spfskpvcqvyicwe6hn75sr4d",
@@ -107,6 +123,17 @@ func Test_toRecord_link(t *testing.T) {
 		Embed:     "external",
 		Key:       "key",
 		Position:  1,
+		Links: []RecordLink{
+			{
+				RecordCid: "bafyreibjfxwfe3z6mmis5nwmb5p6u4k27ji35ammiz3mgwck3mnmmq6vrq",
+				Uri:       "https://youtu.be/Z-LWjF5J6Mw?si=c6MZLWh7RmOb1vd-",
+				Domain:    "youtu.be",
+				Title:     &title,
+			},
+		},
+		Langs: []RecordLang{
+			{RecordCid: "bafyreibjfxwfe3z6mmis5nwmb5p6u4k27ji35ammiz3mgwck3mnmmq6vrq", Lang: "ja"},
+		},
 	}
 
 	if diff := cmp.Diff(expected, rec, cmpopts.IgnoreUnexported(Record{})); diff != "" {
@@ -138,6 +165,8 @@ func Test_toRecord_reply(t *testing.T) {
 	rName := "灘"
 	expected := &Record{
 		Cid:               "bafyreihlk47alkx6tsnhbiyvdygfheegqwekt34j5dd74asujwoxn5p24u",
+		Uri:               "at://did:plc:spfskpvcqvyicwe6hn75sr4d/app.bsky.feed.post/3mgjokds7hs2r",
+		Rkey:              "3mgjokds7hs2r",
 		Text:              "なんか作ったことがある言語は余裕で10以上あるけどよく使うとか影響を受けているというレベルになると6～7くらいしかないな意外と",
 		Timestamp:         ts.UnixMicro(),
 		Did:               "did:plc:spfskpvcqvyicwe6hn75sr4d",
@@ -149,6 +178,10 @@ func Test_toRecord_reply(t *testing.T) {
 		Embed:             "none",
 		Key:               "key",
 		Position:          1,
+		LikeCount:         1,
+		Langs: []RecordLang{
+			{RecordCid: "bafyreihlk47alkx6tsnhbiyvdygfheegqwekt34j5dd74asujwoxn5p24u", Lang: "ja"},
+		},
 	}
 
 	if diff := cmp.Diff(expected, rec, cmpopts.IgnoreUnexported(Record{})); diff != "" {
@@ -159,3 +192,58 @@ func Test_toRecord_reply(t *testing.T) {
 		t.Errorf("Position mismatch: want %d, got %d", expected.Position, rec.Position)
 	}
 }
+
+func Test_toRecord_facets(t *testing.T) {
+	text := `{"post":{"author":{"did":"did:plc:testuser","handle":"example.bsky.app"},"cid":"cid","embed":{"$type":"app.bsky.embed.recordWithMedia#view","media":{"$type":"app.bsky.embed.video#view","alt":"動画の説明","cid":"videocid","playlist":"https://example.com/playlist.m3u8"},"record":{"record":{"$type":"app.bsky.embed.record#viewRecord","author":{"did":"did:plc:quoted","handle":"quoted.example.com","displayName":"Quoted"},"cid":"quotedcid","indexedAt":"2026-01-01T00:00:00.000Z","uri":"at://did:plc:quoted/app.bsky.feed.post/quoted","value":{"$type":"app.bsky.feed.post","createdAt":"2026-01-01T00:00:00.000Z","text":"引用された投稿"}}}},"indexedAt":"2026-01-02T00:00:00.000Z","record":{"$type":"app.bsky.feed.post","createdAt":"2026-01-02T00:00:00.000Z","facets":[{"features":[{"$type":"app.bsky.richtext.facet#tag","tag":"Go"}],"index":{"byteStart":0,"byteEnd":3}},{"features":[{"$type":"app.bsky.richtext.facet#mention","did":"did:plc:friend"}],"index":{"byteStart":4,"byteEnd":23}}],"langs":["ja","en"],"tags":["go","bluesky"],"text":"#Go @Friend.bsky.social ok"},"uri":"at://did:plc:testuser/app.bsky.feed.post/postid"}}`
+
+	var fvp bsky.FeedDefs_FeedViewPost
+	if err := json.Unmarshal([]byte(text), &fvp); err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+
+	rec := ToRecord("key", 1, &fvp)
+
+	ts, err := time.Parse(time.RFC3339, "2026-01-02T00:00:00.000Z")
+	if err != nil {
+		t.Fatalf("time parse error: %v", err)
+	}
+
+	qDid := "did:plc:quoted"
+	qHandle := "quoted.example.com"
+	qName := "Quoted"
+	qText := "引用された投稿"
+	expected := &Record{
+		Cid:             "cid",
+		Uri:             "at://did:plc:testuser/app.bsky.feed.post/postid",
+		Rkey:            "postid",
+		Text:            "#Go @Friend.bsky.social ok",
+		Timestamp:       ts.UnixMicro(),
+		Did:             "did:plc:testuser",
+		Handle:          "example.bsky.app",
+		Embed:           "video",
+		EmbedPostDid:    &qDid,
+		EmbedPostHandle: &qHandle,
+		EmbedPostName:   &qName,
+		EmbedPostText:   &qText,
+		Key:             "key",
+		Position:        1,
+		Tags: []RecordTag{
+			{RecordCid: "cid", Tag: "go"},
+			{RecordCid: "cid", Tag: "bluesky"},
+		},
+		Mentions: []RecordMention{
+			{RecordCid: "cid", Did: "did:plc:friend", Handle: "friend.bsky.social"},
+		},
+		Langs: []RecordLang{
+			{RecordCid: "cid", Lang: "ja"},
+			{RecordCid: "cid", Lang: "en"},
+		},
+		AltTexts: []RecordAltText{
+			{RecordCid: "cid", Kind: "video", Text: "動画の説明"},
+		},
+	}
+
+	if diff := cmp.Diff(expected, rec, cmpopts.IgnoreUnexported(Record{})); diff != "" {
+		t.Errorf("toRecord mismatch (-want +got):\n%s", diff)
+	}
+}
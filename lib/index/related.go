@@ -0,0 +1,271 @@
+package index
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sort"
+)
+
+var ErrNotFound = errors.New("record not found")
+
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+
+	// relatedQueryTerms is the number of the source post's terms, by
+	// TF-IDF, that are used to find related posts.
+	relatedQueryTerms = 25
+)
+
+type RelatedResult struct {
+	Key      string
+	Position int
+	Score    float64
+}
+
+type termStat struct {
+	Term string
+	Df   int
+}
+
+type termHit struct {
+	RecordCid string
+	Term      string
+	Tf        int
+}
+
+type docLength struct {
+	RecordCid string
+	Length    int
+}
+
+// Corpus holds the statistics that BM25 needs over all shards of an
+// index, for the terms of a query.
+type Corpus struct {
+	Docs   int64
+	Length int64
+	Df     map[string]int64
+}
+
+// Add adds the statistics of another shard.
+func (c *Corpus) Add(o *Corpus) {
+	c.Docs += o.Docs
+	c.Length += o.Length
+	if c.Df == nil {
+		c.Df = make(map[string]int64)
+	}
+	for t, n := range o.Df {
+		c.Df[t] += n
+	}
+}
+
+func (c *Corpus) idf(term string) float64 {
+	df, ok := c.Df[term]
+	if !ok {
+		return 0
+	}
+	n := float64(c.Docs)
+	return math.Log(1 + (n-float64(df)+0.5)/(float64(df)+0.5))
+}
+
+// Related returns up to limit posts similar to the post cid, by BM25 over
+// the source post's most distinctive terms.
+func (s *Gorm) Related(ctx context.Context, cid string, limit int) ([]*RelatedResult, error) {
+	source, err := s.SourceTerms(ctx, cid)
+	if err != nil {
+		return nil, err
+	}
+	if len(source) == 0 {
+		return []*RelatedResult{}, nil
+	}
+
+	corpus, err := s.Corpus(ctx, TermsOf(source))
+	if err != nil {
+		return nil, err
+	}
+
+	return s.RelatedByTerms(ctx, QueryTerms(source, corpus), cid, corpus, limit)
+}
+
+// SourceTerms returns the terms of the post cid, or ErrNotFound if it is
+// not in this index.
+func (s *Gorm) SourceTerms(ctx context.Context, cid string) ([]RecordTerm, error) {
+	db := s.db.WithContext(ctx)
+
+	var count int64
+	if err := db.Model(&Record{}).Where("cid = ?", cid).Count(&count).Error; err != nil {
+		s.logger.Error("failed to find record", "cid", cid, "err", err)
+		return nil, err
+	}
+	if count == 0 {
+		return nil, ErrNotFound
+	}
+
+	var source []RecordTerm
+	if err := db.Where("record_cid = ?", cid).Find(&source).Error; err != nil {
+		s.logger.Error("failed to get terms", "cid", cid, "err", err)
+		return nil, err
+	}
+	return source, nil
+}
+
+// TermsOf returns the terms of ts.
+func TermsOf(ts []RecordTerm) []string {
+	terms := make([]string, len(ts))
+	for i, t := range ts {
+		terms[i] = t.Term
+	}
+	return terms
+}
+
+// Corpus returns the statistics of this index for terms.
+func (s *Gorm) Corpus(ctx context.Context, terms []string) (*Corpus, error) {
+	db := s.db.WithContext(ctx)
+
+	var total struct {
+		Docs   int64
+		Length int64
+	}
+	if err := db.Model(&RecordTerm{}).
+		Select("COUNT(DISTINCT record_cid) AS docs, COALESCE(SUM(tf), 0) AS length").
+		Scan(&total).Error; err != nil {
+		s.logger.Error("failed to count terms", "err", err)
+		return nil, err
+	}
+
+	corpus := &Corpus{
+		Docs:   total.Docs,
+		Length: total.Length,
+		Df:     make(map[string]int64),
+	}
+	if len(terms) == 0 {
+		return corpus, nil
+	}
+
+	var dfs []termStat
+	if err := db.Model(&RecordTerm{}).
+		Select("term, COUNT(*) AS df").
+		Where("term IN ?", terms).
+		Group("term").
+		Scan(&dfs).Error; err != nil {
+		s.logger.Error("failed to count document frequency", "err", err)
+		return nil, err
+	}
+	for _, d := range dfs {
+		corpus.Df[d.Term] = int64(d.Df)
+	}
+
+	return corpus, nil
+}
+
+// QueryTerms returns the most distinctive terms of the source post by
+// TF-IDF.
+func QueryTerms(source []RecordTerm, corpus *Corpus) []string {
+	source = append([]RecordTerm(nil), source...)
+	sort.Slice(source, func(i, j int) bool {
+		wi := float64(source[i].Tf) * corpus.idf(source[i].Term)
+		wj := float64(source[j].Tf) * corpus.idf(source[j].Term)
+		if wi != wj {
+			return wi > wj
+		}
+		return source[i].Term < source[j].Term
+	})
+	if len(source) > relatedQueryTerms {
+		source = source[:relatedQueryTerms]
+	}
+	return TermsOf(source)
+}
+
+// RelatedByTerms scores the posts of this index other than exclude by BM25
+// over terms, using the statistics of corpus.
+func (s *Gorm) RelatedByTerms(ctx context.Context, terms []string, exclude string, corpus *Corpus, limit int) ([]*RelatedResult, error) {
+	db := s.db.WithContext(ctx)
+
+	if len(terms) == 0 || corpus.Docs == 0 {
+		return []*RelatedResult{}, nil
+	}
+	avgdl := float64(corpus.Length) / float64(corpus.Docs)
+
+	var hits []termHit
+	if err := db.Model(&RecordTerm{}).
+		Select("record_cid, term, tf").
+		Where("term IN ? AND record_cid <> ?", terms, exclude).
+		Scan(&hits).Error; err != nil {
+		s.logger.Error("failed to find related terms", "err", err)
+		return nil, err
+	}
+	if len(hits) == 0 {
+		return []*RelatedResult{}, nil
+	}
+
+	candidates := make(map[string]bool)
+	for _, h := range hits {
+		candidates[h.RecordCid] = true
+	}
+	cids := make([]string, 0, len(candidates))
+	for c := range candidates {
+		cids = append(cids, c)
+	}
+
+	var lengths []docLength
+	if err := db.Model(&RecordTerm{}).
+		Select("record_cid, SUM(tf) AS length").
+		Where("record_cid IN ?", cids).
+		Group("record_cid").
+		Scan(&lengths).Error; err != nil {
+		s.logger.Error("failed to get document lengths", "err", err)
+		return nil, err
+	}
+	dl := make(map[string]float64)
+	for _, l := range lengths {
+		dl[l.RecordCid] = float64(l.Length)
+	}
+
+	scores := make(map[string]float64)
+	for _, h := range hits {
+		tf := float64(h.Tf)
+		scores[h.RecordCid] += corpus.idf(h.Term) * tf * (bm25K1 + 1) /
+			(tf + bm25K1*(1-bm25B+bm25B*dl[h.RecordCid]/avgdl))
+	}
+
+	cids = cids[:0]
+	for c := range scores {
+		cids = append(cids, c)
+	}
+	sort.Slice(cids, func(i, j int) bool {
+		if scores[cids[i]] != scores[cids[j]] {
+			return scores[cids[i]] > scores[cids[j]]
+		}
+		return cids[i] < cids[j]
+	})
+	if limit > 0 && len(cids) > limit {
+		cids = cids[:limit]
+	}
+
+	var records []Record
+	if err := db.Select("cid", "key", "position").Where("cid IN ?", cids).Find(&records).Error; err != nil {
+		s.logger.Error("failed to get related records", "err", err)
+		return nil, err
+	}
+	byCid := make(map[string]*Record)
+	for i := range records {
+		byCid[records[i].Cid] = &records[i]
+	}
+
+	results := make([]*RelatedResult, 0, len(cids))
+	for _, c := range cids {
+		rec, ok := byCid[c]
+		if !ok {
+			// soft deleted
+			continue
+		}
+		results = append(results, &RelatedResult{
+			Key:      rec.Key,
+			Position: int(rec.Position),
+			Score:    scores[c],
+		})
+	}
+
+	return results, nil
+}
@@ -0,0 +1,45 @@
+package index
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestTokenize(t *testing.T) {
+	got := fmt.Sprint(tokenize("Hello, World! 猫が好き a"))
+	want := "[hello world 猫が が好 好き]"
+	if got != want {
+		t.Errorf("tokenize: want %s, got %s", want, got)
+	}
+}
+
+func TestGorm_Related(t *testing.T) {
+	ctx := context.Background()
+	g := newTestGorm(t)
+
+	post := func(cid string, position int, text string) {
+		putTestPost(t, g, "k", position, fmt.Sprintf(`{"post":{"author":{"did":"did:plc:a","handle":"a.example.com"},"cid":%q,"record":{"$type":"app.bsky.feed.post","createdAt":"2026-01-01T00:00:00Z","text":%q}}}`, cid, text))
+	}
+	post("src", 0, "ポケモンのスロットで777が出た")
+	post("near", 1, "今日もポケモンのスロットを回した")
+	post("far", 2, "ポケモンを買った")
+	post("none", 3, "天気が良い")
+
+	results, err := g.Related(ctx, "src", 10)
+	if err != nil {
+		t.Fatalf("Related: %v", err)
+	}
+	var got []int
+	for _, r := range results {
+		got = append(got, r.Position)
+	}
+	if fmt.Sprint(got) != "[1 2]" {
+		t.Errorf("Related positions: want [1 2], got %v", got)
+	}
+
+	if _, err := g.Related(ctx, "missing", 10); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Related(missing): want ErrNotFound, got %v", err)
+	}
+}
@@ -0,0 +1,58 @@
+package index
+
+import (
+	"path"
+	"strings"
+	"time"
+)
+
+// An index is split into shards by month. A shard key is the month prefix
+// of the day files in the publish bucket, "<did>/YYYY/MM", so the month is
+// in the account's time zone.
+
+// ShardKey returns the shard key of a day file key "<did>/YYYY/MM/DD".
+func ShardKey(key string) string {
+	return path.Dir(key)
+}
+
+// ParseShardKey returns the DID and the first day of the month of a shard
+// key. The month is returned in UTC since the time zone of the account is
+// not known.
+func ParseShardKey(key string) (string, time.Time, bool) {
+	i := strings.LastIndex(key, "/")
+	if i < 0 {
+		return "", time.Time{}, false
+	}
+	j := strings.LastIndex(key[:i], "/")
+	if j <= 0 {
+		return "", time.Time{}, false
+	}
+	month, err := time.Parse("2006/01", key[j+1:])
+	if err != nil {
+		return "", time.Time{}, false
+	}
+	return key[:j], month, true
+}
+
+// shardMargin covers the difference between UTC and the account's time
+// zone at month boundaries.
+const shardMargin = 24 * time.Hour
+
+// ShardInRange reports whether the shard may contain posts with timestamps
+// in [since, until), in unix microseconds. Zero means unbounded. Keys that
+// are not shard keys are always in range.
+func ShardInRange(key string, since, until int64) bool {
+	_, month, ok := ParseShardKey(key)
+	if !ok {
+		return true
+	}
+	start := month.Add(-shardMargin)
+	end := month.AddDate(0, 1, 0).Add(shardMargin)
+	if since != 0 && end.UnixMicro() <= since {
+		return false
+	}
+	if until != 0 && start.UnixMicro() >= until {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,57 @@
+package index
+
+import (
+	"testing"
+	"time"
+)
+
+func TestShardKey(t *testing.T) {
+	if got := ShardKey("did:plc:a/2026/01/31"); got != "did:plc:a/2026/01" {
+		t.Errorf("ShardKey: got %q", got)
+	}
+
+	did, month, ok := ParseShardKey("did:plc:a/2026/01")
+	if !ok || did != "did:plc:a" || !month.Equal(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("ParseShardKey: got %q %v %v", did, month, ok)
+	}
+	if _, _, ok := ParseShardKey("did:plc:a"); ok {
+		t.Errorf("ParseShardKey: legacy key parsed")
+	}
+}
+
+func TestShardInRange(t *testing.T) {
+	micros := func(s string) int64 {
+		tm, err := time.Parse(time.DateOnly, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tm.UnixMicro()
+	}
+
+	tests := []struct {
+		key   string
+		since string
+		until string
+		want  bool
+	}{
+		{"did:plc:a/2026/01", "", "", true},
+		{"did:plc:a/2026/01", "2026-01-15", "2026-01-16", true},
+		{"did:plc:a/2026/01", "2026-02-01", "", true}, // margin for the time zone
+		{"did:plc:a/2026/01", "2026-02-02", "", false},
+		{"did:plc:a/2026/01", "", "2025-12-31", false},
+		{"did:plc:a/2026/01", "", "2026-01-01", true},
+		{"did:plc:a", "2026-02-02", "", true},
+	}
+	for _, tt := range tests {
+		var since, until int64
+		if tt.since != "" {
+			since = micros(tt.since)
+		}
+		if tt.until != "" {
+			until = micros(tt.until)
+		}
+		if got := ShardInRange(tt.key, since, until); got != tt.want {
+			t.Errorf("ShardInRange(%q, %s, %s): got %v, want %v", tt.key, tt.since, tt.until, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package index
+
+import (
+	"context"
+	"sort"
+	"time"
+)
+
+type StatsQuery struct {
+	// Since and Until bound the post timestamps, in unix microseconds.
+	// Zero means unbounded.
+	Since int64
+	Until int64
+
+	// Location is used for the daily, weekly and hour of day buckets.
+	Location *time.Location
+
+	// Top limits the counterpart and tag rankings.
+	Top int
+}
+
+type Count struct {
+	Label string  `json:"label"`
+	Count int     `json:"count"`
+	Ratio float64 `json:"ratio,omitempty"`
+}
+
+type Stats struct {
+	Total int `json:"total"`
+
+	// Daily and Weekly are sorted by date. Weekly labels are the Monday
+	// that starts the week.
+	Daily     []*Count `json:"daily"`
+	Weekly    []*Count `json:"weekly"`
+	HourOfDay []int    `json:"hourOfDay"`
+
+	Embeds []*Count `json:"embeds"`
+
+	// Replies and Quotes count posts by the handle they reply to or
+	// quote, excluding the author's own posts.
+	Replies []*Count `json:"replies"`
+	Quotes  []*Count `json:"quotes"`
+
+	Tags []*Count `json:"tags"`
+}
+
+type statsRecord struct {
+	Did               string
+	Timestamp         int64
+	Embed             string
+	ReplyParentDid    *string
+	ReplyParentHandle *string
+	EmbedPostDid      *string
+	EmbedPostHandle   *string
+}
+
+func sortedCounts(m map[string]int) []*Count {
+	ret := make([]*Count, 0, len(m))
+	for k, v := range m {
+		ret = append(ret, &Count{Label: k, Count: v})
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Label < ret[j].Label })
+	return ret
+}
+
+func topCounts(m map[string]int, top int) []*Count {
+	ret := make([]*Count, 0, len(m))
+	for k, v := range m {
+		ret = append(ret, &Count{Label: k, Count: v})
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Count != ret[j].Count {
+			return ret[i].Count > ret[j].Count
+		}
+		return ret[i].Label < ret[j].Label
+	})
+	if top > 0 && len(ret) > top {
+		ret = ret[:top]
+	}
+	return ret
+}
+
+func (s *Gorm) Stats(ctx context.Context, q *StatsQuery) (*Stats, error) {
+	loc := q.Location
+	if loc == nil {
+		loc = time.UTC
+	}
+
+	db := s.db.WithContext(ctx).Model(&Record{})
+	if q.Since != 0 {
+		db = db.Where("timestamp >= ?", q.Since)
+	}
+	if q.Until != 0 {
+		db = db.Where("timestamp < ?", q.Until)
+	}
+
+	var records []statsRecord
+	if err := db.Select(
+		"did", "timestamp", "embed",
+		"reply_parent_did", "reply_parent_handle",
+		"embed_post_did", "embed_post_handle",
+	).Find(&records).Error; err != nil {
+		s.logger.Error("failed to scan records for stats", "query", q, "err", err)
+		return nil, err
+	}
+
+	daily := make(map[string]int)
+	weekly := make(map[string]int)
+	embeds := make(map[string]int)
+	replies := make(map[string]int)
+	quotes := make(map[string]int)
+	stats := &Stats{
+		Total:     len(records),
+		HourOfDay: make([]int, 24),
+	}
+	for _, rec := range records {
+		t := time.UnixMicro(rec.Timestamp).In(loc)
+		daily[t.Format(time.DateOnly)]++
+		weekday := (int(t.Weekday()) + 6) % 7 // Monday is 0
+		weekly[t.AddDate(0, 0, -weekday).Format(time.DateOnly)]++
+		stats.HourOfDay[t.Hour()]++
+
+		embeds[rec.Embed]++
+
+		if rec.ReplyParentHandle != nil && (rec.ReplyParentDid == nil || *rec.ReplyParentDid != rec.Did) {
+			replies[*rec.ReplyParentHandle]++
+		}
+		if rec.EmbedPostHandle != nil && (rec.EmbedPostDid == nil || *rec.EmbedPostDid != rec.Did) {
+			quotes[*rec.EmbedPostHandle]++
+		}
+	}
+
+	stats.Daily = sortedCounts(daily)
+	stats.Weekly = sortedCounts(weekly)
+	stats.Embeds = topCounts(embeds, 0)
+	for _, c := range stats.Embeds {
+		c.Ratio = float64(c.Count) / float64(stats.Total)
+	}
+	stats.Replies = topCounts(replies, q.Top)
+	stats.Quotes = topCounts(quotes, q.Top)
+
+	tagDB := s.db.WithContext(ctx).
+		Table("record_tags").
+		Select("record_tags.tag AS label, COUNT(*) AS count").
+		Joins("JOIN records ON records.cid = record_tags.record_cid AND records.deleted_at IS NULL")
+	if q.Since != 0 {
+		tagDB = tagDB.Where("records.timestamp >= ?", q.Since)
+	}
+	if q.Until != 0 {
+		tagDB = tagDB.Where("records.timestamp < ?", q.Until)
+	}
+	tagDB = tagDB.Group("record_tags.tag").Order("count DESC, label")
+	if q.Top > 0 {
+		tagDB = tagDB.Limit(q.Top)
+	}
+	stats.Tags = []*Count{}
+	if err := tagDB.Scan(&stats.Tags).Error; err != nil {
+		s.logger.Error("failed to count tags", "query", q, "err", err)
+		return nil, err
+	}
+
+	return stats, nil
+}
+
+func addCounts(m map[string]int, counts []*Count) {
+	for _, c := range counts {
+		m[c.Label] += c.Count
+	}
+}
+
+// MergeStats combines the stats of index shards. The shards must be
+// computed with Top 0 so that the rankings are cut after merging.
+func MergeStats(shards []*Stats, top int) *Stats {
+	daily := make(map[string]int)
+	weekly := make(map[string]int)
+	embeds := make(map[string]int)
+	replies := make(map[string]int)
+	quotes := make(map[string]int)
+	tags := make(map[string]int)
+	stats := &Stats{
+		HourOfDay: make([]int, 24),
+	}
+	for _, s := range shards {
+		stats.Total += s.Total
+		for h, n := range s.HourOfDay {
+			stats.HourOfDay[h] += n
+		}
+		addCounts(daily, s.Daily)
+		addCounts(weekly, s.Weekly)
+		addCounts(embeds, s.Embeds)
+		addCounts(replies, s.Replies)
+		addCounts(quotes, s.Quotes)
+		addCounts(tags, s.Tags)
+	}
+
+	stats.Daily = sortedCounts(daily)
+	stats.Weekly = sortedCounts(weekly)
+	stats.Embeds = topCounts(embeds, 0)
+	for _, c := range stats.Embeds {
+		c.Ratio = float64(c.Count) / float64(stats.Total)
+	}
+	stats.Replies = topCounts(replies, top)
+	stats.Quotes = topCounts(quotes, top)
+	stats.Tags = topCounts(tags, top)
+
+	return stats
+}
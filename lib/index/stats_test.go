@@ -0,0 +1,44 @@
+package index
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestGorm_Stats(t *testing.T) {
+	ctx := context.Background()
+	g := newTestGorm(t)
+
+	// 2026-01-04 is a Sunday in UTC and a Monday in +09:00.
+	putTestPost(t, g, "k", 0, `{"post":{"author":{"did":"did:plc:a","handle":"a.example.com"},"cid":"cid1","record":{"$type":"app.bsky.feed.post","createdAt":"2026-01-04T16:00:00Z","facets":[{"features":[{"$type":"app.bsky.richtext.facet#tag","tag":"go"}],"index":{"byteStart":0,"byteEnd":3}}],"text":"#go"}}}`)
+	putTestPost(t, g, "k", 1, `{"post":{"author":{"did":"did:plc:a","handle":"a.example.com"},"cid":"cid2","record":{"$type":"app.bsky.feed.post","createdAt":"2026-01-05T01:00:00Z","tags":["go","elm"],"text":"reply"}},"reply":{"parent":{"$type":"app.bsky.feed.defs#postView","author":{"did":"did:plc:b","handle":"b.example.com"},"cid":"p","indexedAt":"","record":{"$type":"app.bsky.feed.post","createdAt":"2026-01-05T00:00:00Z","text":"parent"},"uri":"at://did:plc:b/app.bsky.feed.post/p"},"root":{"$type":"app.bsky.feed.defs#postView","author":{"did":"did:plc:b","handle":"b.example.com"},"cid":"p","indexedAt":"","record":{"$type":"app.bsky.feed.post","createdAt":"2026-01-05T00:00:00Z","text":"parent"},"uri":"at://did:plc:b/app.bsky.feed.post/p"}}}`)
+	putTestPost(t, g, "k", 2, `{"post":{"author":{"did":"did:plc:a","handle":"a.example.com"},"cid":"cid3","embed":{"$type":"app.bsky.embed.images#view","images":[]},"record":{"$type":"app.bsky.feed.post","createdAt":"2026-02-01T00:00:00Z","text":"later"}}}`)
+
+	stats, err := g.Stats(ctx, &StatsQuery{
+		Until:    time.Date(2026, 2, 1, 0, 0, 0, 0, time.UTC).UnixMicro(),
+		Location: time.FixedZone("JST", 9*60*60),
+	})
+	if err != nil {
+		t.Fatalf("Stats: %v", err)
+	}
+
+	hours := make([]int, 24)
+	hours[1] = 1
+	hours[10] = 1
+	expected := &Stats{
+		Total:     2,
+		Daily:     []*Count{{Label: "2026-01-05", Count: 2}},
+		Weekly:    []*Count{{Label: "2026-01-05", Count: 2}},
+		HourOfDay: hours,
+		Embeds:    []*Count{{Label: "none", Count: 2, Ratio: 1}},
+		Replies:   []*Count{{Label: "b.example.com", Count: 1}},
+		Quotes:    []*Count{},
+		Tags:      []*Count{{Label: "go", Count: 2}, {Label: "elm", Count: 1}},
+	}
+	if diff := cmp.Diff(expected, stats); diff != "" {
+		t.Errorf("Stats mismatch (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,109 @@
+package index
+
+import (
+	"strings"
+	"unicode"
+)
+
+// RecordTerm is a term frequency of a post for related post search.
+type RecordTerm struct {
+	ID        uint   `gorm:"primaryKey"`
+	RecordCid string `gorm:"index"`
+	Term      string `gorm:"index"`
+	Tf        int
+}
+
+func isCJK(r rune) bool {
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul)
+}
+
+// tokenize splits s into lower case words. Runs of CJK characters, which
+// are not separated by spaces, are split into character bigrams.
+func tokenize(s string) []string {
+	var tokens []string
+	var word []rune
+	var cjk []rune
+
+	flushWord := func() {
+		if len(word) > 1 {
+			tokens = append(tokens, string(word))
+		}
+		word = word[:0]
+	}
+	flushCJK := func() {
+		switch len(cjk) {
+		case 0:
+		case 1:
+			tokens = append(tokens, string(cjk))
+		default:
+			for i := 0; i+1 < len(cjk); i++ {
+				tokens = append(tokens, string(cjk[i:i+2]))
+			}
+		}
+		cjk = cjk[:0]
+	}
+
+	for _, r := range strings.ToLower(s) {
+		switch {
+		case isCJK(r):
+			flushWord()
+			cjk = append(cjk, r)
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			flushCJK()
+			word = append(word, r)
+		default:
+			flushWord()
+			flushCJK()
+		}
+	}
+	flushWord()
+	flushCJK()
+
+	return tokens
+}
+
+// Terms returns the term frequencies of rec. Hashtags, mentions and link
+// domains are kept as "#tag", "@handle" and "domain:example.com" so that
+// they are not confused with words.
+func Terms(rec *Record) map[string]int {
+	tf := make(map[string]int)
+	for _, t := range tokenize(rec.Text) {
+		tf[t]++
+	}
+	for _, alt := range rec.AltTexts {
+		for _, t := range tokenize(alt.Text) {
+			tf[t]++
+		}
+	}
+	for _, link := range rec.Links {
+		if link.Title != nil {
+			for _, t := range tokenize(*link.Title) {
+				tf[t]++
+			}
+		}
+		if link.Domain != "" {
+			tf["domain:"+link.Domain]++
+		}
+	}
+	for _, tag := range rec.Tags {
+		tf["#"+tag.Tag]++
+	}
+	for _, m := range rec.Mentions {
+		if m.Handle != "" {
+			tf["@"+m.Handle]++
+		}
+	}
+	return tf
+}
+
+func recordTerms(rec *Record) []RecordTerm {
+	var ret []RecordTerm
+	for term, n := range Terms(rec) {
+		ret = append(ret, RecordTerm{
+			RecordCid: rec.Cid,
+			Term:      term,
+			Tf:        n,
+		})
+	}
+	return ret
+}
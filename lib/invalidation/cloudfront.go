@@ -0,0 +1,119 @@
+package invalidation
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudfront"
+	"github.com/aws/aws-sdk-go-v2/service/cloudfront/types"
+)
+
+// CloudFrontMaxPaths is the number of paths CloudFront accepts in an
+// invalidation batch.
+const CloudFrontMaxPaths = 3000
+
+type CloudFrontClient interface {
+	CreateInvalidation(ctx context.Context, params *cloudfront.CreateInvalidationInput, optFns ...func(*cloudfront.Options)) (*cloudfront.CreateInvalidationOutput, error)
+}
+
+// CloudFront invalidates the paths in a CloudFront distribution, in as
+// many invalidation batches as needed.
+type CloudFront struct {
+	client       CloudFrontClient
+	distribution string
+}
+
+func NewCloudFront(client CloudFrontClient, distribution string) *CloudFront {
+	return &CloudFront{
+		client:       client,
+		distribution: distribution,
+	}
+}
+
+func (c *CloudFront) Invalidate(ctx context.Context, paths []string) error {
+	var errs []error
+	for i, chunk := range chunks(paths, CloudFrontMaxPaths) {
+		if _, err := c.client.CreateInvalidation(ctx, &cloudfront.CreateInvalidationInput{
+			DistributionId: aws.String(c.distribution),
+			InvalidationBatch: &types.InvalidationBatch{
+				// Unique for each batch, even within a second.
+				CallerReference: aws.String(fmt.Sprintf("%d-%d", time.Now().UnixNano(), i)),
+				Paths: &types.Paths{
+					Quantity: aws.Int32(int32(len(chunk))),
+					Items:    chunk,
+				},
+			},
+		}); err != nil {
+			errs = append(errs, fmt.Errorf("cloudfront %s: %w", c.distribution, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+var ErrDistributionNotFound = errors.New("distribution not found")
+
+type CloudFrontListClient interface {
+	CloudFrontClient
+	ListDistributions(ctx context.Context, params *cloudfront.ListDistributionsInput, optFns ...func(*cloudfront.Options)) (*cloudfront.ListDistributionsOutput, error)
+}
+
+// FindDistribution returns the ID of the distribution with the alternate
+// domain name alias.
+func FindDistribution(ctx context.Context, client CloudFrontListClient, alias string) (string, error) {
+	paginator := cloudfront.NewListDistributionsPaginator(client, &cloudfront.ListDistributionsInput{})
+	for paginator.HasMorePages() {
+		out, err := paginator.NextPage(ctx)
+		if err != nil {
+			return "", err
+		}
+		if out.DistributionList == nil {
+			continue
+		}
+		for _, d := range out.DistributionList.Items {
+			if d.Aliases != nil && slices.Contains(d.Aliases.Items, alias) {
+				return aws.ToString(d.Id), nil
+			}
+		}
+	}
+	return "", fmt.Errorf("%w: %s", ErrDistributionNotFound, alias)
+}
+
+// CloudFrontAlias invalidates the paths in the distribution with the
+// alternate domain name alias, for the origins of the distribution, which
+// cannot be given its ID. The distribution is looked up on the first
+// invalidation.
+type CloudFrontAlias struct {
+	client CloudFrontListClient
+	alias  string
+
+	mu sync.Mutex
+	cf *CloudFront
+}
+
+func NewCloudFrontAlias(client CloudFrontListClient, alias string) *CloudFrontAlias {
+	return &CloudFrontAlias{
+		client: client,
+		alias:  alias,
+	}
+}
+
+func (c *CloudFrontAlias) Invalidate(ctx context.Context, paths []string) error {
+	c.mu.Lock()
+	if c.cf == nil {
+		distribution, err := FindDistribution(ctx, c.client, c.alias)
+		if err != nil {
+			c.mu.Unlock()
+			return err
+		}
+		c.cf = NewCloudFront(c.client, distribution)
+	}
+	cf := c.cf
+	c.mu.Unlock()
+
+	return cf.Invalidate(ctx, paths)
+}
@@ -0,0 +1,182 @@
+// Package invalidation invalidates the cached copies of published files,
+// in a CDN or elsewhere, after the files are updated.
+package invalidation
+
+import (
+	"context"
+	"errors"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Invalidator invalidates paths of the publish bucket. Paths start with
+// '/', and a path ending with '*' stands for all the paths with its
+// prefix.
+type Invalidator interface {
+	Invalidate(ctx context.Context, paths []string) error
+}
+
+// Nop invalidates nothing, for publishing without caches.
+type Nop struct{}
+
+func (Nop) Invalidate(ctx context.Context, paths []string) error {
+	return nil
+}
+
+// Multi invalidates the paths with all of the invalidators.
+type Multi []Invalidator
+
+func (m Multi) Invalidate(ctx context.Context, paths []string) error {
+	var errs []error
+	for _, inv := range m {
+		if err := inv.Invalidate(ctx, paths); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// DefaultThreshold is the number of paths in a directory above which they
+// are coalesced into a wildcard by default.
+const DefaultThreshold = 10
+
+// Coalesce returns paths without duplicates and with the paths of each
+// directory with more than threshold of them replaced by the wildcard of
+// the directory, such as "/<did>/2025/06/*". Wildcards are coalesced into
+// their parent directories in turn, but never into "/*".
+func Coalesce(paths []string, threshold int) []string {
+	set := make(map[string]bool)
+	for _, p := range paths {
+		if p != "" {
+			set[p] = true
+		}
+	}
+
+	if threshold > 0 {
+		for {
+			groups := make(map[string][]string)
+			for p := range set {
+				dir := path.Dir(strings.TrimSuffix(p, "/*"))
+				if dir == "/" || dir == "." {
+					continue
+				}
+				groups[dir] = append(groups[dir], p)
+			}
+
+			changed := false
+			for dir, ps := range groups {
+				if len(ps) <= threshold {
+					continue
+				}
+				for _, p := range ps {
+					delete(set, p)
+				}
+				set[dir+"/*"] = true
+				changed = true
+			}
+			if !changed {
+				break
+			}
+		}
+	}
+
+	ret := make([]string, 0, len(set))
+	for p := range set {
+		if !covered(set, p) {
+			ret = append(ret, p)
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// covered reports whether p is matched by another wildcard of set.
+func covered(set map[string]bool, p string) bool {
+	for dir := path.Dir(strings.TrimSuffix(p, "/*")); dir != "/" && dir != "."; dir = path.Dir(dir) {
+		if set[dir+"/*"] {
+			return true
+		}
+	}
+	return false
+}
+
+// Batch collects the paths of invalidations and invalidates them, as few
+// coalesced requests, on Flush. Invalidate never fails; failures are
+// returned by Flush.
+type Batch struct {
+	next      Invalidator
+	threshold int
+	maxPaths  int
+
+	mu      sync.Mutex
+	pending []string
+}
+
+type BatchOption func(*Batch)
+
+// WithThreshold sets the number of paths in a directory above which they
+// are coalesced into a wildcard. Zero disables coalescing.
+func WithThreshold(n int) BatchOption {
+	return func(b *Batch) {
+		b.threshold = n
+	}
+}
+
+// WithMaxPaths sets the number of paths passed to the invalidator at once.
+func WithMaxPaths(n int) BatchOption {
+	return func(b *Batch) {
+		b.maxPaths = n
+	}
+}
+
+func NewBatch(next Invalidator, opts ...BatchOption) *Batch {
+	b := &Batch{
+		next:      next,
+		threshold: DefaultThreshold,
+		maxPaths:  CloudFrontMaxPaths,
+	}
+	for _, opt := range opts {
+		opt(b)
+	}
+	return b
+}
+
+func (b *Batch) Invalidate(ctx context.Context, paths []string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.pending = append(b.pending, paths...)
+	return nil
+}
+
+// Flush invalidates the pending paths.
+func (b *Batch) Flush(ctx context.Context) error {
+	b.mu.Lock()
+	paths := Coalesce(b.pending, b.threshold)
+	b.pending = nil
+	b.mu.Unlock()
+
+	var errs []error
+	for _, chunk := range chunks(paths, b.maxPaths) {
+		if err := b.next.Invalidate(ctx, chunk); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// chunks splits paths into slices of up to n paths.
+func chunks(paths []string, n int) [][]string {
+	if n <= 0 {
+		n = len(paths)
+	}
+	var ret [][]string
+	for len(paths) > 0 {
+		m := min(n, len(paths))
+		ret = append(ret, paths[:m])
+		paths = paths[m:]
+	}
+	return ret
+}
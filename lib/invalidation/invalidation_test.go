@@ -0,0 +1,284 @@
+package invalidation
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudfront"
+	"github.com/aws/aws-sdk-go-v2/service/cloudfront/types"
+	"github.com/google/go-cmp/cmp"
+)
+
+func days(prefix string, n int) []string {
+	var ret []string
+	for i := 1; i <= n; i++ {
+		ret = append(ret, fmt.Sprintf("%s/%02d", prefix, i))
+	}
+	return ret
+}
+
+func TestCoalesce(t *testing.T) {
+	tests := []struct {
+		name      string
+		paths     []string
+		threshold int
+		want      []string
+	}{
+		{
+			name:      "few",
+			paths:     []string{"/did:plc:a/2025/06/02", "/did:plc:a/2025/06/index", "/did:plc:a/2025/06/02"},
+			threshold: 3,
+			want:      []string{"/did:plc:a/2025/06/02", "/did:plc:a/2025/06/index"},
+		},
+		{
+			name:      "month",
+			paths:     append(days("/did:plc:a/2025/06", 5), "/did:plc:a/2025/05/31", "/did:plc:b/2025/06/01"),
+			threshold: 3,
+			want:      []string{"/did:plc:a/2025/05/31", "/did:plc:a/2025/06/*", "/did:plc:b/2025/06/01"},
+		},
+		{
+			name: "year",
+			paths: append(append(append(append(
+				days("/did:plc:a/2025/01", 4),
+				days("/did:plc:a/2025/02", 4)...),
+				days("/did:plc:a/2025/03", 4)...),
+				days("/did:plc:a/2025/04", 4)...),
+				"/did:plc:a/2024/12/31"),
+			threshold: 3,
+			want:      []string{"/did:plc:a/2024/12/31", "/did:plc:a/2025/*"},
+		},
+		{
+			name:      "covered",
+			paths:     append(days("/did:plc:a/2025/06", 4), "/did:plc:a/2025/*"),
+			threshold: 3,
+			want:      []string{"/did:plc:a/2025/*"},
+		},
+		{
+			name:      "never root",
+			paths:     []string{"/a/*", "/b/*", "/c/*", "/d/*"},
+			threshold: 3,
+			want:      []string{"/a/*", "/b/*", "/c/*", "/d/*"},
+		},
+		{
+			name:      "disabled",
+			paths:     days("/did:plc:a/2025/06", 5),
+			threshold: 0,
+			want:      days("/did:plc:a/2025/06", 5),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if diff := cmp.Diff(tt.want, Coalesce(tt.paths, tt.threshold)); diff != "" {
+				t.Errorf("Coalesce mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+type recorder struct {
+	calls [][]string
+	err   error
+}
+
+func (r *recorder) Invalidate(ctx context.Context, paths []string) error {
+	r.calls = append(r.calls, paths)
+	return r.err
+}
+
+func TestBatch(t *testing.T) {
+	ctx := context.Background()
+	rec := &recorder{}
+	b := NewBatch(rec, WithThreshold(3), WithMaxPaths(2))
+
+	b.Invalidate(ctx, days("/did:plc:a/2025/06", 4))
+	b.Invalidate(ctx, []string{"/did:plc:b/2025/06/01", "/did:plc:b/2025/06/index"})
+	if len(rec.calls) != 0 {
+		t.Fatalf("invalidated before Flush: %v", rec.calls)
+	}
+
+	if err := b.Flush(ctx); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	want := [][]string{
+		{"/did:plc:a/2025/06/*", "/did:plc:b/2025/06/01"},
+		{"/did:plc:b/2025/06/index"},
+	}
+	if diff := cmp.Diff(want, rec.calls); diff != "" {
+		t.Errorf("Flush mismatch (-want +got):\n%s", diff)
+	}
+
+	// Nothing is pending after a flush.
+	rec.calls = nil
+	if err := b.Flush(ctx); err != nil || len(rec.calls) != 0 {
+		t.Errorf("second Flush: %v, %v", rec.calls, err)
+	}
+}
+
+type fakeCloudFront struct {
+	inputs []*cloudfront.CreateInvalidationInput
+	lists  int
+}
+
+func (f *fakeCloudFront) CreateInvalidation(ctx context.Context, params *cloudfront.CreateInvalidationInput, optFns ...func(*cloudfront.Options)) (*cloudfront.CreateInvalidationOutput, error) {
+	f.inputs = append(f.inputs, params)
+	return &cloudfront.CreateInvalidationOutput{}, nil
+}
+
+func (f *fakeCloudFront) ListDistributions(ctx context.Context, params *cloudfront.ListDistributionsInput, optFns ...func(*cloudfront.Options)) (*cloudfront.ListDistributionsOutput, error) {
+	f.lists++
+	return &cloudfront.ListDistributionsOutput{
+		DistributionList: &types.DistributionList{
+			Items: []types.DistributionSummary{
+				{Id: aws.String("E1"), Aliases: &types.Aliases{Items: []string{"other.example.com"}}},
+				{Id: aws.String("E2"), Aliases: &types.Aliases{Items: []string{"log.example.com"}}},
+			},
+		},
+	}, nil
+}
+
+func TestCloudFrontAlias(t *testing.T) {
+	ctx := context.Background()
+	f := &fakeCloudFront{}
+
+	if err := NewCloudFrontAlias(f, "missing.example.com").Invalidate(ctx, []string{"/a"}); !errors.Is(err, ErrDistributionNotFound) {
+		t.Errorf("missing alias: got %v", err)
+	}
+
+	f.lists = 0
+	c := NewCloudFrontAlias(f, "log.example.com")
+	for range 2 {
+		if err := c.Invalidate(ctx, []string{"/a/*"}); err != nil {
+			t.Fatalf("Invalidate: %v", err)
+		}
+	}
+	if f.lists != 1 || len(f.inputs) != 2 || aws.ToString(f.inputs[0].DistributionId) != "E2" {
+		t.Errorf("got %d lookups, %d invalidations", f.lists, len(f.inputs))
+	}
+}
+
+func TestCloudFront(t *testing.T) {
+	f := &fakeCloudFront{}
+	var paths []string
+	for i := 0; i < CloudFrontMaxPaths+1; i++ {
+		paths = append(paths, fmt.Sprintf("/p/%d", i))
+	}
+	if err := NewCloudFront(f, "E123").Invalidate(context.Background(), paths); err != nil {
+		t.Fatalf("Invalidate: %v", err)
+	}
+
+	if len(f.inputs) != 2 {
+		t.Fatalf("batches: got %d, want 2", len(f.inputs))
+	}
+	refs := make(map[string]bool)
+	n := 0
+	for _, in := range f.inputs {
+		if aws.ToString(in.DistributionId) != "E123" {
+			t.Errorf("distribution: got %q", aws.ToString(in.DistributionId))
+		}
+		if int(aws.ToInt32(in.InvalidationBatch.Paths.Quantity)) != len(in.InvalidationBatch.Paths.Items) {
+			t.Errorf("quantity mismatch")
+		}
+		n += len(in.InvalidationBatch.Paths.Items)
+		refs[aws.ToString(in.InvalidationBatch.CallerReference)] = true
+	}
+	if n != len(paths) || len(refs) != 2 {
+		t.Errorf("got %d paths, %d caller references", n, len(refs))
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	var got []string
+	status := http.StatusNoContent
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		var req struct {
+			Paths []string `json:"paths"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		got = req.Paths
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	w := NewWebhook(srv.URL, WithHeader("Authorization", "Bearer token"))
+	paths := []string{"/did:plc:a/2025/06/*", "/did:plc:a/2025/05/31"}
+	if err := w.Invalidate(context.Background(), paths); err != nil {
+		t.Fatalf("Invalidate: %v", err)
+	}
+	if diff := cmp.Diff(paths, got); diff != "" {
+		t.Errorf("paths mismatch (-want +got):\n%s", diff)
+	}
+
+	status = http.StatusInternalServerError
+	if err := w.Invalidate(context.Background(), paths); err == nil {
+		t.Errorf("Invalidate with a failing webhook: no error")
+	}
+}
+
+func TestLocalPurge(t *testing.T) {
+	dir := t.TempDir()
+	files := []string{
+		"did:plc:a/2025/06/01",
+		"did:plc:a/2025/06/02",
+		"did:plc:a/2025/05/31",
+		"did:plc:a/2025/060",
+		"did:plc:b/2025/06/01",
+	}
+	for _, f := range files {
+		p := filepath.Join(dir, filepath.FromSlash(f))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte("x"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	l := NewLocalPurge(dir)
+	if err := l.Invalidate(context.Background(), []string{
+		"/did:plc:a/2025/06/*",
+		"/did:plc:b/2025/06/01",
+		"/did:plc:c/2025/06/01",
+	}); err != nil {
+		t.Fatalf("Invalidate: %v", err)
+	}
+
+	for _, f := range files {
+		_, err := os.Stat(filepath.Join(dir, filepath.FromSlash(f)))
+		exists := err == nil
+		want := f == "did:plc:a/2025/05/31" || f == "did:plc:a/2025/060"
+		if exists != want {
+			t.Errorf("%s: exists %v, want %v", f, exists, want)
+		}
+	}
+
+	for _, p := range []string{"/../x", "/*", "relative", "/a/*/b"} {
+		if err := l.Invalidate(context.Background(), []string{p}); err == nil {
+			t.Errorf("Invalidate(%q): no error", p)
+		}
+	}
+}
+
+func TestMulti(t *testing.T) {
+	a, b := &recorder{}, &recorder{err: errors.New("failed")}
+	if err := (Multi{a, b}).Invalidate(context.Background(), []string{"/x"}); err == nil {
+		t.Errorf("Invalidate: no error")
+	}
+	if len(a.calls) != 1 || len(b.calls) != 1 {
+		t.Errorf("calls: %v, %v", a.calls, b.calls)
+	}
+}
@@ -0,0 +1,70 @@
+package invalidation
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// LocalPurge removes the cached copies of the paths from a directory, such
+// as the cache of a reverse proxy or a mirror of the publish bucket.
+type LocalPurge struct {
+	dir string
+}
+
+func NewLocalPurge(dir string) *LocalPurge {
+	return &LocalPurge{dir: dir}
+}
+
+func (l *LocalPurge) Invalidate(ctx context.Context, paths []string) error {
+	var errs []error
+	for _, p := range paths {
+		if err := l.purge(p); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (l *LocalPurge) purge(p string) error {
+	prefix, wildcard := strings.CutSuffix(p, "*")
+	if strings.ContainsAny(prefix, `*?[\`) {
+		return fmt.Errorf("invalid path: %q", p)
+	}
+	clean := path.Clean("/" + prefix)
+	if strings.HasSuffix(prefix, "/") && clean != "/" {
+		clean += "/"
+	}
+	if clean != prefix || clean == "/" {
+		return fmt.Errorf("invalid path: %q", p)
+	}
+
+	if !wildcard {
+		err := os.Remove(filepath.Join(l.dir, filepath.FromSlash(clean)))
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+
+	// filepath.Join drops the trailing slash of a directory.
+	pattern := filepath.Join(l.dir, filepath.FromSlash(clean)) + "*"
+	if strings.HasSuffix(clean, "/") {
+		pattern = filepath.Join(l.dir, filepath.FromSlash(clean), "*")
+	}
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return err
+	}
+	for _, m := range matches {
+		if err := os.RemoveAll(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package invalidation
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// Webhook posts the paths to a URL as a JSON object {"paths": [...]}, for
+// CDNs and caches other than CloudFront.
+type Webhook struct {
+	url     string
+	client  *http.Client
+	headers map[string]string
+}
+
+type WebhookOption func(*Webhook)
+
+func WithHTTPClient(c *http.Client) WebhookOption {
+	return func(w *Webhook) {
+		w.client = c
+	}
+}
+
+// WithHeader sets a header of the requests, such as an Authorization
+// header.
+func WithHeader(key, value string) WebhookOption {
+	return func(w *Webhook) {
+		w.headers[key] = value
+	}
+}
+
+func NewWebhook(url string, opts ...WebhookOption) *Webhook {
+	w := &Webhook{
+		url:     url,
+		client:  &http.Client{Timeout: 30 * time.Second},
+		headers: make(map[string]string),
+	}
+	for _, opt := range opts {
+		opt(w)
+	}
+	return w
+}
+
+type webhookRequest struct {
+	Paths []string `json:"paths"`
+}
+
+func (w *Webhook) Invalidate(ctx context.Context, paths []string) error {
+	body, err := json.Marshal(&webhookRequest{Paths: paths})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range w.headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook %s: %s", w.url, resp.Status)
+	}
+	return nil
+}
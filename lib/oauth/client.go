@@ -0,0 +1,207 @@
+// Package oauth authorizes the archive to read accounts with atproto OAuth,
+// so that users do not have to give an app password. Sessions, with their
+// DPoP keys and refresh tokens, are kept sealed in the user DB.
+package oauth
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+
+	"github.com/bluesky-social/indigo/atproto/atclient"
+	indigooauth "github.com/bluesky-social/indigo/atproto/auth/oauth"
+	"github.com/bluesky-social/indigo/atproto/identity"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+
+	"github.com/yunomu/bskylog/lib/crawlerdb"
+	"github.com/yunomu/bskylog/lib/signup"
+)
+
+// Scopes are the scopes requested. transition:generic lets the PDS proxy
+// app.bsky requests, such as the author feed, to the AppView.
+var Scopes = []string{"atproto", "transition:generic"}
+
+type Client struct {
+	app       *indigooauth.ClientApp
+	store     *Store
+	crawlerDB crawlerdb.DB
+	crawler   signup.Crawler
+	logger    *slog.Logger
+}
+
+type Option func(*Client)
+
+// WithCrawler starts the first crawl of accounts new to the crawler with
+// cr. Without it, they are crawled at the next trigger.
+func WithCrawler(cr signup.Crawler) Option {
+	return func(c *Client) {
+		c.crawler = cr
+	}
+}
+
+// WithDirectory sets the directory resolving accounts to their PDS.
+func WithDirectory(dir identity.Directory) Option {
+	return func(c *Client) {
+		c.app.Dir = dir
+	}
+}
+
+// WithHTTPClient sets the HTTP client of the requests to the authorization
+// server and the PDS.
+func WithHTTPClient(client *http.Client) Option {
+	return func(c *Client) {
+		c.app.Client = client
+	}
+}
+
+func WithLogger(l *slog.Logger) Option {
+	return func(c *Client) {
+		if l == nil {
+			c.logger = slog.Default()
+		} else {
+			c.logger = l
+		}
+	}
+}
+
+// NewClient returns a client whose metadata document is at clientID and
+// whose callback is callbackURL. An empty clientID is the localhost client
+// for development, which needs no metadata document. Authorized accounts
+// are added to crawlerDB.
+func NewClient(clientID, callbackURL string, store *Store, crawlerDB crawlerdb.DB, opts ...Option) *Client {
+	var config indigooauth.ClientConfig
+	if clientID == "" {
+		config = indigooauth.NewLocalhostConfig(callbackURL, Scopes)
+	} else {
+		config = indigooauth.NewPublicConfig(clientID, callbackURL, Scopes)
+	}
+	config.UserAgent = "bskylog"
+
+	c := &Client{
+		app:       indigooauth.NewClientApp(&config, store),
+		store:     store,
+		crawlerDB: crawlerDB,
+		logger:    slog.Default(),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// ClientMetadata returns the metadata document to serve at the client ID.
+func (c *Client) ClientMetadata() indigooauth.ClientMetadata {
+	m := c.app.Config.ClientMetadata()
+	name := "bskylog"
+	m.ClientName = &name
+	return m
+}
+
+// Start starts the authorization of the account identifier, a handle or a
+// DID, and returns the URL to send the user to. The time zone, in minutes
+// east of UTC, is set at the callback unless nil.
+func (c *Client) Start(ctx context.Context, identifier string, timeZone *int) (string, error) {
+	atid, err := syntax.ParseAtIdentifier(identifier)
+	if err != nil {
+		return "", fmt.Errorf("invalid account identifier %q: %w", identifier, err)
+	}
+	ident, err := c.app.Dir.Lookup(ctx, *atid)
+	if err != nil {
+		return "", fmt.Errorf("resolve %q: %w", identifier, err)
+	}
+	host := ident.PDSEndpoint()
+	if host == "" {
+		return "", fmt.Errorf("no PDS for %s", ident.DID)
+	}
+
+	authServerURL, err := c.app.Resolver.ResolveAuthServerURL(ctx, host)
+	if err != nil {
+		return "", fmt.Errorf("resolve auth server: %w", err)
+	}
+	meta, err := c.app.Resolver.ResolveAuthServerMetadata(ctx, authServerURL)
+	if err != nil {
+		return "", fmt.Errorf("auth server metadata: %w", err)
+	}
+
+	return c.authorize(ctx, meta, ident.DID, identifier, timeZone)
+}
+
+// authorize sends the pushed authorization request of the account to the
+// authorization server and returns the URL of the authorization endpoint.
+func (c *Client) authorize(ctx context.Context, meta *indigooauth.AuthServerMetadata, did syntax.DID, loginHint string, timeZone *int) (string, error) {
+	info, err := c.app.SendAuthRequest(ctx, meta, c.app.Config.Scopes, loginHint)
+	if err != nil {
+		return "", fmt.Errorf("auth request: %w", err)
+	}
+	info.AccountDID = &did
+	if err := c.store.putAuthRequest(ctx, &authRequest{AuthRequestData: *info, TimeZone: timeZone}); err != nil {
+		return "", err
+	}
+
+	params := url.Values{}
+	params.Set("client_id", c.app.Config.ClientID)
+	params.Set("request_uri", info.RequestURI)
+	return meta.AuthorizationEndpoint + "?" + params.Encode(), nil
+}
+
+// Callback completes the authorization with the parameters of the callback
+// and saves the session, with the settings given at the start. Accounts new
+// to the crawler are added to it, and their first crawl is started. It
+// returns the DID of the account.
+func (c *Client) Callback(ctx context.Context, params url.Values) (string, error) {
+	// The request is deleted by ProcessCallback, which fails if it is not
+	// found.
+	var timeZone *int
+	if req, err := c.store.getAuthRequest(ctx, params.Get("state")); err == nil {
+		timeZone = req.TimeZone
+	}
+
+	sess, err := c.app.ProcessCallback(ctx, params)
+	if err != nil {
+		return "", err
+	}
+	did := sess.AccountDID.String()
+
+	var handle string
+	ident, err := c.app.Dir.LookupDID(ctx, sess.AccountDID)
+	if err != nil {
+		c.logger.Warn("LookupDID", "err", err, "did", did)
+	} else {
+		handle = ident.Handle.String()
+	}
+	user, err := c.store.update(ctx, did, handle, timeZone)
+	if err != nil {
+		c.logger.Error("Update user", "err", err, "did", did)
+		return "", err
+	}
+
+	created, err := crawlerdb.Seed(ctx, c.crawlerDB, did)
+	if err != nil {
+		c.logger.Error("crawlerdb.Seed", "err", err, "did", did)
+		return "", err
+	}
+	// A failed first crawl is left to the trigger, as the user is due.
+	if created && !user.Paused && c.crawler != nil {
+		if err := c.crawler.Crawl(ctx, did); err != nil {
+			c.logger.Warn("Failed to start the first crawl", "err", err, "did", did)
+		}
+	}
+
+	return did, nil
+}
+
+// APIClient returns a client of the PDS of did authorized by its session.
+// The client refreshes expired access tokens and saves the new tokens.
+func (c *Client) APIClient(ctx context.Context, did string) (*atclient.APIClient, error) {
+	d, err := syntax.ParseDID(did)
+	if err != nil {
+		return nil, err
+	}
+	sess, err := c.app.ResumeSession(ctx, d, "")
+	if err != nil {
+		return nil, err
+	}
+	return sess.APIClient(), nil
+}
@@ -0,0 +1,104 @@
+package oauth_test
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/lambda"
+
+	"github.com/bluesky-social/indigo/atproto/identity"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+
+	crawlerhandler "github.com/yunomu/bskylog/crawler/handler"
+	"github.com/yunomu/bskylog/lib/crawlerdb"
+	"github.com/yunomu/bskylog/lib/oauth"
+	"github.com/yunomu/bskylog/lib/pds"
+	"github.com/yunomu/bskylog/lib/storage"
+	"github.com/yunomu/bskylog/lib/userdb"
+)
+
+type nopLambda struct{}
+
+func (nopLambda) Invoke(ctx context.Context, params *lambda.InvokeInput, optFns ...func(*lambda.Options)) (*lambda.InvokeOutput, error) {
+	return &lambda.InvokeOutput{}, nil
+}
+
+// Accounts added only through OAuth are crawled with their sessions.
+func TestClient_Callback_crawl(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	const did = "did:plc:alice"
+	// The post is on January 2 in UTC+9.
+	s := oauth.NewStandIn(t, did, `{"feed":[{"post":{"author":{"did":"`+did+`","handle":"alice.test"},"cid":"cid1","indexedAt":"2026-01-01T20:00:00Z","uri":"at://`+did+`/app.bsky.feed.post/cid1","record":{"$type":"app.bsky.feed.post","createdAt":"2026-01-01T20:00:00Z","text":"first post"}}}]}`)
+	mock := identity.NewMockDirectory()
+	mock.Insert(identity.Identity{
+		DID:    syntax.DID(did),
+		Handle: syntax.Handle("alice.test"),
+		Services: map[string]identity.ServiceEndpoint{
+			"atproto_pds": {Type: "AtprotoPersonalDataServer", URL: s.URL()},
+		},
+	})
+
+	sealer, err := userdb.NewAESGCM(make([]byte, 32))
+	if err != nil {
+		t.Fatalf("NewAESGCM: %v", err)
+	}
+	users := userdb.NewFile(filepath.Join(dir, "users.json"))
+	crawlerDB := crawlerdb.NewFile(filepath.Join(dir, "crawler.json"))
+	c := oauth.NewClient("", "http://127.0.0.1/oauth/callback",
+		oauth.NewStore(users, oauth.NewMemRequests(), sealer),
+		crawlerDB,
+		oauth.WithDirectory(&mock),
+		oauth.WithLogger(logger),
+	)
+
+	timeZone := 540
+	redirect, err := c.AuthorizeWith(ctx, s, did, &timeZone)
+	if err != nil {
+		t.Fatalf("authorize: %v", err)
+	}
+	if _, err := c.Callback(ctx, s.Approve(redirect)); err != nil {
+		t.Fatalf("Callback: %v", err)
+	}
+	user, err := users.Get(ctx, did)
+	if err != nil || user.TimeZone != timeZone {
+		t.Fatalf("user: got %+v, %v", user, err)
+	}
+
+	client := storage.NewLocal(filepath.Join(dir, "buckets"))
+	h := crawlerhandler.NewHandler(
+		pds.NewResolver(&mock, users, pds.WithLogger(logger)),
+		users,
+		sealer,
+		c,
+		crawlerDB,
+		client,
+		"publish",
+		nil,
+		nopLambda{},
+		"index",
+		"index",
+		nil,
+		logger,
+	)
+	run, err := h.Handle(ctx, &crawlerhandler.Request{Did: did})
+	if err != nil || run.ErrorClass != "" || run.Posts != 1 {
+		t.Fatalf("crawl: got %+v, %v", run, err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "buckets", "publish", did, "2026", "01", "02"))
+	if err != nil || !strings.Contains(string(data), "first post") {
+		t.Errorf("day file: got %q, %v", data, err)
+	}
+	ts, err := crawlerDB.Get(ctx, did)
+	if err != nil || ts.LatestCid != "cid1" {
+		t.Errorf("crawler DB: got %+v, %v", ts, err)
+	}
+}
@@ -0,0 +1,37 @@
+package oauth
+
+import (
+	"context"
+	"net/url"
+	"testing"
+
+	"github.com/bluesky-social/indigo/atproto/syntax"
+
+	"github.com/yunomu/bskylog/lib/userdb"
+)
+
+// The stand-in is exported to the tests of package oauth_test, which crawl
+// with the crawler handler, itself importing this package.
+
+type StandIn = standIn
+
+func NewStandIn(t *testing.T, did, feed string) *StandIn {
+	return newStandIn(t, did, feed)
+}
+
+func (s *standIn) URL() string {
+	return s.url
+}
+
+func (s *standIn) Approve(redirect string) url.Values {
+	return s.approve(redirect)
+}
+
+func NewMemRequests() userdb.AuthRequests {
+	return &memRequests{requests: make(map[string]string)}
+}
+
+// AuthorizeWith starts the authorization of did at the stand-in s.
+func (c *Client) AuthorizeWith(ctx context.Context, s *StandIn, did string, timeZone *int) (string, error) {
+	return c.authorize(ctx, s.metadata(), syntax.DID(did), did, timeZone)
+}
@@ -0,0 +1,396 @@
+package oauth
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/bluesky-social/indigo/api/bsky"
+	indigooauth "github.com/bluesky-social/indigo/atproto/auth/oauth"
+	"github.com/bluesky-social/indigo/atproto/identity"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+
+	"github.com/yunomu/bskylog/lib/crawlerdb"
+	"github.com/yunomu/bskylog/lib/userdb"
+)
+
+type memUsers struct {
+	mu    sync.Mutex
+	users map[string]userdb.User
+}
+
+func (m *memUsers) Get(ctx context.Context, did string) (*userdb.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.users[did]
+	if !ok {
+		return nil, userdb.ErrNotExists
+	}
+	return &u, nil
+}
+
+func (m *memUsers) GetByHandle(ctx context.Context, handle string) (*userdb.User, error) {
+	return nil, userdb.ErrNotExists
+}
+
+func (m *memUsers) Scan(ctx context.Context, f func(*userdb.User) error) error {
+	return nil
+}
+
+func (m *memUsers) Put(ctx context.Context, user *userdb.User) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.users[user.Did] = *user
+	return nil
+}
+
+func (m *memUsers) SetNextDue(ctx context.Context, did string, prev, next time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.users[did]
+	if !ok || !u.NextDue.Equal(prev) {
+		return userdb.ErrConflict
+	}
+	u.NextDue = next
+	m.users[did] = u
+	return nil
+}
+
+func (m *memUsers) SetSchedule(ctx context.Context, did string, nextDue time.Time, failures int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.users[did]
+	if !ok {
+		return userdb.ErrNotExists
+	}
+	u.NextDue = nextDue
+	u.Failures = failures
+	m.users[did] = u
+	return nil
+}
+
+func (m *memUsers) SetIdentity(ctx context.Context, user *userdb.User) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.users[user.Did]
+	if !ok {
+		return userdb.ErrNotExists
+	}
+	u.PDS = user.PDS
+	u.ResolvedAt = user.ResolvedAt
+	u.Handle = user.Handle
+	u.Handles = user.Handles
+	m.users[user.Did] = u
+	return nil
+}
+
+func (m *memUsers) Delete(ctx context.Context, did string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.users, did)
+	return nil
+}
+
+type recordCrawler struct {
+	dids []string
+}
+
+func (r *recordCrawler) Crawl(ctx context.Context, did string) error {
+	r.dids = append(r.dids, did)
+	return nil
+}
+
+type memRequests struct {
+	mu       sync.Mutex
+	requests map[string]string
+}
+
+func (m *memRequests) GetAuthRequest(ctx context.Context, state string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	v, ok := m.requests[state]
+	if !ok {
+		return "", userdb.ErrNotExists
+	}
+	return v, nil
+}
+
+func (m *memRequests) PutAuthRequest(ctx context.Context, state, sealed string, expiresAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests[state] = sealed
+	return nil
+}
+
+func (m *memRequests) DeleteAuthRequest(ctx context.Context, state string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.requests, state)
+	return nil
+}
+
+// standIn is a stand-in authorization server and PDS. Access tokens
+// expire after one use.
+type standIn struct {
+	t   *testing.T
+	did string
+	// feed is the author feed served.
+	feed string
+
+	mu         sync.Mutex
+	url        string
+	challenges map[string]string // request_uri to code challenge
+	states     map[string]string // request_uri to state
+	codes      map[string]string // code to code challenge
+	access     string
+	refresh    string
+	tokens     int
+}
+
+// checkDPoP checks that the request carries a DPoP proof for itself.
+func (s *standIn) checkDPoP(r *http.Request) bool {
+	parts := strings.Split(r.Header.Get("DPoP"), ".")
+	if len(parts) != 3 {
+		return false
+	}
+	header, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return false
+	}
+	var h struct {
+		Typ string `json:"typ"`
+		Alg string `json:"alg"`
+	}
+	var c struct {
+		Htm string `json:"htm"`
+		Htu string `json:"htu"`
+	}
+	if json.Unmarshal(header, &h) != nil || json.Unmarshal(payload, &c) != nil {
+		return false
+	}
+	return h.Typ == "dpop+jwt" && h.Alg == "ES256" && c.Htm == r.Method && c.Htu == s.url+r.URL.Path
+}
+
+func (s *standIn) issue(w http.ResponseWriter) {
+	s.tokens++
+	s.access = fmt.Sprintf("access%d", s.tokens)
+	s.refresh = fmt.Sprintf("refresh%d", s.tokens)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&indigooauth.TokenResponse{
+		Subject:      s.did,
+		Scope:        strings.Join(Scopes, " "),
+		AccessToken:  s.access,
+		RefreshToken: s.refresh,
+	})
+}
+
+func (s *standIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch r.URL.Path {
+	case "/par":
+		if !s.checkDPoP(r) || r.FormValue("code_challenge_method") != "S256" || r.FormValue("client_id") == "" {
+			http.Error(w, `{"error":"invalid_request"}`, http.StatusBadRequest)
+			return
+		}
+		uri := fmt.Sprintf("urn:ietf:params:oauth:request_uri:%d", len(s.challenges))
+		s.challenges[uri] = r.FormValue("code_challenge")
+		s.states[uri] = r.FormValue("state")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(&indigooauth.PushedAuthResponse{RequestURI: uri, ExpiresIn: 60})
+
+	case "/token":
+		if !s.checkDPoP(r) {
+			http.Error(w, `{"error":"invalid_dpop_proof"}`, http.StatusBadRequest)
+			return
+		}
+		switch r.FormValue("grant_type") {
+		case "authorization_code":
+			challenge, ok := s.codes[r.FormValue("code")]
+			if !ok || indigooauth.S256CodeChallenge(r.FormValue("code_verifier")) != challenge {
+				http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+				return
+			}
+			delete(s.codes, r.FormValue("code"))
+		case "refresh_token":
+			if r.FormValue("refresh_token") != s.refresh {
+				http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+				return
+			}
+		default:
+			http.Error(w, `{"error":"unsupported_grant_type"}`, http.StatusBadRequest)
+			return
+		}
+		s.issue(w)
+
+	case "/xrpc/app.bsky.feed.getAuthorFeed":
+		if !s.checkDPoP(r) || s.access == "" || r.Header.Get("Authorization") != "DPoP "+s.access {
+			w.Header().Set("WWW-Authenticate", `DPoP error="invalid_token"`)
+			http.Error(w, `{"error":"InvalidToken"}`, http.StatusUnauthorized)
+			return
+		}
+		s.access = ""
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, s.feed)
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// newStandIn starts a stand-in for the account did serving feed.
+func newStandIn(t *testing.T, did, feed string) *standIn {
+	t.Helper()
+	s := &standIn{
+		t:          t,
+		did:        did,
+		feed:       feed,
+		challenges: make(map[string]string),
+		states:     make(map[string]string),
+		codes:      make(map[string]string),
+	}
+	srv := httptest.NewServer(s)
+	t.Cleanup(srv.Close)
+	s.url = srv.URL
+	return s
+}
+
+// metadata is the metadata of the stand-in authorization server.
+func (s *standIn) metadata() *indigooauth.AuthServerMetadata {
+	return &indigooauth.AuthServerMetadata{
+		Issuer:                             s.url,
+		AuthorizationEndpoint:              s.url + "/authorize",
+		TokenEndpoint:                      s.url + "/token",
+		PushedAuthorizationRequestEndpoint: s.url + "/par",
+	}
+}
+
+// approve is the user approving the authorization at redirect. It returns
+// the parameters of the callback.
+func (s *standIn) approve(redirect string) url.Values {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, err := url.Parse(redirect)
+	if err != nil {
+		s.t.Fatalf("redirect: %v", err)
+	}
+	uri := u.Query().Get("request_uri")
+	code := fmt.Sprintf("code%d", len(s.codes))
+	s.codes[code] = s.challenges[uri]
+	return url.Values{
+		"state": {s.states[uri]},
+		"iss":   {s.url},
+		"code":  {code},
+	}
+}
+
+func TestClient(t *testing.T) {
+	ctx := context.Background()
+	did := "did:plc:alice"
+
+	s := newStandIn(t, did, `{"feed":[]}`)
+
+	dir := identity.NewMockDirectory()
+	dir.Insert(identity.Identity{
+		DID:    syntax.DID(did),
+		Handle: syntax.Handle("alice.test"),
+		Services: map[string]identity.ServiceEndpoint{
+			"atproto_pds": {Type: "AtprotoPersonalDataServer", URL: s.url},
+		},
+	})
+
+	users := &memUsers{users: map[string]userdb.User{did: {Did: did, TimeZone: 540}}}
+	sealer, err := userdb.NewAESGCM(bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatalf("NewAESGCM: %v", err)
+	}
+	store := NewStore(users, &memRequests{requests: make(map[string]string)}, sealer)
+	crawlerDB := crawlerdb.NewFile(filepath.Join(t.TempDir(), "crawler.json"))
+	crawler := &recordCrawler{}
+	c := NewClient("", "http://127.0.0.1/oauth/callback", store, crawlerDB,
+		WithDirectory(&dir),
+		WithCrawler(crawler),
+		WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil))),
+	)
+
+	redirect, err := c.authorize(ctx, s.metadata(), syntax.DID(did), "alice.test", nil)
+	if err != nil {
+		t.Fatalf("authorize: %v", err)
+	}
+	if !strings.HasPrefix(redirect, s.url+"/authorize?") {
+		t.Errorf("redirect: got %q", redirect)
+	}
+
+	got, err := c.Callback(ctx, s.approve(redirect))
+	if err != nil {
+		t.Fatalf("Callback: %v", err)
+	}
+	if got != did {
+		t.Errorf("Callback: got %q, want %q", got, did)
+	}
+
+	// The time zone is kept, as none was given.
+	user, _ := users.Get(ctx, did)
+	if user.Handle != "alice.test" || user.TimeZone != 540 || !userdb.IsSealed(user.OAuthSession) {
+		t.Errorf("user: %+v", user)
+	}
+	if _, err := crawlerDB.Get(ctx, did); err != nil {
+		t.Errorf("crawler DB: %v", err)
+	}
+	if diff := cmp.Diff([]string{did}, crawler.dids); diff != "" {
+		t.Errorf("crawls mismatch (-want +got):\n%s", diff)
+	}
+
+	// The first request uses the access token, and the second one
+	// refreshes it.
+	for i := range 2 {
+		client, err := c.APIClient(ctx, did)
+		if err != nil {
+			t.Fatalf("APIClient: %v", err)
+		}
+		if _, err := bsky.FeedGetAuthorFeed(ctx, client, did, "", "posts_with_replies", false, 100); err != nil {
+			t.Fatalf("FeedGetAuthorFeed %d: %v", i, err)
+		}
+	}
+
+	sess, err := store.GetSession(ctx, syntax.DID(did), "")
+	if err != nil {
+		t.Fatalf("GetSession: %v", err)
+	}
+	if sess.RefreshToken != "refresh2" || sess.AccessToken != "access2" {
+		t.Errorf("refreshed session: access %q, refresh %q", sess.AccessToken, sess.RefreshToken)
+	}
+}
+
+func TestStore_GetSession_none(t *testing.T) {
+	ctx := context.Background()
+	sealer, _ := userdb.NewAESGCM(bytes.Repeat([]byte{1}, 32))
+	users := &memUsers{users: map[string]userdb.User{"did:plc:a": {Did: "did:plc:a"}}}
+	store := NewStore(users, &memRequests{requests: make(map[string]string)}, sealer)
+
+	for _, did := range []string{"did:plc:a", "did:plc:b"} {
+		if _, err := store.GetSession(ctx, syntax.DID(did), ""); err != ErrNoSession {
+			t.Errorf("GetSession(%s): got %v, want ErrNoSession", did, err)
+		}
+	}
+}
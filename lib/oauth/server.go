@@ -0,0 +1,109 @@
+package oauth
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+
+	"github.com/yunomu/bskylog/lib/signup"
+)
+
+// Server serves the OAuth client as a Lambda function URL handler:
+//
+//	/oauth/client-metadata.json  the client metadata document
+//	/oauth/login?handle=...      starts the authorization of the account,
+//	                             with its time zone in &timezone=minutes
+//	/oauth/callback              completes it and redirects to the archive
+type Server struct {
+	client *Client
+}
+
+func NewServer(client *Client) *Server {
+	return &Server{client: client}
+}
+
+// Handles reports whether path is served by Handle.
+func Handles(path string) bool {
+	return strings.HasPrefix(path, "/oauth/")
+}
+
+func (s *Server) Handle(ctx context.Context, req *events.LambdaFunctionURLRequest) (*events.LambdaFunctionURLResponse, error) {
+	switch req.RawPath {
+	case "/oauth/client-metadata.json":
+		b, err := json.Marshal(s.client.ClientMetadata())
+		if err != nil {
+			s.client.logger.Error("Failed to marshal client metadata", "err", err)
+			return &events.LambdaFunctionURLResponse{StatusCode: http.StatusInternalServerError}, nil
+		}
+		return &events.LambdaFunctionURLResponse{
+			StatusCode: http.StatusOK,
+			Headers: map[string]string{
+				"Content-Type": "application/json",
+			},
+			Body: string(b),
+		}, nil
+
+	case "/oauth/login":
+		handle := req.QueryStringParameters["handle"]
+		if handle == "" {
+			return textResponse(http.StatusBadRequest, "handle is required"), nil
+		}
+		var timeZone *int
+		if v := req.QueryStringParameters["timezone"]; v != "" {
+			tz, err := strconv.Atoi(v)
+			if err == nil {
+				err = signup.ValidateTimeZone(tz)
+			}
+			if err != nil {
+				return textResponse(http.StatusBadRequest, "invalid timezone "+v), nil
+			}
+			timeZone = &tz
+		}
+		redirect, err := s.client.Start(ctx, strings.TrimPrefix(handle, "@"), timeZone)
+		if err != nil {
+			s.client.logger.Warn("Failed to start authorization", "err", err, "handle", handle)
+			return textResponse(http.StatusBadRequest, "cannot authorize "+handle), nil
+		}
+		return redirectResponse(redirect), nil
+
+	case "/oauth/callback":
+		params := make(url.Values)
+		for k, v := range req.QueryStringParameters {
+			params.Set(k, v)
+		}
+		did, err := s.client.Callback(ctx, params)
+		if err != nil {
+			s.client.logger.Warn("Failed to complete authorization", "err", err)
+			return textResponse(http.StatusBadRequest, "authorization failed"), nil
+		}
+		s.client.logger.Info("Authorized", "did", did)
+		return redirectResponse("/" + did), nil
+	}
+
+	return textResponse(http.StatusNotFound, "not found"), nil
+}
+
+func textResponse(status int, body string) *events.LambdaFunctionURLResponse {
+	return &events.LambdaFunctionURLResponse{
+		StatusCode: status,
+		Headers: map[string]string{
+			"Content-Type": "text/plain; charset=utf-8",
+		},
+		Body: body,
+	}
+}
+
+func redirectResponse(location string) *events.LambdaFunctionURLResponse {
+	return &events.LambdaFunctionURLResponse{
+		StatusCode: http.StatusFound,
+		Headers: map[string]string{
+			"Location":      location,
+			"Cache-Control": "no-store",
+		},
+	}
+}
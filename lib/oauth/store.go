@@ -0,0 +1,173 @@
+package oauth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	indigooauth "github.com/bluesky-social/indigo/atproto/auth/oauth"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+
+	"github.com/yunomu/bskylog/lib/userdb"
+)
+
+// ErrNoSession is returned for accounts without an OAuth session.
+var ErrNoSession = errors.New("no OAuth session")
+
+// requestTTL is how long an authorization request waits for the callback.
+const requestTTL = 30 * time.Minute
+
+// Store keeps OAuth sessions sealed in the user DB, one per account, and the
+// authorization requests in progress in AuthRequests.
+type Store struct {
+	users    userdb.DB
+	requests userdb.AuthRequests
+	sealer   userdb.Sealer
+}
+
+var _ indigooauth.ClientAuthStore = (*Store)(nil)
+
+func NewStore(users userdb.DB, requests userdb.AuthRequests, sealer userdb.Sealer) *Store {
+	return &Store{
+		users:    users,
+		requests: requests,
+		sealer:   sealer,
+	}
+}
+
+// GetSession returns the session of did. An empty sessionID matches any
+// session.
+func (s *Store) GetSession(ctx context.Context, did syntax.DID, sessionID string) (*indigooauth.ClientSessionData, error) {
+	user, err := s.users.Get(ctx, did.String())
+	if errors.Is(err, userdb.ErrNotExists) {
+		return nil, ErrNoSession
+	} else if err != nil {
+		return nil, err
+	}
+	if user.OAuthSession == "" {
+		return nil, ErrNoSession
+	}
+
+	b, err := s.sealer.Open(ctx, user.Did, user.OAuthSession)
+	if err != nil {
+		return nil, err
+	}
+	var sess indigooauth.ClientSessionData
+	if err := json.Unmarshal([]byte(b), &sess); err != nil {
+		return nil, err
+	}
+	if sessionID != "" && sess.SessionID != sessionID {
+		return nil, ErrNoSession
+	}
+	return &sess, nil
+}
+
+// SaveSession replaces the session of the account, adding the account to
+// the user DB if it is not there.
+func (s *Store) SaveSession(ctx context.Context, sess indigooauth.ClientSessionData) error {
+	b, err := json.Marshal(&sess)
+	if err != nil {
+		return err
+	}
+	did := sess.AccountDID.String()
+	sealed, err := s.sealer.Seal(ctx, did, string(b))
+	if err != nil {
+		return err
+	}
+
+	user, err := s.users.Get(ctx, did)
+	if errors.Is(err, userdb.ErrNotExists) {
+		user = &userdb.User{Did: did}
+	} else if err != nil {
+		return err
+	}
+	user.OAuthSession = sealed
+	return s.users.Put(ctx, user)
+}
+
+func (s *Store) DeleteSession(ctx context.Context, did syntax.DID, sessionID string) error {
+	user, err := s.users.Get(ctx, did.String())
+	if errors.Is(err, userdb.ErrNotExists) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	user.OAuthSession = ""
+	return s.users.Put(ctx, user)
+}
+
+// requestSubject is what authorization requests are sealed for, since the
+// account is not known before the callback.
+func requestSubject(state string) string {
+	return "state:" + state
+}
+
+// authRequest is an authorization request with the settings of the account
+// given at the login, which are applied at the callback.
+type authRequest struct {
+	indigooauth.AuthRequestData
+	TimeZone *int `json:"timezone,omitempty"`
+}
+
+func (s *Store) getAuthRequest(ctx context.Context, state string) (*authRequest, error) {
+	sealed, err := s.requests.GetAuthRequest(ctx, state)
+	if err != nil {
+		return nil, err
+	}
+	b, err := s.sealer.Open(ctx, requestSubject(state), sealed)
+	if err != nil {
+		return nil, err
+	}
+	var req authRequest
+	if err := json.Unmarshal([]byte(b), &req); err != nil {
+		return nil, err
+	}
+	return &req, nil
+}
+
+func (s *Store) putAuthRequest(ctx context.Context, req *authRequest) error {
+	b, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	sealed, err := s.sealer.Seal(ctx, requestSubject(req.State), string(b))
+	if err != nil {
+		return err
+	}
+	return s.requests.PutAuthRequest(ctx, req.State, sealed, time.Now().Add(requestTTL))
+}
+
+func (s *Store) GetAuthRequestInfo(ctx context.Context, state string) (*indigooauth.AuthRequestData, error) {
+	req, err := s.getAuthRequest(ctx, state)
+	if err != nil {
+		return nil, err
+	}
+	return &req.AuthRequestData, nil
+}
+
+func (s *Store) SaveAuthRequestInfo(ctx context.Context, info indigooauth.AuthRequestData) error {
+	return s.putAuthRequest(ctx, &authRequest{AuthRequestData: info})
+}
+
+func (s *Store) DeleteAuthRequestInfo(ctx context.Context, state string) error {
+	return s.requests.DeleteAuthRequest(ctx, state)
+}
+
+// update records the handle of the account, unless empty, in its handle
+// history and sets its time zone, unless nil.
+func (s *Store) update(ctx context.Context, did, handle string, timeZone *int) (*userdb.User, error) {
+	user, err := s.users.Get(ctx, did)
+	if err != nil {
+		return nil, err
+	}
+	changed := handle != "" && user.SetHandle(handle, time.Now())
+	if timeZone != nil && user.TimeZone != *timeZone {
+		user.TimeZone = *timeZone
+		changed = true
+	}
+	if !changed {
+		return user, nil
+	}
+	return user, s.users.Put(ctx, user)
+}
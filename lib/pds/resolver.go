@@ -0,0 +1,149 @@
+// Package pds resolves accounts to the PDS they are hosted on, so that
+// accounts outside of bsky.social can be crawled.
+package pds
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/identity"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+
+	"github.com/yunomu/bskylog/lib/userdb"
+)
+
+// DefaultPLCURL is the PLC directory resolving did:plc.
+const DefaultPLCURL = "https://plc.directory"
+
+// NewDirectory returns a directory resolving did:plc with the PLC directory
+// at plcURL, did:web over HTTPS and handles over DNS and HTTPS. Lookups are
+// cached in memory.
+func NewDirectory(plcURL string) identity.Directory {
+	if plcURL == "" {
+		plcURL = DefaultPLCURL
+	}
+	base := &identity.BaseDirectory{
+		PLCURL: plcURL,
+		HTTPClient: http.Client{
+			Timeout: 10 * time.Second,
+		},
+		TryAuthoritativeDNS: true,
+		UserAgent:           "bskylog",
+	}
+	dir := identity.NewCacheDirectory(base, 10000, time.Hour, 2*time.Minute, 5*time.Minute)
+	return &dir
+}
+
+// Resolver resolves the PDS and the handle of users, keeping them in the
+// user DB.
+type Resolver struct {
+	dir    identity.Directory
+	users  userdb.DB
+	ttl    time.Duration
+	logger *slog.Logger
+}
+
+type Option func(*Resolver)
+
+// WithTTL sets how long a resolved PDS is used without resolving the DID
+// again.
+func WithTTL(ttl time.Duration) Option {
+	return func(r *Resolver) {
+		r.ttl = ttl
+	}
+}
+
+func WithLogger(l *slog.Logger) Option {
+	return func(r *Resolver) {
+		if l == nil {
+			r.logger = slog.Default()
+		} else {
+			r.logger = l
+		}
+	}
+}
+
+func NewResolver(dir identity.Directory, users userdb.DB, opts ...Option) *Resolver {
+	r := &Resolver{
+		dir:    dir,
+		users:  users,
+		ttl:    24 * time.Hour,
+		logger: slog.Default(),
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
+
+// Directory returns the directory of the resolver.
+func (r *Resolver) Directory() identity.Directory {
+	return r.dir
+}
+
+// Host returns the PDS of user. The PDS kept in the user is used within the
+// TTL.
+func (r *Resolver) Host(ctx context.Context, user *userdb.User) (string, error) {
+	if user.PDS != "" && time.Since(user.ResolvedAt) < r.ttl {
+		return user.PDS, nil
+	}
+	return r.Refresh(ctx, user)
+}
+
+// Refresh resolves the DID of user, and updates the PDS and the handle
+// history of user and of the user DB.
+func (r *Resolver) Refresh(ctx context.Context, user *userdb.User) (string, error) {
+	did, err := syntax.ParseDID(user.Did)
+	if err != nil {
+		return "", err
+	}
+	if err := r.dir.Purge(ctx, did.AtIdentifier()); err != nil {
+		r.logger.Warn("Purge", "err", err, "did", user.Did)
+	}
+	ident, err := r.dir.LookupDID(ctx, did)
+	if err != nil {
+		return "", fmt.Errorf("resolve %s: %w", user.Did, err)
+	}
+	host := ident.PDSEndpoint()
+	if host == "" {
+		return "", fmt.Errorf("no PDS for %s", user.Did)
+	}
+
+	if host != user.PDS {
+		r.logger.Info("PDS resolved", "did", user.Did, "pds", host, "previous", user.PDS)
+	}
+	user.PDS = host
+	user.ResolvedAt = time.Now()
+	// An unverified handle is handle.invalid, which is not kept.
+	if ident.Handle != syntax.HandleInvalid && user.SetHandle(ident.Handle.String(), user.ResolvedAt) {
+		r.logger.Info("Handle changed", "did", user.Did, "handle", user.Handle)
+	}
+	// Only the identity is written, as the rest of the user may have
+	// changed since it was read.
+	if err := r.users.SetIdentity(ctx, user); err != nil {
+		r.logger.Warn("Failed to keep the resolved PDS", "err", err, "did", user.Did)
+	}
+
+	return host, nil
+}
+
+// Lookup resolves identifier, a handle or a DID.
+func (r *Resolver) Lookup(ctx context.Context, identifier string) (*identity.Identity, error) {
+	return Lookup(ctx, r.dir, identifier)
+}
+
+// Lookup resolves identifier, a handle or a DID, with dir.
+func Lookup(ctx context.Context, dir identity.Directory, identifier string) (*identity.Identity, error) {
+	atid, err := syntax.ParseAtIdentifier(identifier)
+	if err != nil {
+		return nil, fmt.Errorf("invalid account identifier %q: %w", identifier, err)
+	}
+	ident, err := dir.Lookup(ctx, *atid)
+	if err != nil {
+		return nil, fmt.Errorf("resolve %q: %w", identifier, err)
+	}
+	return ident, nil
+}
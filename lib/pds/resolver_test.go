@@ -0,0 +1,203 @@
+package pds
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/identity"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+
+	"github.com/yunomu/bskylog/lib/userdb"
+)
+
+type memUsers struct {
+	mu    sync.Mutex
+	users map[string]userdb.User
+}
+
+func (m *memUsers) Get(ctx context.Context, did string) (*userdb.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.users[did]
+	if !ok {
+		return nil, userdb.ErrNotExists
+	}
+	return &u, nil
+}
+
+func (m *memUsers) GetByHandle(ctx context.Context, handle string) (*userdb.User, error) {
+	return nil, userdb.ErrNotExists
+}
+
+func (m *memUsers) Scan(ctx context.Context, f func(*userdb.User) error) error {
+	return nil
+}
+
+func (m *memUsers) Put(ctx context.Context, user *userdb.User) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.users[user.Did] = *user
+	return nil
+}
+
+func (m *memUsers) SetNextDue(ctx context.Context, did string, prev, next time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.users[did]
+	if !ok || !u.NextDue.Equal(prev) {
+		return userdb.ErrConflict
+	}
+	u.NextDue = next
+	m.users[did] = u
+	return nil
+}
+
+func (m *memUsers) SetSchedule(ctx context.Context, did string, nextDue time.Time, failures int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.users[did]
+	if !ok {
+		return userdb.ErrNotExists
+	}
+	u.NextDue = nextDue
+	u.Failures = failures
+	m.users[did] = u
+	return nil
+}
+
+func (m *memUsers) SetIdentity(ctx context.Context, user *userdb.User) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.users[user.Did]
+	if !ok {
+		return userdb.ErrNotExists
+	}
+	u.PDS = user.PDS
+	u.ResolvedAt = user.ResolvedAt
+	u.Handle = user.Handle
+	u.Handles = user.Handles
+	m.users[user.Did] = u
+	return nil
+}
+
+func (m *memUsers) Delete(ctx context.Context, did string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.users, did)
+	return nil
+}
+
+var discard = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// TestResolver_plc resolves against a stand-in PLC directory.
+func TestResolver_plc(t *testing.T) {
+	ctx := context.Background()
+
+	var mu sync.Mutex
+	requests := 0
+	pds := "https://pds1.example.com"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests++
+		if r.URL.Path != "/did:plc:alice" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/did+ld+json")
+		io.WriteString(w, `{"id":"did:plc:alice","service":[{"id":"#atproto_pds","type":"AtprotoPersonalDataServer","serviceEndpoint":"`+pds+`"}]}`)
+	}))
+	defer srv.Close()
+
+	users := &memUsers{users: make(map[string]userdb.User)}
+	r := NewResolver(NewDirectory(srv.URL), users, WithLogger(discard))
+
+	user := &userdb.User{Did: "did:plc:alice", Handle: "alice.test"}
+	users.users[user.Did] = *user
+	for range 2 {
+		host, err := r.Host(ctx, user)
+		if err != nil {
+			t.Fatalf("Host: %v", err)
+		}
+		if host != "https://pds1.example.com" {
+			t.Errorf("Host: got %q", host)
+		}
+	}
+	if requests != 1 {
+		t.Errorf("requests: got %d, want 1", requests)
+	}
+	// The handle is not verified against the stand-in, and is kept.
+	if got := users.users["did:plc:alice"]; got.PDS != "https://pds1.example.com" || got.ResolvedAt.IsZero() || got.Handle != "alice.test" {
+		t.Errorf("user: %+v", got)
+	}
+
+	// The account moved.
+	mu.Lock()
+	pds = "https://pds2.example.com"
+	mu.Unlock()
+	host, err := r.Refresh(ctx, user)
+	if err != nil {
+		t.Fatalf("Refresh: %v", err)
+	}
+	if host != "https://pds2.example.com" || requests != 2 {
+		t.Errorf("Refresh: got %q, requests %d", host, requests)
+	}
+
+	if _, err := r.Host(ctx, &userdb.User{Did: "did:plc:bob"}); err == nil {
+		t.Errorf("Host of an unknown DID: no error")
+	}
+}
+
+func TestResolver_handle(t *testing.T) {
+	ctx := context.Background()
+
+	dir := identity.NewMockDirectory()
+	dir.Insert(identity.Identity{
+		DID:    syntax.DID("did:plc:alice"),
+		Handle: syntax.Handle("alice2.test"),
+		Services: map[string]identity.ServiceEndpoint{
+			"atproto_pds": {Type: "AtprotoPersonalDataServer", URL: "https://pds.example.com"},
+		},
+	})
+	users := &memUsers{users: make(map[string]userdb.User)}
+	r := NewResolver(&dir, users, WithLogger(discard))
+
+	user := &userdb.User{Did: "did:plc:alice", Handle: "alice.test", PDS: "https://old.example.com"}
+	// Changed since user was read, and not overwritten.
+	paused := *user
+	paused.Paused = true
+	users.users[user.Did] = paused
+
+	if _, err := r.Refresh(ctx, user); err != nil {
+		t.Fatalf("Refresh: %v", err)
+	}
+	if user.Handle != "alice2.test" || users.users["did:plc:alice"].Handle != "alice2.test" {
+		t.Errorf("handle: got %q", user.Handle)
+	}
+	if got := users.users["did:plc:alice"]; !got.Paused || got.PDS != "https://pds.example.com" {
+		t.Errorf("user: %+v", got)
+	}
+
+	// Deleted users are not put back.
+	delete(users.users, user.Did)
+	if _, err := r.Refresh(ctx, user); err != nil {
+		t.Fatalf("Refresh: %v", err)
+	}
+	if _, ok := users.users[user.Did]; ok {
+		t.Errorf("deleted user put back")
+	}
+	if got := user.PastHandles(); len(got) != 1 || got[0] != "alice.test" || !user.HasHandle("alice.test") {
+		t.Errorf("past handles: got %v", got)
+	}
+
+	ident, err := r.Lookup(ctx, "alice2.test")
+	if err != nil || ident.DID != "did:plc:alice" {
+		t.Errorf("Lookup: got %v, %v", ident, err)
+	}
+}
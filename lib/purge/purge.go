@@ -0,0 +1,272 @@
+// Package purge removes accounts with all their data: the user, the
+// crawler state and crawl history, the day files and month indexes in the
+// publish bucket, and the search index with the batch manifests left for
+// it.
+package purge
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+
+	"github.com/bluesky-social/indigo/atproto/syntax"
+
+	indexhandler "github.com/yunomu/bskylog/index/handler"
+	"github.com/yunomu/bskylog/lib/crawlerdb"
+	"github.com/yunomu/bskylog/lib/invalidation"
+	"github.com/yunomu/bskylog/lib/userdb"
+)
+
+// maxDeleteKeys is the number of keys S3 deletes in a request.
+const maxDeleteKeys = 1000
+
+type S3Client interface {
+	ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error)
+	DeleteObjects(ctx context.Context, params *s3.DeleteObjectsInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectsOutput, error)
+}
+
+// Plan is what purging an account deletes.
+type Plan struct {
+	Did string `json:"did"`
+	// User and Crawler are whether the account is in the user DB and the
+	// crawler DB.
+	User    bool `json:"user"`
+	Crawler bool `json:"crawler"`
+	// Runs is the number of runs in the crawl history.
+	Runs int `json:"runs"`
+
+	PublishKeys []string `json:"publishKeys"`
+	IndexKeys   []string `json:"indexKeys"`
+	// ManifestKeys are the index batch manifests, with the posts of the
+	// account, not yet removed by the indexer.
+	ManifestKeys []string `json:"manifestKeys"`
+	// Paths are the CDN paths invalidated.
+	Paths []string `json:"paths"`
+}
+
+type Purger struct {
+	users         userdb.DB
+	crawlerDB     crawlerdb.DB
+	history       crawlerdb.History
+	s3Client      S3Client
+	publishBucket string
+	indexBucket   string
+
+	invalidator invalidation.Invalidator
+	logger      *slog.Logger
+}
+
+type Option func(*Purger)
+
+// WithInvalidator invalidates the paths of the account with inv.
+func WithInvalidator(inv invalidation.Invalidator) Option {
+	return func(p *Purger) {
+		p.invalidator = inv
+	}
+}
+
+func WithLogger(l *slog.Logger) Option {
+	return func(p *Purger) {
+		if l == nil {
+			p.logger = slog.Default()
+		} else {
+			p.logger = l
+		}
+	}
+}
+
+// NewPurger returns a purger of the accounts in users. Without history, as
+// when crawls are not kept, there are no runs to delete.
+func NewPurger(
+	users userdb.DB,
+	crawlerDB crawlerdb.DB,
+	history crawlerdb.History,
+	s3Client S3Client,
+	publishBucket string,
+	indexBucket string,
+	opts ...Option,
+) *Purger {
+	p := &Purger{
+		users:         users,
+		crawlerDB:     crawlerDB,
+		history:       history,
+		s3Client:      s3Client,
+		publishBucket: publishBucket,
+		indexBucket:   indexBucket,
+		logger:        slog.Default(),
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p
+}
+
+// Plan returns what purging did deletes, without deleting anything.
+func (p *Purger) Plan(ctx context.Context, did string) (*Plan, error) {
+	// The DID is a key prefix, which must not match other accounts, let
+	// alone the whole bucket.
+	if _, err := syntax.ParseDID(did); err != nil {
+		return nil, err
+	}
+
+	plan := &Plan{Did: did}
+
+	_, err := p.users.Get(ctx, did)
+	if err == nil {
+		plan.User = true
+	} else if !errors.Is(err, userdb.ErrNotExists) {
+		return nil, err
+	}
+	_, err = p.crawlerDB.Get(ctx, did)
+	if err == nil {
+		plan.Crawler = true
+	} else if !errors.Is(err, crawlerdb.ErrNotExists) {
+		return nil, err
+	}
+
+	if p.history != nil {
+		runs, err := p.history.Runs(ctx, did, math.MaxInt32)
+		if err != nil {
+			p.logger.Error("history.Runs", "err", err, "did", did)
+			return nil, err
+		}
+		plan.Runs = len(runs)
+	}
+
+	if plan.PublishKeys, err = p.accountKeys(ctx, p.publishBucket, did); err != nil {
+		return nil, err
+	}
+	// The index is kept in month shards under the DID and, from before
+	// sharding, in an object named by the DID.
+	if plan.IndexKeys, err = p.accountKeys(ctx, p.indexBucket, did); err != nil {
+		return nil, err
+	}
+	if plan.ManifestKeys, err = p.listKeys(ctx, p.indexBucket, indexhandler.ManifestPrefix+did+"/"); err != nil {
+		return nil, err
+	}
+	if len(plan.PublishKeys) != 0 && p.invalidator != nil {
+		plan.Paths = []string{"/" + did + "/*"}
+	}
+
+	return plan, nil
+}
+
+// accountKeys returns the keys of bucket that are did or under it.
+func (p *Purger) accountKeys(ctx context.Context, bucket, did string) ([]string, error) {
+	keys, err := p.listKeys(ctx, bucket, did)
+	if err != nil {
+		return nil, err
+	}
+	var ret []string
+	for _, key := range keys {
+		if key == did || strings.HasPrefix(key, did+"/") {
+			ret = append(ret, key)
+		}
+	}
+	return ret, nil
+}
+
+// listKeys returns the keys of bucket starting with prefix.
+func (p *Purger) listKeys(ctx context.Context, bucket, prefix string) ([]string, error) {
+	var keys []string
+	paginator := s3.NewListObjectsV2Paginator(p.s3Client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(prefix),
+	})
+	for paginator.HasMorePages() {
+		out, err := paginator.NextPage(ctx)
+		if err != nil {
+			p.logger.Error("ListObjectsV2", "err", err, "bucket", bucket, "prefix", prefix)
+			return nil, err
+		}
+		for _, obj := range out.Contents {
+			keys = append(keys, aws.ToString(obj.Key))
+		}
+	}
+	return keys, nil
+}
+
+// Purge deletes what plan lists. The user is deleted first, so that the
+// account is not crawled again, and crawls in progress stop before they
+// write anything more.
+func (p *Purger) Purge(ctx context.Context, plan *Plan) error {
+	if plan.User {
+		if err := p.users.Delete(ctx, plan.Did); err != nil {
+			p.logger.Error("userdb.Delete", "err", err, "did", plan.Did)
+			return err
+		}
+	}
+	if plan.Crawler {
+		if err := p.crawlerDB.Delete(ctx, plan.Did); err != nil {
+			p.logger.Error("crawlerdb.Delete", "err", err, "did", plan.Did)
+			return err
+		}
+	}
+	if plan.Runs != 0 && p.history != nil {
+		if _, err := p.history.DeleteRuns(ctx, plan.Did); err != nil {
+			p.logger.Error("history.DeleteRuns", "err", err, "did", plan.Did)
+			return err
+		}
+	}
+	if err := p.deleteKeys(ctx, p.publishBucket, plan.PublishKeys); err != nil {
+		return err
+	}
+	if err := p.deleteKeys(ctx, p.indexBucket, plan.IndexKeys); err != nil {
+		return err
+	}
+	if err := p.deleteKeys(ctx, p.indexBucket, plan.ManifestKeys); err != nil {
+		return err
+	}
+	if len(plan.Paths) != 0 && p.invalidator != nil {
+		if err := p.invalidator.Invalidate(ctx, plan.Paths); err != nil {
+			p.logger.Error("Invalidate", "err", err, "did", plan.Did)
+			return err
+		}
+	}
+
+	p.logger.Info("Purged",
+		"did", plan.Did,
+		"user", plan.User,
+		"crawler", plan.Crawler,
+		"runs", plan.Runs,
+		"publishKeys", len(plan.PublishKeys),
+		"indexKeys", len(plan.IndexKeys),
+		"manifestKeys", len(plan.ManifestKeys),
+	)
+	return nil
+}
+
+func (p *Purger) deleteKeys(ctx context.Context, bucket string, keys []string) error {
+	for len(keys) > 0 {
+		n := min(len(keys), maxDeleteKeys)
+		objects := make([]types.ObjectIdentifier, n)
+		for i, key := range keys[:n] {
+			objects[i] = types.ObjectIdentifier{Key: aws.String(key)}
+		}
+		out, err := p.s3Client.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+			Bucket: aws.String(bucket),
+			Delete: &types.Delete{
+				Objects: objects,
+				Quiet:   aws.Bool(true),
+			},
+		})
+		if err != nil {
+			p.logger.Error("DeleteObjects", "err", err, "bucket", bucket)
+			return err
+		}
+		if len(out.Errors) != 0 {
+			e := out.Errors[0]
+			p.logger.Error("DeleteObjects", "bucket", bucket, "errors", len(out.Errors), "key", aws.ToString(e.Key), "message", aws.ToString(e.Message))
+			return fmt.Errorf("delete %s/%s: %s", bucket, aws.ToString(e.Key), aws.ToString(e.Message))
+		}
+		keys = keys[n:]
+	}
+	return nil
+}
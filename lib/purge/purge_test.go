@@ -0,0 +1,185 @@
+package purge
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/google/go-cmp/cmp"
+
+	indexhandler "github.com/yunomu/bskylog/index/handler"
+	"github.com/yunomu/bskylog/lib/crawlerdb"
+	"github.com/yunomu/bskylog/lib/storage"
+	"github.com/yunomu/bskylog/lib/userdb"
+)
+
+type recordInvalidator struct {
+	paths []string
+}
+
+func (r *recordInvalidator) Invalidate(ctx context.Context, paths []string) error {
+	r.paths = append(r.paths, paths...)
+	return nil
+}
+
+func TestPurger(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	const did = "did:plc:alice"
+	const other = "did:plc:alice2"
+
+	users := userdb.NewFile(filepath.Join(dir, "users.json"))
+	crawlerDB := crawlerdb.NewFile(filepath.Join(dir, "crawler.json"))
+	history := crawlerdb.NewFileHistory(filepath.Join(dir, "history.jsonl"))
+	for _, d := range []string{did, other, did} {
+		if err := users.Put(ctx, &userdb.User{Did: d}); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+		if err := crawlerDB.Put(ctx, &crawlerdb.Timestamp{Did: d}); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+		if err := history.PutRun(ctx, &crawlerdb.Run{Did: d}); err != nil {
+			t.Fatalf("PutRun: %v", err)
+		}
+	}
+
+	client := storage.NewLocal(filepath.Join(dir, "buckets"))
+	put := func(bucket, key string) {
+		if _, err := client.PutObject(ctx, &s3.PutObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+			Body:   strings.NewReader("x"),
+		}); err != nil {
+			t.Fatalf("PutObject(%s/%s): %v", bucket, key, err)
+		}
+	}
+	// More day files than a DeleteObjects request takes.
+	var wantPublish []string
+	for i := range 1100 {
+		key := fmt.Sprintf("%s/%04d/01/01", did, 2000+i)
+		put("publish", key)
+		wantPublish = append(wantPublish, key)
+	}
+	put("publish", did+"/2026/01/index")
+	wantPublish = append(wantPublish, did+"/2026/01/index")
+	sort.Strings(wantPublish)
+	put("publish", other+"/2026/01/01")
+	put("publish", "index.html")
+	put("index", did+"/2026/01")
+	put("index", other+"/2026/01")
+	// A batch left by a failed index request.
+	manifest := indexhandler.ManifestKey(did, time.Unix(1700000000, 0))
+	put("index", manifest)
+	put("index", indexhandler.ManifestKey(other, time.Unix(1700000000, 0)))
+
+	invalidator := &recordInvalidator{}
+	p := NewPurger(users, crawlerDB, history, client, "publish", "index",
+		WithInvalidator(invalidator),
+		WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil))),
+	)
+
+	if _, err := p.Plan(ctx, ""); err == nil {
+		t.Errorf("Plan of an empty DID: expected error")
+	}
+
+	plan, err := p.Plan(ctx, did)
+	if err != nil {
+		t.Fatalf("Plan: %v", err)
+	}
+	if !plan.User || !plan.Crawler || plan.Runs != 2 {
+		t.Errorf("Plan: got user %v, crawler %v, runs %d", plan.User, plan.Crawler, plan.Runs)
+	}
+	if diff := cmp.Diff(wantPublish, plan.PublishKeys); diff != "" {
+		t.Errorf("publish keys mismatch (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{did + "/2026/01"}, plan.IndexKeys); diff != "" {
+		t.Errorf("index keys mismatch (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{manifest}, plan.ManifestKeys); diff != "" {
+		t.Errorf("manifest keys mismatch (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"/" + did + "/*"}, plan.Paths); diff != "" {
+		t.Errorf("paths mismatch (-want +got):\n%s", diff)
+	}
+
+	// Planning deletes nothing.
+	if _, err := users.Get(ctx, did); err != nil {
+		t.Errorf("user deleted by Plan: %v", err)
+	}
+	if runs, err := history.Runs(ctx, did, 10); err != nil || len(runs) != 2 {
+		t.Errorf("runs deleted by Plan: %v, %v", runs, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "buckets", "index", filepath.FromSlash(manifest))); err != nil {
+		t.Errorf("manifest deleted by Plan: %v", err)
+	}
+	if len(invalidator.paths) != 0 {
+		t.Errorf("invalidated by Plan: %v", invalidator.paths)
+	}
+
+	if err := p.Purge(ctx, plan); err != nil {
+		t.Fatalf("Purge: %v", err)
+	}
+
+	if _, err := users.Get(ctx, did); err != userdb.ErrNotExists {
+		t.Errorf("user: got %v", err)
+	}
+	if _, err := crawlerDB.Get(ctx, did); err != crawlerdb.ErrNotExists {
+		t.Errorf("crawler DB: got %v", err)
+	}
+	if runs, err := history.Runs(ctx, did, 10); err != nil || len(runs) != 0 {
+		t.Errorf("history: got %v, %v", runs, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "buckets", "publish", did)); !os.IsNotExist(err) {
+		t.Errorf("publish directory: got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "buckets", "index", filepath.FromSlash(manifest))); !os.IsNotExist(err) {
+		t.Errorf("manifest: got %v", err)
+	}
+	if diff := cmp.Diff(plan.Paths, invalidator.paths); diff != "" {
+		t.Errorf("invalidated mismatch (-want +got):\n%s", diff)
+	}
+
+	// Other accounts are kept.
+	if _, err := users.Get(ctx, other); err != nil {
+		t.Errorf("other user: %v", err)
+	}
+	if runs, err := history.Runs(ctx, other, 10); err != nil || len(runs) != 1 {
+		t.Errorf("other history: got %v, %v", runs, err)
+	}
+	for _, name := range []string{
+		"publish/" + other + "/2026/01/01",
+		"publish/index.html",
+		"index/" + other + "/2026/01",
+		"index/" + indexhandler.ManifestKey(other, time.Unix(1700000000, 0)),
+	} {
+		if _, err := os.Stat(filepath.Join(dir, "buckets", filepath.FromSlash(name))); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+
+	// An index from before sharding is named by the DID.
+	const legacy = "did:plc:bob"
+	put("index", legacy)
+	plan, err = p.Plan(ctx, legacy)
+	if err != nil {
+		t.Fatalf("Plan(%s): %v", legacy, err)
+	}
+	if diff := cmp.Diff([]string{legacy}, plan.IndexKeys); diff != "" {
+		t.Errorf("legacy index keys mismatch (-want +got):\n%s", diff)
+	}
+
+	plan, err = p.Plan(ctx, did)
+	if err != nil || plan.User || plan.Crawler || plan.Runs != 0 || len(plan.PublishKeys) != 0 || len(plan.IndexKeys) != 0 || len(plan.ManifestKeys) != 0 || len(plan.Paths) != 0 {
+		t.Errorf("Plan after Purge: got %+v, %v", plan, err)
+	}
+}
@@ -0,0 +1,48 @@
+package signup
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/lambda"
+	"github.com/aws/aws-sdk-go-v2/service/lambda/types"
+)
+
+type LambdaClient interface {
+	Invoke(ctx context.Context, params *lambda.InvokeInput, optFns ...func(*lambda.Options)) (*lambda.InvokeOutput, error)
+}
+
+// LambdaCrawler starts crawls by invoking the crawler function
+// asynchronously.
+type LambdaCrawler struct {
+	client   LambdaClient
+	function string
+}
+
+var _ Crawler = (*LambdaCrawler)(nil)
+
+func NewLambdaCrawler(client LambdaClient, function string) *LambdaCrawler {
+	return &LambdaCrawler{
+		client:   client,
+		function: function,
+	}
+}
+
+// crawlRequest is the request of the crawler function.
+type crawlRequest struct {
+	Did string `json:"did"`
+}
+
+func (c *LambdaCrawler) Crawl(ctx context.Context, did string) error {
+	payload, err := json.Marshal(&crawlRequest{Did: did})
+	if err != nil {
+		return err
+	}
+	_, err = c.client.Invoke(ctx, &lambda.InvokeInput{
+		FunctionName:   aws.String(c.function),
+		InvocationType: types.InvocationTypeEvent,
+		Payload:        payload,
+	})
+	return err
+}
@@ -0,0 +1,344 @@
+// Package signup lets users add their accounts to the archive, change
+// their settings and delete them, with their app password.
+package signup
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+
+	"github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/atproto/identity"
+	"github.com/bluesky-social/indigo/xrpc"
+
+	"github.com/yunomu/bskylog/lib/crawlerdb"
+	"github.com/yunomu/bskylog/lib/pds"
+	"github.com/yunomu/bskylog/lib/purge"
+	"github.com/yunomu/bskylog/lib/userdb"
+)
+
+// Path is the path served by Handle.
+const Path = "/signup"
+
+// Time zones are minutes east of UTC, from UTC-12:00 to UTC+14:00 in steps
+// of 15 minutes.
+const (
+	minTimeZone  = -12 * 60
+	maxTimeZone  = 14 * 60
+	timeZoneStep = 15
+)
+
+// ValidateTimeZone reports whether tz, in minutes east of UTC, is the offset
+// of a time zone.
+func ValidateTimeZone(tz int) error {
+	if tz < minTimeZone || tz > maxTimeZone {
+		return fmt.Errorf("time zone %d is out of range", tz)
+	}
+	if tz%timeZoneStep != 0 {
+		return fmt.Errorf("time zone %d is not a multiple of %d minutes", tz, timeZoneStep)
+	}
+	return nil
+}
+
+// Crawler starts crawls of accounts.
+type Crawler interface {
+	Crawl(ctx context.Context, did string) error
+}
+
+// Request is the body of a signup request. Settings left out are kept for
+// existing users.
+type Request struct {
+	// Identifier is the handle or the DID of the account.
+	Identifier string `json:"identifier"`
+	// Password is an app password of the account.
+	Password string `json:"password"`
+	// TimeZone is minutes east of UTC, which the day files are split by.
+	TimeZone *int  `json:"timezone,omitempty"`
+	Paused   *bool `json:"paused,omitempty"`
+	// DryRun is whether a deletion only returns what would be deleted.
+	DryRun bool `json:"dryRun,omitempty"`
+}
+
+// Response is the body of the response to a successful signup.
+type Response struct {
+	Did      string `json:"did"`
+	Handle   string `json:"handle"`
+	TimeZone int    `json:"timezone"`
+	Paused   bool   `json:"paused"`
+	// Created is whether the account was new to the archive.
+	Created bool `json:"created"`
+}
+
+// Server serves the signup as a Lambda function URL handler. POST adds or
+// updates the account, and DELETE deletes it. Credentials are verified by
+// creating a session on the PDS of the account, and the DID of the session,
+// not of the request, is the account acted on.
+type Server struct {
+	users     userdb.DB
+	crawlerDB crawlerdb.DB
+	sealer    userdb.Sealer
+	dir       identity.Directory
+
+	crawler    Crawler
+	purger     *purge.Purger
+	httpClient *http.Client
+	logger     *slog.Logger
+}
+
+type Option func(*Server)
+
+// WithCrawler starts the first crawl of new accounts with c. Without it,
+// they are crawled at the next trigger.
+func WithCrawler(c Crawler) Option {
+	return func(s *Server) {
+		s.crawler = c
+	}
+}
+
+// WithPurger deletes accounts, and all their data, with p on DELETE.
+func WithPurger(p *purge.Purger) Option {
+	return func(s *Server) {
+		s.purger = p
+	}
+}
+
+func WithHTTPClient(c *http.Client) Option {
+	return func(s *Server) {
+		s.httpClient = c
+	}
+}
+
+func WithLogger(l *slog.Logger) Option {
+	return func(s *Server) {
+		if l == nil {
+			s.logger = slog.Default()
+		} else {
+			s.logger = l
+		}
+	}
+}
+
+func NewServer(
+	users userdb.DB,
+	crawlerDB crawlerdb.DB,
+	sealer userdb.Sealer,
+	dir identity.Directory,
+	opts ...Option,
+) *Server {
+	s := &Server{
+		users:     users,
+		crawlerDB: crawlerDB,
+		sealer:    sealer,
+		dir:       dir,
+		httpClient: &http.Client{
+			Timeout: 10 * time.Second,
+		},
+		logger: slog.Default(),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// Handles reports whether path is served by Handle.
+func Handles(path string) bool {
+	return path == Path
+}
+
+func (s *Server) Handle(ctx context.Context, req *events.LambdaFunctionURLRequest) (*events.LambdaFunctionURLResponse, error) {
+	method := req.RequestContext.HTTP.Method
+	if method != http.MethodPost && (method != http.MethodDelete || s.purger == nil) {
+		res := textResponse(http.StatusMethodNotAllowed, "method not allowed")
+		res.Headers["Allow"] = http.MethodPost
+		if s.purger != nil {
+			res.Headers["Allow"] += ", " + http.MethodDelete
+		}
+		return res, nil
+	}
+
+	body := []byte(req.Body)
+	if req.IsBase64Encoded {
+		b, err := base64.StdEncoding.DecodeString(req.Body)
+		if err != nil {
+			return textResponse(http.StatusBadRequest, "invalid body"), nil
+		}
+		body = b
+	}
+	var in Request
+	if err := json.Unmarshal(body, &in); err != nil {
+		return textResponse(http.StatusBadRequest, "invalid body"), nil
+	}
+	in.Identifier = strings.TrimPrefix(strings.TrimSpace(in.Identifier), "@")
+	if in.Identifier == "" || in.Password == "" {
+		return textResponse(http.StatusBadRequest, "identifier and password are required"), nil
+	}
+	if in.TimeZone != nil && method == http.MethodPost {
+		if err := ValidateTimeZone(*in.TimeZone); err != nil {
+			return textResponse(http.StatusBadRequest, err.Error()), nil
+		}
+	}
+
+	session, host, err := s.verify(ctx, in.Identifier, in.Password)
+	if errors.Is(err, errNotResolved) {
+		return textResponse(http.StatusBadRequest, "cannot resolve "+in.Identifier), nil
+	} else if err != nil {
+		return textResponse(http.StatusUnauthorized, "cannot sign in to "+in.Identifier), nil
+	}
+
+	if method == http.MethodDelete {
+		return s.delete(ctx, session.Did, in.DryRun), nil
+	}
+
+	res, err := s.save(ctx, session, host, &in)
+	if err != nil {
+		return textResponse(http.StatusInternalServerError, "failed to save the account"), nil
+	}
+	status := http.StatusOK
+	if res.Created {
+		status = http.StatusCreated
+	}
+	return s.jsonResponse(status, res), nil
+}
+
+// delete purges the account of did, or returns what would be purged.
+func (s *Server) delete(ctx context.Context, did string, dryRun bool) *events.LambdaFunctionURLResponse {
+	plan, err := s.purger.Plan(ctx, did)
+	if err != nil {
+		return textResponse(http.StatusInternalServerError, "failed to list the data of the account")
+	}
+	if dryRun {
+		return s.jsonResponse(http.StatusOK, plan)
+	}
+	if err := s.purger.Purge(ctx, plan); err != nil {
+		return textResponse(http.StatusInternalServerError, "failed to delete the account")
+	}
+	s.logger.Info("Deleted", "did", did)
+	return s.jsonResponse(http.StatusOK, plan)
+}
+
+func (s *Server) jsonResponse(status int, v any) *events.LambdaFunctionURLResponse {
+	b, err := json.Marshal(v)
+	if err != nil {
+		s.logger.Error("Failed to marshal response", "err", err)
+		return textResponse(http.StatusInternalServerError, "internal error")
+	}
+	return &events.LambdaFunctionURLResponse{
+		StatusCode: status,
+		Headers: map[string]string{
+			"Content-Type":  "application/json",
+			"Cache-Control": "no-store",
+		},
+		Body: string(b),
+	}
+}
+
+var errNotResolved = errors.New("not resolved")
+
+// verify creates a session of the account on its PDS and returns it with
+// the PDS. The session must be of the resolved DID, so that a PDS cannot
+// sign in accounts it does not host.
+func (s *Server) verify(ctx context.Context, identifier, password string) (*atproto.ServerCreateSession_Output, string, error) {
+	ident, err := pds.Lookup(ctx, s.dir, identifier)
+	if err != nil {
+		s.logger.Warn("Lookup", "err", err, "identifier", identifier)
+		return nil, "", errNotResolved
+	}
+	host := ident.PDSEndpoint()
+	if host == "" {
+		s.logger.Warn("No PDS", "did", ident.DID)
+		return nil, "", errNotResolved
+	}
+
+	client := &xrpc.Client{
+		Client: s.httpClient,
+		Host:   host,
+	}
+	session, err := atproto.ServerCreateSession(ctx, client, &atproto.ServerCreateSession_Input{
+		Identifier: ident.DID.String(),
+		Password:   password,
+	})
+	if err != nil {
+		s.logger.Warn("ServerCreateSession", "err", err, "did", ident.DID, "pds", host)
+		return nil, "", err
+	}
+	if session.Did != ident.DID.String() {
+		s.logger.Warn("Session of another account", "did", ident.DID, "session", session.Did, "pds", host)
+		return nil, "", fmt.Errorf("session of %s for %s", session.Did, ident.DID)
+	}
+	return session, host, nil
+}
+
+// save adds or updates the user of session, and starts its first crawl if
+// it is new to the crawler.
+func (s *Server) save(ctx context.Context, session *atproto.ServerCreateSession_Output, host string, in *Request) (*Response, error) {
+	did := session.Did
+	sealed, err := s.sealer.Seal(ctx, did, in.Password)
+	if err != nil {
+		s.logger.Error("Seal", "err", err, "did", did)
+		return nil, err
+	}
+
+	now := time.Now()
+	user, err := s.users.Get(ctx, did)
+	if errors.Is(err, userdb.ErrNotExists) {
+		user = &userdb.User{Did: did}
+	} else if err != nil {
+		s.logger.Error("userdb.Get", "err", err, "did", did)
+		return nil, err
+	}
+	user.SealedPassword = sealed
+	user.PDS = host
+	user.ResolvedAt = now
+	user.SetHandle(session.Handle, now)
+	if in.TimeZone != nil {
+		user.TimeZone = *in.TimeZone
+	}
+	if in.Paused != nil {
+		user.Paused = *in.Paused
+	}
+	if err := s.users.Put(ctx, user); err != nil {
+		s.logger.Error("userdb.Put", "err", err, "did", did)
+		return nil, err
+	}
+
+	created, err := crawlerdb.Seed(ctx, s.crawlerDB, did)
+	if err != nil {
+		s.logger.Error("crawlerdb.Seed", "err", err, "did", did)
+		return nil, err
+	}
+	s.logger.Info("Signed up", "did", did, "handle", user.Handle, "created", created)
+
+	// A failed first crawl is left to the trigger, as the user is due.
+	if created && !user.Paused && s.crawler != nil {
+		if err := s.crawler.Crawl(ctx, did); err != nil {
+			s.logger.Warn("Failed to start the first crawl", "err", err, "did", did)
+		}
+	}
+
+	return &Response{
+		Did:      user.Did,
+		Handle:   user.Handle,
+		TimeZone: user.TimeZone,
+		Paused:   user.Paused,
+		Created:  created,
+	}, nil
+}
+
+func textResponse(status int, body string) *events.LambdaFunctionURLResponse {
+	return &events.LambdaFunctionURLResponse{
+		StatusCode: status,
+		Headers: map[string]string{
+			"Content-Type": "text/plain; charset=utf-8",
+		},
+		Body: body,
+	}
+}
@@ -0,0 +1,286 @@
+package signup
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/bluesky-social/indigo/atproto/identity"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+
+	"github.com/yunomu/bskylog/lib/crawlerdb"
+	"github.com/yunomu/bskylog/lib/purge"
+	"github.com/yunomu/bskylog/lib/storage"
+	"github.com/yunomu/bskylog/lib/userdb"
+)
+
+type recordCrawler struct {
+	dids []string
+}
+
+func (r *recordCrawler) Crawl(ctx context.Context, did string) error {
+	r.dids = append(r.dids, did)
+	return nil
+}
+
+// newTestPDS serves sessions for the app password "secret" of did, as the
+// account sessionDid.
+func newTestPDS(t *testing.T, did, sessionDid string) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path != "/xrpc/com.atproto.server.createSession" {
+			http.NotFound(w, r)
+			return
+		}
+		var in struct {
+			Identifier string `json:"identifier"`
+			Password   string `json:"password"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&in); err != nil || in.Identifier != did || in.Password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			io.WriteString(w, `{"error":"AuthenticationRequired"}`)
+			return
+		}
+		io.WriteString(w, `{"accessJwt":"access","refreshJwt":"refresh","did":"`+sessionDid+`","handle":"alice.test"}`)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func post(body string) *events.LambdaFunctionURLRequest {
+	req := &events.LambdaFunctionURLRequest{
+		RawPath: Path,
+		Body:    body,
+	}
+	req.RequestContext.HTTP.Method = http.MethodPost
+	return req
+}
+
+func TestServer_Handle(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	const did = "did:plc:alice"
+	const impostor = "did:plc:mallory"
+	srv := newTestPDS(t, did, did)
+	evil := newTestPDS(t, impostor, did)
+	mock := identity.NewMockDirectory()
+	for _, a := range []struct{ did, handle, url string }{
+		{did, "alice.test", srv.URL},
+		{impostor, "mallory.test", evil.URL},
+	} {
+		mock.Insert(identity.Identity{
+			DID:    syntax.DID(a.did),
+			Handle: syntax.Handle(a.handle),
+			Services: map[string]identity.ServiceEndpoint{
+				"atproto_pds": {Type: "AtprotoPersonalDataServer", URL: a.url},
+			},
+		})
+	}
+
+	sealer, err := userdb.NewAESGCM(make([]byte, 32))
+	if err != nil {
+		t.Fatalf("NewAESGCM: %v", err)
+	}
+	users := userdb.NewFile(filepath.Join(dir, "users.json"))
+	crawlerDB := crawlerdb.NewFile(filepath.Join(dir, "crawler.json"))
+	crawler := &recordCrawler{}
+	s := NewServer(users, crawlerDB, sealer, &mock, WithCrawler(crawler), WithLogger(logger))
+
+	for _, tc := range []struct {
+		name   string
+		req    *events.LambdaFunctionURLRequest
+		status int
+	}{
+		{"method", &events.LambdaFunctionURLRequest{RawPath: Path}, http.StatusMethodNotAllowed},
+		{"body", post(`{`), http.StatusBadRequest},
+		{"password", post(`{"identifier":"alice.test"}`), http.StatusBadRequest},
+		{"timezone", post(`{"identifier":"alice.test","password":"secret","timezone":1000}`), http.StatusBadRequest},
+		{"timezone step", post(`{"identifier":"alice.test","password":"secret","timezone":7}`), http.StatusBadRequest},
+		{"unknown", post(`{"identifier":"bob.test","password":"secret"}`), http.StatusBadRequest},
+		{"wrong password", post(`{"identifier":"alice.test","password":"wrong"}`), http.StatusUnauthorized},
+		{"another account", post(`{"identifier":"mallory.test","password":"secret"}`), http.StatusUnauthorized},
+	} {
+		res, err := s.Handle(ctx, tc.req)
+		if err != nil || res.StatusCode != tc.status {
+			t.Errorf("%s: got %d %q, %v, want %d", tc.name, res.StatusCode, res.Body, err, tc.status)
+		}
+	}
+	if _, err := users.Get(ctx, impostor); err != userdb.ErrNotExists {
+		t.Errorf("impostor: got %v", err)
+	}
+	if _, err := users.Get(ctx, did); err != userdb.ErrNotExists {
+		t.Errorf("user added by failed requests: %v", err)
+	}
+
+	// The DID is taken from the session.
+	res, err := s.Handle(ctx, post(`{"identifier":"@alice.test","password":"secret","timezone":540}`))
+	if err != nil || res.StatusCode != http.StatusCreated {
+		t.Fatalf("signup: got %d %q, %v", res.StatusCode, res.Body, err)
+	}
+	var out Response
+	if err := json.Unmarshal([]byte(res.Body), &out); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	want := Response{Did: did, Handle: "alice.test", TimeZone: 540, Created: true}
+	if diff := cmp.Diff(want, out); diff != "" {
+		t.Errorf("signup mismatch (-want +got):\n%s", diff)
+	}
+
+	user, err := users.Get(ctx, did)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if password, err := sealer.Open(ctx, did, user.SealedPassword); err != nil || password != "secret" {
+		t.Errorf("sealed password: got %q, %v", password, err)
+	}
+	if user.PDS != srv.URL || user.TimeZone != 540 {
+		t.Errorf("user: got %+v", user)
+	}
+	if _, err := crawlerDB.Get(ctx, did); err != nil {
+		t.Errorf("crawler DB: %v", err)
+	}
+	if diff := cmp.Diff([]string{did}, crawler.dids); diff != "" {
+		t.Errorf("crawls mismatch (-want +got):\n%s", diff)
+	}
+
+	// Signing up again changes the settings given, without crawling from
+	// the beginning.
+	res, err = s.Handle(ctx, post(`{"identifier":"`+did+`","password":"secret","paused":true}`))
+	if err != nil || res.StatusCode != http.StatusOK {
+		t.Fatalf("settings: got %d %q, %v", res.StatusCode, res.Body, err)
+	}
+	user, err = users.Get(ctx, did)
+	if err != nil || user.TimeZone != 540 || !user.Paused {
+		t.Errorf("settings: got %+v, %v", user, err)
+	}
+	if len(crawler.dids) != 1 {
+		t.Errorf("settings crawled: %v", crawler.dids)
+	}
+}
+
+func TestServer_Handle_delete(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	const did = "did:plc:alice"
+	srv := newTestPDS(t, did, did)
+	mock := identity.NewMockDirectory()
+	mock.Insert(identity.Identity{
+		DID:    syntax.DID(did),
+		Handle: syntax.Handle("alice.test"),
+		Services: map[string]identity.ServiceEndpoint{
+			"atproto_pds": {Type: "AtprotoPersonalDataServer", URL: srv.URL},
+		},
+	})
+
+	sealer, err := userdb.NewAESGCM(make([]byte, 32))
+	if err != nil {
+		t.Fatalf("NewAESGCM: %v", err)
+	}
+	users := userdb.NewFile(filepath.Join(dir, "users.json"))
+	crawlerDB := crawlerdb.NewFile(filepath.Join(dir, "crawler.json"))
+	history := crawlerdb.NewFileHistory(filepath.Join(dir, "history.jsonl"))
+	if err := history.PutRun(ctx, &crawlerdb.Run{Did: did}); err != nil {
+		t.Fatalf("PutRun: %v", err)
+	}
+	client := storage.NewLocal(filepath.Join(dir, "buckets"))
+	if _, err := client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: aws.String("publish"),
+		Key:    aws.String(did + "/2026/01/01"),
+		Body:   strings.NewReader("[]"),
+	}); err != nil {
+		t.Fatalf("PutObject: %v", err)
+	}
+
+	s := NewServer(users, crawlerDB, sealer, &mock, WithLogger(logger))
+	del := func(body string) *events.LambdaFunctionURLRequest {
+		req := post(body)
+		req.RequestContext.HTTP.Method = http.MethodDelete
+		return req
+	}
+
+	// Deletion is not served without a purger.
+	res, err := s.Handle(ctx, del(`{"identifier":"alice.test","password":"secret"}`))
+	if err != nil || res.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("without purger: got %d, %v", res.StatusCode, err)
+	}
+
+	s = NewServer(users, crawlerDB, sealer, &mock,
+		WithPurger(purge.NewPurger(users, crawlerDB, history, client, "publish", "index", purge.WithLogger(logger))),
+		WithLogger(logger),
+	)
+	if res, err := s.Handle(ctx, post(`{"identifier":"alice.test","password":"secret"}`)); err != nil || res.StatusCode != http.StatusCreated {
+		t.Fatalf("signup: got %d %q, %v", res.StatusCode, res.Body, err)
+	}
+
+	res, err = s.Handle(ctx, del(`{"identifier":"alice.test","password":"wrong"}`))
+	if err != nil || res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("wrong password: got %d, %v", res.StatusCode, err)
+	}
+
+	res, err = s.Handle(ctx, del(`{"identifier":"alice.test","password":"secret","dryRun":true}`))
+	if err != nil || res.StatusCode != http.StatusOK {
+		t.Fatalf("dry run: got %d %q, %v", res.StatusCode, res.Body, err)
+	}
+	var plan purge.Plan
+	if err := json.Unmarshal([]byte(res.Body), &plan); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	want := purge.Plan{Did: did, User: true, Crawler: true, Runs: 1, PublishKeys: []string{did + "/2026/01/01"}}
+	if diff := cmp.Diff(want, plan); diff != "" {
+		t.Errorf("dry run mismatch (-want +got):\n%s", diff)
+	}
+	if _, err := users.Get(ctx, did); err != nil {
+		t.Errorf("deleted by dry run: %v", err)
+	}
+
+	res, err = s.Handle(ctx, del(`{"identifier":"alice.test","password":"secret"}`))
+	if err != nil || res.StatusCode != http.StatusOK {
+		t.Fatalf("delete: got %d %q, %v", res.StatusCode, res.Body, err)
+	}
+	if _, err := users.Get(ctx, did); err != userdb.ErrNotExists {
+		t.Errorf("user: got %v", err)
+	}
+	if _, err := crawlerDB.Get(ctx, did); err != crawlerdb.ErrNotExists {
+		t.Errorf("crawler DB: got %v", err)
+	}
+	if runs, err := history.Runs(ctx, did, 10); err != nil || len(runs) != 0 {
+		t.Errorf("history: got %v, %v", runs, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "buckets", "publish", did)); !os.IsNotExist(err) {
+		t.Errorf("day files: got %v", err)
+	}
+}
+
+func TestValidateTimeZone(t *testing.T) {
+	for tz, valid := range map[int]bool{
+		0:    true,
+		540:  true,
+		345:  true, // Nepal
+		-720: true,
+		840:  true,
+		-735: false,
+		855:  false,
+		10:   false,
+	} {
+		if err := ValidateTimeZone(tz); (err == nil) != valid {
+			t.Errorf("%d: got %v", tz, err)
+		}
+	}
+}
@@ -0,0 +1,352 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+// localTmpPrefix marks files being written, which are not listed.
+const localTmpPrefix = ".local-"
+
+// Local serves the S3 operations used in this repository from a directory.
+// Buckets are subdirectories of the root and keys are paths below them.
+// ETags are derived from the modification time and size of the files.
+// As with a synced copy of a bucket, a key cannot be both an object and a
+// prefix of other keys.
+type Local struct {
+	root string
+
+	// mu serializes conditional writes and deletes.
+	mu sync.Mutex
+}
+
+func NewLocal(root string) *Local {
+	return &Local{root: root}
+}
+
+func (l *Local) path(bucket, key *string) (string, error) {
+	b, k := aws.ToString(bucket), aws.ToString(key)
+	if b == "" || strings.ContainsAny(b, `/\`) || b == "." || b == ".." {
+		return "", fmt.Errorf("invalid bucket: %q", b)
+	}
+	if k == "" || strings.HasSuffix(k, "/") || path.Clean("/"+k) != "/"+k {
+		return "", fmt.Errorf("invalid key: %q", k)
+	}
+	return filepath.Join(l.root, b, filepath.FromSlash(k)), nil
+}
+
+func localETag(fi fs.FileInfo) string {
+	return fmt.Sprintf(`"%x-%x"`, fi.ModTime().UnixNano(), fi.Size())
+}
+
+func preconditionFailed() error {
+	return &smithy.GenericAPIError{Code: "PreconditionFailed", Message: "At least one of the pre-conditions you specified did not hold"}
+}
+
+// stat returns the file of an object, or nil if there is none.
+func stat(p string) (fs.FileInfo, error) {
+	fi, err := os.Stat(p)
+	if errors.Is(err, fs.ErrNotExist) || (err == nil && fi.IsDir()) {
+		return nil, nil
+	}
+	return fi, err
+}
+
+func checkConditions(fi fs.FileInfo, ifMatch, ifNoneMatch *string) error {
+	if ifNoneMatch != nil && fi != nil && (*ifNoneMatch == "*" || *ifNoneMatch == localETag(fi)) {
+		return preconditionFailed()
+	}
+	if ifMatch != nil && (fi == nil || *ifMatch != localETag(fi)) {
+		return preconditionFailed()
+	}
+	return nil
+}
+
+func (l *Local) GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	p, err := l.path(params.Bucket, params.Key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, &types.NoSuchKey{}
+	} else if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if fi.IsDir() {
+		f.Close()
+		return nil, &types.NoSuchKey{}
+	}
+	if params.IfMatch != nil && *params.IfMatch != localETag(fi) {
+		f.Close()
+		return nil, preconditionFailed()
+	}
+
+	contentType := mime.TypeByExtension(path.Ext(*params.Key))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	return &s3.GetObjectOutput{
+		Body:          f,
+		ContentLength: aws.Int64(fi.Size()),
+		ContentType:   aws.String(contentType),
+		ETag:          aws.String(localETag(fi)),
+		LastModified:  aws.Time(fi.ModTime()),
+	}, nil
+}
+
+func (l *Local) HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+	p, err := l.path(params.Bucket, params.Key)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := stat(p)
+	if err != nil {
+		return nil, err
+	}
+	if fi == nil {
+		return nil, &types.NotFound{}
+	}
+	return &s3.HeadObjectOutput{
+		ContentLength: aws.Int64(fi.Size()),
+		ETag:          aws.String(localETag(fi)),
+		LastModified:  aws.Time(fi.ModTime()),
+	}, nil
+}
+
+// PutObject writes the object to a temporary file and renames it, so
+// readers never see a partial object.
+func (l *Local) PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	p, err := l.path(params.Bucket, params.Key)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return nil, err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(p), localTmpPrefix+"*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+
+	body := params.Body
+	if body == nil {
+		body = bytes.NewReader(nil)
+	}
+	if _, err := io.Copy(tmp, body); err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	fi, err := stat(p)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkConditions(fi, params.IfMatch, params.IfNoneMatch); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp.Name(), p); err != nil {
+		return nil, err
+	}
+	if fi, err = os.Stat(p); err != nil {
+		return nil, err
+	}
+	return &s3.PutObjectOutput{ETag: aws.String(localETag(fi))}, nil
+}
+
+func (l *Local) DeleteObject(ctx context.Context, params *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error) {
+	p, err := l.path(params.Bucket, params.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	fi, err := stat(p)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkConditions(fi, params.IfMatch, nil); err != nil {
+		return nil, err
+	}
+	if fi == nil {
+		return &s3.DeleteObjectOutput{}, nil
+	}
+	if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	l.removeEmptyDirs(filepath.Dir(p), filepath.Join(l.root, aws.ToString(params.Bucket)))
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+// removeEmptyDirs removes dir and its parents below bucketDir while they
+// are empty, as prefixes without objects do not exist in S3.
+func (l *Local) removeEmptyDirs(dir, bucketDir string) {
+	for dir != bucketDir && strings.HasPrefix(dir, bucketDir) {
+		if err := os.Remove(dir); err != nil {
+			return
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+// DeleteObjects deletes the objects one by one. Failures are reported in
+// the errors of the output, as S3 does.
+func (l *Local) DeleteObjects(ctx context.Context, params *s3.DeleteObjectsInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectsOutput, error) {
+	out := &s3.DeleteObjectsOutput{}
+	if params.Delete == nil {
+		return out, nil
+	}
+	for _, obj := range params.Delete.Objects {
+		if _, err := l.DeleteObject(ctx, &s3.DeleteObjectInput{
+			Bucket: params.Bucket,
+			Key:    obj.Key,
+		}); err != nil {
+			out.Errors = append(out.Errors, types.Error{
+				Key:     obj.Key,
+				Message: aws.String(err.Error()),
+			})
+			continue
+		}
+		if !aws.ToBool(params.Delete.Quiet) {
+			out.Deleted = append(out.Deleted, types.DeletedObject{Key: obj.Key})
+		}
+	}
+	return out, nil
+}
+
+// ListObjectsV2 lists keys in lexical order with Prefix, Delimiter,
+// StartAfter, MaxKeys and continuation tokens.
+func (l *Local) ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	bucket := aws.ToString(params.Bucket)
+	if bucket == "" || strings.ContainsAny(bucket, `/\`) || bucket == "." || bucket == ".." {
+		return nil, fmt.Errorf("invalid bucket: %q", bucket)
+	}
+	root := filepath.Join(l.root, bucket)
+	prefix := aws.ToString(params.Prefix)
+	delimiter := aws.ToString(params.Delimiter)
+
+	after := aws.ToString(params.StartAfter)
+	if params.ContinuationToken != nil {
+		after = *params.ContinuationToken
+	}
+	maxKeys := 1000
+	if params.MaxKeys != nil && *params.MaxKeys > 0 && *params.MaxKeys < 1000 {
+		maxKeys = int(*params.MaxKeys)
+	}
+
+	// Walk only below the directory part of the prefix.
+	dir := root
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		if path.Clean("/"+prefix[:i]) != "/"+prefix[:i] {
+			return nil, fmt.Errorf("invalid prefix: %q", prefix)
+		}
+		dir = filepath.Join(root, filepath.FromSlash(prefix[:i]))
+	}
+
+	type entry struct {
+		key string
+		fi  fs.FileInfo
+	}
+	var entries []entry
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() || strings.HasPrefix(d.Name(), localTmpPrefix) {
+			return nil
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		entries = append(entries, entry{key: key, fi: fi})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].key < entries[j].key })
+
+	out := &s3.ListObjectsV2Output{
+		Name:      params.Bucket,
+		Prefix:    params.Prefix,
+		Delimiter: params.Delimiter,
+	}
+	var last string
+	n := 0
+	for _, e := range entries {
+		key := e.key
+		if delimiter != "" {
+			if i := strings.Index(key[len(prefix):], delimiter); i >= 0 {
+				key = key[:len(prefix)+i+len(delimiter)]
+			}
+		}
+		if key <= after || key == last {
+			continue
+		}
+		if n == maxKeys {
+			out.IsTruncated = aws.Bool(true)
+			out.NextContinuationToken = aws.String(last)
+			break
+		}
+		if key != e.key {
+			out.CommonPrefixes = append(out.CommonPrefixes, types.CommonPrefix{Prefix: aws.String(key)})
+		} else {
+			out.Contents = append(out.Contents, types.Object{
+				Key:          aws.String(key),
+				ETag:         aws.String(localETag(e.fi)),
+				Size:         aws.Int64(e.fi.Size()),
+				LastModified: aws.Time(e.fi.ModTime()),
+			})
+		}
+		last = key
+		n++
+	}
+	out.KeyCount = aws.Int32(int32(n))
+	if out.IsTruncated == nil {
+		out.IsTruncated = aws.Bool(false)
+	}
+	return out, nil
+}
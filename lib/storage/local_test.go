@@ -0,0 +1,197 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+func localPut(t *testing.T, l *Local, key, body string) string {
+	t.Helper()
+
+	out, err := l.PutObject(context.Background(), &s3.PutObjectInput{
+		Bucket: aws.String("b"),
+		Key:    aws.String(key),
+		Body:   strings.NewReader(body),
+	})
+	if err != nil {
+		t.Fatalf("PutObject(%s): %v", key, err)
+	}
+	return aws.ToString(out.ETag)
+}
+
+func TestLocal_object(t *testing.T) {
+	ctx := context.Background()
+	l := NewLocal(t.TempDir())
+
+	etag := localPut(t, l, "did:plc:a/2026/01/01", "hello")
+
+	out, err := l.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String("b"), Key: aws.String("did:plc:a/2026/01/01")})
+	if err != nil {
+		t.Fatalf("GetObject: %v", err)
+	}
+	body, _ := io.ReadAll(out.Body)
+	out.Body.Close()
+	if string(body) != "hello" || aws.ToString(out.ETag) != etag {
+		t.Errorf("GetObject: body %q, etag %s, want %s", body, aws.ToString(out.ETag), etag)
+	}
+
+	// Directories are not objects.
+	_, err = l.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String("b"), Key: aws.String("did:plc:a/2026")})
+	var noSuchKey *types.NoSuchKey
+	if !errors.As(err, &noSuchKey) {
+		t.Errorf("GetObject(dir): got %v, want NoSuchKey", err)
+	}
+	_, err = l.HeadObject(ctx, &s3.HeadObjectInput{Bucket: aws.String("b"), Key: aws.String("missing")})
+	var notFound *types.NotFound
+	if !errors.As(err, &notFound) {
+		t.Errorf("HeadObject: got %v, want NotFound", err)
+	}
+	if _, err := l.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String("b"), Key: aws.String("../b/x")}); err == nil {
+		t.Errorf("GetObject(../b/x): expected error")
+	}
+}
+
+func TestLocal_conditional(t *testing.T) {
+	ctx := context.Background()
+	l := NewLocal(t.TempDir())
+
+	isPreconditionFailed := func(err error) bool {
+		var apiErr smithy.APIError
+		return errors.As(err, &apiErr) && apiErr.ErrorCode() == "PreconditionFailed"
+	}
+
+	etag := localPut(t, l, "k", "1")
+
+	_, err := l.PutObject(ctx, &s3.PutObjectInput{Bucket: aws.String("b"), Key: aws.String("k"), Body: strings.NewReader("2"), IfNoneMatch: aws.String("*")})
+	if !isPreconditionFailed(err) {
+		t.Errorf("PutObject(IfNoneMatch): got %v", err)
+	}
+	_, err = l.PutObject(ctx, &s3.PutObjectInput{Bucket: aws.String("b"), Key: aws.String("k"), Body: strings.NewReader("22"), IfMatch: aws.String(`"other"`)})
+	if !isPreconditionFailed(err) {
+		t.Errorf("PutObject(IfMatch other): got %v", err)
+	}
+	out, err := l.PutObject(ctx, &s3.PutObjectInput{Bucket: aws.String("b"), Key: aws.String("k"), Body: strings.NewReader("22"), IfMatch: aws.String(etag)})
+	if err != nil {
+		t.Fatalf("PutObject(IfMatch): %v", err)
+	}
+	if aws.ToString(out.ETag) == etag {
+		t.Errorf("ETag not changed: %s", etag)
+	}
+
+	_, err = l.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: aws.String("b"), Key: aws.String("k"), IfMatch: aws.String(etag)})
+	if !isPreconditionFailed(err) {
+		t.Errorf("DeleteObject(IfMatch old): got %v", err)
+	}
+	if _, err := l.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: aws.String("b"), Key: aws.String("k")}); err != nil {
+		t.Errorf("DeleteObject: %v", err)
+	}
+	if _, err := l.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: aws.String("b"), Key: aws.String("k")}); err != nil {
+		t.Errorf("DeleteObject(missing): %v", err)
+	}
+}
+
+func TestLocal_ListObjectsV2(t *testing.T) {
+	l := NewLocal(t.TempDir())
+	for _, key := range []string{
+		"did:plc:a/2025/12/31",
+		"did:plc:a/2026/01/01",
+		"did:plc:a/2026/01/02",
+		"did:plc:a/2026/01/index",
+		"did:plc:a-b/2026/01/01",
+		"did:plc:b/2026/01/01",
+	} {
+		localPut(t, l, key, "x")
+	}
+
+	list := func(prefix, delimiter string, maxKeys int32) ([]string, int) {
+		t.Helper()
+
+		var keys []string
+		pages := 0
+		paginator := s3.NewListObjectsV2Paginator(l, &s3.ListObjectsV2Input{
+			Bucket:    aws.String("b"),
+			Prefix:    aws.String(prefix),
+			Delimiter: aws.String(delimiter),
+			MaxKeys:   aws.Int32(maxKeys),
+		})
+		for paginator.HasMorePages() {
+			out, err := paginator.NextPage(context.Background())
+			if err != nil {
+				t.Fatalf("NextPage: %v", err)
+			}
+			pages++
+			for _, obj := range out.Contents {
+				keys = append(keys, aws.ToString(obj.Key))
+			}
+			for _, p := range out.CommonPrefixes {
+				keys = append(keys, aws.ToString(p.Prefix))
+			}
+		}
+		return keys, pages
+	}
+
+	for _, tc := range []struct {
+		prefix, delimiter string
+		maxKeys           int32
+		want              string
+		pages             int
+	}{
+		{"did:plc:a/", "", 0, "did:plc:a/2025/12/31 did:plc:a/2026/01/01 did:plc:a/2026/01/02 did:plc:a/2026/01/index", 1},
+		{"did:plc:a/", "", 3, "did:plc:a/2025/12/31 did:plc:a/2026/01/01 did:plc:a/2026/01/02 did:plc:a/2026/01/index", 2},
+		{"did:plc:a/", "/", 0, "did:plc:a/2025/ did:plc:a/2026/", 1},
+		{"did:plc:a/2026/", "/", 1, "did:plc:a/2026/01/", 1},
+		{"did:plc:a", "/", 0, "did:plc:a-b/ did:plc:a/", 1},
+		{"", "/", 2, "did:plc:a-b/ did:plc:a/ did:plc:b/", 2},
+		{"x/", "", 0, "", 1},
+	} {
+		keys, pages := list(tc.prefix, tc.delimiter, tc.maxKeys)
+		if got := strings.Join(keys, " "); got != tc.want || pages != tc.pages {
+			t.Errorf("prefix %q delimiter %q maxKeys %d: got %q in %d pages, want %q in %d", tc.prefix, tc.delimiter, tc.maxKeys, got, pages, tc.want, tc.pages)
+		}
+	}
+}
+
+func TestLocal_DeleteObjects(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	l := NewLocal(root)
+	localPut(t, l, "did:plc:a/2026/01/01", "x")
+	localPut(t, l, "did:plc:a/2026/01/index", "x")
+	localPut(t, l, "did:plc:b/2026/01/01", "x")
+
+	out, err := l.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+		Bucket: aws.String("b"),
+		Delete: &types.Delete{
+			Objects: []types.ObjectIdentifier{
+				{Key: aws.String("did:plc:a/2026/01/01")},
+				{Key: aws.String("did:plc:a/2026/01/index")},
+				{Key: aws.String("missing")},
+				{Key: aws.String("../x")},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("DeleteObjects: %v", err)
+	}
+	if len(out.Deleted) != 3 || len(out.Errors) != 1 || aws.ToString(out.Errors[0].Key) != "../x" {
+		t.Errorf("DeleteObjects: deleted %v, errors %v", out.Deleted, out.Errors)
+	}
+
+	// Prefixes left without objects are removed.
+	if _, err := os.Stat(filepath.Join(root, "b", "did:plc:a")); !os.IsNotExist(err) {
+		t.Errorf("did:plc:a: got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "b", "did:plc:b", "2026", "01", "01")); err != nil {
+		t.Errorf("did:plc:b: %v", err)
+	}
+}
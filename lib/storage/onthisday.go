@@ -0,0 +1,138 @@
+package storage
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+
+	"github.com/bluesky-social/indigo/api/bsky"
+)
+
+// Year is the day file of a year in OnThisDay.
+type Year struct {
+	Year  int                           `json:"year"`
+	Key   string                        `json:"key"`
+	Posts []*bsky.FeedDefs_FeedViewPost `json:"posts"`
+}
+
+// DayKey returns the key of the day file of did on date.
+func DayKey(did string, date time.Time) string {
+	return fmt.Sprintf("%s/%04d/%02d/%02d", did, date.Year(), date.Month(), date.Day())
+}
+
+// GetDay returns the posts of the day file key. It returns nil without an
+// error if there is no such file.
+func (s *S3) GetDay(ctx context.Context, key string) ([]*bsky.FeedDefs_FeedViewPost, error) {
+	output, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		var noSuchKey *types.NoSuchKey
+		if errors.As(err, &noSuchKey) {
+			return nil, nil
+		}
+		s.logger.Error("failed to get S3 object", "bucket", s.bucket, "key", key, "err", err)
+		return nil, err
+	}
+	defer output.Body.Close()
+
+	var posts []*bsky.FeedDefs_FeedViewPost
+	scanner := bufio.NewScanner(output.Body)
+	for scanner.Scan() {
+		var post bsky.FeedDefs_FeedViewPost
+		if err := json.Unmarshal(scanner.Bytes(), &post); err != nil {
+			s.logger.Error("failed to unmarshal JSON from S3 object", "bucket", s.bucket, "key", key, "err", err)
+			return nil, err
+		}
+		posts = append(posts, &post)
+	}
+	if err := scanner.Err(); err != nil {
+		s.logger.Error("failed to read S3 object", "bucket", s.bucket, "key", key, "err", err)
+		return nil, err
+	}
+	return posts, nil
+}
+
+// Years returns the years that did has day files in, in ascending order.
+func (s *S3) Years(ctx context.Context, did string) ([]int, error) {
+	prefix := did + "/"
+	var years []int
+	paginator := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
+		Bucket:    aws.String(s.bucket),
+		Prefix:    aws.String(prefix),
+		Delimiter: aws.String("/"),
+	})
+	for paginator.HasMorePages() {
+		output, err := paginator.NextPage(ctx)
+		if err != nil {
+			s.logger.Error("failed to list S3 objects", "bucket", s.bucket, "prefix", prefix, "err", err)
+			return nil, err
+		}
+		for _, p := range output.CommonPrefixes {
+			y, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(aws.ToString(p.Prefix), prefix), "/"))
+			if err != nil {
+				continue
+			}
+			years = append(years, y)
+		}
+	}
+	sort.Ints(years)
+	return years, nil
+}
+
+// OnThisDay returns the posts of did on the month and day of date in every
+// earlier year, most recent year first. Years without posts on the day are
+// omitted, as is February 29 in common years. date is in the time zone of
+// the account, as the day files are.
+func (s *S3) OnThisDay(ctx context.Context, did string, date time.Time) ([]*Year, error) {
+	years, err := s.Years(ctx, did)
+	if err != nil {
+		return nil, err
+	}
+
+	var days []*Year
+	for _, y := range years {
+		if y >= date.Year() {
+			break
+		}
+		d := time.Date(y, date.Month(), date.Day(), 0, 0, 0, 0, time.UTC)
+		if d.Day() != date.Day() {
+			continue
+		}
+		days = append(days, &Year{Year: y, Key: DayKey(did, d)})
+	}
+
+	g, ctx := errgroup.WithContext(ctx)
+	g.SetLimit(s.parallelism)
+	for _, day := range days {
+		g.Go(func() error {
+			var err error
+			day.Posts, err = s.GetDay(ctx, day.Key)
+			return err
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+
+	ret := make([]*Year, 0, len(days))
+	for i := len(days) - 1; i >= 0; i-- {
+		if len(days[i].Posts) != 0 {
+			ret = append(ret, days[i])
+		}
+	}
+	return ret, nil
+}
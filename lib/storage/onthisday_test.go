@@ -0,0 +1,56 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+)
+
+func TestS3_OnThisDay(t *testing.T) {
+	l := NewLocal(t.TempDir())
+	post := func(cid string) string {
+		return fmt.Sprintf(`{"post":{"cid":%q,"record":{"$type":"app.bsky.feed.post","createdAt":"2020-01-01T00:00:00Z","text":"x"}}}`+"\n", cid)
+	}
+	for key, body := range map[string]string{
+		"did:plc:a/2020/02/29":    post("leap"),
+		"did:plc:a/2021/02/28":    post("a") + post("b"),
+		"did:plc:a/2022/02/28":    "",
+		"did:plc:a/2023/02/28":    post("c"),
+		"did:plc:a/2024/02/28":    post("d"),
+		"did:plc:a/2024/02/index": "x",
+		"did:plc:a/2025/02/28":    post("this year"),
+		"did:plc:a/2026/02/28":    post("future"),
+		"did:plc:b/2024/02/28":    post("other"),
+	} {
+		localPut(t, l, key, body)
+	}
+
+	s := NewS3(l, "b", S3OptionLogger(slog.New(slog.NewTextHandler(io.Discard, nil))))
+	ctx := context.Background()
+
+	years, err := s.OnThisDay(ctx, "did:plc:a", time.Date(2025, 2, 28, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatalf("OnThisDay: %v", err)
+	}
+	var got []string
+	for _, y := range years {
+		for _, p := range y.Posts {
+			got = append(got, fmt.Sprintf("%d:%s", y.Year, p.Post.Cid))
+		}
+	}
+	if want := "[2024:d 2023:c 2021:a 2021:b]"; fmt.Sprint(got) != want {
+		t.Errorf("got %v, want %s", got, want)
+	}
+
+	// February 29 only exists in leap years.
+	years, err = s.OnThisDay(ctx, "did:plc:a", time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatalf("OnThisDay: %v", err)
+	}
+	if len(years) != 1 || years[0].Key != "did:plc:a/2020/02/29" {
+		t.Errorf("leap day: got %+v", years)
+	}
+}
@@ -0,0 +1,109 @@
+package userdb
+
+import (
+	"context"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// AuthRequests keeps the OAuth authorization requests in progress, sealed,
+// by their state until the callback.
+type AuthRequests interface {
+	GetAuthRequest(ctx context.Context, state string) (string, error)
+	PutAuthRequest(ctx context.Context, state, sealed string, expiresAt time.Time) error
+	DeleteAuthRequest(ctx context.Context, state string) error
+}
+
+// DynamoDBAuthRequests keeps authorization requests in a table with the
+// hash key State. Requests expire through the TTL attribute ExpiresAt.
+type DynamoDBAuthRequests struct {
+	client    *dynamodb.Client
+	tableName string
+}
+
+var _ AuthRequests = (*DynamoDBAuthRequests)(nil)
+
+func NewDynamoDBAuthRequests(
+	client *dynamodb.Client,
+	tableName string,
+) *DynamoDBAuthRequests {
+	return &DynamoDBAuthRequests{
+		client:    client,
+		tableName: tableName,
+	}
+}
+
+type DynamoDBAuthRequestRecord struct {
+	State     string `dynamodbav:"State"`
+	Request   string `dynamodbav:"Request"`
+	ExpiresAt int64  `dynamodbav:"ExpiresAt"` // unix seconds
+}
+
+func (d *DynamoDBAuthRequests) key(state string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"State": &types.AttributeValueMemberS{
+			Value: state,
+		},
+	}
+}
+
+func (d *DynamoDBAuthRequests) GetAuthRequest(ctx context.Context, state string) (string, error) {
+	out, err := d.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(d.tableName),
+		Key:       d.key(state),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if out.Item == nil {
+		return "", ErrNotExists
+	}
+
+	var rec DynamoDBAuthRequestRecord
+	if err := attributevalue.UnmarshalMap(out.Item, &rec); err != nil {
+		return "", err
+	}
+
+	// The TTL deletes expired items only eventually.
+	if time.Now().Unix() > rec.ExpiresAt {
+		return "", ErrNotExists
+	}
+
+	return rec.Request, nil
+}
+
+func (d *DynamoDBAuthRequests) PutAuthRequest(ctx context.Context, state, sealed string, expiresAt time.Time) error {
+	item, err := attributevalue.MarshalMap(&DynamoDBAuthRequestRecord{
+		State:     state,
+		Request:   sealed,
+		ExpiresAt: expiresAt.Unix(),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = d.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(d.tableName),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(#state)"),
+		ExpressionAttributeNames: map[string]string{
+			"#state": "State",
+		},
+	})
+
+	return err
+}
+
+func (d *DynamoDBAuthRequests) DeleteAuthRequest(ctx context.Context, state string) error {
+	_, err := d.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(d.tableName),
+		Key:       d.key(state),
+	})
+
+	return err
+}
@@ -3,20 +3,120 @@ package userdb
 import (
 	"context"
 	"errors"
+	"strings"
+	"time"
 )
 
 type User struct {
-	Did      string
-	Handle   string
-	Password string
-	TimeZone int
+	Did    string
+	Handle string
+	// SealedPassword is the app password sealed by a Sealer.
+	SealedPassword string
+	// OAuthSession is the OAuth session of the account, with its refresh
+	// token, sealed by a Sealer. Accounts with a session are crawled
+	// without the app password.
+	OAuthSession string
+	TimeZone     int
+
+	// PDS is the endpoint of the PDS of the account, resolved from the DID
+	// at ResolvedAt.
+	PDS        string
+	ResolvedAt time.Time
+
+	// Handles is the handle history of the account, oldest first. The last
+	// one is the current handle.
+	Handles []HandleRecord
+
+	// Paused users are not crawled. Others are crawled at the first
+	// trigger after NextDue, and then every Interval; a zero Interval
+	// means every trigger.
+	Paused   bool
+	Interval time.Duration
+	NextDue  time.Time
+	// Failures is the number of consecutive failed crawls.
+	Failures int
+}
+
+// HandleRecord is a handle of an account and when it was first seen.
+type HandleRecord struct {
+	Handle string
+	Since  time.Time
+}
+
+// SetHandle sets the current handle of the user, seen at t, and records it
+// in the handle history. It reports whether the user was changed.
+func (u *User) SetHandle(handle string, t time.Time) bool {
+	handle = strings.ToLower(handle)
+	if handle == "" {
+		return false
+	}
+	if n := len(u.Handles); n > 0 && u.Handles[n-1].Handle == handle && u.Handle == handle {
+		return false
+	}
+
+	// Handles of users from before the history are kept as of their
+	// first crawl.
+	if len(u.Handles) == 0 && u.Handle != "" && !strings.EqualFold(u.Handle, handle) {
+		u.Handles = append(u.Handles, HandleRecord{Handle: strings.ToLower(u.Handle)})
+	}
+	u.Handle = handle
+	if n := len(u.Handles); n == 0 || u.Handles[n-1].Handle != handle {
+		u.Handles = append(u.Handles, HandleRecord{Handle: handle, Since: t})
+	}
+	return true
+}
+
+// HasHandle reports whether handle is the current or a previous handle of
+// the user.
+func (u *User) HasHandle(handle string) bool {
+	if strings.EqualFold(u.Handle, handle) {
+		return true
+	}
+	for _, h := range u.Handles {
+		if strings.EqualFold(h.Handle, handle) {
+			return true
+		}
+	}
+	return false
+}
+
+// PastHandles returns the previous handles of the user, without the
+// current one.
+func (u *User) PastHandles() []string {
+	var ret []string
+	for _, h := range u.Handles {
+		if !strings.EqualFold(h.Handle, u.Handle) {
+			ret = append(ret, h.Handle)
+		}
+	}
+	return ret
 }
 
 var ErrNotExists = errors.New("not exists")
 
+// ErrConflict is returned when a user was changed by another writer.
+var ErrConflict = errors.New("conflict")
+
 type DB interface {
 	Get(ctx context.Context, did string) (*User, error)
+	// GetByHandle returns the user whose current handle is handle or,
+	// without one, a user who had handle before.
 	GetByHandle(ctx context.Context, handle string) (*User, error)
 	Scan(ctx context.Context, f func(*User) error) error
 	Put(ctx context.Context, user *User) error
+	// SetNextDue sets NextDue of the user of did to next if it is still
+	// prev, leaving the rest of the user as it is. It returns ErrConflict
+	// if NextDue was changed, or the user deleted, since it was read.
+	SetNextDue(ctx context.Context, did string, prev, next time.Time) error
+	// SetSchedule sets NextDue and Failures of the user of did, leaving the
+	// rest of the user as it is. It returns ErrNotExists if the user does
+	// not exist.
+	SetSchedule(ctx context.Context, did string, nextDue time.Time, failures int) error
+	// SetIdentity sets the PDS, ResolvedAt, the handle and the handle
+	// history of the user of user.Did to those of user, leaving the rest
+	// as it is. It returns ErrNotExists if the user does not exist.
+	SetIdentity(ctx context.Context, user *User) error
+	// Delete removes the user of did. Users that do not exist are
+	// ignored.
+	Delete(ctx context.Context, did string) error
 }
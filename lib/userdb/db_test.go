@@ -0,0 +1,54 @@
+package userdb
+
+import (
+	"testing"
+	"time"
+)
+
+func TestUser_SetHandle(t *testing.T) {
+	t1 := time.Unix(1700000000, 0)
+	t2 := t1.Add(time.Hour)
+
+	user := &User{Did: "did:plc:alice", Handle: "Alice.bsky.social"}
+	if !user.SetHandle("alice.bsky.social", t1) {
+		t.Errorf("first SetHandle: not changed")
+	}
+	if len(user.Handles) != 1 || user.Handles[0].Handle != "alice.bsky.social" || !user.Handles[0].Since.Equal(t1) {
+		t.Errorf("handles: got %+v", user.Handles)
+	}
+	if user.SetHandle("alice.bsky.social", t2) {
+		t.Errorf("same handle: changed")
+	}
+
+	if !user.SetHandle("alice.example.com", t2) {
+		t.Errorf("new handle: not changed")
+	}
+	if user.Handle != "alice.example.com" || len(user.Handles) != 2 {
+		t.Errorf("new handle: got %q, %+v", user.Handle, user.Handles)
+	}
+	if got := user.PastHandles(); len(got) != 1 || got[0] != "alice.bsky.social" {
+		t.Errorf("PastHandles: got %v", got)
+	}
+	if !user.HasHandle("ALICE.bsky.social") || !user.HasHandle("alice.example.com") || user.HasHandle("bob.bsky.social") {
+		t.Errorf("HasHandle: unexpected")
+	}
+
+	// Going back to a previous handle starts a new period.
+	if !user.SetHandle("alice.bsky.social", t2.Add(time.Hour)) || len(user.Handles) != 3 {
+		t.Errorf("previous handle: got %+v", user.Handles)
+	}
+}
+
+func TestUser_SetHandle_legacy(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+
+	// The handle of a user from before the history is kept, as of an
+	// unknown time.
+	user := &User{Did: "did:plc:alice", Handle: "alice.bsky.social"}
+	if !user.SetHandle("alice.example.com", now) {
+		t.Fatalf("SetHandle: not changed")
+	}
+	if len(user.Handles) != 2 || user.Handles[0].Handle != "alice.bsky.social" || !user.Handles[0].Since.IsZero() {
+		t.Errorf("handles: got %+v", user.Handles)
+	}
+}
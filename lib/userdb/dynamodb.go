@@ -2,6 +2,9 @@ package userdb
 
 import (
 	"context"
+	"errors"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
@@ -15,36 +18,93 @@ type DynamoDB struct {
 
 	tableName   string
 	handleIndex string
+	// handleTable maps the previous handles of users to their DIDs, since
+	// the handle index has only the current ones.
+	handleTable string
 }
 
 var _ DB = (*DynamoDB)(nil)
 
+// NewDynamoDB returns the users in tableName. Previous handles are kept in
+// handleTable, and not looked up if it is empty. They are written when
+// users are put, so users put before handleTable was set are found by
+// their previous handles only after they are put again, as by a crawl.
 func NewDynamoDB(
 	client *dynamodb.Client,
 	tableName string,
 	handleIndex string,
+	handleTable string,
 ) *DynamoDB {
 	return &DynamoDB{
 		client:      client,
 		tableName:   tableName,
 		handleIndex: handleIndex,
+		handleTable: handleTable,
 	}
 }
 
 type DynamoDBRecord struct {
-	Did      string `dynamodbav:"Did"`
-	Handle   string `dynamodbav:"Handle"`
-	Password string `dynamodbav:"PW"`
-	TimeZone int    `dynamodbav:"TZ"`
+	Did            string `dynamodbav:"Did"`
+	Handle         string `dynamodbav:"Handle"`
+	SealedPassword string `dynamodbav:"PW,omitempty"`
+	OAuthSession   string `dynamodbav:"OAuth,omitempty"`
+	TimeZone       int    `dynamodbav:"TZ"`
+	PDS            string `dynamodbav:"PDS,omitempty"`
+	ResolvedAt     int64  `dynamodbav:"ResolvedAt,omitempty"` // unix seconds
+
+	Handles []DynamoDBHandle `dynamodbav:"Handles,omitempty"`
+
+	Paused   bool  `dynamodbav:"Paused,omitempty"`
+	Interval int64 `dynamodbav:"Interval,omitempty"` // seconds
+	NextDue  int64 `dynamodbav:"NextDue,omitempty"`  // unix seconds
+	Failures int   `dynamodbav:"Failures,omitempty"`
+}
+
+type DynamoDBHandle struct {
+	Handle string `dynamodbav:"H"`
+	Since  int64  `dynamodbav:"Since,omitempty"` // unix seconds
+}
+
+// DynamoDBHandleRecord is a previous handle of a user in the handle table.
+type DynamoDBHandleRecord struct {
+	Handle string `dynamodbav:"Handle"`
+	Did    string `dynamodbav:"Did"`
+}
+
+func handleKey(handle string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"Handle": &types.AttributeValueMemberS{
+			Value: strings.ToLower(handle),
+		},
+	}
 }
 
 func dynamoToUser(rec *DynamoDBRecord) *User {
-	return &User{
-		Did:      rec.Did,
-		Handle:   rec.Handle,
-		Password: rec.Password,
-		TimeZone: rec.TimeZone,
+	user := &User{
+		Did:            rec.Did,
+		Handle:         rec.Handle,
+		SealedPassword: rec.SealedPassword,
+		OAuthSession:   rec.OAuthSession,
+		TimeZone:       rec.TimeZone,
+		PDS:            rec.PDS,
+		Paused:         rec.Paused,
+		Interval:       time.Duration(rec.Interval) * time.Second,
+		Failures:       rec.Failures,
+	}
+	if rec.ResolvedAt != 0 {
+		user.ResolvedAt = time.Unix(rec.ResolvedAt, 0)
+	}
+	if rec.NextDue != 0 {
+		user.NextDue = time.Unix(rec.NextDue, 0)
+	}
+	for _, h := range rec.Handles {
+		hr := HandleRecord{Handle: h.Handle}
+		if h.Since != 0 {
+			hr.Since = time.Unix(h.Since, 0)
+		}
+		user.Handles = append(user.Handles, hr)
 	}
+	return user
 }
 
 func (d *DynamoDB) Get(ctx context.Context, did string) (*User, error) {
@@ -60,6 +120,10 @@ func (d *DynamoDB) Get(ctx context.Context, did string) (*User, error) {
 		return nil, err
 	}
 
+	if out.Item == nil {
+		return nil, ErrNotExists
+	}
+
 	var rec DynamoDBRecord
 	if err := attributevalue.UnmarshalMap(out.Item, &rec); err != nil {
 		return nil, err
@@ -97,7 +161,40 @@ func (d *DynamoDB) GetByHandle(ctx context.Context, handle string) (*User, error
 		return dynamoToUser(&rec), nil
 	}
 
-	return nil, ErrNotExists
+	return d.getByPreviousHandle(ctx, handle)
+}
+
+// getByPreviousHandle returns the user who had handle before, from the
+// handle table.
+func (d *DynamoDB) getByPreviousHandle(ctx context.Context, handle string) (*User, error) {
+	if d.handleTable == "" {
+		return nil, ErrNotExists
+	}
+
+	out, err := d.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(d.handleTable),
+		Key:       handleKey(handle),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if out.Item == nil {
+		return nil, ErrNotExists
+	}
+	var rec DynamoDBHandleRecord
+	if err := attributevalue.UnmarshalMap(out.Item, &rec); err != nil {
+		return nil, err
+	}
+
+	user, err := d.Get(ctx, rec.Did)
+	if err != nil {
+		return nil, err
+	}
+	// The history may have been rewritten since the handle was put.
+	if !user.HasHandle(handle) {
+		return nil, ErrNotExists
+	}
+	return user, nil
 }
 
 func (d *DynamoDB) Scan(ctx context.Context, f func(*User) error) error {
@@ -125,21 +222,225 @@ func (d *DynamoDB) Scan(ctx context.Context, f func(*User) error) error {
 	return nil
 }
 
+// dynamoHandles returns the handle history of user as stored in DynamoDB.
+func dynamoHandles(user *User) []DynamoDBHandle {
+	var ret []DynamoDBHandle
+	for _, h := range user.Handles {
+		dh := DynamoDBHandle{Handle: h.Handle}
+		if !h.Since.IsZero() {
+			dh.Since = h.Since.Unix()
+		}
+		ret = append(ret, dh)
+	}
+	return ret
+}
+
 func (d *DynamoDB) Put(ctx context.Context, user *User) error {
-	item, err := attributevalue.MarshalMap(&DynamoDBRecord{
-		Did:      user.Did,
-		Handle:   user.Handle,
-		Password: user.Password,
-		TimeZone: user.TimeZone,
-	})
+	rec := &DynamoDBRecord{
+		Did:            user.Did,
+		Handle:         user.Handle,
+		SealedPassword: user.SealedPassword,
+		OAuthSession:   user.OAuthSession,
+		TimeZone:       user.TimeZone,
+		PDS:            user.PDS,
+		Paused:         user.Paused,
+		Interval:       int64(user.Interval / time.Second),
+		Failures:       user.Failures,
+	}
+	if !user.ResolvedAt.IsZero() {
+		rec.ResolvedAt = user.ResolvedAt.Unix()
+	}
+	if !user.NextDue.IsZero() {
+		rec.NextDue = user.NextDue.Unix()
+	}
+	rec.Handles = dynamoHandles(user)
+	item, err := attributevalue.MarshalMap(rec)
 	if err != nil {
 		return err
 	}
 
-	_, err = d.client.PutItem(ctx, &dynamodb.PutItemInput{
+	if _, err := d.client.PutItem(ctx, &dynamodb.PutItemInput{
 		TableName: aws.String(d.tableName),
 		Item:      item,
+	}); err != nil {
+		return err
+	}
+
+	return d.putPreviousHandles(ctx, user)
+}
+
+// putPreviousHandles puts the previous handles of user in the handle table.
+// A handle that was also another user's is kept for the last one put.
+func (d *DynamoDB) putPreviousHandles(ctx context.Context, user *User) error {
+	if d.handleTable == "" {
+		return nil
+	}
+	for _, h := range user.Handles {
+		if strings.EqualFold(h.Handle, user.Handle) {
+			continue
+		}
+		item, err := attributevalue.MarshalMap(&DynamoDBHandleRecord{
+			Handle: strings.ToLower(h.Handle),
+			Did:    user.Did,
+		})
+		if err != nil {
+			return err
+		}
+		if _, err := d.client.PutItem(ctx, &dynamodb.PutItemInput{
+			TableName: aws.String(d.handleTable),
+			Item:      item,
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *DynamoDB) SetNextDue(ctx context.Context, did string, prev, next time.Time) error {
+	// NextDue is left out of the item when it is zero.
+	cond := expression.AttributeExists(expression.Name("Did"))
+	if prev.IsZero() {
+		cond = cond.And(expression.AttributeNotExists(expression.Name("NextDue")))
+	} else {
+		cond = cond.And(expression.Name("NextDue").Equal(expression.Value(prev.Unix())))
+	}
+	var update expression.UpdateBuilder
+	if next.IsZero() {
+		update = update.Remove(expression.Name("NextDue"))
+	} else {
+		update = update.Set(expression.Name("NextDue"), expression.Value(next.Unix()))
+	}
+	expr, err := expression.NewBuilder().
+		WithCondition(cond).
+		WithUpdate(update).
+		Build()
+	if err != nil {
+		return err
+	}
+
+	_, err = d.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(d.tableName),
+		Key: map[string]types.AttributeValue{
+			"Did": &types.AttributeValueMemberS{
+				Value: did,
+			},
+		},
+
+		ConditionExpression:       expr.Condition(),
+		UpdateExpression:          expr.Update(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
 	})
+	var ccf *types.ConditionalCheckFailedException
+	if errors.As(err, &ccf) {
+		return ErrConflict
+	}
+	return err
+}
+
+// setOrRemove adds setting name to v to update, or removing it if v is
+// zero, as attributes with omitempty are left out of items.
+func setOrRemove(update expression.UpdateBuilder, name string, v interface{}, zero bool) expression.UpdateBuilder {
+	if zero {
+		return update.Remove(expression.Name(name))
+	}
+	return update.Set(expression.Name(name), expression.Value(v))
+}
 
+// update applies update to the user of did, which must exist.
+func (d *DynamoDB) update(ctx context.Context, did string, update expression.UpdateBuilder) error {
+	expr, err := expression.NewBuilder().
+		WithCondition(expression.AttributeExists(expression.Name("Did"))).
+		WithUpdate(update).
+		Build()
+	if err != nil {
+		return err
+	}
+
+	_, err = d.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(d.tableName),
+		Key: map[string]types.AttributeValue{
+			"Did": &types.AttributeValueMemberS{
+				Value: did,
+			},
+		},
+
+		ConditionExpression:       expr.Condition(),
+		UpdateExpression:          expr.Update(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	})
+	var ccf *types.ConditionalCheckFailedException
+	if errors.As(err, &ccf) {
+		return ErrNotExists
+	}
 	return err
 }
+
+func (d *DynamoDB) SetSchedule(ctx context.Context, did string, nextDue time.Time, failures int) error {
+	var update expression.UpdateBuilder
+	update = setOrRemove(update, "NextDue", nextDue.Unix(), nextDue.IsZero())
+	update = setOrRemove(update, "Failures", failures, failures == 0)
+	return d.update(ctx, did, update)
+}
+
+func (d *DynamoDB) SetIdentity(ctx context.Context, user *User) error {
+	var update expression.UpdateBuilder
+	update = update.Set(expression.Name("Handle"), expression.Value(user.Handle))
+	update = setOrRemove(update, "PDS", user.PDS, user.PDS == "")
+	update = setOrRemove(update, "ResolvedAt", user.ResolvedAt.Unix(), user.ResolvedAt.IsZero())
+	update = setOrRemove(update, "Handles", dynamoHandles(user), len(user.Handles) == 0)
+	if err := d.update(ctx, user.Did, update); err != nil {
+		return err
+	}
+
+	return d.putPreviousHandles(ctx, user)
+}
+
+func (d *DynamoDB) Delete(ctx context.Context, did string) error {
+	var handles []HandleRecord
+	if d.handleTable != "" {
+		user, err := d.Get(ctx, did)
+		if errors.Is(err, ErrNotExists) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		handles = user.Handles
+	}
+
+	if _, err := d.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(d.tableName),
+		Key: map[string]types.AttributeValue{
+			"Did": &types.AttributeValueMemberS{
+				Value: did,
+			},
+		},
+	}); err != nil {
+		return err
+	}
+
+	// Handles put since by other users are kept.
+	expr, err := expression.NewBuilder().
+		WithCondition(expression.Name("Did").Equal(expression.Value(did))).
+		Build()
+	if err != nil {
+		return err
+	}
+	for _, h := range handles {
+		_, err := d.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+			TableName: aws.String(d.handleTable),
+			Key:       handleKey(h.Handle),
+
+			ConditionExpression:       expr.Condition(),
+			ExpressionAttributeNames:  expr.Names(),
+			ExpressionAttributeValues: expr.Values(),
+		})
+		var ccf *types.ConditionalCheckFailedException
+		if err != nil && !errors.As(err, &ccf) {
+			return err
+		}
+	}
+
+	return nil
+}
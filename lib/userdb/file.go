@@ -0,0 +1,226 @@
+package userdb
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// File keeps the users in a JSON file, for running without DynamoDB. The
+// file is read on every call, so that it can be edited by other commands
+// while a runner is using it.
+type File struct {
+	path string
+
+	mu sync.Mutex
+}
+
+var _ DB = (*File)(nil)
+
+func NewFile(path string) *File {
+	return &File{path: path}
+}
+
+// load returns the users of the file, or none if it does not exist.
+func (f *File) load() ([]*User, error) {
+	data, err := os.ReadFile(f.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var users []*User
+	if err := json.Unmarshal(data, &users); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// save writes users to a temporary file and renames it, so readers never
+// see a partial file.
+func (f *File) save(users []*User) error {
+	sort.Slice(users, func(i, j int) bool { return users[i].Did < users[j].Did })
+	data, err := json.MarshalIndent(users, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(f.path), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(f.path), filepath.Base(f.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	// The file has sealed credentials.
+	if err := os.Chmod(tmp.Name(), 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), f.path)
+}
+
+func (f *File) Get(ctx context.Context, did string) (*User, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	users, err := f.load()
+	if err != nil {
+		return nil, err
+	}
+	for _, user := range users {
+		if user.Did == did {
+			return user, nil
+		}
+	}
+	return nil, ErrNotExists
+}
+
+func (f *File) GetByHandle(ctx context.Context, handle string) (*User, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	users, err := f.load()
+	if err != nil {
+		return nil, err
+	}
+	// As with DynamoDB, the current handles come first.
+	for _, user := range users {
+		if user.Handle == handle {
+			return user, nil
+		}
+	}
+	for _, user := range users {
+		if user.HasHandle(handle) {
+			return user, nil
+		}
+	}
+	return nil, ErrNotExists
+}
+
+func (f *File) Scan(ctx context.Context, fn func(*User) error) error {
+	f.mu.Lock()
+	users, err := f.load()
+	f.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	for _, user := range users {
+		if err := fn(user); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *File) Put(ctx context.Context, user *User) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	users, err := f.load()
+	if err != nil {
+		return err
+	}
+
+	u := *user
+	replaced := false
+	for i := range users {
+		if users[i].Did == user.Did {
+			users[i] = &u
+			replaced = true
+			break
+		}
+	}
+	if !replaced {
+		users = append(users, &u)
+	}
+	return f.save(users)
+}
+
+func (f *File) SetNextDue(ctx context.Context, did string, prev, next time.Time) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	users, err := f.load()
+	if err != nil {
+		return err
+	}
+	for _, user := range users {
+		if user.Did != did {
+			continue
+		}
+		if !user.NextDue.Equal(prev) {
+			return ErrConflict
+		}
+		user.NextDue = next
+		return f.save(users)
+	}
+	return ErrConflict
+}
+
+func (f *File) SetSchedule(ctx context.Context, did string, nextDue time.Time, failures int) error {
+	return f.update(did, func(user *User) {
+		user.NextDue = nextDue
+		user.Failures = failures
+	})
+}
+
+func (f *File) SetIdentity(ctx context.Context, user *User) error {
+	return f.update(user.Did, func(u *User) {
+		u.PDS = user.PDS
+		u.ResolvedAt = user.ResolvedAt
+		u.Handle = user.Handle
+		u.Handles = slices.Clone(user.Handles)
+	})
+}
+
+// update applies fn to the user of did and saves it.
+func (f *File) update(did string, fn func(*User)) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	users, err := f.load()
+	if err != nil {
+		return err
+	}
+	for _, user := range users {
+		if user.Did == did {
+			fn(user)
+			return f.save(users)
+		}
+	}
+	return ErrNotExists
+}
+
+func (f *File) Delete(ctx context.Context, did string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	users, err := f.load()
+	if err != nil {
+		return err
+	}
+
+	n := len(users)
+	users = slices.DeleteFunc(users, func(u *User) bool { return u.Did == did })
+	if len(users) == n {
+		return nil
+	}
+	return f.save(users)
+}
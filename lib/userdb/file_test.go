@@ -0,0 +1,104 @@
+package userdb
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFile(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "users.json")
+	db := NewFile(path)
+
+	if _, err := db.Get(ctx, "did:plc:a"); err != ErrNotExists {
+		t.Errorf("Get of an empty file: got %v", err)
+	}
+
+	alice := &User{Did: "did:plc:a", Handle: "a.example.com", SealedPassword: "aesgcm:x", TimeZone: 540}
+	alice.SetHandle("a2.example.com", time.Unix(1700000000, 0))
+	if err := db.Put(ctx, alice); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if err := db.Put(ctx, &User{Did: "did:plc:b", Handle: "b.example.com"}); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	// Another File of the same path sees the users.
+	db = NewFile(path)
+	got, err := db.Get(ctx, "did:plc:a")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if got.Handle != "a2.example.com" || got.SealedPassword != "aesgcm:x" || got.TimeZone != 540 || len(got.Handles) != 2 {
+		t.Errorf("Get: got %+v", got)
+	}
+
+	if u, err := db.GetByHandle(ctx, "a.example.com"); err != nil || u.Did != "did:plc:a" {
+		t.Errorf("GetByHandle of a previous handle: got %v, %v", u, err)
+	}
+	if _, err := db.GetByHandle(ctx, "c.example.com"); err != ErrNotExists {
+		t.Errorf("GetByHandle of an unknown handle: got %v", err)
+	}
+
+	got.TimeZone = 0
+	if err := db.Put(ctx, got); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	var dids []string
+	if err := db.Scan(ctx, func(u *User) error {
+		dids = append(dids, u.Did)
+		if u.Did == "did:plc:a" && u.TimeZone != 0 {
+			t.Errorf("Scan: not replaced: %+v", u)
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf("Scan: %v", err)
+	}
+	if len(dids) != 2 || dids[0] != "did:plc:a" || dids[1] != "did:plc:b" {
+		t.Errorf("Scan: got %v", dids)
+	}
+
+	due := time.Unix(1700000000, 0)
+	if err := db.SetNextDue(ctx, "did:plc:b", time.Time{}, due); err != nil {
+		t.Fatalf("SetNextDue: %v", err)
+	}
+	if err := db.SetNextDue(ctx, "did:plc:b", time.Time{}, due.Add(time.Hour)); err != ErrConflict {
+		t.Errorf("SetNextDue of a changed user: got %v", err)
+	}
+	if err := db.SetNextDue(ctx, "did:plc:c", time.Time{}, due); err != ErrConflict {
+		t.Errorf("SetNextDue of an unknown user: got %v", err)
+	}
+	if u, err := db.Get(ctx, "did:plc:b"); err != nil || !u.NextDue.Equal(due) || u.Handle != "b.example.com" {
+		t.Errorf("SetNextDue: got %+v, %v", u, err)
+	}
+
+	if err := db.SetSchedule(ctx, "did:plc:b", due.Add(time.Hour), 2); err != nil {
+		t.Fatalf("SetSchedule: %v", err)
+	}
+	b := &User{Did: "did:plc:b", Handle: "b.example.com", PDS: "https://pds.example.com", ResolvedAt: due}
+	b.SetHandle("b2.example.com", due)
+	if err := db.SetIdentity(ctx, b); err != nil {
+		t.Fatalf("SetIdentity: %v", err)
+	}
+	if u, err := db.Get(ctx, "did:plc:b"); err != nil || !u.NextDue.Equal(due.Add(time.Hour)) || u.Failures != 2 ||
+		u.Handle != "b2.example.com" || len(u.Handles) != 2 || u.PDS != "https://pds.example.com" {
+		t.Errorf("SetSchedule and SetIdentity: got %+v, %v", u, err)
+	}
+	if err := db.SetSchedule(ctx, "did:plc:c", due, 0); err != ErrNotExists {
+		t.Errorf("SetSchedule of an unknown user: got %v", err)
+	}
+	if err := db.SetIdentity(ctx, &User{Did: "did:plc:c"}); err != ErrNotExists {
+		t.Errorf("SetIdentity of an unknown user: got %v", err)
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if fi.Mode().Perm() != 0o600 {
+		t.Errorf("mode: got %v", fi.Mode())
+	}
+}
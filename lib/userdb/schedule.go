@@ -0,0 +1,54 @@
+package userdb
+
+import (
+	"sort"
+	"time"
+)
+
+const (
+	// RetryInterval is the delay before the first retry of a failed crawl.
+	// It doubles with each consecutive failure, up to MaxRetryInterval.
+	RetryInterval    = 15 * time.Minute
+	MaxRetryInterval = 24 * time.Hour
+)
+
+// Due reports whether the user is to be crawled at now.
+func (u *User) Due(now time.Time) bool {
+	return !u.Paused && !u.NextDue.After(now)
+}
+
+// Reschedule sets when the user is due next after a crawl ending at now.
+// Successful crawls are repeated after the interval of the user, and failed
+// ones retried with backoff, but never later than the interval.
+func (u *User) Reschedule(now time.Time, failed bool) {
+	if !failed {
+		u.Failures = 0
+		u.NextDue = now.Add(u.Interval)
+		return
+	}
+
+	u.Failures++
+	retry := RetryInterval
+	for i := 1; i < u.Failures && retry < MaxRetryInterval; i++ {
+		retry *= 2
+	}
+	retry = min(retry, MaxRetryInterval)
+	if u.Interval > 0 {
+		retry = min(retry, u.Interval)
+	}
+	u.NextDue = now.Add(retry)
+}
+
+// SelectDue returns the users due at now, the longest overdue first.
+func SelectDue(users []*User, now time.Time) []*User {
+	var ret []*User
+	for _, u := range users {
+		if u.Due(now) {
+			ret = append(ret, u)
+		}
+	}
+	sort.SliceStable(ret, func(i, j int) bool {
+		return ret[i].NextDue.Before(ret[j].NextDue)
+	})
+	return ret
+}
@@ -0,0 +1,74 @@
+package userdb
+
+import (
+	"testing"
+	"time"
+)
+
+func TestUser_Reschedule(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+
+	user := &User{Did: "did:plc:alice", Interval: 6 * time.Hour}
+	if !user.Due(now) {
+		t.Errorf("new user: not due")
+	}
+
+	user.Reschedule(now, false)
+	if !user.NextDue.Equal(now.Add(6*time.Hour)) || user.Failures != 0 {
+		t.Errorf("success: got %v, %d", user.NextDue, user.Failures)
+	}
+	if user.Due(now.Add(time.Hour)) {
+		t.Errorf("due before interval")
+	}
+
+	for i, want := range []time.Duration{
+		15 * time.Minute,
+		30 * time.Minute,
+		time.Hour,
+		2 * time.Hour,
+		4 * time.Hour,
+		6 * time.Hour, // capped at the interval
+		6 * time.Hour,
+	} {
+		user.Reschedule(now, true)
+		if got := user.NextDue.Sub(now); got != want {
+			t.Errorf("failure %d: got %v, want %v", i+1, got, want)
+		}
+	}
+
+	user.Reschedule(now, false)
+	if user.Failures != 0 {
+		t.Errorf("failures not reset: %d", user.Failures)
+	}
+
+	user.Interval = 0
+	for range 20 {
+		user.Reschedule(now, true)
+	}
+	if got := user.NextDue.Sub(now); got != MaxRetryInterval {
+		t.Errorf("max retry: got %v", got)
+	}
+}
+
+func TestSelectDue(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+
+	users := []*User{
+		{Did: "did:plc:later", NextDue: now.Add(time.Hour)},
+		{Did: "did:plc:recent", NextDue: now.Add(-time.Minute)},
+		{Did: "did:plc:paused", Paused: true},
+		{Did: "did:plc:new"},
+		{Did: "did:plc:overdue", NextDue: now.Add(-time.Hour)},
+	}
+
+	got := SelectDue(users, now)
+	want := []string{"did:plc:new", "did:plc:overdue", "did:plc:recent"}
+	if len(got) != len(want) {
+		t.Fatalf("got %d users, want %d", len(got), len(want))
+	}
+	for i, u := range got {
+		if u.Did != want[i] {
+			t.Errorf("%d: got %s, want %s", i, u.Did, want[i])
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package userdb
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+)
+
+// ErrNotSealed is returned by Open for values that are not sealed by the
+// sealer, such as passwords stored in plaintext before sealing.
+var ErrNotSealed = errors.New("not sealed")
+
+// Sealer encrypts the credentials of users, such as app passwords. The DID,
+// or the subject the credential is of, is bound to the sealed value, which
+// cannot be opened for another account.
+type Sealer interface {
+	Seal(ctx context.Context, did, password string) (string, error)
+	Open(ctx context.Context, did, sealed string) (string, error)
+}
+
+const (
+	aesGCMPrefix = "aesgcm:"
+	kmsPrefix    = "kms:"
+)
+
+// IsSealed reports whether v is a value sealed by one of the sealers.
+func IsSealed(v string) bool {
+	return strings.HasPrefix(v, aesGCMPrefix) || strings.HasPrefix(v, kmsPrefix)
+}
+
+// AESGCM seals with AES-256-GCM under a local key.
+type AESGCM struct {
+	aead cipher.AEAD
+}
+
+var _ Sealer = (*AESGCM)(nil)
+
+// NewAESGCM returns a sealer with a 32 byte key.
+func NewAESGCM(key []byte) (*AESGCM, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("key must be 32 bytes, got %d", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &AESGCM{aead: aead}, nil
+}
+
+// ParseAESGCMKey decodes a base64 encoded key, as generated by
+// "openssl rand -base64 32".
+func ParseAESGCMKey(s string) ([]byte, error) {
+	return base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+}
+
+// ReadAESGCMKeyFile reads a base64 encoded key from a file.
+func ReadAESGCMKeyFile(path string) ([]byte, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseAESGCMKey(string(b))
+}
+
+func (s *AESGCM) Seal(ctx context.Context, did, password string) (string, error) {
+	nonce := make([]byte, s.aead.NonceSize(), s.aead.NonceSize()+len(password)+s.aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	b := s.aead.Seal(nonce, nonce, []byte(password), []byte(did))
+	return aesGCMPrefix + base64.StdEncoding.EncodeToString(b), nil
+}
+
+func (s *AESGCM) Open(ctx context.Context, did, sealed string) (string, error) {
+	v, ok := strings.CutPrefix(sealed, aesGCMPrefix)
+	if !ok {
+		return "", ErrNotSealed
+	}
+	b, err := base64.StdEncoding.DecodeString(v)
+	if err != nil {
+		return "", err
+	}
+	if len(b) < s.aead.NonceSize() {
+		return "", errors.New("sealed value is too short")
+	}
+	nonce, ciphertext := b[:s.aead.NonceSize()], b[s.aead.NonceSize():]
+	plaintext, err := s.aead.Open(nil, nonce, ciphertext, []byte(did))
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+type KMSClient interface {
+	Encrypt(ctx context.Context, params *kms.EncryptInput, optFns ...func(*kms.Options)) (*kms.EncryptOutput, error)
+	Decrypt(ctx context.Context, params *kms.DecryptInput, optFns ...func(*kms.Options)) (*kms.DecryptOutput, error)
+}
+
+// KMS seals with a KMS key. The DID is the encryption context "did".
+type KMS struct {
+	client KMSClient
+	keyID  string
+}
+
+var _ Sealer = (*KMS)(nil)
+
+func NewKMS(client KMSClient, keyID string) *KMS {
+	return &KMS{
+		client: client,
+		keyID:  keyID,
+	}
+}
+
+func (s *KMS) Seal(ctx context.Context, did, password string) (string, error) {
+	out, err := s.client.Encrypt(ctx, &kms.EncryptInput{
+		KeyId:             aws.String(s.keyID),
+		Plaintext:         []byte(password),
+		EncryptionContext: map[string]string{"did": did},
+	})
+	if err != nil {
+		return "", err
+	}
+	return kmsPrefix + base64.StdEncoding.EncodeToString(out.CiphertextBlob), nil
+}
+
+func (s *KMS) Open(ctx context.Context, did, sealed string) (string, error) {
+	v, ok := strings.CutPrefix(sealed, kmsPrefix)
+	if !ok {
+		return "", ErrNotSealed
+	}
+	b, err := base64.StdEncoding.DecodeString(v)
+	if err != nil {
+		return "", err
+	}
+	out, err := s.client.Decrypt(ctx, &kms.DecryptInput{
+		KeyId:             aws.String(s.keyID),
+		CiphertextBlob:    b,
+		EncryptionContext: map[string]string{"did": did},
+	})
+	if err != nil {
+		return "", err
+	}
+	return string(out.Plaintext), nil
+}
+
+// NewSealer returns the KMS sealer if kmsKeyID is given, and otherwise the
+// AES-GCM sealer with the key in keyFile or, without keyFile, the base64
+// encoded key.
+func NewSealer(client KMSClient, kmsKeyID, keyFile, key string) (Sealer, error) {
+	switch {
+	case kmsKeyID != "":
+		return NewKMS(client, kmsKeyID), nil
+	case keyFile != "":
+		b, err := ReadAESGCMKeyFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		return NewAESGCM(b)
+	case key != "":
+		b, err := ParseAESGCMKey(key)
+		if err != nil {
+			return nil, err
+		}
+		return NewAESGCM(b)
+	}
+	return nil, errors.New("no credential key")
+}
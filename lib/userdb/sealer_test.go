@@ -0,0 +1,74 @@
+package userdb
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+)
+
+func TestAESGCM(t *testing.T) {
+	ctx := context.Background()
+	s, err := NewAESGCM(bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatalf("NewAESGCM: %v", err)
+	}
+
+	sealed, err := s.Seal(ctx, "did:plc:a", "xxxx-xxxx-xxxx-xxxx")
+	if err != nil {
+		t.Fatalf("Seal: %v", err)
+	}
+	if !IsSealed(sealed) {
+		t.Errorf("IsSealed(%q) = false", sealed)
+	}
+
+	if pw, err := s.Open(ctx, "did:plc:a", sealed); err != nil || pw != "xxxx-xxxx-xxxx-xxxx" {
+		t.Errorf("Open: got %q, %v", pw, err)
+	}
+	if _, err := s.Open(ctx, "did:plc:b", sealed); err == nil {
+		t.Errorf("Open with another did: no error")
+	}
+	if _, err := s.Open(ctx, "did:plc:a", "xxxx-xxxx-xxxx-xxxx"); !errors.Is(err, ErrNotSealed) {
+		t.Errorf("Open plaintext: got %v, want ErrNotSealed", err)
+	}
+
+	if _, err := NewAESGCM([]byte("short")); err == nil {
+		t.Errorf("NewAESGCM with a short key: no error")
+	}
+}
+
+// fakeKMS "encrypts" by prefixing the plaintext with the did of the
+// encryption context.
+type fakeKMS struct{}
+
+func (fakeKMS) Encrypt(ctx context.Context, params *kms.EncryptInput, optFns ...func(*kms.Options)) (*kms.EncryptOutput, error) {
+	return &kms.EncryptOutput{
+		CiphertextBlob: append([]byte(params.EncryptionContext["did"]+"|"), params.Plaintext...),
+	}, nil
+}
+
+func (fakeKMS) Decrypt(ctx context.Context, params *kms.DecryptInput, optFns ...func(*kms.Options)) (*kms.DecryptOutput, error) {
+	did, pw, ok := bytes.Cut(params.CiphertextBlob, []byte("|"))
+	if !ok || string(did) != params.EncryptionContext["did"] {
+		return nil, errors.New("invalid ciphertext")
+	}
+	return &kms.DecryptOutput{Plaintext: pw}, nil
+}
+
+func TestKMS(t *testing.T) {
+	ctx := context.Background()
+	s := NewKMS(fakeKMS{}, "key")
+
+	sealed, err := s.Seal(ctx, "did:plc:a", "pw")
+	if err != nil {
+		t.Fatalf("Seal: %v", err)
+	}
+	if pw, err := s.Open(ctx, "did:plc:a", sealed); err != nil || pw != "pw" {
+		t.Errorf("Open: got %q, %v", pw, err)
+	}
+	if _, err := s.Open(ctx, "did:plc:b", sealed); err == nil {
+		t.Errorf("Open with another did: no error")
+	}
+}
@@ -0,0 +1,315 @@
+package handler
+
+import (
+	"container/list"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/glebarez/sqlite"
+	"golang.org/x/sync/singleflight"
+	"gorm.io/gorm"
+	gormlogger "gorm.io/gorm/logger"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+
+	"github.com/yunomu/bskylog/lib/index"
+)
+
+// loadTimeout bounds the download of an index, which is shared by the
+// requests waiting for it and so is not canceled with any of them.
+const loadTimeout = time.Minute
+
+// shardObject is an index object in the search index bucket.
+type shardObject struct {
+	key  string
+	etag string
+}
+
+type shardList struct {
+	objects []shardObject
+	listed  time.Time
+}
+
+// indexEntry is an index object downloaded to tmpDir and opened read-only.
+// An entry is stale once it is replaced by a newer version or evicted, and
+// it is closed when the last request using it releases it.
+type indexEntry struct {
+	key      string
+	etag     string
+	filePath string
+	size     int64
+	idx      *index.Gorm
+	sqlDB    *sql.DB
+
+	refs  int
+	stale bool
+	elem  *list.Element
+}
+
+// indexCache keeps open indexes across requests of a warm Lambda. The
+// listings of shards, with their ETags, are reused for the revalidate
+// interval, so an index is never older than that.
+type indexCache struct {
+	mu      sync.Mutex
+	entries map[string]*indexEntry
+	lru     *list.List // most recently used first
+	size    int64
+	lists   map[string]*shardList
+	seq     int
+
+	group singleflight.Group
+}
+
+func newIndexCache() *indexCache {
+	return &indexCache{
+		entries: make(map[string]*indexEntry),
+		lru:     list.New(),
+		lists:   make(map[string]*shardList),
+	}
+}
+
+func (e *indexEntry) close() {
+	e.sqlDB.Close()
+	os.Remove(e.filePath)
+}
+
+// drop removes e from the cache. It must be called with c.mu held.
+func (c *indexCache) drop(e *indexEntry) {
+	if e.stale {
+		return
+	}
+	e.stale = true
+	c.lru.Remove(e.elem)
+	c.size -= e.size
+	if c.entries[e.key] == e {
+		delete(c.entries, e.key)
+	}
+	if e.refs == 0 {
+		e.close()
+	}
+}
+
+// evict drops the least recently used entries that are not in use, other
+// than keep, until the cache fits in maxBytes. It must be called with c.mu
+// held.
+func (c *indexCache) evict(maxBytes int64, keep *indexEntry) {
+	for el := c.lru.Back(); el != nil && c.size > maxBytes; {
+		e := el.Value.(*indexEntry)
+		el = el.Prev()
+		if e != keep && e.refs == 0 {
+			c.drop(e)
+		}
+	}
+}
+
+// listShards returns the index objects of did: its month shards, or the
+// index from before sharding. Listings are cached for the revalidate
+// interval.
+func (h *Handler) listShards(ctx context.Context, did string) ([]shardObject, error) {
+	h.cache.mu.Lock()
+	if l, ok := h.cache.lists[did]; ok && time.Since(l.listed) < h.revalidateInterval {
+		h.cache.mu.Unlock()
+		return l.objects, nil
+	}
+	h.cache.mu.Unlock()
+
+	var objects []shardObject
+	paginator := s3.NewListObjectsV2Paginator(h.s3Client, &s3.ListObjectsV2Input{
+		Bucket: &h.searchIndexBucket,
+		Prefix: aws.String(did + "/"),
+	})
+	for paginator.HasMorePages() {
+		out, err := paginator.NextPage(ctx)
+		if err != nil {
+			h.logger.Error("Failed to list index shards", "err", err, "did", did, "bucket", h.searchIndexBucket)
+			return nil, err
+		}
+		for _, obj := range out.Contents {
+			objects = append(objects, shardObject{key: aws.ToString(obj.Key), etag: aws.ToString(obj.ETag)})
+		}
+	}
+
+	if len(objects) == 0 {
+		out, err := h.s3Client.HeadObject(ctx, &s3.HeadObjectInput{
+			Bucket: &h.searchIndexBucket,
+			Key:    &did,
+		})
+		if err != nil {
+			var notFound *types.NotFound
+			if errors.As(err, &notFound) {
+				h.logger.Info("Index file not found in S3", "did", did, "bucket", h.searchIndexBucket)
+				return nil, ErrIndexNotPrepared
+			}
+			h.logger.Error("Failed to head object", "err", err, "did", did, "bucket", h.searchIndexBucket)
+			return nil, err
+		}
+		objects = []shardObject{{key: did, etag: aws.ToString(out.ETag)}}
+	}
+
+	h.cache.mu.Lock()
+	h.cache.lists[did] = &shardList{objects: objects, listed: time.Now()}
+	h.cache.mu.Unlock()
+
+	return objects, nil
+}
+
+// openIndex returns the index of obj, downloading it unless the cached
+// version has the same ETag. The returned function releases the index.
+func (h *Handler) openIndex(ctx context.Context, obj shardObject) (*index.Gorm, func(), error) {
+	for {
+		h.cache.mu.Lock()
+		e, ok := h.cache.entries[obj.key]
+		if !ok || e.etag != obj.etag {
+			h.cache.mu.Unlock()
+
+			ch := h.cache.group.DoChan(obj.key+"@"+obj.etag, func() (any, error) {
+				ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), loadTimeout)
+				defer cancel()
+				return h.loadIndex(ctx, obj)
+			})
+			var res singleflight.Result
+			select {
+			case <-ctx.Done():
+				return nil, nil, ctx.Err()
+			case res = <-ch:
+			}
+			if res.Err != nil {
+				return nil, nil, res.Err
+			}
+			e = res.Val.(*indexEntry)
+
+			h.cache.mu.Lock()
+		}
+		if e.stale {
+			// Evicted before it was used; load it again.
+			h.cache.mu.Unlock()
+			continue
+		}
+		e.refs++
+		h.cache.lru.MoveToFront(e.elem)
+		h.cache.mu.Unlock()
+
+		return e.idx, func() { h.releaseIndex(e) }, nil
+	}
+}
+
+func (h *Handler) releaseIndex(e *indexEntry) {
+	h.cache.mu.Lock()
+	defer h.cache.mu.Unlock()
+
+	e.refs--
+	if e.stale && e.refs == 0 {
+		e.close()
+	}
+	h.cache.evict(h.cacheSize, nil)
+}
+
+func (h *Handler) loadIndex(ctx context.Context, obj shardObject) (*indexEntry, error) {
+	h.cache.mu.Lock()
+	h.cache.seq++
+	filePath := filepath.Join(h.tmpDir, fmt.Sprintf("%s.%d", strings.ReplaceAll(obj.key, "/", "_"), h.cache.seq))
+	h.cache.mu.Unlock()
+
+	h.logger.Debug("Retrieving index from S3", "key", obj.key, "etag", obj.etag, "bucket", h.searchIndexBucket)
+	output, err := h.s3Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: &h.searchIndexBucket,
+		Key:    &obj.key,
+	})
+	if err != nil {
+		var noSuchKey *types.NoSuchKey
+		if errors.As(err, &noSuchKey) {
+			h.logger.Info("Index file not found in S3", "key", obj.key, "bucket", h.searchIndexBucket)
+			return nil, ErrIndexNotPrepared
+		}
+		h.logger.Error("Failed to get object from S3", "err", err, "key", obj.key, "bucket", h.searchIndexBucket)
+		return nil, err
+	}
+	defer output.Body.Close()
+
+	size, err := func() (int64, error) {
+		file, err := os.Create(filePath)
+		if err != nil {
+			return 0, err
+		}
+		defer file.Close()
+		return io.Copy(file, output.Body)
+	}()
+	if err != nil {
+		h.logger.Error("Failed to write S3 object to file", "err", err, "path", filePath)
+		os.Remove(filePath)
+		return nil, err
+	}
+
+	// The file is a private copy, so indexes of an older schema, such as
+	// month shards the indexer no longer writes, are migrated here.
+	db, err := gorm.Open(sqlite.Open(filePath), &gorm.Config{
+		Logger: gormlogger.Default.LogMode(gormlogger.Silent),
+	})
+	if err != nil {
+		h.logger.Error("Failed to open SQLite database", "err", err, "path", filePath)
+		os.Remove(filePath)
+		return nil, err
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		h.logger.Error("Failed to get sql.DB", "err", err, "path", filePath)
+		os.Remove(filePath)
+		return nil, err
+	}
+
+	idx, err := h.migrateIndex(ctx, db)
+	if err != nil {
+		sqlDB.Close()
+		os.Remove(filePath)
+		return nil, err
+	}
+
+	e := &indexEntry{
+		key:      obj.key,
+		etag:     aws.ToString(output.ETag),
+		filePath: filePath,
+		size:     size,
+		idx:      idx,
+		sqlDB:    sqlDB,
+	}
+
+	h.cache.mu.Lock()
+	defer h.cache.mu.Unlock()
+
+	if old, ok := h.cache.entries[obj.key]; ok {
+		h.cache.drop(old)
+	}
+	e.elem = h.cache.lru.PushFront(e)
+	h.cache.entries[obj.key] = e
+	h.cache.size += e.size
+	h.cache.evict(h.cacheSize, e)
+
+	h.logger.Info("Retrieved index", "key", obj.key, "etag", e.etag, "size", size, "cacheSize", h.cache.size)
+
+	return e, nil
+}
+
+// migrateIndex applies the migrations pending on db and opens it read-only.
+func (h *Handler) migrateIndex(ctx context.Context, db *gorm.DB) (*index.Gorm, error) {
+	version, _, err := index.GetSchemaVersion(ctx, db)
+	if err != nil {
+		h.logger.Error("Failed to get schema version", "err", err)
+		return nil, err
+	}
+	if version < index.CurrentSchemaVersion {
+		if err := index.Migrate(ctx, db, h.logger); err != nil {
+			return nil, err
+		}
+	}
+	return index.NewGorm(ctx, db, index.GormOptionLogger(h.logger), index.GormOptionReadOnly())
+}
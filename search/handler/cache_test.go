@@ -0,0 +1,336 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+
+	"github.com/bluesky-social/indigo/api/bsky"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+	gormlogger "gorm.io/gorm/logger"
+
+	"github.com/yunomu/bskylog/lib/index"
+)
+
+type fakeObject struct {
+	data []byte
+	etag string
+}
+
+// fakeS3 is an in-memory S3 that counts downloads. Objects are keyed by
+// "<bucket>:<key>".
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string]*fakeObject
+	version int
+	gets    int
+
+	// beforeGet is called before each GetObject, without the lock.
+	beforeGet func(ctx context.Context) error
+}
+
+func (f *fakeS3) GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	if f.beforeGet != nil {
+		if err := f.beforeGet(ctx); err != nil {
+			return nil, err
+		}
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.gets++
+	obj, ok := f.objects[aws.ToString(params.Bucket)+":"+aws.ToString(params.Key)]
+	if !ok {
+		return nil, &types.NoSuchKey{}
+	}
+	return &s3.GetObjectOutput{
+		Body: io.NopCloser(bytes.NewReader(obj.data)),
+		ETag: aws.String(obj.etag),
+	}, nil
+}
+
+func (f *fakeS3) HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	obj, ok := f.objects[aws.ToString(params.Bucket)+":"+aws.ToString(params.Key)]
+	if !ok {
+		return nil, &types.NotFound{}
+	}
+	return &s3.HeadObjectOutput{ETag: aws.String(obj.etag)}, nil
+}
+
+func (f *fakeS3) ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	out := &s3.ListObjectsV2Output{}
+	for k, obj := range f.objects {
+		key, ok := strings.CutPrefix(k, aws.ToString(params.Bucket)+":")
+		if ok && strings.HasPrefix(key, aws.ToString(params.Prefix)) {
+			out.Contents = append(out.Contents, types.Object{Key: aws.String(key), ETag: aws.String(obj.etag)})
+		}
+	}
+	return out, nil
+}
+
+func (f *fakeS3) put(key string, data []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.version++
+	f.objects[key] = &fakeObject{data: data, etag: fmt.Sprintf(`"%d"`, f.version)}
+}
+
+func testPostJSON(did string, cid string, createdAt string) string {
+	return `{"post":{"author":{"did":"` + did + `","handle":"` + did + `.example.com"},"cid":"` + cid + `","uri":"at://` + did + `/app.bsky.feed.post/` + cid + `","record":{"$type":"app.bsky.feed.post","createdAt":"` + createdAt + `","text":"hello ` + cid + `"}}}`
+}
+
+// testIndex returns an index file holding posts with cids in the day file
+// "<did>/2026/01/01".
+func testIndex(t *testing.T, did string, cids ...string) []byte {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "index")
+	db, err := gorm.Open(sqlite.Open(path), &gorm.Config{
+		Logger: gormlogger.Default.LogMode(gormlogger.Silent),
+	})
+	if err != nil {
+		t.Fatalf("gorm.Open: %v", err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatalf("db.DB: %v", err)
+	}
+	g, err := index.NewGorm(context.Background(), db)
+	if err != nil {
+		t.Fatalf("NewGorm: %v", err)
+	}
+	for i, cid := range cids {
+		var post bsky.FeedDefs_FeedViewPost
+		if err := json.Unmarshal([]byte(testPostJSON(did, cid, "2026-01-01T00:00:00Z")), &post); err != nil {
+			t.Fatalf("unmarshal error: %v", err)
+		}
+		if err := g.Put(context.Background(), did+"/2026/01/01", i, &post); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+	}
+	sqlDB.Close()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	return data
+}
+
+func newTestHandler(t *testing.T, f *fakeS3, opts ...HandlerOption) *Handler {
+	t.Helper()
+
+	return NewHandler(f, "index", "publish", append([]HandlerOption{
+		WithTmpDir(t.TempDir()),
+		WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil))),
+	}, opts...)...)
+}
+
+// search returns the number of posts matching "hello" and the files in
+// tmpDir.
+func search(t *testing.T, h *Handler) (int, int) {
+	t.Helper()
+
+	ctx := context.Background()
+	shards, release, err := h.openShards(ctx, "did:plc:a", 0, 0)
+	if err != nil {
+		t.Fatalf("openShards: %v", err)
+	}
+	defer release()
+
+	n := 0
+	for _, idx := range shards {
+		rs, err := idx.Search(ctx, index.ParseQuery("hello"))
+		if err != nil {
+			t.Fatalf("Search: %v", err)
+		}
+		n += len(rs)
+	}
+
+	files, err := os.ReadDir(h.tmpDir)
+	if err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+	return n, len(files)
+}
+
+func TestHandler_openShards_revalidate(t *testing.T) {
+	f := &fakeS3{objects: make(map[string]*fakeObject)}
+	f.put("index:did:plc:a/2026/01", testIndex(t, "did:plc:a", "cid1"))
+	f.put("index:did:plc:a/2026/02", testIndex(t, "did:plc:a", "cid2"))
+
+	h := newTestHandler(t, f, WithRevalidateInterval(time.Hour))
+
+	if n, _ := search(t, h); n != 2 {
+		t.Errorf("posts: got %d, want 2", n)
+	}
+
+	// Within the interval, neither the listing nor the files are fetched.
+	f.put("index:did:plc:a/2026/02", testIndex(t, "did:plc:a", "cid2", "cid3"))
+	if n, _ := search(t, h); n != 2 || f.gets != 2 {
+		t.Errorf("cached: posts %d, gets %d", n, f.gets)
+	}
+
+	// Only the changed shard is fetched again, and its old file is removed.
+	h.revalidateInterval = 0
+	n, files := search(t, h)
+	if n != 3 || f.gets != 3 || files != 2 {
+		t.Errorf("revalidated: posts %d, gets %d, files %d", n, f.gets, files)
+	}
+}
+
+func TestHandler_openShards_evict(t *testing.T) {
+	f := &fakeS3{objects: make(map[string]*fakeObject)}
+	f.put("index:did:plc:a/2026/01", testIndex(t, "did:plc:a", "cid1"))
+	f.put("index:did:plc:a/2026/02", testIndex(t, "did:plc:a", "cid2"))
+
+	h := newTestHandler(t, f, WithCacheSize(1))
+
+	// Shards in use are kept beyond the cache size.
+	if n, files := search(t, h); n != 2 || files != 2 {
+		t.Errorf("posts %d, files %d", n, files)
+	}
+
+	files, err := os.ReadDir(h.tmpDir)
+	if err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+	if len(files) != 0 {
+		t.Errorf("files after release: got %d, want 0", len(files))
+	}
+}
+
+// testIndexV1 returns an index file of schema version 1, from before
+// schema versioning, holding one post in "<did>/2026/01/01".
+func testIndexV1(t *testing.T, did string, cid string) []byte {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "index")
+	db, err := gorm.Open(sqlite.Open(path), &gorm.Config{
+		Logger: gormlogger.Default.LogMode(gormlogger.Silent),
+	})
+	if err != nil {
+		t.Fatalf("gorm.Open: %v", err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatalf("db.DB: %v", err)
+	}
+	for _, stmt := range []string{
+		"CREATE TABLE records (cid text PRIMARY KEY, created_at datetime, updated_at datetime, deleted_at datetime, " +
+			"text text, timestamp integer, did text, handle text, name text, " +
+			"reply_parent_handle text, reply_parent_did text, reply_parent_name text, " +
+			"embed text, embed_post_handle text, embed_post_did text, embed_post_name text, " +
+			"key text, position integer)",
+		"INSERT INTO records (cid, text, timestamp, did, handle, key, position) VALUES " +
+			"('" + cid + "', 'hello " + cid + "', 0, '" + did + "', '" + did + ".example.com', '" + did + "/2026/01/01', 0)",
+	} {
+		if err := db.Exec(stmt).Error; err != nil {
+			t.Fatalf("Exec: %v", err)
+		}
+	}
+	sqlDB.Close()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	return data
+}
+
+func TestHandler_openShards_outdated(t *testing.T) {
+	f := &fakeS3{objects: make(map[string]*fakeObject)}
+	f.put("index:did:plc:a/2026/01", testIndexV1(t, "did:plc:a", "cid1"))
+	f.put("index:did:plc:a/2026/02", testIndex(t, "did:plc:a", "cid2"))
+
+	h := newTestHandler(t, f)
+	if n, _ := search(t, h); n != 2 {
+		t.Errorf("posts: got %d, want 2", n)
+	}
+}
+
+// A download shared by requests is not canceled with the first of them.
+func TestHandler_openShards_canceled(t *testing.T) {
+	f := &fakeS3{objects: make(map[string]*fakeObject)}
+	f.put("index:did:plc:a/2026/01", testIndex(t, "did:plc:a", "cid1"))
+	started := make(chan struct{})
+	release := make(chan struct{})
+	f.beforeGet = func(ctx context.Context) error {
+		close(started)
+		select {
+		case <-release:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	h := newTestHandler(t, f)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan error)
+	go func() {
+		_, _, err := h.openShards(ctx, "did:plc:a", 0, 0)
+		first <- err
+	}()
+	<-started
+	second := make(chan error)
+	go func() {
+		_, release, err := h.openShards(context.Background(), "did:plc:a", 0, 0)
+		if err == nil {
+			release()
+		}
+		second <- err
+	}()
+
+	cancel()
+	if err := <-first; err != context.Canceled {
+		t.Errorf("canceled request: got %v", err)
+	}
+	close(release)
+	if err := <-second; err != nil {
+		t.Errorf("waiting request: %v", err)
+	}
+	if n, _ := search(t, h); n != 1 {
+		t.Errorf("posts: got %d, want 1", n)
+	}
+	if f.gets != 1 {
+		t.Errorf("gets: got %d, want 1", f.gets)
+	}
+}
+
+func TestHandler_openShards_legacy(t *testing.T) {
+	f := &fakeS3{objects: make(map[string]*fakeObject)}
+
+	h := newTestHandler(t, f)
+	if _, _, err := h.openShards(context.Background(), "did:plc:a", 0, 0); err != ErrIndexNotPrepared {
+		t.Errorf("openShards: got %v, want ErrIndexNotPrepared", err)
+	}
+
+	f.put("index:did:plc:a", testIndex(t, "did:plc:a", "cid1", "cid2"))
+	h = newTestHandler(t, f)
+	if n, _ := search(t, h); n != 2 {
+		t.Errorf("posts: got %d, want 2", n)
+	}
+}
@@ -0,0 +1,129 @@
+package handler
+
+import (
+	"context"
+	"time"
+
+	"github.com/yunomu/bskylog/lib/feedgen"
+	"github.com/yunomu/bskylog/lib/index"
+)
+
+const (
+	// FeedOnThisDay is the viewer's posts on this day in earlier years.
+	FeedOnThisDay = "onthisday"
+	// FeedMostLiked is the viewer's posts with the most likes.
+	FeedMostLiked = "mostliked"
+
+	// mostLikedMax is the number of posts of the most liked feed.
+	mostLikedMax = 500
+)
+
+// WithFeedGenerator serves the feeds of the archive as a feed generator at
+// https://<hostname>, with feed records in the repository of publisher.
+// Days of the on this day feed start in loc.
+func WithFeedGenerator(hostname, publisher string, loc *time.Location) HandlerOption {
+	return func(h *Handler) {
+		h.feedHostname = hostname
+		h.feedPublisher = publisher
+		h.feedLocation = loc
+	}
+}
+
+func (h *Handler) newFeedServer() *feedgen.Server {
+	return feedgen.NewServer(h.feedHostname, h.feedPublisher,
+		feedgen.WithLogger(h.logger),
+		feedgen.WithFeed(FeedOnThisDay, h.feedOnThisDay),
+		feedgen.WithFeed(FeedMostLiked, h.feedMostLiked),
+	)
+}
+
+func (h *Handler) feedOnThisDay(ctx context.Context, req *feedgen.Request) (*feedgen.Skeleton, error) {
+	offset, err := feedgen.OffsetCursor(req.Cursor)
+	if err != nil || req.Viewer == "" {
+		return &feedgen.Skeleton{}, err
+	}
+
+	loc := h.feedLocation
+	if loc == nil {
+		loc = time.UTC
+	}
+	years, err := h.publish.OnThisDay(ctx, req.Viewer, time.Now().In(loc))
+	if err != nil {
+		return nil, err
+	}
+
+	var uris []string
+	for _, y := range years {
+		for _, post := range y.Posts {
+			if post.Post == nil || post.Post.Author == nil || post.Post.Author.Did != req.Viewer {
+				continue
+			}
+			uris = append(uris, post.Post.Uri)
+		}
+	}
+	return skeleton(uris, offset, req.Limit), nil
+}
+
+func (h *Handler) feedMostLiked(ctx context.Context, req *feedgen.Request) (*feedgen.Skeleton, error) {
+	offset, err := feedgen.OffsetCursor(req.Cursor)
+	if err != nil || req.Viewer == "" || offset >= mostLikedMax {
+		return &feedgen.Skeleton{}, err
+	}
+	limit := min(offset+req.Limit, mostLikedMax)
+
+	shards, closeShards, err := h.openShards(ctx, req.Viewer, 0, 0)
+	if err == ErrIndexNotPrepared {
+		return &feedgen.Skeleton{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer closeShards()
+
+	results := make([][]*index.LikedResult, len(shards))
+	if err := eachShard(ctx, shards, func(ctx context.Context, i int, idx *index.Gorm) error {
+		var err error
+		results[i], err = idx.MostLiked(ctx, limit)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	liked := index.MergeLiked(results, limit)
+	total := len(liked)
+	if offset >= total {
+		return &feedgen.Skeleton{}, nil
+	}
+	liked = liked[offset:min(offset+req.Limit, total)]
+
+	searchResults := make([]*index.SearchResult, len(liked))
+	for i, r := range liked {
+		searchResults[i] = &index.SearchResult{Key: r.Key, Position: r.Position}
+	}
+	items, err := h.getPostsFromSearchResults(ctx, searchResults)
+	if err != nil {
+		return nil, err
+	}
+	uris := make(map[index.SearchResult]string, len(items))
+	for _, item := range items {
+		if item.Post.Post == nil {
+			continue
+		}
+		uris[index.SearchResult{Key: item.Key, Position: item.Position}] = item.Post.Post.Uri
+	}
+
+	ret := &feedgen.Skeleton{Cursor: feedgen.NextOffsetCursor(offset, req.Limit, total)}
+	for _, r := range searchResults {
+		if uri := uris[*r]; uri != "" {
+			ret.Feed = append(ret.Feed, &feedgen.SkeletonPost{Post: uri})
+		}
+	}
+	return ret, nil
+}
+
+// skeleton returns the page of uris from offset.
+func skeleton(uris []string, offset, limit int) *feedgen.Skeleton {
+	ret := &feedgen.Skeleton{Cursor: feedgen.NextOffsetCursor(offset, limit, len(uris))}
+	for _, uri := range uris[min(offset, len(uris)):min(offset+limit, len(uris))] {
+		ret.Feed = append(ret.Feed, &feedgen.SkeletonPost{Post: uri})
+	}
+	return ret
+}
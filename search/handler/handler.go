@@ -5,34 +5,39 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
-	"io"
 	"log/slog"
 	"net/http"
-	"os"
-	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-lambda-go/events"
-	"github.com/glebarez/sqlite"
 	"golang.org/x/sync/errgroup"
-	"gorm.io/gorm"
-	gormlogger "gorm.io/gorm/logger"
 
 	"github.com/aws/aws-sdk-go-v2/service/s3"
-	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 
 	"github.com/bluesky-social/indigo/api/bsky"
 
 	indexhandler "github.com/yunomu/bskylog/index/handler"
+	"github.com/yunomu/bskylog/lib/feedgen"
 	"github.com/yunomu/bskylog/lib/index"
+	"github.com/yunomu/bskylog/lib/oauth"
+	"github.com/yunomu/bskylog/lib/signup"
+	"github.com/yunomu/bskylog/lib/storage"
+	"github.com/yunomu/bskylog/lib/userdb"
 )
 
 var ErrIndexNotPrepared = errors.New("index not prepared")
 
 type S3Client interface {
 	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+	ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error)
+	HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error)
 }
 
+// shardParallelism is the number of index shards retrieved and queried at
+// the same time.
+const shardParallelism = 8
+
 type Handler struct {
 	s3Client          S3Client
 	searchIndexBucket string
@@ -40,10 +45,51 @@ type Handler struct {
 	tmpDir            string
 	logger            *slog.Logger
 	limit             int
+
+	revalidateInterval time.Duration
+	cacheSize          int64
+	cache              *indexCache
+
+	groups             map[string][]string
+	accountParallelism int
+
+	publish *storage.S3
+
+	feedHostname  string
+	feedPublisher string
+	feedLocation  *time.Location
+	feeds         *feedgen.Server
+
+	oauth  *oauth.Server
+	signup *signup.Server
+
+	users userdb.DB
 }
 
 type HandlerOption func(*Handler)
 
+// WithOAuth serves the OAuth client under /oauth/.
+func WithOAuth(s *oauth.Server) HandlerOption {
+	return func(h *Handler) {
+		h.oauth = s
+	}
+}
+
+// WithSignup serves the signup under /signup.
+func WithSignup(s *signup.Server) HandlerOption {
+	return func(h *Handler) {
+		h.signup = s
+	}
+}
+
+// WithUserDB matches `from:` and `to:` of users by all the handles in
+// their handle history.
+func WithUserDB(users userdb.DB) HandlerOption {
+	return func(h *Handler) {
+		h.users = users
+	}
+}
+
 func WithLimit(p int) HandlerOption {
 	return func(h *Handler) {
 		h.limit = p
@@ -62,6 +108,37 @@ func WithTmpDir(t string) HandlerOption {
 	}
 }
 
+// WithRevalidateInterval sets how long listings of index shards are reused
+// before new versions are looked up.
+func WithRevalidateInterval(d time.Duration) HandlerOption {
+	return func(h *Handler) {
+		h.revalidateInterval = d
+	}
+}
+
+// WithCacheSize sets the bytes of index files kept in tmpDir. Indexes in
+// use are kept even beyond it.
+func WithCacheSize(n int64) HandlerOption {
+	return func(h *Handler) {
+		h.cacheSize = n
+	}
+}
+
+// WithGroups sets the named groups of DIDs for cross-account search.
+func WithGroups(groups map[string][]string) HandlerOption {
+	return func(h *Handler) {
+		h.groups = groups
+	}
+}
+
+// WithAccountParallelism sets the number of accounts searched at the same
+// time by cross-account search.
+func WithAccountParallelism(n int) HandlerOption {
+	return func(h *Handler) {
+		h.accountParallelism = n
+	}
+}
+
 func NewHandler(
 	s3Client S3Client,
 	searchIndexBucket string,
@@ -75,53 +152,23 @@ func NewHandler(
 		tmpDir:            "/tmp",
 		logger:            slog.Default(),
 		limit:             100,
-	}
 
-	for _, opt := range opts {
-		opt(h)
-	}
+		revalidateInterval: 30 * time.Second,
+		cacheSize:          384 << 20, // of the 512 MB /tmp of Lambda
+		cache:              newIndexCache(),
 
-	return h
-}
-
-func (h *Handler) retrieveIndexFile(ctx context.Context, did string, filePath string) error {
-	if _, err := os.Stat(filePath); err == nil {
-		h.logger.Debug("Index file already exists in /tmp", "path", filePath)
-		return nil
-	} else if !os.IsNotExist(err) {
-		h.logger.Error("Failed to check file existence in /tmp", "err", err, "path", filePath)
-		return err
-	}
-
-	h.logger.Debug("Index file not found in /tmp, retrieving from S3", "did", did, "bucket", h.searchIndexBucket)
-	output, err := h.s3Client.GetObject(ctx, &s3.GetObjectInput{
-		Bucket: &h.searchIndexBucket,
-		Key:    &did,
-	})
-	if err != nil {
-		if _, ok := err.(*types.NoSuchKey); ok {
-			h.logger.Info("Index file not found in S3", "did", did, "bucket", h.searchIndexBucket)
-			return ErrIndexNotPrepared
-		}
-		h.logger.Error("Failed to get object from S3", "err", err, "did", did, "bucket", h.searchIndexBucket)
-		return err
+		accountParallelism: 4,
 	}
-	defer output.Body.Close()
 
-	file, err := os.Create(filePath)
-	if err != nil {
-		h.logger.Error("Failed to create file in /tmp", "err", err, "path", filePath)
-		return err
+	for _, opt := range opts {
+		opt(h)
 	}
-	defer file.Close()
-
-	if _, err := io.Copy(file, output.Body); err != nil {
-		h.logger.Error("Failed to write S3 object to file", "err", err, "path", filePath)
-		return err
+	h.publish = storage.NewS3(s3Client, publishBucket, storage.S3OptionLogger(h.logger))
+	if h.feedHostname != "" {
+		h.feeds = h.newFeedServer()
 	}
 
-	h.logger.Info("Successfully retrieved and stored index file", "path", filePath)
-	return nil
+	return h
 }
 
 func extractUniqueKeys(searchResults []*index.SearchResult) map[string][]int {
@@ -133,7 +180,7 @@ func extractUniqueKeys(searchResults []*index.SearchResult) map[string][]int {
 	return ret
 }
 
-func (h *Handler) getPostsFromSearchResults(ctx context.Context, searchResults []*index.SearchResult) ([]*bsky.FeedDefs_FeedViewPost, error) {
+func (h *Handler) getPostsFromSearchResults(ctx context.Context, searchResults []*index.SearchResult) ([]*indexhandler.Item, error) {
 	keyMap := extractUniqueKeys(searchResults)
 
 	g, ctx := errgroup.WithContext(ctx)
@@ -213,118 +260,321 @@ func (h *Handler) getPostsFromSearchResults(ctx context.Context, searchResults [
 
 	indexhandler.SortItems(items)
 
-	var ret []*bsky.FeedDefs_FeedViewPost
+	return items, nil
+}
+
+const snippetWidth = 100
+
+// Result is a search hit. Matches and Snippet are computed from the same
+// normalized query terms as the index search.
+type Result struct {
+	Key      string                      `json:"key"`
+	Position int                         `json:"pos"`
+	Post     *bsky.FeedDefs_FeedViewPost `json:"post"`
+	Matches  []*index.Match              `json:"matches"`
+	Snippet  string                      `json:"snippet"`
+	Score    float64                     `json:"score,omitempty"`
+
+	// Did is the account the result came from, set by cross-account
+	// search.
+	Did string `json:"did,omitempty"`
+
+	timestamp int64
+}
+
+func toResults(items []*indexhandler.Item, query *index.Query) []*Result {
+	ret := make([]*Result, 0, len(items))
 	for _, item := range items {
-		ret = append(ret, item.Post)
+		res := &Result{
+			Key:      item.Key,
+			Position: item.Position,
+			Post:     item.Post,
+			Matches:  []*index.Match{},
+		}
+		if rec := index.ToRecord(item.Key, item.Position, item.Post); rec != nil {
+			res.timestamp = rec.Timestamp
+			if matches := index.Highlight(rec, query); matches != nil {
+				res.Matches = matches
+			}
+			res.Snippet = index.Snippet(rec, res.Matches, snippetWidth)
+		}
+		ret = append(ret, res)
 	}
-
-	return ret, nil
+	return ret
 }
 
-func (h *Handler) Handle(ctx context.Context, req *events.LambdaFunctionURLRequest) (*events.LambdaFunctionURLResponse, error) {
-	path := req.RawPath
-	const prefix = "/search/"
-	if !strings.HasPrefix(path, prefix) {
-		h.logger.Info("Response",
+func badRequest(logger *slog.Logger, reason string, args ...any) *events.LambdaFunctionURLResponse {
+	logger.Info("Response",
+		append([]any{
 			"status", http.StatusBadRequest,
-			"reason", "Path does not start with /search/",
-			"rawPath", req.RawPath,
-		)
+			"reason", reason,
+		}, args...)...,
+	)
+	return &events.LambdaFunctionURLResponse{
+		StatusCode: http.StatusBadRequest,
+	}
+}
+
+func jsonResponse(logger *slog.Logger, v any) *events.LambdaFunctionURLResponse {
+	jsonBytes, err := json.Marshal(v)
+	if err != nil {
+		logger.Error("Failed to marshal response to JSON", "err", err)
 		return &events.LambdaFunctionURLResponse{
-			StatusCode: http.StatusBadRequest,
-		}, nil
+			StatusCode: http.StatusInternalServerError,
+		}
 	}
-	did := strings.TrimPrefix(path, prefix)
-	if did == "" {
-		h.logger.Info("Response",
-			"status", http.StatusBadRequest,
-			"reason", "DID is empty in path",
-			"rawPath", req.RawPath,
-		)
+
+	return &events.LambdaFunctionURLResponse{
+		StatusCode: http.StatusOK,
+		Headers: map[string]string{
+			"Content-Type": "application/json",
+		},
+		Body: string(jsonBytes),
+	}
+}
+
+// openShards opens the shards of the index of did that may hold posts in
+// [since, until), in unix microseconds. The returned function releases
+// them.
+func (h *Handler) openShards(ctx context.Context, did string, since, until int64) ([]*index.Gorm, func(), error) {
+	objects, err := h.listShards(ctx, did)
+	if err != nil {
+		return nil, nil, err
+	}
+	var inRange []shardObject
+	for _, obj := range objects {
+		if index.ShardInRange(obj.key, since, until) {
+			inRange = append(inRange, obj)
+		}
+	}
+
+	shards := make([]*index.Gorm, len(inRange))
+	closers := make([]func(), len(inRange))
+	closeAll := func() {
+		for _, c := range closers {
+			if c != nil {
+				c()
+			}
+		}
+	}
+
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(shardParallelism)
+	for i, obj := range inRange {
+		g.Go(func() error {
+			idx, closeIndex, err := h.openIndex(gctx, obj)
+			if err != nil {
+				return err
+			}
+			shards[i], closers[i] = idx, closeIndex
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		closeAll()
+		return nil, nil, err
+	}
+
+	h.logger.Debug("Opened index shards", "did", did, "shards", len(shards), "total", len(objects))
+
+	return shards, closeAll, nil
+}
+
+// eachShard runs f for every shard in parallel.
+func eachShard(ctx context.Context, shards []*index.Gorm, f func(ctx context.Context, i int, idx *index.Gorm) error) error {
+	g, ctx := errgroup.WithContext(ctx)
+	g.SetLimit(shardParallelism)
+	for i, idx := range shards {
+		g.Go(func() error {
+			return f(ctx, i, idx)
+		})
+	}
+	return g.Wait()
+}
+
+func (h *Handler) openIndexErrorResponse(err error, did string) *events.LambdaFunctionURLResponse {
+	switch {
+	case errors.Is(err, ErrIndexNotPrepared):
+		h.logger.Info("Index not prepared for did", "did", did)
+		return &events.LambdaFunctionURLResponse{
+			StatusCode: http.StatusInternalServerError,
+			Body:       ErrIndexNotPrepared.Error(),
+		}
+	case errors.Is(err, index.ErrSchemaOutdated) || errors.Is(err, index.ErrSchemaTooNew):
+		h.logger.Warn("Index schema is not supported", "err", err, "did", did)
+		return &events.LambdaFunctionURLResponse{
+			StatusCode: http.StatusServiceUnavailable,
+			Body:       err.Error(),
+		}
+	default:
+		h.logger.Error("Failed to read index", "err", err, "did", did)
 		return &events.LambdaFunctionURLResponse{
-			StatusCode: http.StatusBadRequest,
-		}, nil
+			StatusCode: http.StatusInternalServerError,
+		}
+	}
+}
+
+func (h *Handler) Handle(ctx context.Context, req *events.LambdaFunctionURLRequest) (*events.LambdaFunctionURLResponse, error) {
+	routes := []struct {
+		prefix string
+		// nargs is the number of path segments after the prefix, the
+		// first of which is the DID.
+		nargs  int
+		handle func(context.Context, *events.LambdaFunctionURLRequest, []string) *events.LambdaFunctionURLResponse
+	}{
+		{"/search/", 1, h.handleSearch},
+		{"/stats/", 1, h.handleStats},
+		{"/related/", 2, h.handleRelated},
+		{"/onthisday/", 1, h.handleOnThisDay},
+		{"/post/", 2, h.handlePost},
+	}
+
+	if h.feeds != nil && feedgen.Handles(req.RawPath) {
+		return h.feeds.Handle(ctx, req)
+	}
+	if h.oauth != nil && oauth.Handles(req.RawPath) {
+		return h.oauth.Handle(ctx, req)
+	}
+	if h.signup != nil && signup.Handles(req.RawPath) {
+		return h.signup.Handle(ctx, req)
+	}
+
+	if req.RawPath == "/search" {
+		return h.handleMultiSearch(ctx, req), nil
+	}
+
+	for _, route := range routes {
+		if !strings.HasPrefix(req.RawPath, route.prefix) {
+			continue
+		}
+
+		args := strings.Split(strings.TrimPrefix(req.RawPath, route.prefix), "/")
+		if args[0] == "" {
+			return badRequest(h.logger, "DID is empty in path", "rawPath", req.RawPath), nil
+		}
+		if len(args) != route.nargs {
+			return badRequest(h.logger, "Unexpected path", "rawPath", req.RawPath), nil
+		}
+		for _, arg := range args {
+			if arg == "" {
+				return badRequest(h.logger, "Empty path segment", "rawPath", req.RawPath), nil
+			}
+		}
+
+		return route.handle(ctx, req, args), nil
 	}
 
-	query, ok := req.QueryStringParameters["q"]
+	return badRequest(h.logger, "Unknown path", "rawPath", req.RawPath), nil
+}
+
+// parseSearchQuery parses q, since, until and tz of a search request. It
+// returns a response instead if there is nothing to search.
+func (h *Handler) parseSearchQuery(ctx context.Context, req *events.LambdaFunctionURLRequest) (*index.Query, *events.LambdaFunctionURLResponse) {
+	params := req.QueryStringParameters
+	query, ok := params["q"]
 	if !ok {
-		h.logger.Info("Response",
-			"status", http.StatusBadRequest,
-			"reason", "Query parameter `q` is not found",
+		return nil, badRequest(h.logger, "Query parameter `q` is not found",
 			"queryStringParameters", req.QueryStringParameters,
 		)
-		return &events.LambdaFunctionURLResponse{
-			StatusCode: http.StatusBadRequest,
-		}, nil
 	}
 	if query == "" {
-		return &events.LambdaFunctionURLResponse{
+		return nil, &events.LambdaFunctionURLResponse{
 			StatusCode: http.StatusOK,
 			Headers: map[string]string{
 				"Content-Type": "application/json",
 			},
 			Body: "[]",
-		}, nil
+		}
 	}
 
-	filePath := filepath.Join(h.tmpDir, did)
-	if err := h.retrieveIndexFile(ctx, did, filePath); err != nil {
-		if errors.Is(err, ErrIndexNotPrepared) {
-			h.logger.Info("Index not prepared for did", "did", did)
-			return &events.LambdaFunctionURLResponse{
-				StatusCode: http.StatusInternalServerError,
-				Body:       ErrIndexNotPrepared.Error(),
-			}, nil
+	loc, err := ParseLocation(params["tz"])
+	if err != nil {
+		return nil, badRequest(h.logger, "Invalid tz", "tz", params["tz"], "err", err)
+	}
+	q := index.ParseQuery(query)
+	if q.Since, err = parseDate(params["since"], loc); err != nil {
+		return nil, badRequest(h.logger, "Invalid since", "since", params["since"], "err", err)
+	}
+	if q.Until, err = parseDate(params["until"], loc); err != nil {
+		return nil, badRequest(h.logger, "Invalid until", "until", params["until"], "err", err)
+	}
+	h.addAliases(ctx, q)
+	return q, nil
+}
+
+// addAliases adds the DIDs and the handle histories of the users of
+// `from:` and `to:` to q.
+func (h *Handler) addAliases(ctx context.Context, q *index.Query) {
+	if h.users == nil {
+		return
+	}
+	for _, account := range q.Accounts() {
+		var user *userdb.User
+		var err error
+		if strings.HasPrefix(account, "did:") {
+			user, err = h.users.Get(ctx, account)
+		} else {
+			user, err = h.users.GetByHandle(ctx, account)
+		}
+		if err == userdb.ErrNotExists {
+			continue
+		} else if err != nil {
+			h.logger.Warn("Failed to get the handle history", "err", err, "account", account)
+			continue
+		}
+
+		q.AddAlias(account, user.Did)
+		q.AddAlias(account, user.Handle)
+		for _, hr := range user.Handles {
+			q.AddAlias(account, hr.Handle)
 		}
-		h.logger.Error("Failed to retrieve index file", "err", err, "did", did)
-		return &events.LambdaFunctionURLResponse{
-			StatusCode: http.StatusInternalServerError,
-		}, nil
 	}
+}
 
-	db, err := gorm.Open(sqlite.Open(filePath), &gorm.Config{
-		Logger: gormlogger.Default.LogMode(gormlogger.Silent),
-	})
+// search searches the shards of the index of did in parallel.
+func (h *Handler) search(ctx context.Context, did string, q *index.Query) ([]*Result, error) {
+	shards, closeShards, err := h.openShards(ctx, did, q.Since, q.Until)
 	if err != nil {
-		h.logger.Error("Failed to open SQLite database", "err", err, "path", filePath)
-		return &events.LambdaFunctionURLResponse{
-			StatusCode: http.StatusInternalServerError,
-		}, nil
+		return nil, err
 	}
+	defer closeShards()
 
-	idx := index.NewGorm(db, index.GormOptionLogger(h.logger))
+	results := make([][]*index.SearchResult, len(shards))
+	if err := eachShard(ctx, shards, func(ctx context.Context, i int, idx *index.Gorm) error {
+		var err error
+		results[i], err = idx.Search(ctx, q)
+		return err
+	}); err != nil {
+		h.logger.Error("Failed to perform search", "err", err, "did", did, "query", q)
+		return nil, err
+	}
+	var searchResults []*index.SearchResult
+	for _, r := range results {
+		searchResults = append(searchResults, r...)
+	}
 
-	searchResults, err := idx.Search(ctx, &index.Query{
-		Text: strings.Fields(query),
-	})
+	items, err := h.getPostsFromSearchResults(ctx, searchResults)
 	if err != nil {
-		h.logger.Error("Failed to perform search", "err", err, "query", query)
-		return &events.LambdaFunctionURLResponse{
-			StatusCode: http.StatusInternalServerError,
-		}, nil
+		h.logger.Error("Failed to get posts from search results", "err", err, "did", did)
+		return nil, err
 	}
 
-	posts, err := h.getPostsFromSearchResults(ctx, searchResults)
-	if err != nil {
-		h.logger.Error("Failed to get posts from search results", "err", err)
-		return &events.LambdaFunctionURLResponse{
-			StatusCode: http.StatusInternalServerError,
-		}, nil
+	return toResults(items, q), nil
+}
+
+// handleSearch serves /search/<did>?q=...&since=YYYY-MM-DD&until=YYYY-MM-DD&tz=Asia/Tokyo.
+// until is exclusive, and only the shards of the months in range are read.
+func (h *Handler) handleSearch(ctx context.Context, req *events.LambdaFunctionURLRequest, args []string) *events.LambdaFunctionURLResponse {
+	did := args[0]
+	q, resp := h.parseSearchQuery(ctx, req)
+	if resp != nil {
+		return resp
 	}
 
-	jsonBytes, err := json.Marshal(posts)
+	results, err := h.search(ctx, did, q)
 	if err != nil {
-		h.logger.Error("Failed to marshal posts to JSON", "err", err)
-		return &events.LambdaFunctionURLResponse{
-			StatusCode: http.StatusInternalServerError,
-		}, nil
+		return h.openIndexErrorResponse(err, did)
 	}
 
-	return &events.LambdaFunctionURLResponse{
-		StatusCode: http.StatusOK,
-		Headers: map[string]string{
-			"Content-Type": "application/json",
-		},
-		Body: string(jsonBytes),
-	}, nil
+	return jsonResponse(h.logger, results)
 }
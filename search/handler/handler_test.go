@@ -0,0 +1,117 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+
+	"github.com/yunomu/bskylog/lib/userdb"
+)
+
+type fakeUsers struct {
+	users []*userdb.User
+}
+
+func (f *fakeUsers) Get(ctx context.Context, did string) (*userdb.User, error) {
+	for _, u := range f.users {
+		if u.Did == did {
+			return u, nil
+		}
+	}
+	return nil, userdb.ErrNotExists
+}
+
+func (f *fakeUsers) GetByHandle(ctx context.Context, handle string) (*userdb.User, error) {
+	for _, u := range f.users {
+		if u.HasHandle(handle) {
+			return u, nil
+		}
+	}
+	return nil, userdb.ErrNotExists
+}
+
+func (f *fakeUsers) Scan(ctx context.Context, fn func(*userdb.User) error) error {
+	for _, u := range f.users {
+		if err := fn(u); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *fakeUsers) Put(ctx context.Context, user *userdb.User) error {
+	return nil
+}
+
+func (f *fakeUsers) SetNextDue(ctx context.Context, did string, prev, next time.Time) error {
+	return nil
+}
+
+func (f *fakeUsers) SetSchedule(ctx context.Context, did string, nextDue time.Time, failures int) error {
+	return nil
+}
+
+func (f *fakeUsers) SetIdentity(ctx context.Context, user *userdb.User) error {
+	return nil
+}
+
+func (f *fakeUsers) Delete(ctx context.Context, did string) error {
+	return nil
+}
+
+func TestHandler_handleSearch_handleHistory(t *testing.T) {
+	f := &fakeS3{objects: make(map[string]*fakeObject)}
+	f.put("index:did:plc:a/2026/01", testIndex(t, "did:plc:a", "a1"))
+	f.put("publish:did:plc:a/2026/01/01", []byte(testPostJSON("did:plc:a", "a1", "2026-01-01T01:00:00Z")+"\n"))
+
+	// The posts were indexed as did:plc:a.example.com, and the user has
+	// changed the handle twice since.
+	users := &fakeUsers{users: []*userdb.User{{
+		Did:    "did:plc:a",
+		Handle: "a3.example.com",
+		Handles: []userdb.HandleRecord{
+			{Handle: "a2.example.com"},
+			{Handle: "a3.example.com"},
+		},
+	}}}
+
+	tests := []struct {
+		name  string
+		query string
+		opts  []HandlerOption
+		want  int
+	}{
+		{"indexed handle", "from:did:plc:a.example.com", nil, 1},
+		{"previous handle", "from:a2.example.com", []HandlerOption{WithUserDB(users)}, 1},
+		{"current handle", "from:A3.example.com hello", []HandlerOption{WithUserDB(users)}, 1},
+		{"without history", "from:a2.example.com", nil, 0},
+		{"other account", "from:b.example.com", []HandlerOption{WithUserDB(users)}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestHandler(t, f, tt.opts...)
+			resp, err := h.Handle(context.Background(), &events.LambdaFunctionURLRequest{
+				RawPath:               "/search/did:plc:a",
+				QueryStringParameters: map[string]string{"q": tt.query},
+			})
+			if err != nil {
+				t.Fatalf("Handle: %v", err)
+			}
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("status: got %d, body %s", resp.StatusCode, resp.Body)
+			}
+
+			var results []*Result
+			if err := json.Unmarshal([]byte(resp.Body), &results); err != nil {
+				t.Fatalf("unmarshal error: %v", err)
+			}
+			if len(results) != tt.want {
+				t.Errorf("results: got %d, want %d", len(results), tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,146 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"golang.org/x/sync/errgroup"
+)
+
+// maxSearchAccounts limits the accounts of a cross-account search.
+const maxSearchAccounts = 20
+
+// searchAccounts returns the DIDs of the dids and group parameters,
+// without duplicates.
+func (h *Handler) searchAccounts(params map[string]string) ([]string, error) {
+	var dids []string
+	seen := make(map[string]bool)
+	add := func(did string) {
+		if did != "" && !seen[did] {
+			seen[did] = true
+			dids = append(dids, did)
+		}
+	}
+
+	if v := params["dids"]; v != "" {
+		for _, did := range strings.Split(v, ",") {
+			add(strings.TrimSpace(did))
+		}
+	}
+	if name := params["group"]; name != "" {
+		group, ok := h.groups[name]
+		if !ok {
+			return nil, errors.New("unknown group")
+		}
+		for _, did := range group {
+			add(did)
+		}
+	}
+
+	if len(dids) == 0 {
+		return nil, errors.New("no accounts")
+	}
+	if len(dids) > maxSearchAccounts {
+		return nil, errors.New("too many accounts")
+	}
+	return dids, nil
+}
+
+// sortResults orders results of several accounts, newest first, or by the
+// number of matches with sort=relevance.
+func sortResults(results []*Result, by string) {
+	if by == "relevance" {
+		for _, r := range results {
+			r.Score = float64(len(r.Matches))
+		}
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		if by == "relevance" && results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].timestamp > results[j].timestamp
+	})
+}
+
+// skippedAccountsHeader lists the accounts left out of a cross-account
+// search, separated by commas.
+const skippedAccountsHeader = "X-Skipped-Accounts"
+
+// handleMultiSearch serves /search?dids=<did>,<did>&group=<name>&q=...&sort=relevance
+// with the other parameters of handleSearch. Each result is tagged with its
+// account. Accounts without an index, or whose index cannot be read, are
+// skipped and listed in the X-Skipped-Accounts header. The search fails
+// only if no account could be searched.
+func (h *Handler) handleMultiSearch(ctx context.Context, req *events.LambdaFunctionURLRequest) *events.LambdaFunctionURLResponse {
+	params := req.QueryStringParameters
+
+	dids, err := h.searchAccounts(params)
+	if err != nil {
+		return badRequest(h.logger, "Invalid accounts", "dids", params["dids"], "group", params["group"], "err", err)
+	}
+	switch params["sort"] {
+	case "", "time", "relevance":
+	default:
+		return badRequest(h.logger, "Invalid sort", "sort", params["sort"])
+	}
+
+	q, resp := h.parseSearchQuery(ctx, req)
+	if resp != nil {
+		return resp
+	}
+
+	perAccount := make([][]*Result, len(dids))
+	errs := make([]error, len(dids))
+	var g errgroup.Group
+	g.SetLimit(h.accountParallelism)
+	for i, did := range dids {
+		g.Go(func() error {
+			results, err := h.search(ctx, did, q)
+			if err != nil {
+				errs[i] = err
+				return nil
+			}
+			for _, r := range results {
+				r.Did = did
+			}
+			perAccount[i] = results
+			return nil
+		})
+	}
+	g.Wait()
+
+	var skipped []string
+	failed := -1
+	for i, err := range errs {
+		switch {
+		case err == nil:
+			continue
+		case errors.Is(err, ErrIndexNotPrepared):
+			h.logger.Info("Index not prepared for did, skipped", "did", dids[i])
+		default:
+			h.logger.Warn("Failed to search did, skipped", "err", err, "did", dids[i])
+			if failed < 0 {
+				failed = i
+			}
+		}
+		skipped = append(skipped, dids[i])
+	}
+	if failed >= 0 && len(skipped) == len(dids) {
+		return h.openIndexErrorResponse(errs[failed], dids[failed])
+	}
+
+	results := []*Result{}
+	for _, r := range perAccount {
+		results = append(results, r...)
+	}
+	sortResults(results, params["sort"])
+
+	resp = jsonResponse(h.logger, results)
+	if len(skipped) != 0 && resp.Headers != nil {
+		resp.Headers[skippedAccountsHeader] = strings.Join(skipped, ",")
+	}
+	return resp
+}
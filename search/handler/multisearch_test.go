@@ -0,0 +1,111 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+func TestHandler_handleMultiSearch(t *testing.T) {
+	f := &fakeS3{objects: make(map[string]*fakeObject)}
+	for _, a := range []struct {
+		did, cid, createdAt string
+	}{
+		{"did:plc:a", "a1", "2026-01-01T01:00:00Z"},
+		{"did:plc:b", "b1", "2026-01-01T02:00:00Z"},
+	} {
+		f.put("index:"+a.did+"/2026/01", testIndex(t, a.did, a.cid))
+		f.put("publish:"+a.did+"/2026/01/01", []byte(testPostJSON(a.did, a.cid, a.createdAt)+"\n"))
+	}
+	// An index that cannot be read.
+	f.put("index:did:plc:broken/2026/01", []byte("broken"))
+
+	h := newTestHandler(t, f, WithGroups(map[string][]string{
+		"team": {"did:plc:a", "did:plc:b"},
+	}))
+
+	tests := []struct {
+		name    string
+		params  map[string]string
+		status  int
+		want    []string
+		skipped string
+	}{
+		{
+			name:    "group and dids",
+			params:  map[string]string{"q": "hello", "group": "team", "dids": "did:plc:a,did:plc:none"},
+			status:  http.StatusOK,
+			want:    []string{"did:plc:b/b1", "did:plc:a/a1"},
+			skipped: "did:plc:none",
+		},
+		{
+			name:    "broken index",
+			params:  map[string]string{"q": "hello", "dids": "did:plc:broken,did:plc:a"},
+			status:  http.StatusOK,
+			want:    []string{"did:plc:a/a1"},
+			skipped: "did:plc:broken",
+		},
+		{
+			name:   "only broken indexes",
+			params: map[string]string{"q": "hello", "dids": "did:plc:broken,did:plc:none"},
+			status: http.StatusInternalServerError,
+		},
+		{
+			name:   "dids",
+			params: map[string]string{"q": "a1", "dids": "did:plc:a,did:plc:b"},
+			status: http.StatusOK,
+			want:   []string{"did:plc:a/a1"},
+		},
+		{
+			name:   "unknown group",
+			params: map[string]string{"q": "hello", "group": "other"},
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "no accounts",
+			params: map[string]string{"q": "hello"},
+			status: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := h.Handle(context.Background(), &events.LambdaFunctionURLRequest{
+				RawPath:               "/search",
+				QueryStringParameters: tt.params,
+			})
+			if err != nil {
+				t.Fatalf("Handle: %v", err)
+			}
+			if resp.StatusCode != tt.status {
+				t.Fatalf("status: got %d, want %d", resp.StatusCode, tt.status)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			if got := resp.Headers["X-Skipped-Accounts"]; got != tt.skipped {
+				t.Errorf("skipped: got %q, want %q", got, tt.skipped)
+			}
+
+			var results []*Result
+			if err := json.Unmarshal([]byte(resp.Body), &results); err != nil {
+				t.Fatalf("unmarshal error: %v", err)
+			}
+			var got []string
+			for _, r := range results {
+				got = append(got, r.Did+"/"+r.Post.Post.Cid)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("results: got %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("results: got %v, want %v", got, tt.want)
+					break
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,48 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+
+	"github.com/yunomu/bskylog/lib/storage"
+)
+
+type onThisDayResponse struct {
+	Date  string          `json:"date"`
+	Years []*storage.Year `json:"years"`
+}
+
+// handleOnThisDay serves /onthisday/<did>?date=YYYY-MM-DD&tz=Asia/Tokyo,
+// the posts of the same month and day in earlier years. date defaults to
+// today in tz.
+func (h *Handler) handleOnThisDay(ctx context.Context, req *events.LambdaFunctionURLRequest, args []string) *events.LambdaFunctionURLResponse {
+	did := args[0]
+	params := req.QueryStringParameters
+
+	loc, err := ParseLocation(params["tz"])
+	if err != nil {
+		return badRequest(h.logger, "Invalid tz", "tz", params["tz"], "err", err)
+	}
+	date := time.Now().In(loc)
+	if v := params["date"]; v != "" {
+		if date, err = time.ParseInLocation(time.DateOnly, v, loc); err != nil {
+			return badRequest(h.logger, "Invalid date", "date", v, "err", err)
+		}
+	}
+
+	years, err := h.publish.OnThisDay(ctx, did, date)
+	if err != nil {
+		h.logger.Error("Failed to get posts on this day", "err", err, "did", did, "date", date.Format(time.DateOnly))
+		return &events.LambdaFunctionURLResponse{
+			StatusCode: http.StatusInternalServerError,
+		}
+	}
+
+	return jsonResponse(h.logger, &onThisDayResponse{
+		Date:  date.Format(time.DateOnly),
+		Years: years,
+	})
+}
@@ -0,0 +1,139 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+
+	indexhandler "github.com/yunomu/bskylog/index/handler"
+	"github.com/yunomu/bskylog/lib/index"
+)
+
+const (
+	defaultPostContext = 3
+	maxPostContext     = 20
+
+	// tidMargin is how far the creation time of a post may be from the
+	// time of its record key for the shards of that time to be searched
+	// first.
+	tidMargin = 24 * time.Hour
+)
+
+// PostLocation is where a post is in the archive, with the posts around it
+// in its day file.
+type PostLocation struct {
+	Uri      string `json:"uri"`
+	Key      string `json:"key"`
+	Position int    `json:"pos"`
+
+	// Posts are the posts of the day file within the context before and
+	// after Position, in file order.
+	Posts []*indexhandler.Item `json:"posts"`
+}
+
+// findByURI looks up uri in shards. It returns index.ErrNotFound if no
+// shard has it.
+func findByURI(ctx context.Context, shards []*index.Gorm, uri string) (*index.SearchResult, error) {
+	found := make([]*index.SearchResult, len(shards))
+	if err := eachShard(ctx, shards, func(ctx context.Context, i int, idx *index.Gorm) error {
+		r, err := idx.FindByURI(ctx, uri)
+		if errors.Is(err, index.ErrNotFound) {
+			return nil
+		}
+		found[i] = r
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	for _, r := range found {
+		if r != nil {
+			return r, nil
+		}
+	}
+	return nil, index.ErrNotFound
+}
+
+// findPost looks up the post rkey of did. The shards around the time of
+// the record key are searched first.
+func (h *Handler) findPost(ctx context.Context, did, rkey string) (*index.SearchResult, error) {
+	uri := index.PostURI(did, rkey)
+
+	if t, ok := index.TIDTime(rkey); ok {
+		shards, closeShards, err := h.openShards(ctx, did, t.Add(-tidMargin).UnixMicro(), t.Add(tidMargin).UnixMicro())
+		if err != nil {
+			return nil, err
+		}
+		r, err := findByURI(ctx, shards, uri)
+		closeShards()
+		if !errors.Is(err, index.ErrNotFound) {
+			return r, err
+		}
+	}
+
+	shards, closeShards, err := h.openShards(ctx, did, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer closeShards()
+	return findByURI(ctx, shards, uri)
+}
+
+// lookupPost returns the location of the post rkey of did with n posts of
+// context on each side.
+func (h *Handler) lookupPost(ctx context.Context, did, rkey string, n int) (*PostLocation, error) {
+	r, err := h.findPost(ctx, did, rkey)
+	if err != nil {
+		return nil, err
+	}
+
+	posts, err := h.publish.GetDay(ctx, r.Key)
+	if err != nil {
+		return nil, err
+	}
+	if r.Position >= len(posts) {
+		h.logger.Warn("Indexed post is not in the day file", "key", r.Key, "pos", r.Position, "posts", len(posts))
+		return nil, index.ErrNotFound
+	}
+
+	loc := &PostLocation{
+		Uri:      index.PostURI(did, rkey),
+		Key:      r.Key,
+		Position: r.Position,
+	}
+	for i := max(r.Position-n, 0); i <= min(r.Position+n, len(posts)-1); i++ {
+		loc.Posts = append(loc.Posts, &indexhandler.Item{Key: r.Key, Position: i, Post: posts[i]})
+	}
+	return loc, nil
+}
+
+// handlePost serves /post/<did>/<rkey>?context=N, the location of a post
+// in the archive and N posts around it.
+func (h *Handler) handlePost(ctx context.Context, req *events.LambdaFunctionURLRequest, args []string) *events.LambdaFunctionURLResponse {
+	did, rkey := args[0], args[1]
+
+	n := defaultPostContext
+	if v, ok := req.QueryStringParameters["context"]; ok {
+		var err error
+		n, err = strconv.Atoi(v)
+		if err != nil || n < 0 || n > maxPostContext {
+			return badRequest(h.logger, "Invalid context", "context", v)
+		}
+	}
+
+	loc, err := h.lookupPost(ctx, did, rkey, n)
+	if err != nil {
+		if errors.Is(err, index.ErrNotFound) {
+			h.logger.Info("Response", "status", http.StatusNotFound, "did", did, "rkey", rkey)
+			return &events.LambdaFunctionURLResponse{
+				StatusCode: http.StatusNotFound,
+			}
+		}
+		return h.openIndexErrorResponse(err, did)
+	}
+
+	return jsonResponse(h.logger, loc)
+}
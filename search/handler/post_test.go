@@ -0,0 +1,67 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+func TestHandler_handlePost(t *testing.T) {
+	f := &fakeS3{objects: make(map[string]*fakeObject)}
+	cids := []string{"cid1", "cid2", "cid3", "cid4"}
+	var day []string
+	for _, cid := range cids {
+		day = append(day, testPostJSON("did:plc:a", cid, "2026-01-01T00:00:00Z"))
+	}
+	f.put("index:did:plc:a/2026/01", testIndex(t, "did:plc:a", cids...))
+	f.put("publish:did:plc:a/2026/01/01", []byte(strings.Join(day, "\n")+"\n"))
+
+	h := newTestHandler(t, f)
+
+	tests := []struct {
+		path   string
+		params map[string]string
+		status int
+		pos    int
+		want   []string
+	}{
+		{"/post/did:plc:a/cid2", map[string]string{"context": "1"}, http.StatusOK, 1, []string{"cid1", "cid2", "cid3"}},
+		{"/post/did:plc:a/cid1", nil, http.StatusOK, 0, []string{"cid1", "cid2", "cid3", "cid4"}},
+		{"/post/did:plc:a/cid4", map[string]string{"context": "0"}, http.StatusOK, 3, []string{"cid4"}},
+		{"/post/did:plc:a/missing", nil, http.StatusNotFound, 0, nil},
+		{"/post/did:plc:a/cid1", map[string]string{"context": "-1"}, http.StatusBadRequest, 0, nil},
+		{"/post/did:plc:a", nil, http.StatusBadRequest, 0, nil},
+	}
+	for _, tt := range tests {
+		res, err := h.Handle(context.Background(), &events.LambdaFunctionURLRequest{
+			RawPath:               tt.path,
+			QueryStringParameters: tt.params,
+		})
+		if err != nil {
+			t.Fatalf("Handle: %v", err)
+		}
+		if res.StatusCode != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.path, res.StatusCode, tt.status)
+			continue
+		}
+		if tt.status != http.StatusOK {
+			continue
+		}
+
+		var loc PostLocation
+		if err := json.Unmarshal([]byte(res.Body), &loc); err != nil {
+			t.Fatalf("unmarshal error: %v", err)
+		}
+		var got []string
+		for _, item := range loc.Posts {
+			got = append(got, item.Post.Post.Cid)
+		}
+		if loc.Key != "did:plc:a/2026/01/01" || loc.Position != tt.pos || strings.Join(got, " ") != strings.Join(tt.want, " ") {
+			t.Errorf("%s: got %s %d %v, want %d %v", tt.path, loc.Key, loc.Position, got, tt.pos, tt.want)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/aws/aws-lambda-go/events"
+
+	"github.com/yunomu/bskylog/lib/index"
+)
+
+const maxRelatedLimit = 100
+
+// handleRelated serves /related/<did>/<cid>?limit=N, ordered by similarity.
+func (h *Handler) handleRelated(ctx context.Context, req *events.LambdaFunctionURLRequest, args []string) *events.LambdaFunctionURLResponse {
+	did, cid := args[0], args[1]
+
+	limit := 20
+	if v, ok := req.QueryStringParameters["limit"]; ok {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > maxRelatedLimit {
+			return badRequest(h.logger, "Invalid limit", "limit", v)
+		}
+		limit = n
+	}
+
+	shards, closeShards, err := h.openShards(ctx, did, 0, 0)
+	if err != nil {
+		return h.openIndexErrorResponse(err, did)
+	}
+	defer closeShards()
+
+	related, err := findRelated(ctx, shards, cid, limit)
+	if err != nil {
+		if errors.Is(err, index.ErrNotFound) {
+			h.logger.Info("Response", "status", http.StatusNotFound, "did", did, "cid", cid)
+			return &events.LambdaFunctionURLResponse{
+				StatusCode: http.StatusNotFound,
+			}
+		}
+		h.logger.Error("Failed to find related posts", "err", err, "did", did, "cid", cid)
+		return &events.LambdaFunctionURLResponse{
+			StatusCode: http.StatusInternalServerError,
+		}
+	}
+
+	searchResults := make([]*index.SearchResult, len(related))
+	scores := make(map[index.SearchResult]float64)
+	for i, r := range related {
+		searchResults[i] = &index.SearchResult{Key: r.Key, Position: r.Position}
+		scores[*searchResults[i]] = r.Score
+	}
+
+	items, err := h.getPostsFromSearchResults(ctx, searchResults)
+	if err != nil {
+		h.logger.Error("Failed to get posts from related results", "err", err)
+		return &events.LambdaFunctionURLResponse{
+			StatusCode: http.StatusInternalServerError,
+		}
+	}
+
+	results := toResults(items, &index.Query{})
+	for _, r := range results {
+		r.Score = scores[index.SearchResult{Key: r.Key, Position: r.Position}]
+	}
+	sort.SliceStable(results, func(i, j int) bool { return results[i].Score > results[j].Score })
+
+	return jsonResponse(h.logger, results)
+}
+
+// findRelated is index.Gorm.Related over shards. The source post is looked up
+// in every shard and the posts are scored with the statistics of all of
+// them.
+func findRelated(ctx context.Context, shards []*index.Gorm, cid string, limit int) ([]*index.RelatedResult, error) {
+	sources := make([][]index.RecordTerm, len(shards))
+	found := make([]bool, len(shards))
+	if err := eachShard(ctx, shards, func(ctx context.Context, i int, idx *index.Gorm) error {
+		terms, err := idx.SourceTerms(ctx, cid)
+		if errors.Is(err, index.ErrNotFound) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		sources[i], found[i] = terms, true
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	var source []index.RecordTerm
+	var ok bool
+	for i := range shards {
+		if found[i] {
+			source, ok = sources[i], true
+			break
+		}
+	}
+	if !ok {
+		return nil, index.ErrNotFound
+	}
+	if len(source) == 0 {
+		return []*index.RelatedResult{}, nil
+	}
+
+	corpora := make([]*index.Corpus, len(shards))
+	if err := eachShard(ctx, shards, func(ctx context.Context, i int, idx *index.Gorm) error {
+		var err error
+		corpora[i], err = idx.Corpus(ctx, index.TermsOf(source))
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	corpus := &index.Corpus{}
+	for _, c := range corpora {
+		corpus.Add(c)
+	}
+	terms := index.QueryTerms(source, corpus)
+
+	results := make([][]*index.RelatedResult, len(shards))
+	if err := eachShard(ctx, shards, func(ctx context.Context, i int, idx *index.Gorm) error {
+		var err error
+		results[i], err = idx.RelatedByTerms(ctx, terms, cid, corpus, limit)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+
+	ret := []*index.RelatedResult{}
+	for _, r := range results {
+		ret = append(ret, r...)
+	}
+	sort.SliceStable(ret, func(i, j int) bool { return ret[i].Score > ret[j].Score })
+	if len(ret) > limit {
+		ret = ret[:limit]
+	}
+	return ret, nil
+}
@@ -0,0 +1,89 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+
+	"github.com/yunomu/bskylog/lib/index"
+)
+
+// ParseLocation accepts an IANA time zone name or an offset in minutes
+// like userdb.User.TimeZone.
+func ParseLocation(tz string) (*time.Location, error) {
+	if tz == "" {
+		return time.UTC, nil
+	}
+	if min, err := strconv.Atoi(tz); err == nil {
+		return time.FixedZone(fmt.Sprintf("%dmin", min), min*60), nil
+	}
+	return time.LoadLocation(tz)
+}
+
+// parseDate parses YYYY-MM-DD in loc. It returns 0 for an empty string.
+func parseDate(s string, loc *time.Location) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	t, err := time.ParseInLocation(time.DateOnly, s, loc)
+	if err != nil {
+		return 0, err
+	}
+	return t.UnixMicro(), nil
+}
+
+// handleStats serves /stats/<did>?since=YYYY-MM-DD&until=YYYY-MM-DD&tz=Asia/Tokyo&top=N.
+// until is exclusive.
+func (h *Handler) handleStats(ctx context.Context, req *events.LambdaFunctionURLRequest, args []string) *events.LambdaFunctionURLResponse {
+	did := args[0]
+	params := req.QueryStringParameters
+
+	loc, err := ParseLocation(params["tz"])
+	if err != nil {
+		return badRequest(h.logger, "Invalid tz", "tz", params["tz"], "err", err)
+	}
+	since, err := parseDate(params["since"], loc)
+	if err != nil {
+		return badRequest(h.logger, "Invalid since", "since", params["since"], "err", err)
+	}
+	until, err := parseDate(params["until"], loc)
+	if err != nil {
+		return badRequest(h.logger, "Invalid until", "until", params["until"], "err", err)
+	}
+	top := 20
+	if v, ok := params["top"]; ok {
+		top, err = strconv.Atoi(v)
+		if err != nil || top < 0 {
+			return badRequest(h.logger, "Invalid top", "top", v)
+		}
+	}
+
+	shards, closeShards, err := h.openShards(ctx, did, since, until)
+	if err != nil {
+		return h.openIndexErrorResponse(err, did)
+	}
+	defer closeShards()
+
+	// Rankings are cut after merging the shards.
+	shardStats := make([]*index.Stats, len(shards))
+	if err := eachShard(ctx, shards, func(ctx context.Context, i int, idx *index.Gorm) error {
+		var err error
+		shardStats[i], err = idx.Stats(ctx, &index.StatsQuery{
+			Since:    since,
+			Until:    until,
+			Location: loc,
+		})
+		return err
+	}); err != nil {
+		h.logger.Error("Failed to compute stats", "err", err, "did", did)
+		return &events.LambdaFunctionURLResponse{
+			StatusCode: http.StatusInternalServerError,
+		}
+	}
+
+	return jsonResponse(h.logger, index.MergeStats(shardStats, top))
+}
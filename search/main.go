@@ -2,13 +2,26 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"log/slog"
 	"os"
 
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/cloudfront"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	lambdaclient "github.com/aws/aws-sdk-go-v2/service/lambda"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 
+	"github.com/yunomu/bskylog/lib/crawlerdb"
+	"github.com/yunomu/bskylog/lib/invalidation"
+	"github.com/yunomu/bskylog/lib/oauth"
+	"github.com/yunomu/bskylog/lib/pds"
+	"github.com/yunomu/bskylog/lib/purge"
+	"github.com/yunomu/bskylog/lib/signup"
+	"github.com/yunomu/bskylog/lib/userdb"
+
 	"github.com/yunomu/bskylog/search/handler"
 )
 
@@ -32,13 +45,145 @@ func main() {
 		"tmpDir", tmpDir,
 	)
 
+	// SEARCH_GROUPS is a JSON object of group names to lists of DIDs.
+	var groups map[string][]string
+	if v := os.Getenv("SEARCH_GROUPS"); v != "" {
+		if err := json.Unmarshal([]byte(v), &groups); err != nil {
+			logger.Error("SEARCH_GROUPS", "err", err)
+			os.Exit(1)
+		}
+	}
+
+	// The feed generator is served when FEED_HOSTNAME is set. FEED_TZ is
+	// minutes east of UTC or a time zone name.
+	feedLoc, err := handler.ParseLocation(os.Getenv("FEED_TZ"))
+	if err != nil {
+		logger.Error("FEED_TZ", "err", err)
+		os.Exit(1)
+	}
+
+	// `from:` and `to:` of users match their previous handles when
+	// USER_TABLE is set.
+	dynamodbClient := dynamodb.NewFromConfig(cfg)
+	var users userdb.DB
+	if userTable := os.Getenv("USER_TABLE"); userTable != "" {
+		users = userdb.NewDynamoDB(dynamodbClient, userTable, os.Getenv("USER_HANDLE_INDEX"), os.Getenv("USER_HANDLE_TABLE"))
+	}
+
+	// Passwords and OAuth sessions are sealed with the credential key.
+	callbackURL := os.Getenv("OAUTH_CALLBACK_URL")
+	signupEnabled := os.Getenv("SIGNUP_ENABLED") == "true"
+	var sealer userdb.Sealer
+	if callbackURL != "" || signupEnabled {
+		sealer, err = userdb.NewSealer(
+			kms.NewFromConfig(cfg),
+			os.Getenv("CREDENTIAL_KMS_KEY"),
+			os.Getenv("CREDENTIAL_KEY_FILE"),
+			os.Getenv("CREDENTIAL_KEY"),
+		)
+		if err != nil {
+			logger.Error("NewSealer", "err", err)
+			os.Exit(1)
+		}
+	}
+	dir := pds.NewDirectory(os.Getenv("PLC_URL"))
+
+	// Users added through the OAuth client or the signup are added to
+	// CRAWLER_TABLE, and crawled first by CRAWLER_FUNCTION.
+	crawlerDB := crawlerdb.NewDynamoDB(dynamodbClient, os.Getenv("CRAWLER_TABLE"))
+	var crawler signup.Crawler
+	if crawlerFunction := os.Getenv("CRAWLER_FUNCTION"); crawlerFunction != "" {
+		crawler = signup.NewLambdaCrawler(lambdaclient.NewFromConfig(cfg), crawlerFunction)
+	}
+
+	// The OAuth client is served when OAUTH_CALLBACK_URL is set.
+	var oauthServer *oauth.Server
+	if callbackURL != "" {
+		opts := []oauth.Option{
+			oauth.WithDirectory(dir),
+			oauth.WithLogger(logger.With("module", "oauth")),
+		}
+		if crawler != nil {
+			opts = append(opts, oauth.WithCrawler(crawler))
+		}
+		oauthServer = oauth.NewServer(oauth.NewClient(
+			os.Getenv("OAUTH_CLIENT_ID"),
+			callbackURL,
+			oauth.NewStore(
+				users,
+				userdb.NewDynamoDBAuthRequests(dynamodbClient, os.Getenv("OAUTH_REQUEST_TABLE")),
+				sealer,
+			),
+			crawlerDB,
+			opts...,
+		))
+	}
+
+	// The signup is served when SIGNUP_ENABLED is true. Deleted users are
+	// invalidated in DISTRIBUTION, or the distribution of SITE_DOMAIN_NAME,
+	// since this function is its origin, and through
+	// INVALIDATION_WEBHOOK_URL.
+	s3Client := s3.NewFromConfig(cfg)
+	var signupServer *signup.Server
+	if signupEnabled {
+		if users == nil {
+			logger.Error("USER_TABLE is required by the signup")
+			os.Exit(1)
+		}
+
+		var invalidators invalidation.Multi
+		if distribution := os.Getenv("DISTRIBUTION"); distribution != "" {
+			invalidators = append(invalidators, invalidation.NewCloudFront(cloudfront.NewFromConfig(cfg), distribution))
+		} else if alias := os.Getenv("SITE_DOMAIN_NAME"); alias != "" {
+			invalidators = append(invalidators, invalidation.NewCloudFrontAlias(cloudfront.NewFromConfig(cfg), alias))
+		}
+		if webhookURL := os.Getenv("INVALIDATION_WEBHOOK_URL"); webhookURL != "" {
+			var opts []invalidation.WebhookOption
+			if token := os.Getenv("INVALIDATION_WEBHOOK_TOKEN"); token != "" {
+				opts = append(opts, invalidation.WithHeader("Authorization", "Bearer "+token))
+			}
+			invalidators = append(invalidators, invalidation.NewWebhook(webhookURL, opts...))
+		}
+		purgeOpts := []purge.Option{
+			purge.WithLogger(logger.With("module", "purge")),
+		}
+		if len(invalidators) != 0 {
+			purgeOpts = append(purgeOpts, purge.WithInvalidator(invalidators))
+		}
+
+		var history crawlerdb.History
+		if historyTable := os.Getenv("CRAWL_HISTORY_TABLE"); historyTable != "" {
+			history = crawlerdb.NewDynamoDBHistory(dynamodbClient, historyTable, 0)
+		}
+
+		opts := []signup.Option{
+			signup.WithLogger(logger.With("module", "signup")),
+			signup.WithPurger(purge.NewPurger(users, crawlerDB, history, s3Client, publishBucket, searchIndexBucket, purgeOpts...)),
+		}
+		if crawler != nil {
+			opts = append(opts, signup.WithCrawler(crawler))
+		}
+		signupServer = signup.NewServer(
+			users,
+			crawlerDB,
+			sealer,
+			dir,
+			opts...,
+		)
+	}
+
 	h := handler.NewHandler(
-		s3.NewFromConfig(cfg),
+		s3Client,
 		searchIndexBucket,
 		publishBucket,
 		handler.WithTmpDir(tmpDir),
 		handler.WithLogger(logger.With("module", "handler")),
 		handler.WithLimit(100),
+		handler.WithGroups(groups),
+		handler.WithFeedGenerator(os.Getenv("FEED_HOSTNAME"), os.Getenv("FEED_PUBLISHER_DID"), feedLoc),
+		handler.WithOAuth(oauthServer),
+		handler.WithSignup(signupServer),
+		handler.WithUserDB(users),
 	)
 
 	lambda.StartWithContext(ctx, h.Handle)
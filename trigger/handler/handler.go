@@ -4,7 +4,9 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"log/slog"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/lambda"
@@ -14,6 +16,15 @@ import (
 	"github.com/yunomu/bskylog/lib/userdb"
 )
 
+// DefaultLease is how long an invoked user is not due, for the crawler
+// to reschedule it. It outlasts the timeout of the crawler, so that users
+// whose crawl was lost are due again.
+const DefaultLease = 20 * time.Minute
+
+// deadlineMargin is the time left before the deadline of a trigger, such as
+// the timeout of the function, at which it stops invoking crawls.
+const deadlineMargin = 10 * time.Second
+
 type LambdaClient interface {
 	Invoke(ctx context.Context, params *lambda.InvokeInput, optFns ...func(*lambda.Options)) (*lambda.InvokeOutput, error)
 }
@@ -23,21 +34,58 @@ type Handler struct {
 	lambdaClient    LambdaClient
 	crawlerFunction string
 
+	budget  int
+	spacing time.Duration
+	lease   time.Duration
+	now     func() time.Time
+
 	logger *slog.Logger
 }
 
+type HandlerOption func(*Handler)
+
+// WithBudget limits the crawls invoked per trigger to n, which bounds the
+// concurrent crawls and the requests to the PDSs. Due users over the budget
+// are left for the next trigger, before the users due after them. Zero
+// means no limit.
+func WithBudget(n int) HandlerOption {
+	return func(h *Handler) {
+		h.budget = n
+	}
+}
+
+// WithSpacing spreads the invocations d apart.
+func WithSpacing(d time.Duration) HandlerOption {
+	return func(h *Handler) {
+		h.spacing = d
+	}
+}
+
+func WithLease(d time.Duration) HandlerOption {
+	return func(h *Handler) {
+		h.lease = d
+	}
+}
+
 func NewHandler(
 	userDB userdb.DB,
 	lambdaClient LambdaClient,
 	crawlerFunction string,
 	logger *slog.Logger,
+	opts ...HandlerOption,
 ) *Handler {
-	return &Handler{
+	h := &Handler{
 		userDB:          userDB,
 		lambdaClient:    lambdaClient,
 		crawlerFunction: crawlerFunction,
+		lease:           DefaultLease,
+		now:             time.Now,
 		logger:          logger,
 	}
+	for _, f := range opts {
+		f(h)
+	}
+	return h
 }
 
 func (h *Handler) Handle(ctx context.Context) {
@@ -52,39 +100,98 @@ func (h *Handler) Handle(ctx context.Context) {
 		return
 	}
 
-	for _, user := range users {
-		payload := &handler.Request{
-			Handle:   user.Handle,
-			Password: user.Password,
-			TimeZone: user.TimeZone,
-		}
+	due := userdb.SelectDue(users, h.now())
+	if h.budget > 0 && len(due) > h.budget {
+		h.logger.Info("Over budget",
+			"due", len(due),
+			"budget", h.budget,
+		)
+		due = due[:h.budget]
+	}
 
-		var buf bytes.Buffer
-		enc := json.NewEncoder(&buf)
-		if err := enc.Encode(payload); err != nil {
-			h.logger.Error("Request encode error",
-				"err", err,
-				"request", payload,
-			)
-			continue
+	for i, user := range due {
+		if i > 0 && h.spacing > 0 {
+			select {
+			case <-ctx.Done():
+				h.logger.Warn("Canceled",
+					"err", ctx.Err(),
+					"left", len(due)-i,
+				)
+				return
+			case <-time.After(h.spacing):
+			}
 		}
 
-		if _, err := h.lambdaClient.Invoke(ctx, &lambda.InvokeInput{
-			FunctionName:   aws.String(h.crawlerFunction),
-			InvocationType: types.InvocationTypeEvent,
-			Payload:        buf.Bytes(),
-		}); err != nil {
-			h.logger.Error("lambda.Invoke",
-				"err", err,
-				"function", h.crawlerFunction,
-				"payload", buf.String(),
+		// Users left are due at the next trigger, before the users due
+		// after them.
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < deadlineMargin {
+			h.logger.Warn("Stopped before the deadline",
+				"invoked", i,
+				"skipped", len(due)-i,
 			)
-			continue
+			return
 		}
 
-		h.logger.Info("Invoked",
+		h.invoke(ctx, user)
+	}
+}
+
+// invoke invokes the crawler for user, which is leased until the crawler
+// reschedules it.
+func (h *Handler) invoke(ctx context.Context, user *userdb.User) {
+	payload := &handler.Request{
+		Did: user.Did,
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	if err := enc.Encode(payload); err != nil {
+		h.logger.Error("Request encode error",
+			"err", err,
+			"request", payload,
+		)
+		return
+	}
+
+	// The lease is taken before the invocation, which may reschedule the
+	// user before Invoke returns. Only NextDue is written, so that changes
+	// to the user since the scan are kept, and users rescheduled since are
+	// left to their new schedule.
+	lease := h.now().Add(h.lease)
+	if err := h.userDB.SetNextDue(ctx, user.Did, user.NextDue, lease); errors.Is(err, userdb.ErrConflict) {
+		h.logger.Info("Rescheduled since the scan",
+			"did", user.Did,
+		)
+		return
+	} else if err != nil {
+		h.logger.Error("userdb.SetNextDue",
+			"err", err,
+			"did", user.Did,
+		)
+		return
+	}
+
+	if _, err := h.lambdaClient.Invoke(ctx, &lambda.InvokeInput{
+		FunctionName:   aws.String(h.crawlerFunction),
+		InvocationType: types.InvocationTypeEvent,
+		Payload:        buf.Bytes(),
+	}); err != nil {
+		h.logger.Error("lambda.Invoke",
+			"err", err,
 			"function", h.crawlerFunction,
 			"payload", buf.String(),
 		)
+		if err := h.userDB.SetNextDue(ctx, user.Did, lease, user.NextDue); err != nil {
+			h.logger.Error("userdb.SetNextDue",
+				"err", err,
+				"did", user.Did,
+			)
+		}
+		return
 	}
+
+	h.logger.Info("Invoked",
+		"function", h.crawlerFunction,
+		"payload", buf.String(),
+	)
 }
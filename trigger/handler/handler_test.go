@@ -0,0 +1,182 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/aws/aws-sdk-go-v2/service/lambda"
+
+	crawlerhandler "github.com/yunomu/bskylog/crawler/handler"
+	"github.com/yunomu/bskylog/lib/userdb"
+)
+
+type fakeLambda struct {
+	dids []string
+	err  error
+}
+
+func (f *fakeLambda) Invoke(ctx context.Context, params *lambda.InvokeInput, optFns ...func(*lambda.Options)) (*lambda.InvokeOutput, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	var req crawlerhandler.Request
+	if err := json.Unmarshal(params.Payload, &req); err != nil {
+		return nil, err
+	}
+	f.dids = append(f.dids, req.Did)
+	return &lambda.InvokeOutput{StatusCode: 202}, nil
+}
+
+// racingUsers changes users between the scan and the lease.
+type racingUsers struct {
+	userdb.DB
+	race func()
+}
+
+func (r *racingUsers) Scan(ctx context.Context, f func(*userdb.User) error) error {
+	if err := r.DB.Scan(ctx, f); err != nil {
+		return err
+	}
+	r.race()
+	return nil
+}
+
+func TestHandler_Handle(t *testing.T) {
+	ctx := context.Background()
+	now := time.Unix(1700000000, 0)
+
+	users := userdb.NewFile(filepath.Join(t.TempDir(), "users.json"))
+	for _, u := range []*userdb.User{
+		{Did: "did:plc:later", NextDue: now.Add(time.Hour)},
+		{Did: "did:plc:recent", NextDue: now.Add(-time.Minute)},
+		{Did: "did:plc:paused", Paused: true},
+		{Did: "did:plc:overdue", NextDue: now.Add(-time.Hour)},
+	} {
+		if err := users.Put(ctx, u); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+	}
+
+	client := &fakeLambda{}
+	h := NewHandler(users, client, "crawler", slog.New(slog.NewTextHandler(io.Discard, nil)), WithBudget(1))
+	h.now = func() time.Time { return now }
+
+	h.Handle(ctx)
+	if diff := cmp.Diff([]string{"did:plc:overdue"}, client.dids); diff != "" {
+		t.Errorf("first trigger mismatch (-want +got):\n%s", diff)
+	}
+	user, err := users.Get(ctx, "did:plc:overdue")
+	if err != nil || !user.NextDue.Equal(now.Add(DefaultLease)) {
+		t.Errorf("lease: got %+v, %v", user, err)
+	}
+
+	// The users over the budget are invoked at the next trigger, and the
+	// leased one is not.
+	h.Handle(ctx)
+	if diff := cmp.Diff([]string{"did:plc:overdue", "did:plc:recent"}, client.dids); diff != "" {
+		t.Errorf("second trigger mismatch (-want +got):\n%s", diff)
+	}
+
+	// The lease is released when the invocation fails.
+	client.err = errors.New("throttled")
+	h.now = func() time.Time { return now.Add(2 * time.Hour) }
+	before, err := users.Get(ctx, "did:plc:later")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	h.Handle(ctx)
+	after, err := users.Get(ctx, "did:plc:later")
+	if err != nil || !after.NextDue.Equal(before.NextDue) {
+		t.Errorf("failed invocation: got %v, want %v (%v)", after.NextDue, before.NextDue, err)
+	}
+}
+
+// Changes to users made after the scan are kept by the lease.
+func TestHandler_Handle_race(t *testing.T) {
+	ctx := context.Background()
+	now := time.Unix(1700000000, 0)
+
+	users := userdb.NewFile(filepath.Join(t.TempDir(), "users.json"))
+	for _, u := range []*userdb.User{
+		{Did: "did:plc:a", NextDue: now.Add(-time.Hour)},
+		{Did: "did:plc:b", NextDue: now.Add(-time.Hour)},
+	} {
+		if err := users.Put(ctx, u); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+	}
+	update := func(did string, f func(*userdb.User)) {
+		u, err := users.Get(ctx, did)
+		if err != nil {
+			t.Fatalf("Get: %v", err)
+		}
+		f(u)
+		if err := users.Put(ctx, u); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+	}
+	racing := &racingUsers{
+		DB: users,
+		race: func() {
+			// A new session of a, and b crawled by an earlier trigger.
+			update("did:plc:a", func(u *userdb.User) { u.OAuthSession = "aesgcm:new" })
+			update("did:plc:b", func(u *userdb.User) { u.NextDue = now.Add(time.Hour) })
+		},
+	}
+
+	client := &fakeLambda{}
+	h := NewHandler(racing, client, "crawler", slog.New(slog.NewTextHandler(io.Discard, nil)))
+	h.now = func() time.Time { return now }
+
+	h.Handle(ctx)
+	if diff := cmp.Diff([]string{"did:plc:a"}, client.dids); diff != "" {
+		t.Errorf("invoked mismatch (-want +got):\n%s", diff)
+	}
+	a, err := users.Get(ctx, "did:plc:a")
+	if err != nil || a.OAuthSession != "aesgcm:new" || !a.NextDue.Equal(now.Add(DefaultLease)) {
+		t.Errorf("a: got %+v, %v", a, err)
+	}
+	b, err := users.Get(ctx, "did:plc:b")
+	if err != nil || !b.NextDue.Equal(now.Add(time.Hour)) {
+		t.Errorf("b: got %+v, %v", b, err)
+	}
+}
+
+// Users left at the deadline of a trigger are skipped.
+func TestHandler_Handle_deadline(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+
+	users := userdb.NewFile(filepath.Join(t.TempDir(), "users.json"))
+	for _, u := range []*userdb.User{
+		{Did: "did:plc:a", NextDue: now.Add(-3 * time.Hour)},
+		{Did: "did:plc:b", NextDue: now.Add(-2 * time.Hour)},
+		{Did: "did:plc:c", NextDue: now.Add(-time.Hour)},
+	} {
+		if err := users.Put(context.Background(), u); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+	}
+
+	client := &fakeLambda{}
+	h := NewHandler(users, client, "crawler", slog.New(slog.NewTextHandler(io.Discard, nil)), WithSpacing(100*time.Millisecond))
+	h.now = func() time.Time { return now }
+
+	ctx, cancel := context.WithTimeout(context.Background(), deadlineMargin+50*time.Millisecond)
+	defer cancel()
+	h.Handle(ctx)
+	if diff := cmp.Diff([]string{"did:plc:a"}, client.dids); diff != "" {
+		t.Errorf("invoked mismatch (-want +got):\n%s", diff)
+	}
+	user, err := users.Get(context.Background(), "did:plc:b")
+	if err != nil || !user.NextDue.Equal(now.Add(-2*time.Hour)) {
+		t.Errorf("skipped user: got %+v, %v", user, err)
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"context"
 	"log/slog"
 	"os"
+	"strconv"
+	"time"
 
 	lambdaserver "github.com/aws/aws-lambda-go/lambda"
 
@@ -38,14 +40,36 @@ func main() {
 	crawlerFunction := os.Getenv("CRAWLER_FUNCTION")
 	userTable := os.Getenv("USER_TABLE")
 	userHandleIndex := os.Getenv("USER_HANDLE_INDEX")
+	crawlBudget := os.Getenv("CRAWL_BUDGET")
+	crawlSpacing := os.Getenv("CRAWL_SPACING")
 
 	logger.Info("Init",
 		"region", region,
 		"crawlerFunction", crawlerFunction,
 		"userTable", userTable,
 		"userHandleIndex", userHandleIndex,
+		"crawlBudget", crawlBudget,
+		"crawlSpacing", crawlSpacing,
 	)
 
+	var opts []handler.HandlerOption
+	if crawlBudget != "" {
+		budget, err := strconv.Atoi(crawlBudget)
+		if err != nil {
+			logger.Error("CRAWL_BUDGET", "err", err)
+			return
+		}
+		opts = append(opts, handler.WithBudget(budget))
+	}
+	if crawlSpacing != "" {
+		spacing, err := time.ParseDuration(crawlSpacing)
+		if err != nil {
+			logger.Error("CRAWL_SPACING", "err", err)
+			return
+		}
+		opts = append(opts, handler.WithSpacing(spacing))
+	}
+
 	ctx := context.Background()
 
 	awsCfg, err := config.LoadDefaultConfig(ctx,
@@ -64,10 +88,13 @@ func main() {
 			dynamodb.NewFromConfig(awsCfg),
 			userTable,
 			userHandleIndex,
+			// The trigger does not change handles.
+			"",
 		),
 		lambda.NewFromConfig(awsCfg),
 		crawlerFunction,
 		logger.With("module", "handler"),
+		opts...,
 	)
 
 	lambdaserver.Start(h.Handle)
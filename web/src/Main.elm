@@ -217,7 +217,7 @@ update msg model =
                     (\did ->
                         Http.get
                             { url = UrlBuilder.absolute [ "search", did ] [ UrlBuilder.string "q" query ]
-                            , expect = Http.expectJson SearchResult (JD.list Feed.decoder)
+                            , expect = Http.expectJson SearchResult (JD.list (JD.field "post" Feed.decoder))
                             }
                     )
                 |> Maybe.withDefault Cmd.none